@@ -0,0 +1,600 @@
+// Package audience expands publish recipients into subscriber ids.
+package audience
+
+import (
+	"context"
+
+	"github.com/gamegos/scotty/storage"
+)
+
+// PageSize is the maximum number of subscribers passed to a PageFunc at once.
+const PageSize = 1000
+
+// Audience describes the recipients of a publish.
+//
+// Recipients are the Subscribers and members of Channels that are members of
+// every IntersectChannels, are not members of ExceptChannels or in
+// ExceptSubscribers. Without Subscribers and Channels, members of
+// IntersectChannels are recipients; an audience with only a filter targets
+// every subscriber of the app. If Filter is set, only devices matching it are
+// recipients.
+//
+// Subscribers reached through Channels that opted out of the channel are not
+// recipients. If Category is set, subscribers that opted out of it, or did not
+// opt in to it if it is an opt-in category, are not recipients, unless
+// IgnorePreferences is set.
+type Audience struct {
+	Subscribers       []string
+	Channels          []string
+	IntersectChannels []string
+	ExceptChannels    []string
+	ExceptSubscribers []string
+	Filter            *Filter
+	Category          *storage.Category
+
+	// IgnorePreferences keeps the subscribers that opted out of Category or
+	// of Channels, e.g. to count the recipients preferences suppress.
+	IgnorePreferences bool
+}
+
+// FromSegment creates the audience of a saved segment.
+func FromSegment(segment *storage.Segment) (*Audience, error) {
+	aud := &Audience{
+		Subscribers:       segment.Subscribers,
+		Channels:          segment.Channels,
+		IntersectChannels: segment.IntersectChannels,
+		ExceptChannels:    segment.ExceptChannels,
+		ExceptSubscribers: segment.ExceptSubscribers,
+	}
+
+	if segment.Filter != "" {
+		filter, err := ParseFilter(segment.Filter)
+		if err != nil {
+			return nil, err
+		}
+		aud.Filter = filter
+	}
+
+	return aud, nil
+}
+
+// Restrict narrows the audience to the recipients that r allows: members of
+// every r.IntersectChannels that are not members of r.ExceptChannels or in
+// r.ExceptSubscribers, with devices matching r.Filter. r.Category replaces
+// the category if set. Subscribers and Channels of r are ignored.
+func (aud *Audience) Restrict(r *Audience) {
+	aud.IntersectChannels = concat(aud.IntersectChannels, r.IntersectChannels)
+	aud.ExceptChannels = concat(aud.ExceptChannels, r.ExceptChannels)
+	aud.ExceptSubscribers = concat(aud.ExceptSubscribers, r.ExceptSubscribers)
+	aud.Filter = And(aud.Filter, r.Filter)
+
+	if r.Category != nil {
+		aud.Category = r.Category
+	}
+}
+
+// ResolveAliases adds the subscribers that ids in Subscribers and
+// ExceptSubscribers were merged into, so audiences naming old ids still reach
+// or exclude the same people. The old ids are kept, as they may have been
+// registered again after the merge.
+func (aud *Audience) ResolveAliases(ctx context.Context, stg storage.Storage, appID string) error {
+	ids := concat(aud.Subscribers, aud.ExceptSubscribers)
+	if len(ids) == 0 {
+		return nil
+	}
+
+	aliases, err := stg.ResolveAliases(ctx, appID, ids)
+	if err != nil {
+		return err
+	}
+
+	aud.Subscribers = withAliases(aud.Subscribers, aliases)
+	aud.ExceptSubscribers = withAliases(aud.ExceptSubscribers, aliases)
+
+	return nil
+}
+
+// IsEmpty reports whether the audience can not have any recipients because it
+// defines neither a base set of subscribers nor a filter.
+func (aud *Audience) IsEmpty() bool {
+	return len(aud.Subscribers) == 0 && len(aud.Channels) == 0 &&
+		len(aud.IntersectChannels) == 0 && aud.Filter == nil
+}
+
+// MatchDevice reports whether a device of a subscriber is a recipient.
+func (aud *Audience) MatchDevice(subscriberID string, device *storage.Device) bool {
+	return aud.Filter == nil || aud.Filter.Match(subscriberID, device)
+}
+
+// Contains returns the subscribers of subscriberIDs that belong to the
+// audience, in the same order. Devices are not checked against the filter.
+func (aud *Audience) Contains(ctx context.Context, stg storage.Storage, appID string, subscriberIDs []string) ([]string, error) {
+	if aud.IsEmpty() {
+		return nil, nil
+	}
+
+	page := subscriberIDs
+
+	if len(aud.Subscribers) > 0 || len(aud.Channels) > 0 {
+		remaining := difference(subscriberIDs, aud.Subscribers)
+		for _, channelID := range aud.Channels {
+			if len(remaining) == 0 {
+				break
+			}
+
+			members, err := aud.channelRecipients(ctx, stg, appID, channelID, remaining)
+			if err != nil {
+				return nil, err
+			}
+
+			remaining = difference(remaining, members)
+		}
+
+		page = difference(subscriberIDs, remaining)
+	}
+
+	return aud.restrict(ctx, stg, appID, page, true, true)
+}
+
+// PageFunc receives a page of subscriber ids during expansion.
+type PageFunc func(subscriberIDs []string) error
+
+// Expand streams the subscriber ids of the audience to fn in pages of at most
+// PageSize, without loading whole channels into memory. Explicit subscribers
+// come first, then members of each channel that are not explicit subscribers
+// or recipients through an earlier channel. Expansion stops at the first error
+// returned from fn, and that error is returned.
+//
+// If the audience has a filter, subscribers without any device that can match
+// it are dropped using the storage attribute indexes where possible; devices
+// must still be checked with MatchDevice.
+func Expand(ctx context.Context, stg storage.Storage, appID string, aud *Audience, fn PageFunc) error {
+	switch {
+	case len(aud.Subscribers) > 0 || len(aud.Channels) > 0:
+		return aud.expandUnion(ctx, stg, appID, aud.restrictPages(ctx, stg, appID, true, true, fn))
+
+	case len(aud.IntersectChannels) > 0:
+		// the storage computes channel intersections and exclusions.
+		scanner := storage.NewIntersectionScanner(stg, appID, unique(aud.IntersectChannels), unique(aud.ExceptChannels), PageSize)
+		return expandScanner(ctx, scanner, aud.restrictPages(ctx, stg, appID, false, true, fn))
+
+	case aud.Filter != nil:
+		if attribute, values, ok := aud.Filter.indexPlan(); ok {
+			return expandAttribute(ctx, stg, appID, attribute, values, aud.restrictPages(ctx, stg, appID, true, false, fn))
+		}
+
+		scanner := storage.NewSubscriberScanner(stg, appID, PageSize)
+		return expandScanner(ctx, scanner, aud.restrictPages(ctx, stg, appID, true, false, fn))
+	}
+
+	return nil
+}
+
+// MatchFunc reports whether a device of a subscriber is a recipient.
+type MatchFunc func(subscriberID string, device *storage.Device) bool
+
+// UnionPageFunc receives a page of subscriber ids and the function selecting
+// their recipient devices during expansion of many audiences.
+type UnionPageFunc func(subscriberIDs []string, match MatchFunc) error
+
+// ExpandUnion expands the union of audiences as Expand does. A subscriber of
+// many audiences may be passed to fn more than once, but match selects each
+// of its devices at most once.
+func ExpandUnion(ctx context.Context, stg storage.Storage, appID string, auds []*Audience, fn UnionPageFunc) error {
+	for i, aud := range auds {
+		aud, prevAuds := aud, auds[:i]
+
+		err := Expand(ctx, stg, appID, aud, func(subscriberIDs []string) error {
+			// earlier audiences containing each subscriber; their matching
+			// devices were already selected.
+			earlier := make(map[string][]*Audience)
+			page := subscriberIDs
+
+			for _, prevAud := range prevAuds {
+				if len(page) == 0 {
+					return nil
+				}
+
+				members, err := prevAud.Contains(ctx, stg, appID, page)
+				if err != nil {
+					return err
+				}
+
+				if prevAud.Filter == nil {
+					page = difference(page, members)
+					continue
+				}
+
+				for _, subscriberID := range members {
+					earlier[subscriberID] = append(earlier[subscriberID], prevAud)
+				}
+			}
+
+			if len(page) == 0 {
+				return nil
+			}
+
+			return fn(page, func(subscriberID string, device *storage.Device) bool {
+				if !aud.MatchDevice(subscriberID, device) {
+					return false
+				}
+
+				for _, prevAud := range earlier[subscriberID] {
+					if prevAud.MatchDevice(subscriberID, device) {
+						return false
+					}
+				}
+
+				return true
+			})
+		})
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Size is the number of recipients of an audience.
+type Size struct {
+	Subscribers int `json:"subscribers"`
+	Devices     int `json:"devices"`
+}
+
+// Count expands the audience and counts the subscribers having recipient
+// devices and those devices. The audience may change at any time, so the
+// result is an estimate of the recipients of a later publish.
+func Count(ctx context.Context, stg storage.Storage, appID string, aud *Audience) (*Size, error) {
+	size := &Size{}
+
+	err := Expand(ctx, stg, appID, aud, func(subscriberIDs []string) error {
+		return stg.GetSubscribersDevices(ctx, appID, subscriberIDs, func(subscriberID string, devices []*storage.Device) error {
+			matched := 0
+			for _, device := range devices {
+				if aud.MatchDevice(subscriberID, device) {
+					matched++
+				}
+			}
+
+			if matched > 0 {
+				size.Subscribers++
+				size.Devices += matched
+			}
+
+			return nil
+		})
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return size, nil
+}
+
+// expandUnion streams the explicit subscribers, then members of each channel
+// that are not explicit subscribers or recipients through an earlier channel.
+// Members that opted out of a channel are skipped.
+func (aud *Audience) expandUnion(ctx context.Context, stg storage.Storage, appID string, fn PageFunc) error {
+	explicit := unique(aud.Subscribers)
+	for start := 0; start < len(explicit); start += PageSize {
+		end := start + PageSize
+		if end > len(explicit) {
+			end = len(explicit)
+		}
+
+		if err := fn(explicit[start:end]); err != nil {
+			return err
+		}
+	}
+
+	isExplicit := make(map[string]struct{}, len(explicit))
+	for _, subscriberID := range explicit {
+		isExplicit[subscriberID] = struct{}{}
+	}
+
+	channels := unique(aud.Channels)
+	for i, channelID := range channels {
+		scanner := storage.NewChannelScanner(stg, appID, channelID, PageSize)
+
+		for scanner.Next(ctx) {
+			page := make([]string, 0, len(scanner.Subscribers()))
+			for _, subscriberID := range scanner.Subscribers() {
+				if _, ok := isExplicit[subscriberID]; !ok {
+					page = append(page, subscriberID)
+				}
+			}
+
+			page, err := aud.withoutOptOuts(ctx, stg, appID, channelID, page)
+			if err != nil {
+				return err
+			}
+
+			// recipients through earlier channels were already passed to fn.
+			for _, prevChannelID := range channels[:i] {
+				if len(page) == 0 {
+					break
+				}
+
+				members, err := aud.channelRecipients(ctx, stg, appID, prevChannelID, page)
+				if err != nil {
+					return err
+				}
+
+				page = difference(page, members)
+			}
+
+			if len(page) == 0 {
+				continue
+			}
+
+			if err := fn(page); err != nil {
+				return err
+			}
+		}
+
+		if err := scanner.Err(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// expandAttribute streams the subscribers having a device with the attribute
+// set to one of values, skipping those already streamed for an earlier value.
+func expandAttribute(ctx context.Context, stg storage.Storage, appID string, attribute string, values []string, fn PageFunc) error {
+	values = unique(values)
+	for i, value := range values {
+		scanner := storage.NewAttributeScanner(stg, appID, attribute, value, PageSize)
+
+		for scanner.Next(ctx) {
+			page := scanner.Subscribers()
+
+			for _, prevValue := range values[:i] {
+				if len(page) == 0 {
+					break
+				}
+
+				members, err := stg.FilterAttributeSubscribers(ctx, appID, attribute, prevValue, page)
+				if err != nil {
+					return err
+				}
+
+				page = difference(page, members)
+			}
+
+			if len(page) == 0 {
+				continue
+			}
+
+			if err := fn(page); err != nil {
+				return err
+			}
+		}
+
+		if err := scanner.Err(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// expandScanner streams every page of scanner.
+func expandScanner(ctx context.Context, scanner *storage.Scanner, fn PageFunc) error {
+	for scanner.Next(ctx) {
+		if err := fn(scanner.Subscribers()); err != nil {
+			return err
+		}
+	}
+
+	return scanner.Err()
+}
+
+// restrictPages wraps fn to restrict pages with restrict, skipping pages left
+// empty.
+func (aud *Audience) restrictPages(ctx context.Context, stg storage.Storage, appID string, checkChannels bool, useIndex bool, fn PageFunc) PageFunc {
+	return func(subscriberIDs []string) error {
+		page, err := aud.restrict(ctx, stg, appID, subscriberIDs, checkChannels, useIndex)
+		if err != nil || len(page) == 0 {
+			return err
+		}
+
+		return fn(page)
+	}
+}
+
+// restrict returns the subscribers of subscriberIDs that are not excluded, in
+// the same order. If checkChannels is true, only members of every intersected
+// channel that are not members of an excluded channel are kept. If useIndex
+// is true, subscribers without a device that can match the filter by the
+// attribute indexes are dropped too.
+func (aud *Audience) restrict(ctx context.Context, stg storage.Storage, appID string, subscriberIDs []string, checkChannels bool, useIndex bool) ([]string, error) {
+	page, err := aud.restrictCategory(ctx, stg, appID, difference(subscriberIDs, aud.ExceptSubscribers))
+	if err != nil {
+		return nil, err
+	}
+
+	if checkChannels {
+		return aud.restrictChannels(ctx, stg, appID, page, useIndex)
+	}
+
+	return aud.restrictFilter(ctx, stg, appID, page, useIndex)
+}
+
+// restrictChannels keeps the members of every intersected channel that are
+// not members of an excluded channel, then restricts them by the filter.
+func (aud *Audience) restrictChannels(ctx context.Context, stg storage.Storage, appID string, page []string, useIndex bool) ([]string, error) {
+	for _, channelID := range aud.IntersectChannels {
+		if len(page) == 0 {
+			return nil, nil
+		}
+
+		members, err := stg.FilterChannelMembers(ctx, appID, channelID, page)
+		if err != nil {
+			return nil, err
+		}
+
+		page = members
+	}
+
+	for _, channelID := range aud.ExceptChannels {
+		if len(page) == 0 {
+			return nil, nil
+		}
+
+		members, err := stg.FilterChannelMembers(ctx, appID, channelID, page)
+		if err != nil {
+			return nil, err
+		}
+
+		page = difference(page, members)
+	}
+
+	return aud.restrictFilter(ctx, stg, appID, page, useIndex)
+}
+
+// restrictFilter drops the subscribers without a device that can match the
+// filter by the attribute indexes if useIndex is true.
+func (aud *Audience) restrictFilter(ctx context.Context, stg storage.Storage, appID string, page []string, useIndex bool) ([]string, error) {
+	if useIndex && aud.Filter != nil && len(page) > 0 {
+		if attribute, values, ok := aud.Filter.indexPlan(); ok {
+			return filterAttribute(ctx, stg, appID, attribute, values, page)
+		}
+	}
+
+	return page, nil
+}
+
+// restrictCategory drops the subscribers that opted out of the category, or
+// did not opt in to it if it is an opt-in category.
+func (aud *Audience) restrictCategory(ctx context.Context, stg storage.Storage, appID string, page []string) ([]string, error) {
+	if aud.Category == nil || aud.IgnorePreferences || len(page) == 0 {
+		return page, nil
+	}
+
+	if aud.Category.OptIn {
+		return stg.FilterCategoryChoices(ctx, appID, aud.Category.ID, true, page)
+	}
+
+	optOuts, err := stg.FilterCategoryChoices(ctx, appID, aud.Category.ID, false, page)
+	if err != nil {
+		return nil, err
+	}
+
+	return difference(page, optOuts), nil
+}
+
+// channelRecipients returns the subscribers of subscriberIDs that are members
+// of the channel and did not opt out of it, in the same order.
+func (aud *Audience) channelRecipients(ctx context.Context, stg storage.Storage, appID string, channelID string, subscriberIDs []string) ([]string, error) {
+	members, err := stg.FilterChannelMembers(ctx, appID, channelID, subscriberIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	return aud.withoutOptOuts(ctx, stg, appID, channelID, members)
+}
+
+// withoutOptOuts returns the subscribers of subscriberIDs that did not opt out
+// of the channel, in the same order.
+func (aud *Audience) withoutOptOuts(ctx context.Context, stg storage.Storage, appID string, channelID string, subscriberIDs []string) ([]string, error) {
+	if len(subscriberIDs) == 0 || aud.IgnorePreferences {
+		return subscriberIDs, nil
+	}
+
+	optOuts, err := stg.FilterChannelOptOuts(ctx, appID, channelID, subscriberIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	return difference(subscriberIDs, optOuts), nil
+}
+
+// filterAttribute returns the subscribers of subscriberIDs having a device
+// with the attribute set to one of values, in the same order.
+func filterAttribute(ctx context.Context, stg storage.Storage, appID string, attribute string, values []string, subscriberIDs []string) ([]string, error) {
+	remaining := subscriberIDs
+
+	for _, value := range unique(values) {
+		if len(remaining) == 0 {
+			break
+		}
+
+		members, err := stg.FilterAttributeSubscribers(ctx, appID, attribute, value, remaining)
+		if err != nil {
+			return nil, err
+		}
+
+		remaining = difference(remaining, members)
+	}
+
+	return difference(subscriberIDs, remaining), nil
+}
+
+// concat returns a new slice of the ids of a followed by the ids of b.
+func concat(a []string, b []string) []string {
+	if len(b) == 0 {
+		return a
+	}
+
+	result := make([]string, 0, len(a)+len(b))
+	return append(append(result, a...), b...)
+}
+
+// withAliases returns ids followed by the subscribers aliases maps them to,
+// without duplicates.
+func withAliases(ids []string, aliases map[string]string) []string {
+	var targets []string
+	for _, id := range ids {
+		if target, ok := aliases[id]; ok {
+			targets = append(targets, target)
+		}
+	}
+
+	if len(targets) == 0 {
+		return ids
+	}
+
+	return unique(concat(ids, targets))
+}
+
+// unique returns ids without duplicates, keeping the first occurrences.
+func unique(ids []string) []string {
+	seen := make(map[string]struct{}, len(ids))
+	result := make([]string, 0, len(ids))
+
+	for _, id := range ids {
+		if _, ok := seen[id]; ok {
+			continue
+		}
+		seen[id] = struct{}{}
+		result = append(result, id)
+	}
+
+	return result
+}
+
+// difference returns ids that are not in remove, keeping the order of ids.
+func difference(ids []string, remove []string) []string {
+	if len(remove) == 0 {
+		return ids
+	}
+
+	removed := make(map[string]struct{}, len(remove))
+	for _, id := range remove {
+		removed[id] = struct{}{}
+	}
+
+	result := make([]string, 0, len(ids))
+	for _, id := range ids {
+		if _, ok := removed[id]; !ok {
+			result = append(result, id)
+		}
+	}
+
+	return result
+}
@@ -0,0 +1,268 @@
+package audience
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/gamegos/scotty/storage"
+	memstorage "github.com/gamegos/scotty/storage/drivers/memory"
+)
+
+var ctx = context.Background()
+
+func TestExpand(t *testing.T) {
+	stg := memstorage.New()
+
+	if err := stg.AddSubscriber(ctx, "app", "chan1", []string{"sub_1", "sub_2", "sub_3"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := stg.AddSubscriber(ctx, "app", "chan2", []string{"sub_3", "sub_4"}); err != nil {
+		t.Fatal(err)
+	}
+
+	aud := &Audience{
+		Subscribers: []string{"sub_2", "sub_5", "sub_2"},
+		Channels:    []string{"chan1", "chan2", "chan1"},
+	}
+
+	var expanded []string
+	err := Expand(ctx, stg, "app", aud, func(subscriberIDs []string) error {
+		expanded = append(expanded, subscriberIDs...)
+		return nil
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sort.Strings(expanded)
+	expected := []string{"sub_1", "sub_2", "sub_3", "sub_4", "sub_5"}
+
+	if !reflect.DeepEqual(expanded, expected) {
+		t.Errorf("Expanded subscribers do not match. got %v, expected %v", expanded, expected)
+	}
+}
+
+func TestExpandIntersectExcept(t *testing.T) {
+	stg := memstorage.New()
+
+	channels := map[string][]string{
+		"premium":   {"sub_1", "sub_2", "sub_3", "sub_4"},
+		"tr_locale": {"sub_1", "sub_2", "sub_5"},
+		"purchased": {"sub_2"},
+	}
+
+	for channelID, members := range channels {
+		if err := stg.AddSubscriber(ctx, "app", channelID, members); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		aud      *Audience
+		expected []string
+	}{
+		{&Audience{IntersectChannels: []string{"premium", "tr_locale"}, ExceptChannels: []string{"purchased"}}, []string{"sub_1"}},
+		{&Audience{Channels: []string{"premium"}, ExceptSubscribers: []string{"sub_3"}}, []string{"sub_1", "sub_2", "sub_4"}},
+		{&Audience{Subscribers: []string{"sub_5", "sub_6"}, IntersectChannels: []string{"tr_locale"}}, []string{"sub_5"}},
+		{&Audience{ExceptChannels: []string{"purchased"}}, nil},
+	}
+
+	for _, test := range tests {
+		var expanded []string
+		err := Expand(ctx, stg, "app", test.aud, func(subscriberIDs []string) error {
+			expanded = append(expanded, subscriberIDs...)
+			return nil
+		})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		sort.Strings(expanded)
+
+		if !reflect.DeepEqual(expanded, test.expected) {
+			t.Errorf("Expanded subscribers do not match. got %v, expected %v", expanded, test.expected)
+		}
+	}
+}
+
+func TestExpandUnion(t *testing.T) {
+	stg := memstorage.New()
+
+	devices := []struct {
+		subscriberID string
+		device       *storage.Device
+	}{
+		{"sub_1", &storage.Device{Platform: "gcm", Token: "t1", Locale: "tr"}},
+		{"sub_1", &storage.Device{Platform: "gcm", Token: "t2", Locale: "de"}},
+		{"sub_2", &storage.Device{Platform: "gcm", Token: "t3", Locale: "tr"}},
+	}
+
+	for _, d := range devices {
+		if err := stg.AddSubscriberDevice(ctx, "app", d.subscriberID, d.device); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := stg.AddSubscriber(ctx, "app", "chan", []string{"sub_1", "sub_2"}); err != nil {
+		t.Fatal(err)
+	}
+
+	auds := []*Audience{
+		{Channels: []string{"chan"}, Filter: mustParseFilter(t, `locale == "tr"`)},
+		{Subscribers: []string{"sub_1", "sub_2"}},
+		{Subscribers: []string{"sub_2"}},
+	}
+
+	var tokens []string
+	err := ExpandUnion(ctx, stg, "app", auds, func(subscriberIDs []string, match MatchFunc) error {
+		return stg.GetSubscribersDevices(ctx, "app", subscriberIDs, func(subscriberID string, devices []*storage.Device) error {
+			for _, device := range devices {
+				if match(subscriberID, device) {
+					tokens = append(tokens, device.Token)
+				}
+			}
+			return nil
+		})
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sort.Strings(tokens)
+	expected := []string{"t1", "t2", "t3"}
+
+	if !reflect.DeepEqual(tokens, expected) {
+		t.Errorf("Selected devices do not match. got %v, expected %v", tokens, expected)
+	}
+}
+
+func TestCount(t *testing.T) {
+	stg := memstorage.New()
+
+	devices := []struct {
+		subscriberID string
+		device       *storage.Device
+	}{
+		{"sub_1", &storage.Device{Platform: "gcm", Token: "t1", Locale: "tr"}},
+		{"sub_1", &storage.Device{Platform: "gcm", Token: "t2", Locale: "tr"}},
+		{"sub_2", &storage.Device{Platform: "gcm", Token: "t3", Locale: "de"}},
+	}
+
+	for _, d := range devices {
+		if err := stg.AddSubscriberDevice(ctx, "app", d.subscriberID, d.device); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	aud := &Audience{
+		Subscribers: []string{"sub_1", "sub_2", "sub_3"},
+		Filter:      mustParseFilter(t, `locale == "tr"`),
+	}
+
+	size, err := Count(ctx, stg, "app", aud)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := &Size{Subscribers: 1, Devices: 2}
+	if !reflect.DeepEqual(size, expected) {
+		t.Errorf("Size does not match. got %+v, expected %+v", size, expected)
+	}
+}
+
+func TestResolveAliases(t *testing.T) {
+	stg := memstorage.New()
+
+	if err := stg.AddSubscriber(ctx, "app", "chan", []string{"anon_1", "anon_2"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := stg.MergeSubscriber(ctx, "app", "anon_1", "sub_1"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := stg.MergeSubscriber(ctx, "app", "anon_2", "sub_2"); err != nil {
+		t.Fatal(err)
+	}
+
+	aud := &Audience{
+		Subscribers:       []string{"anon_1", "sub_1", "sub_3"},
+		ExceptSubscribers: []string{"anon_2"},
+	}
+
+	if err := aud.ResolveAliases(ctx, stg, "app"); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"anon_1", "sub_1", "sub_3"}
+	if !reflect.DeepEqual(aud.Subscribers, expected) {
+		t.Errorf("Subscribers do not match. got %v, expected %v", aud.Subscribers, expected)
+	}
+
+	expected = []string{"anon_2", "sub_2"}
+	if !reflect.DeepEqual(aud.ExceptSubscribers, expected) {
+		t.Errorf("ExceptSubscribers do not match. got %v, expected %v", aud.ExceptSubscribers, expected)
+	}
+}
+
+func TestExpandPreferences(t *testing.T) {
+	stg := memstorage.New()
+
+	if err := stg.AddSubscriber(ctx, "app", "chan1", []string{"sub_1", "sub_2", "sub_3"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := stg.AddSubscriber(ctx, "app", "chan2", []string{"sub_1", "sub_4"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// sub_1 is still reached through chan2.
+	prefs := map[string]*storage.Preferences{
+		"sub_1": {Channels: map[string]bool{"chan1": false}},
+		"sub_2": {Categories: map[string]bool{"promotions": false}},
+		"sub_3": {Categories: map[string]bool{"beta": true}},
+		"sub_4": {Channels: map[string]bool{"chan2": false}},
+	}
+
+	for subscriberID, p := range prefs {
+		if err := stg.PutPreferences(ctx, "app", subscriberID, p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		category *storage.Category
+		ignore   bool
+		expected []string
+	}{
+		{nil, false, []string{"sub_1", "sub_2", "sub_3"}},
+		{&storage.Category{ID: "promotions"}, false, []string{"sub_1", "sub_3"}},
+		{&storage.Category{ID: "beta", OptIn: true}, false, []string{"sub_3"}},
+		{&storage.Category{ID: "beta", OptIn: true}, true, []string{"sub_1", "sub_2", "sub_3", "sub_4"}},
+	}
+
+	for _, test := range tests {
+		aud := &Audience{Channels: []string{"chan1", "chan2"}, Category: test.category, IgnorePreferences: test.ignore}
+
+		var expanded []string
+		err := Expand(ctx, stg, "app", aud, func(subscriberIDs []string) error {
+			expanded = append(expanded, subscriberIDs...)
+			return nil
+		})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		sort.Strings(expanded)
+		if !reflect.DeepEqual(expanded, test.expected) {
+			t.Errorf("Expanded subscribers with category %v do not match. got %v, expected %v", test.category, expanded, test.expected)
+		}
+	}
+}
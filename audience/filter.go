@@ -0,0 +1,529 @@
+package audience
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/gamegos/scotty/storage"
+)
+
+// Filter is a parsed filter expression over device and subscriber
+// attributes, e.g.
+//
+//	platform == "gcm" && appVersion >= "2.3" && locale in ["tr", "de"]
+//
+// Attributes are the device attributes known by storage.Device.Attribute and
+// subscriberId. Comparison operators are ==, !=, <, <=, >, >= and in; they can
+// be combined with &&, ||, ! and parentheses. Versions are compared segment
+// by segment, numeric values as numbers and other values as strings.
+type Filter struct {
+	root filterNode
+}
+
+type filterNode interface {
+	match(subscriberID string, device *storage.Device) bool
+}
+
+// versionAttributes are compared as dotted version numbers.
+var versionAttributes = map[string]bool{
+	"appVersion": true,
+	"osVersion":  true,
+}
+
+// ParseFilter parses a filter expression.
+func ParseFilter(expr string) (*Filter, error) {
+	tokens, err := lexFilter(expr)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &filterParser{tokens: tokens}
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+
+	if tok := p.peek(); tok.kind != tokenEOF {
+		return nil, p.unexpected(tok)
+	}
+
+	return &Filter{root: root}, nil
+}
+
+// Match reports whether a device of a subscriber matches the filter.
+func (f *Filter) Match(subscriberID string, device *storage.Device) bool {
+	return f.root.match(subscriberID, device)
+}
+
+// And returns a filter matching the devices that match both a and b. Either
+// of them may be nil to match every device.
+func And(a, b *Filter) *Filter {
+	switch {
+	case a == nil:
+		return b
+	case b == nil:
+		return a
+	}
+
+	return &Filter{root: &andNode{a.root, b.root}}
+}
+
+// indexPlan returns an indexed attribute and the values one of which every
+// matching device must have, so only subscribers in those attribute indexes
+// need to be considered. ok is false if the filter has no such condition.
+// Only conditions comparing values as plain strings qualify, as indexes hold
+// exact values: "2.3.0" is equal to a version "2.3", and "1.0" to a number 1.
+func (f *Filter) indexPlan() (attribute string, values []string, ok bool) {
+	var candidates []filterNode
+	var collect func(n filterNode)
+	collect = func(n filterNode) {
+		if and, isAnd := n.(*andNode); isAnd {
+			collect(and.left)
+			collect(and.right)
+			return
+		}
+		candidates = append(candidates, n)
+	}
+	collect(f.root)
+
+	// prefer equality, it needs a single index.
+	for _, n := range candidates {
+		if cmp, isCmp := n.(*compareNode); isCmp && cmp.op == "==" {
+			if _, indexed := storage.IndexedAttributes[cmp.attribute]; indexed && exactValues(cmp.attribute, cmp.value) {
+				return cmp.attribute, []string{cmp.value}, true
+			}
+		}
+	}
+
+	for _, n := range candidates {
+		if in, isIn := n.(*inNode); isIn {
+			if _, indexed := storage.IndexedAttributes[in.attribute]; indexed && exactValues(in.attribute, in.values...) {
+				return in.attribute, in.values, true
+			}
+		}
+	}
+
+	return "", nil, false
+}
+
+// exactValues reports whether values of an attribute are only equal to the
+// same strings, so they can be looked up in an index.
+func exactValues(attribute string, values ...string) bool {
+	if versionAttributes[attribute] {
+		return false
+	}
+
+	for _, value := range values {
+		if _, err := strconv.ParseFloat(value, 64); err == nil {
+			return false
+		}
+	}
+
+	return true
+}
+
+type andNode struct {
+	left, right filterNode
+}
+
+func (n *andNode) match(subscriberID string, device *storage.Device) bool {
+	return n.left.match(subscriberID, device) && n.right.match(subscriberID, device)
+}
+
+type orNode struct {
+	left, right filterNode
+}
+
+func (n *orNode) match(subscriberID string, device *storage.Device) bool {
+	return n.left.match(subscriberID, device) || n.right.match(subscriberID, device)
+}
+
+type notNode struct {
+	node filterNode
+}
+
+func (n *notNode) match(subscriberID string, device *storage.Device) bool {
+	return !n.node.match(subscriberID, device)
+}
+
+type compareNode struct {
+	attribute string
+	op        string
+	value     string
+}
+
+func (n *compareNode) match(subscriberID string, device *storage.Device) bool {
+	c := compareValues(n.attribute, attributeValue(n.attribute, subscriberID, device), n.value)
+
+	switch n.op {
+	case "==":
+		return c == 0
+	case "!=":
+		return c != 0
+	case "<":
+		return c < 0
+	case "<=":
+		return c <= 0
+	case ">":
+		return c > 0
+	case ">=":
+		return c >= 0
+	}
+
+	return false
+}
+
+type inNode struct {
+	attribute string
+	values    []string
+}
+
+func (n *inNode) match(subscriberID string, device *storage.Device) bool {
+	value := attributeValue(n.attribute, subscriberID, device)
+	for _, v := range n.values {
+		if compareValues(n.attribute, value, v) == 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// attributeValue returns the value of an attribute for a subscriber's device.
+func attributeValue(attribute string, subscriberID string, device *storage.Device) string {
+	if attribute == "subscriberId" {
+		return subscriberID
+	}
+
+	value, _ := device.Attribute(attribute)
+	return value
+}
+
+// isAttribute reports whether name is a known filter attribute.
+func isAttribute(name string) bool {
+	if name == "subscriberId" {
+		return true
+	}
+
+	_, ok := (&storage.Device{}).Attribute(name)
+	return ok
+}
+
+// compareValues compares two values of an attribute and returns -1, 0 or 1.
+func compareValues(attribute string, a, b string) int {
+	if versionAttributes[attribute] {
+		return compareVersions(a, b)
+	}
+
+	if x, err := strconv.ParseFloat(a, 64); err == nil {
+		if y, err := strconv.ParseFloat(b, 64); err == nil {
+			return compareNumbers(x, y)
+		}
+	}
+
+	return strings.Compare(a, b)
+}
+
+// compareVersions compares versions like "2.10.1-beta" segment by segment.
+// Numeric segments are compared as numbers and missing segments as zero.
+func compareVersions(a, b string) int {
+	isSeparator := func(r rune) bool {
+		return r == '.' || r == '-' || r == '_' || r == '+'
+	}
+
+	as := strings.FieldsFunc(a, isSeparator)
+	bs := strings.FieldsFunc(b, isSeparator)
+
+	for i := 0; i < len(as) || i < len(bs); i++ {
+		x, y := "0", "0"
+		if i < len(as) {
+			x = as[i]
+		}
+		if i < len(bs) {
+			y = bs[i]
+		}
+
+		xn, xerr := strconv.ParseUint(x, 10, 64)
+		yn, yerr := strconv.ParseUint(y, 10, 64)
+
+		var c int
+		if xerr == nil && yerr == nil {
+			c = compareNumbers(float64(xn), float64(yn))
+		} else {
+			c = strings.Compare(x, y)
+		}
+
+		if c != 0 {
+			return c
+		}
+	}
+
+	return 0
+}
+
+func compareNumbers(x, y float64) int {
+	switch {
+	case x < y:
+		return -1
+	case x > y:
+		return 1
+	}
+
+	return 0
+}
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenIdent
+	tokenString
+	tokenNumber
+	tokenOp
+)
+
+type filterToken struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+// lexFilter splits a filter expression into tokens.
+func lexFilter(expr string) ([]filterToken, error) {
+	var tokens []filterToken
+
+	for i := 0; i < len(expr); {
+		c := expr[i]
+
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+
+		case c == '"':
+			end := i + 1
+			for ; end < len(expr) && expr[end] != '"'; end++ {
+				if expr[end] == '\\' {
+					end++
+				}
+			}
+			if end >= len(expr) {
+				return nil, fmt.Errorf("audience: filter: unterminated string at %d", i)
+			}
+
+			value, err := strconv.Unquote(expr[i : end+1])
+			if err != nil {
+				return nil, fmt.Errorf("audience: filter: invalid string at %d", i)
+			}
+
+			tokens = append(tokens, filterToken{tokenString, value, i})
+			i = end + 1
+
+		case c >= '0' && c <= '9' || c == '-':
+			end := i + 1
+			for end < len(expr) && (expr[end] >= '0' && expr[end] <= '9' || expr[end] == '.') {
+				end++
+			}
+
+			tokens = append(tokens, filterToken{tokenNumber, expr[i:end], i})
+			i = end
+
+		case c == '_' || unicode.IsLetter(rune(c)):
+			end := i + 1
+			for end < len(expr) && (expr[end] == '_' || expr[end] == '.' || unicode.IsLetter(rune(expr[end])) || unicode.IsDigit(rune(expr[end]))) {
+				end++
+			}
+
+			tokens = append(tokens, filterToken{tokenIdent, expr[i:end], i})
+			i = end
+
+		default:
+			op := ""
+			for _, candidate := range []string{"==", "!=", "<=", ">=", "&&", "||", "<", ">", "!", "(", ")", "[", "]", ","} {
+				if strings.HasPrefix(expr[i:], candidate) {
+					op = candidate
+					break
+				}
+			}
+
+			if op == "" {
+				return nil, fmt.Errorf("audience: filter: unexpected character %q at %d", c, i)
+			}
+
+			tokens = append(tokens, filterToken{tokenOp, op, i})
+			i += len(op)
+		}
+	}
+
+	return append(tokens, filterToken{tokenEOF, "", len(expr)}), nil
+}
+
+// filterParser is a recursive descent parser of filter expressions:
+//
+//	or         = and { "||" and }
+//	and        = unary { "&&" unary }
+//	unary      = "!" unary | "(" or ")" | comparison
+//	comparison = attribute op value | attribute "in" "[" value { "," value } "]"
+type filterParser struct {
+	tokens []filterToken
+	pos    int
+}
+
+func (p *filterParser) peek() filterToken {
+	return p.tokens[p.pos]
+}
+
+func (p *filterParser) next() filterToken {
+	tok := p.tokens[p.pos]
+	if tok.kind != tokenEOF {
+		p.pos++
+	}
+	return tok
+}
+
+func (p *filterParser) isOp(op string) bool {
+	tok := p.peek()
+	return tok.kind == tokenOp && tok.text == op
+}
+
+func (p *filterParser) expectOp(op string) error {
+	if tok := p.next(); tok.kind != tokenOp || tok.text != op {
+		return p.unexpected(tok)
+	}
+	return nil
+}
+
+func (p *filterParser) unexpected(tok filterToken) error {
+	if tok.kind == tokenEOF {
+		return fmt.Errorf("audience: filter: unexpected end of expression")
+	}
+	return fmt.Errorf("audience: filter: unexpected %q at %d", tok.text, tok.pos)
+}
+
+func (p *filterParser) parseOr() (filterNode, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.isOp("||") {
+		p.next()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &orNode{left, right}
+	}
+
+	return left, nil
+}
+
+func (p *filterParser) parseAnd() (filterNode, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.isOp("&&") {
+		p.next()
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = &andNode{left, right}
+	}
+
+	return left, nil
+}
+
+func (p *filterParser) parseUnary() (filterNode, error) {
+	if p.isOp("!") {
+		p.next()
+		node, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &notNode{node}, nil
+	}
+
+	if p.isOp("(") {
+		p.next()
+		node, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expectOp(")"); err != nil {
+			return nil, err
+		}
+		return node, nil
+	}
+
+	return p.parseComparison()
+}
+
+func (p *filterParser) parseComparison() (filterNode, error) {
+	tok := p.next()
+	if tok.kind != tokenIdent || tok.text == "in" {
+		return nil, p.unexpected(tok)
+	}
+
+	attribute := tok.text
+	if !isAttribute(attribute) {
+		return nil, fmt.Errorf("audience: filter: unknown attribute %q at %d", attribute, tok.pos)
+	}
+
+	tok = p.next()
+
+	if tok.kind == tokenIdent && tok.text == "in" {
+		if err := p.expectOp("["); err != nil {
+			return nil, err
+		}
+
+		var values []string
+		for {
+			value, err := p.parseValue()
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, value)
+
+			if !p.isOp(",") {
+				break
+			}
+			p.next()
+		}
+
+		if err := p.expectOp("]"); err != nil {
+			return nil, err
+		}
+
+		return &inNode{attribute, values}, nil
+	}
+
+	if tok.kind != tokenOp {
+		return nil, p.unexpected(tok)
+	}
+
+	switch tok.text {
+	case "==", "!=", "<", "<=", ">", ">=":
+	default:
+		return nil, p.unexpected(tok)
+	}
+
+	value, err := p.parseValue()
+	if err != nil {
+		return nil, err
+	}
+
+	return &compareNode{attribute, tok.text, value}, nil
+}
+
+func (p *filterParser) parseValue() (string, error) {
+	tok := p.next()
+	if tok.kind != tokenString && tok.kind != tokenNumber {
+		return "", p.unexpected(tok)
+	}
+
+	return tok.text, nil
+}
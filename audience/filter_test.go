@@ -0,0 +1,201 @@
+package audience
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/gamegos/scotty/storage"
+	memstorage "github.com/gamegos/scotty/storage/drivers/memory"
+)
+
+func TestFilterMatch(t *testing.T) {
+	device := &storage.Device{
+		Platform:   "gcm",
+		Token:      "token",
+		AppVersion: "2.10.1",
+		Locale:     "tr",
+		LastSeen:   1500,
+		Tags:       map[string]string{"tier": "gold"},
+	}
+
+	tests := []struct {
+		expr     string
+		expected bool
+	}{
+		{`platform == "gcm"`, true},
+		{`platform != "gcm"`, false},
+		{`appVersion >= "2.3"`, true},
+		{`appVersion < "2.9"`, false},
+		{`appVersion == "2.10.1.0"`, true},
+		{`locale in ["tr", "de"]`, true},
+		{`locale in ["en"]`, false},
+		{`lastSeen > 1000 && lastSeen <= 1500`, true},
+		{`tags.tier == "gold"`, true},
+		{`tags.missing == ""`, true},
+		{`subscriberId == "sub_1"`, true},
+		{`platform == "gcm" && appVersion >= "2.3" && locale in ["tr","de"]`, true},
+		{`platform == "apns" || locale == "tr"`, true},
+		{`!(platform == "apns" || locale == "tr")`, false},
+		{`!platform == "apns"`, true},
+	}
+
+	for _, test := range tests {
+		filter, err := ParseFilter(test.expr)
+		if err != nil {
+			t.Errorf("Could not parse %q: %v", test.expr, err)
+			continue
+		}
+
+		if got := filter.Match("sub_1", device); got != test.expected {
+			t.Errorf("Match of %q does not match. got %v, expected %v", test.expr, got, test.expected)
+		}
+	}
+}
+
+func TestParseFilterInvalid(t *testing.T) {
+	invalid := []string{
+		``,
+		`platform`,
+		`platform ==`,
+		`platform = "gcm"`,
+		`unknown == "x"`,
+		`platform == "gcm" &&`,
+		`(platform == "gcm"`,
+		`platform == "gcm")`,
+		`locale in []`,
+		`locale in ["tr"`,
+		`platform == "gcm`,
+		`platform == gcm`,
+	}
+
+	for _, expr := range invalid {
+		if _, err := ParseFilter(expr); err == nil {
+			t.Errorf("Expected an error for %q", expr)
+		}
+	}
+}
+
+func TestExpandFilter(t *testing.T) {
+	stg := memstorage.New()
+
+	devices := map[string]*storage.Device{
+		"sub_1": {Platform: "gcm", Token: "t1", AppVersion: "2.3", Locale: "tr"},
+		"sub_2": {Platform: "gcm", Token: "t2", AppVersion: "2.1", Locale: "de"},
+		"sub_3": {Platform: "apns", Token: "t3", AppVersion: "3.0", Locale: "tr"},
+		"sub_4": {Platform: "gcm", Token: "t4", AppVersion: "2.4", Locale: "en"},
+	}
+
+	for subscriberID, device := range devices {
+		if err := stg.AddSubscriberDevice(ctx, "app", subscriberID, device); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := stg.AddSubscriber(ctx, "app", "chan", []string{"sub_1", "sub_3"}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		aud      *Audience
+		expected []string
+	}{
+		{&Audience{Filter: mustParseFilter(t, `locale in ["tr", "de"]`)}, []string{"sub_1", "sub_2", "sub_3"}},
+		{&Audience{Filter: mustParseFilter(t, `appVersion >= "2.3"`)}, []string{"sub_1", "sub_2", "sub_3", "sub_4"}},
+		{&Audience{Channels: []string{"chan"}, Filter: mustParseFilter(t, `platform == "gcm"`)}, []string{"sub_1"}},
+		{&Audience{Subscribers: []string{"sub_2", "sub_3"}, Filter: mustParseFilter(t, `locale == "tr"`)}, []string{"sub_3"}},
+	}
+
+	for _, test := range tests {
+		var expanded []string
+		err := Expand(ctx, stg, "app", test.aud, func(subscriberIDs []string) error {
+			expanded = append(expanded, subscriberIDs...)
+			return nil
+		})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		sort.Strings(expanded)
+
+		if !reflect.DeepEqual(expanded, test.expected) {
+			t.Errorf("Expanded subscribers do not match. got %v, expected %v", expanded, test.expected)
+		}
+	}
+}
+
+func TestExpandFilterIndexPlan(t *testing.T) {
+	stg := memstorage.New()
+
+	devices := map[string]*storage.Device{
+		"sub_1": {Platform: "gcm", Token: "t1", AppVersion: "2.3", Locale: "tr", Model: "10"},
+		"sub_2": {Platform: "gcm", Token: "t2", AppVersion: "2.3.0", Locale: "de", Model: "10.0"},
+		"sub_3": {Platform: "apns", Token: "t3", AppVersion: "2.30", Locale: "tr", Model: "pixel"},
+	}
+
+	for subscriberID, device := range devices {
+		if err := stg.AddSubscriberDevice(ctx, "app", subscriberID, device); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		expr    string
+		indexed bool
+	}{
+		{`locale == "tr"`, true},
+		{`platform in ["gcm", "apns"]`, true},
+		{`appVersion == "2.3"`, false},
+		{`osVersion in ["2"]`, false},
+		{`model == "10"`, false},
+		{`model in ["pixel", "10"]`, false},
+	}
+
+	for _, test := range tests {
+		filter := mustParseFilter(t, test.expr)
+
+		if _, _, ok := filter.indexPlan(); ok != test.indexed {
+			t.Errorf("Index plan of %s does not match. got %v, expected %v", test.expr, ok, test.indexed)
+		}
+
+		// the subscribers a scan of all devices selects.
+		var scanned []string
+		for subscriberID, device := range devices {
+			if filter.Match(subscriberID, device) {
+				scanned = append(scanned, subscriberID)
+			}
+		}
+
+		// expansion passes candidates, their devices are matched on delivery.
+		var expanded []string
+		err := Expand(ctx, stg, "app", &Audience{Filter: filter}, func(subscriberIDs []string) error {
+			for _, subscriberID := range subscriberIDs {
+				if filter.Match(subscriberID, devices[subscriberID]) {
+					expanded = append(expanded, subscriberID)
+				}
+			}
+			return nil
+		})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		sort.Strings(scanned)
+		sort.Strings(expanded)
+
+		if !reflect.DeepEqual(expanded, scanned) {
+			t.Errorf("Expanded subscribers of %s do not match. got %v, expected %v", test.expr, expanded, scanned)
+		}
+	}
+}
+
+func mustParseFilter(t *testing.T, expr string) *Filter {
+	filter, err := ParseFilter(expr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return filter
+}
@@ -8,6 +8,10 @@ import (
 
 type ServerConfig struct {
 	Addr string
+	// RequestTimeout is the time limit of a request in seconds. Storage calls
+	// of the request are canceled when it passes. Sends of publish and replay
+	// requests are not limited. Zero disables the limit.
+	RequestTimeout int
 }
 
 type StorageConfig struct {
@@ -15,19 +19,112 @@ type StorageConfig struct {
 	Options map[string]interface{}
 }
 
+// QueueConfig is the queue the batches of publish requests are sent through
+// to the workers. Without a driver, batches are sent while handling the
+// request.
+type QueueConfig struct {
+	Driver  string
+	Options map[string]interface{}
+}
+
+type WorkerConfig struct {
+	// Concurrency is the number of batches a process sends at once.
+	Concurrency int
+	// ClaimInterval is the time between checks for batches left pending in
+	// seconds, e.g. by a worker that stopped, and ClaimIdle is the time they
+	// are pending before they are sent again by another worker.
+	ClaimInterval int
+	ClaimIdle     int
+	// MaxDeliveries is the number of times a batch failing temporarily is
+	// sent before its tokens are recorded as dead letters.
+	MaxDeliveries int
+}
+
+type JanitorConfig struct {
+	// Interval is the time between removals of stale devices in seconds. Zero
+	// disables the janitor.
+	Interval int
+	// RetentionDays is the number of days devices are kept after they were
+	// last seen, for apps without their own retention. Zero keeps devices of
+	// such apps forever.
+	RetentionDays int
+	// BatchSize is the number of subscribers checked in a batch.
+	BatchSize int
+	// BatchInterval is the minimum time between two batches in milliseconds.
+	BatchInterval int
+}
+
+type DeliveryConfig struct {
+	// MaxAttempts is the number of times a batch or a token is sent before
+	// its delivery fails. One disables retries.
+	MaxAttempts int
+	// InitialBackoff is the delay before the first retry in milliseconds. It
+	// doubles with each retry up to MaxBackoff, and delays are jittered.
+	// Longer delays asked by the provider are honored up to MaxBackoff,
+	// beyond it the send fails as retryable and is retried later.
+	InitialBackoff int
+	MaxBackoff     int
+	// RetryBudgetRatio is the number of retries an app earns with each batch
+	// it sends, and RetryBudget is the most retries it can save. Retries of an
+	// app stop while its budget is spent.
+	RetryBudgetRatio float64
+	RetryBudget      int
+	// DeadLetterTTL is the number of seconds messages that could not be
+	// delivered are kept for inspection and replay.
+	DeadLetterTTL int
+	// BreakerThreshold is the number of consecutive authentication, server or
+	// network errors of a provider that open the circuit of an app, which
+	// fails its deliveries to the provider fast. After BreakerCooldown
+	// milliseconds a single delivery probes the provider and closes the
+	// circuit if it succeeds. Zero disables circuit breakers.
+	BreakerThreshold int
+	BreakerCooldown  int
+	// CircuitReportInterval is the number of seconds between two reports of
+	// the circuits of a process to the storage, where the API servers of all
+	// processes read them. Reports expire after three intervals.
+	CircuitReportInterval int
+}
+
 type Config struct {
-	Server  ServerConfig
-	Storage StorageConfig
+	Server   ServerConfig
+	Storage  StorageConfig
+	Queue    QueueConfig
+	Worker   WorkerConfig
+	Janitor  JanitorConfig
+	Delivery DeliveryConfig
 }
 
 func DefaultConfig() *Config {
 	return &Config{
 		Server: ServerConfig{
-			Addr: ":9009",
+			Addr:           ":9009",
+			RequestTimeout: 30,
 		},
 		Storage: StorageConfig{
 			Driver: "redis",
 		},
+		Worker: WorkerConfig{
+			Concurrency:   4,
+			ClaimInterval: 30,
+			ClaimIdle:     60,
+			MaxDeliveries: 5,
+		},
+		Janitor: JanitorConfig{
+			Interval:      3600,
+			BatchSize:     100,
+			BatchInterval: 100,
+		},
+		Delivery: DeliveryConfig{
+			MaxAttempts:           4,
+			InitialBackoff:        500,
+			MaxBackoff:            30000,
+			RetryBudgetRatio:      0.2,
+			RetryBudget:           100,
+			DeadLetterTTL:         604800,
+			BreakerThreshold:      5,
+			BreakerCooldown:       30000,
+			CircuitReportInterval: 5,
+		},
 	}
 }
 
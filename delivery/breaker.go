@@ -0,0 +1,234 @@
+package delivery
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gamegos/scotty/storage"
+)
+
+// ProviderGCM is the provider of GCM deliveries.
+const ProviderGCM = "gcm"
+
+// States of a circuit.
+const (
+	// StateClosed lets every delivery through.
+	StateClosed = "closed"
+	// StateOpen fails deliveries fast until the cooldown passes.
+	StateOpen = "open"
+	// StateHalfOpen lets a single probe delivery through; the circuit closes
+	// if it succeeds and opens again otherwise.
+	StateHalfOpen = "halfOpen"
+)
+
+// ErrCircuitOpen is returned for deliveries to a provider the circuit of the
+// app is open for.
+var ErrCircuitOpen = errors.New("delivery: circuit open, provider is failing")
+
+// Circuit describes the circuit breaker of an app and a provider. It is
+// reported to the storage, as circuits are kept by each process.
+type Circuit = storage.Circuit
+
+// breaker stops deliveries of an app to a provider after consecutive
+// authentication or server errors.
+type breaker struct {
+	mu        sync.Mutex
+	state     string
+	failures  int
+	lastError string
+	openedAt  time.Time
+	// probing is true while the probe of a half open circuit is in flight.
+	probing bool
+}
+
+// allow reports whether a delivery may be attempted at now. A half open
+// circuit allows one delivery at a time.
+func (b *breaker) allow(now time.Time, cooldown time.Duration) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case StateOpen:
+		if now.Sub(b.openedAt) < cooldown {
+			return false
+		}
+		b.state = StateHalfOpen
+		fallthrough
+	case StateHalfOpen:
+		if b.probing {
+			return false
+		}
+		b.probing = true
+	}
+
+	return true
+}
+
+// record records the outcome of an allowed delivery. A success closes the
+// circuit and errors failing it count towards threshold. Other errors, e.g. of
+// a bad request, leave the circuit as it is.
+func (b *breaker) record(err error, now time.Time, threshold int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.probing = false
+
+	if err == nil {
+		b.state = StateClosed
+		b.failures = 0
+		return
+	}
+
+	if !failsCircuit(err) {
+		return
+	}
+
+	b.failures++
+	b.lastError = err.Error()
+
+	if b.state == StateHalfOpen || (threshold > 0 && b.failures >= threshold) {
+		b.state = StateOpen
+		b.openedAt = now
+	}
+}
+
+// circuit returns the state of the breaker at now.
+func (b *breaker) circuit(now time.Time, cooldown time.Duration) *Circuit {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	c := &Circuit{
+		State:     b.state,
+		Failures:  b.failures,
+		LastError: b.lastError,
+	}
+
+	if b.state == StateOpen && now.Sub(b.openedAt) >= cooldown {
+		c.State = StateHalfOpen
+	}
+
+	if !b.openedAt.IsZero() {
+		c.OpenedAt = int(b.openedAt.Unix())
+	}
+
+	if c.State == StateOpen {
+		c.ProbeAt = int(b.openedAt.Add(cooldown).Unix())
+	}
+
+	return c
+}
+
+// failsCircuit reports whether an error returned from a provider client
+// counts towards opening a circuit: it has a 401, 403 or 5xx status code, as
+// the *HTTPError of such a response does, or no status code at all, as
+// network errors and timeouts.
+func failsCircuit(err error) bool {
+	if e, ok := err.(interface {
+		StatusCode() int
+	}); ok {
+		code := e.StatusCode()
+		return code == 401 || code == 403 || code >= 500
+	}
+	return true
+}
+
+// circuitKey identifies the circuit breaker of an app and a provider.
+type circuitKey struct {
+	appID    string
+	provider string
+}
+
+// breaker returns the circuit breaker of an app and a provider.
+func (d *Deliverer) breaker(appID string, provider string) *breaker {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	key := circuitKey{appID, provider}
+	b, ok := d.breakers[key]
+	if !ok {
+		b = &breaker{state: StateClosed}
+		d.breakers[key] = b
+	}
+
+	return b
+}
+
+// Circuits returns the circuits of an app, or of all apps if appID is empty,
+// ordered by app and provider. Apps that did not deliver anything have none.
+func (d *Deliverer) Circuits(appID string) []*Circuit {
+	now := d.now()
+
+	d.mu.Lock()
+	circuits := make([]*Circuit, 0, len(d.breakers))
+	for key, b := range d.breakers {
+		if appID != "" && key.appID != appID {
+			continue
+		}
+
+		c := b.circuit(now, d.cooldown())
+		c.AppID = key.appID
+		c.Provider = key.provider
+		circuits = append(circuits, c)
+	}
+	d.mu.Unlock()
+
+	sort.Slice(circuits, func(i, j int) bool {
+		if circuits[i].AppID != circuits[j].AppID {
+			return circuits[i].AppID < circuits[j].AppID
+		}
+		return circuits[i].Provider < circuits[j].Provider
+	})
+
+	return circuits
+}
+
+func (d *Deliverer) cooldown() time.Duration {
+	return time.Duration(d.conf.BreakerCooldown) * time.Millisecond
+}
+
+// Report records the circuits of the deliverer in stg every
+// conf.CircuitReportInterval seconds until ctx is done, so the API servers of
+// all processes report them. process names the reporting process.
+func (d *Deliverer) Report(ctx context.Context, stg storage.Storage, process string) {
+	if d.conf.CircuitReportInterval <= 0 {
+		return
+	}
+
+	interval := time.Duration(d.conf.CircuitReportInterval) * time.Second
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := d.report(ctx, stg, process, interval); err != nil && ctx.Err() == nil {
+			log.Printf("delivery: could not report circuits: %s", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// report records the circuits of the deliverer once. Reports expire after
+// three intervals, e.g. if the process stopped.
+func (d *Deliverer) report(ctx context.Context, stg storage.Storage, process string, interval time.Duration) error {
+	circuits := d.Circuits("")
+	if len(circuits) == 0 {
+		return nil
+	}
+
+	now := d.now()
+	for _, c := range circuits {
+		c.Process = process
+		c.ReportedAt = int(now.Unix())
+		c.ExpiresAt = int(now.Add(3 * interval).Unix())
+	}
+
+	return stg.PutCircuits(ctx, circuits)
+}
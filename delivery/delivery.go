@@ -0,0 +1,269 @@
+// Package delivery sends messages to push providers, retrying temporary
+// failures with backoff under a retry budget of each app and failing fast
+// while a circuit breaker of the app and the provider is open.
+package delivery
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/gamegos/gcmlib"
+	"github.com/gamegos/scotty/config"
+)
+
+// GCMClient sends messages to GCM. *GCM implements it.
+type GCMClient interface {
+	Send(msg *gcmlib.Message) (*GCMResponse, error)
+}
+
+// Deliverer sends messages to providers. It is safe for concurrent use.
+type Deliverer struct {
+	conf config.DeliveryConfig
+
+	mu       sync.Mutex
+	budgets  map[string]*budget
+	breakers map[circuitKey]*breaker
+
+	// rand returns a number in [0, 1) to jitter delays.
+	rand func() float64
+	// sleep waits for d or until ctx is done.
+	sleep func(ctx context.Context, d time.Duration) error
+	// now returns the current time of circuit breakers.
+	now func() time.Time
+}
+
+// New creates a deliverer.
+func New(conf config.DeliveryConfig) *Deliverer {
+	return &Deliverer{
+		conf:     conf,
+		budgets:  make(map[string]*budget),
+		breakers: make(map[circuitKey]*breaker),
+		rand:     rand.Float64,
+		sleep:    sleep,
+		now:      time.Now,
+	}
+}
+
+// SendGCM sends a message to GCM for an app. A batch failing with a retryable
+// error is sent again, and then the tokens with retryable errors in the
+// response; retried results replace the results of the response. Nothing is
+// sent while the GCM circuit of the app is open, the error is ErrCircuitOpen
+// then. The returned error is an *Error.
+func (d *Deliverer) SendGCM(ctx context.Context, appID string, client GCMClient, msg *gcmlib.Message) (*gcmlib.Response, error) {
+	b := d.budget(appID)
+	b.deposit()
+
+	br := d.breaker(appID, ProviderGCM)
+
+	batchRes, err := d.sendBatch(ctx, b, br, client, msg)
+	if err != nil {
+		return nil, err
+	}
+
+	res := batchRes.Response
+	if len(res.Results) != len(msg.RegistrationIDs) {
+		return res, nil
+	}
+
+	// tokens are retried after the delay asked for by the last response.
+	retryAfter := batchRes.RetryAfter
+
+	for attempt := 1; attempt < d.maxAttempts(); attempt++ {
+		var pending []int
+		for i, result := range res.Results {
+			if RetryableResult(result.Error) {
+				pending = append(pending, i)
+			}
+		}
+
+		// tokens asked to wait longer than MaxBackoff are left to the queue.
+		delay, ok := d.backoff(attempt, retryAfter)
+		if len(pending) == 0 || !ok || !b.withdraw() {
+			break
+		}
+
+		if err := d.sleep(ctx, delay); err != nil {
+			break
+		}
+
+		retry := *msg
+		retry.RegistrationIDs = make([]string, len(pending))
+		for j, i := range pending {
+			retry.RegistrationIDs[j] = msg.RegistrationIDs[i]
+		}
+
+		if !br.allow(d.now(), d.cooldown()) {
+			break
+		}
+
+		retryRes, err := client.Send(&retry)
+		br.record(err, d.now(), d.conf.BreakerThreshold)
+
+		if err != nil {
+			if Retryable(err) {
+				retryAfter = RetryAfter(err)
+				continue
+			}
+			break
+		}
+
+		retryAfter = retryRes.RetryAfter
+		if len(retryRes.Results) != len(pending) {
+			break
+		}
+
+		for j, i := range pending {
+			res.Results[i] = retryRes.Results[j]
+		}
+		recount(res)
+	}
+
+	return res, nil
+}
+
+// sendBatch sends a message, sending it again while it fails with a retryable
+// error and the circuit allows it.
+func (d *Deliverer) sendBatch(ctx context.Context, b *budget, br *breaker, client GCMClient, msg *gcmlib.Message) (*GCMResponse, error) {
+	for attempt := 1; ; attempt++ {
+		if !br.allow(d.now(), d.cooldown()) {
+			return nil, &Error{Err: ErrCircuitOpen, Retryable: true, Attempts: attempt - 1}
+		}
+
+		res, err := client.Send(msg)
+		br.record(err, d.now(), d.conf.BreakerThreshold)
+
+		if err == nil {
+			return res, nil
+		}
+
+		if !Retryable(err) {
+			return nil, &Error{Err: err, Attempts: attempt}
+		}
+
+		// a batch asked to wait longer than MaxBackoff is left to the queue.
+		delay, ok := d.backoff(attempt, RetryAfter(err))
+		if !ok || attempt >= d.maxAttempts() || !b.withdraw() {
+			return nil, &Error{Err: err, Retryable: true, Attempts: attempt}
+		}
+
+		if d.sleep(ctx, delay) != nil {
+			return nil, &Error{Err: err, Retryable: true, Attempts: attempt}
+		}
+	}
+}
+
+func (d *Deliverer) maxAttempts() int {
+	if d.conf.MaxAttempts < 1 {
+		return 1
+	}
+	return d.conf.MaxAttempts
+}
+
+// backoff returns the delay before a retry: InitialBackoff doubled for each
+// earlier retry up to MaxBackoff, jittered between half and all of it, or
+// retryAfter if it is longer. It returns false if retryAfter is longer than
+// MaxBackoff, the retry should not wait inline then.
+func (d *Deliverer) backoff(attempt int, retryAfter time.Duration) (time.Duration, bool) {
+	delay := time.Duration(d.conf.InitialBackoff) * time.Millisecond
+	max := time.Duration(d.conf.MaxBackoff) * time.Millisecond
+
+	for i := 1; i < attempt && delay < max; i++ {
+		delay *= 2
+	}
+
+	if delay > max {
+		delay = max
+	}
+
+	delay = delay/2 + time.Duration(d.rand()*float64(delay/2))
+
+	if max > 0 && retryAfter > max {
+		return 0, false
+	}
+
+	if retryAfter > delay {
+		return retryAfter, true
+	}
+
+	return delay, true
+}
+
+// budget returns the retry budget of an app.
+func (d *Deliverer) budget(appID string) *budget {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	b, ok := d.budgets[appID]
+	if !ok {
+		b = &budget{
+			ratio:  d.conf.RetryBudgetRatio,
+			max:    float64(d.conf.RetryBudget),
+			tokens: float64(d.conf.RetryBudget),
+		}
+		d.budgets[appID] = b
+	}
+
+	return b
+}
+
+// recount updates the counts of a response from its results.
+func recount(res *gcmlib.Response) {
+	res.Success, res.Failure, res.CanonicalIDs = 0, 0, 0
+
+	for _, result := range res.Results {
+		if result.Error != "" {
+			res.Failure++
+			continue
+		}
+
+		res.Success++
+		if result.RegistrationID != "" {
+			res.CanonicalIDs++
+		}
+	}
+}
+
+// budget limits the retries of an app. Each send deposits ratio tokens up to
+// max and each retry withdraws one.
+type budget struct {
+	mu     sync.Mutex
+	ratio  float64
+	max    float64
+	tokens float64
+}
+
+func (b *budget) deposit() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.tokens += b.ratio
+	if b.tokens > b.max {
+		b.tokens = b.max
+	}
+}
+
+func (b *budget) withdraw() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.tokens < 1 {
+		return false
+	}
+
+	b.tokens--
+	return true
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,265 @@
+package delivery
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gamegos/gcmlib"
+	"github.com/gamegos/scotty/config"
+	memstorage "github.com/gamegos/scotty/storage/drivers/memory"
+)
+
+var ctx = context.Background()
+
+// fakeClient returns the responses and errors of its calls in order and
+// records the tokens it was sent.
+type fakeClient struct {
+	responses []*gcmlib.Response
+	errs      []error
+	sent      [][]string
+}
+
+func (c *fakeClient) Send(msg *gcmlib.Message) (*GCMResponse, error) {
+	i := len(c.sent)
+	c.sent = append(c.sent, msg.RegistrationIDs)
+
+	if i < len(c.errs) && c.errs[i] != nil {
+		return nil, c.errs[i]
+	}
+	return &GCMResponse{Response: c.responses[i]}, nil
+}
+
+// temporaryError is a provider error asking for a retry.
+type temporaryError struct {
+	retryAfter time.Duration
+}
+
+func (e *temporaryError) Error() string             { return "gcm: unavailable" }
+func (e *temporaryError) Temporary() bool           { return true }
+func (e *temporaryError) RetryAfter() time.Duration { return e.retryAfter }
+
+func testDeliverer(conf config.DeliveryConfig) (*Deliverer, *[]time.Duration) {
+	var delays []time.Duration
+
+	d := New(conf)
+	d.rand = func() float64 { return 0.5 }
+	d.sleep = func(ctx context.Context, delay time.Duration) error {
+		delays = append(delays, delay)
+		return nil
+	}
+
+	return d, &delays
+}
+
+func TestRetryBatch(t *testing.T) {
+	d, delays := testDeliverer(config.DefaultConfig().Delivery)
+
+	client := &fakeClient{
+		errs:      []error{&temporaryError{}, &temporaryError{retryAfter: 10 * time.Second}, nil},
+		responses: []*gcmlib.Response{nil, nil, {Success: 1, Results: []gcmlib.Result{{MessageID: "1"}}}},
+	}
+
+	res, err := d.SendGCM(ctx, "app", client, &gcmlib.Message{RegistrationIDs: []string{"t1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res.Success != 1 || len(client.sent) != 3 {
+		t.Errorf("Batch was not retried. got %+v after %d sends", res, len(client.sent))
+	}
+
+	// 500ms jittered to 375ms, then Retry-After instead of 750ms.
+	expected := []time.Duration{375 * time.Millisecond, 10 * time.Second}
+	if !reflect.DeepEqual(*delays, expected) {
+		t.Errorf("Delays do not match. got %v, expected %v", *delays, expected)
+	}
+}
+
+func TestLongRetryAfter(t *testing.T) {
+	d, delays := testDeliverer(config.DefaultConfig().Delivery)
+
+	client := &fakeClient{errs: []error{&temporaryError{retryAfter: time.Hour}}}
+
+	_, err := d.SendGCM(ctx, "app", client, &gcmlib.Message{RegistrationIDs: []string{"t1"}})
+
+	deliveryErr, ok := err.(*Error)
+	if !ok || !deliveryErr.Retryable || deliveryErr.Attempts != 1 || len(client.sent) != 1 {
+		t.Errorf("Expected a retryable error without retries, got %#v after %d sends", err, len(client.sent))
+	}
+
+	if len(*delays) != 0 {
+		t.Errorf("Expected no delays, got %v", *delays)
+	}
+}
+
+func TestPermanentError(t *testing.T) {
+	d, _ := testDeliverer(config.DefaultConfig().Delivery)
+
+	client := &fakeClient{errs: []error{errors.New("gcm: unauthorized")}}
+
+	_, err := d.SendGCM(ctx, "app", client, &gcmlib.Message{RegistrationIDs: []string{"t1"}})
+
+	deliveryErr, ok := err.(*Error)
+	if !ok || deliveryErr.Retryable || deliveryErr.Attempts != 1 || len(client.sent) != 1 {
+		t.Errorf("Expected a permanent error without retries, got %#v after %d sends", err, len(client.sent))
+	}
+}
+
+func TestRetryTokens(t *testing.T) {
+	d, _ := testDeliverer(config.DefaultConfig().Delivery)
+
+	client := &fakeClient{
+		responses: []*gcmlib.Response{
+			{Success: 1, Failure: 2, Results: []gcmlib.Result{{MessageID: "1"}, {Error: "Unavailable"}, {Error: "NotRegistered"}}},
+			{Success: 1, Results: []gcmlib.Result{{MessageID: "2", RegistrationID: "t2new"}}},
+		},
+	}
+
+	msg := &gcmlib.Message{RegistrationIDs: []string{"t1", "t2", "t3"}}
+	res, err := d.SendGCM(ctx, "app", client, msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(client.sent, [][]string{{"t1", "t2", "t3"}, {"t2"}}) {
+		t.Errorf("Sent tokens do not match. got %v", client.sent)
+	}
+
+	expected := &gcmlib.Response{
+		Success:      2,
+		Failure:      1,
+		CanonicalIDs: 1,
+		Results:      []gcmlib.Result{{MessageID: "1"}, {MessageID: "2", RegistrationID: "t2new"}, {Error: "NotRegistered"}},
+	}
+
+	if !reflect.DeepEqual(res, expected) {
+		t.Errorf("Response does not match. got %+v, expected %+v", res, expected)
+	}
+}
+
+func TestRetryBudget(t *testing.T) {
+	conf := config.DefaultConfig().Delivery
+	conf.RetryBudget = 1
+	conf.RetryBudgetRatio = 0
+
+	d, _ := testDeliverer(conf)
+
+	client := &fakeClient{errs: []error{&temporaryError{}, &temporaryError{}, &temporaryError{}}}
+
+	_, err := d.SendGCM(ctx, "app", client, &gcmlib.Message{RegistrationIDs: []string{"t1"}})
+
+	deliveryErr, ok := err.(*Error)
+	if !ok || !deliveryErr.Retryable || deliveryErr.Attempts != 2 {
+		t.Errorf("Expected a retryable error after 2 attempts, got %#v", err)
+	}
+
+	// the budget of the app is spent, other apps have their own.
+	client = &fakeClient{errs: []error{&temporaryError{}, &temporaryError{}}}
+	if _, err := d.SendGCM(ctx, "app", client, &gcmlib.Message{RegistrationIDs: []string{"t1"}}); len(client.sent) != 1 {
+		t.Errorf("Expected no retries with a spent budget, got %d sends, %v", len(client.sent), err)
+	}
+
+	client = &fakeClient{errs: []error{&temporaryError{}, &temporaryError{}}}
+	if _, err := d.SendGCM(ctx, "other", client, &gcmlib.Message{RegistrationIDs: []string{"t1"}}); len(client.sent) != 2 {
+		t.Errorf("Expected a retry for another app, got %d sends, %v", len(client.sent), err)
+	}
+}
+
+// statusError is a provider error with a status code.
+type statusError int
+
+func (e statusError) Error() string   { return "gcm: status " + strconv.Itoa(int(e)) }
+func (e statusError) StatusCode() int { return int(e) }
+
+func TestCircuitBreaker(t *testing.T) {
+	conf := config.DefaultConfig().Delivery
+	conf.MaxAttempts = 1
+	conf.BreakerThreshold = 2
+	conf.BreakerCooldown = 1000
+
+	d, _ := testDeliverer(conf)
+
+	now := time.Unix(1000, 0)
+	d.now = func() time.Time { return now }
+
+	// a network error without a status code.
+	reset := errors.New("gcm: connection reset by peer")
+
+	msg := &gcmlib.Message{RegistrationIDs: []string{"t1"}}
+	client := &fakeClient{
+		errs: []error{statusError(401), statusError(400), reset, reset, nil},
+		responses: []*gcmlib.Response{
+			4: {Success: 1, Results: []gcmlib.Result{{MessageID: "1"}}},
+		},
+	}
+
+	// a bad request neither counts nor breaks the series of failures.
+	for i := 0; i < 3; i++ {
+		d.SendGCM(ctx, "app", client, msg)
+	}
+
+	if circuits := d.Circuits("app"); len(circuits) != 1 || circuits[0].State != StateOpen || circuits[0].ProbeAt != 1001 {
+		t.Fatalf("Expected an open circuit, got %+v", circuits[0])
+	}
+
+	_, err := d.SendGCM(ctx, "app", client, msg)
+	if deliveryErr, ok := err.(*Error); !ok || deliveryErr.Err != ErrCircuitOpen || len(client.sent) != 3 {
+		t.Errorf("Expected to fail fast with an open circuit, got %v after %d sends", err, len(client.sent))
+	}
+
+	// other apps are not affected.
+	if circuits := d.Circuits("other"); len(circuits) != 0 {
+		t.Errorf("Expected no circuits of another app, got %+v", circuits)
+	}
+
+	// a probe failing with a network error opens the circuit again.
+	now = now.Add(time.Second)
+	if circuits := d.Circuits(""); circuits[0].State != StateHalfOpen {
+		t.Errorf("Expected a half open circuit after the cooldown, got %+v", circuits[0])
+	}
+
+	d.SendGCM(ctx, "app", client, msg)
+	if circuits := d.Circuits("app"); circuits[0].State != StateOpen || len(client.sent) != 4 {
+		t.Errorf("Expected the circuit to open after a failed probe, got %+v after %d sends", circuits[0], len(client.sent))
+	}
+
+	now = now.Add(time.Second)
+	if _, err := d.SendGCM(ctx, "app", client, msg); err != nil {
+		t.Fatal(err)
+	}
+
+	if circuits := d.Circuits("app"); circuits[0].State != StateClosed || circuits[0].Failures != 0 {
+		t.Errorf("Expected the circuit to close after a probe, got %+v", circuits[0])
+	}
+}
+
+func TestReportCircuits(t *testing.T) {
+	conf := config.DefaultConfig().Delivery
+	conf.MaxAttempts = 1
+	conf.BreakerThreshold = 1
+
+	d, _ := testDeliverer(conf)
+	stg := memstorage.New()
+
+	client := &fakeClient{errs: []error{statusError(500)}}
+	d.SendGCM(ctx, "app", client, &gcmlib.Message{RegistrationIDs: []string{"t1"}})
+
+	if err := d.report(ctx, stg, "host-1", 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	// the API servers of other processes read the circuit from the storage.
+	circuits, err := stg.GetCircuits(ctx, "app")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(circuits) != 1 || circuits[0].State != StateOpen || circuits[0].Process != "host-1" ||
+		circuits[0].ExpiresAt != circuits[0].ReportedAt+15 {
+		t.Errorf("Reported circuits do not match. got %+v", circuits)
+	}
+}
@@ -0,0 +1,93 @@
+package delivery
+
+import (
+	"strconv"
+	"time"
+)
+
+// Error is a failed delivery.
+type Error struct {
+	Err error
+	// Retryable is true if the last attempt failed temporarily, but the
+	// attempts or the retry budget ran out.
+	Retryable bool
+	// Attempts is the number of times the delivery was attempted.
+	Attempts int
+}
+
+func (e *Error) Error() string {
+	if e.Attempts > 1 {
+		return e.Err.Error() + " (after " + strconv.Itoa(e.Attempts) + " attempts)"
+	}
+	return e.Err.Error()
+}
+
+// retryableResults are the errors of GCM results that are temporary.
+var retryableResults = map[string]bool{
+	"Unavailable":         true,
+	"InternalServerError": true,
+}
+
+// RetryableResult reports whether the error of a GCM result for a token is
+// temporary.
+func RetryableResult(err string) bool {
+	return retryableResults[err]
+}
+
+// invalidTokenResults are the errors of GCM results for tokens that are not
+// valid anymore, e.g. of uninstalled apps.
+var invalidTokenResults = map[string]bool{
+	"NotRegistered":       true,
+	"InvalidRegistration": true,
+	"MissingRegistration": true,
+}
+
+// InvalidTokenResult reports whether the error of a GCM result for a token
+// means the token will never receive messages.
+func InvalidTokenResult(err string) bool {
+	return invalidTokenResults[err]
+}
+
+// Retryable reports whether an error returned from a provider client is
+// temporary: it reports so with a Temporary method, has a 5xx or 429 status
+// code, asks for a retry with a RetryAfter method or is a timeout.
+func Retryable(err error) bool {
+	if e, ok := err.(interface {
+		Temporary() bool
+	}); ok && e.Temporary() {
+		return true
+	}
+
+	if e, ok := err.(interface {
+		StatusCode() int
+	}); ok {
+		code := e.StatusCode()
+		if code >= 500 || code == 429 {
+			return true
+		}
+	}
+
+	if RetryAfter(err) > 0 {
+		return true
+	}
+
+	if e, ok := err.(interface {
+		Timeout() bool
+	}); ok && e.Timeout() {
+		return true
+	}
+
+	return false
+}
+
+// RetryAfter returns the delay before a retry a provider asked for with the
+// Retry-After header of a response, if the error exposes it with a RetryAfter
+// method.
+func RetryAfter(err error) time.Duration {
+	if e, ok := err.(interface {
+		RetryAfter() time.Duration
+	}); ok {
+		return e.RetryAfter()
+	}
+	return 0
+}
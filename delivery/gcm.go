@@ -0,0 +1,127 @@
+package delivery
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gamegos/gcmlib"
+)
+
+// GCMEndpoint is the URL of the GCM HTTP connection server.
+const GCMEndpoint = "https://gcm-http.googleapis.com/gcm/send"
+
+// gcmTimeout is the time limit of a request to GCM.
+const gcmTimeout = 30 * time.Second
+
+// gcmHTTPClient is shared by the GCM clients of all apps.
+var gcmHTTPClient = &http.Client{Timeout: gcmTimeout}
+
+// GCMResponse is a response of GCM and the delay it asked for before tokens
+// with retryable results are sent again.
+type GCMResponse struct {
+	*gcmlib.Response
+	RetryAfter time.Duration
+}
+
+// HTTPError is a request to a provider that failed with an HTTP status. Its
+// StatusCode and RetryAfter methods classify it for retries and circuit
+// breakers.
+type HTTPError struct {
+	Provider string
+	Code     int
+	Status   string
+	// After is the delay asked for with the Retry-After header, if any.
+	After time.Duration
+}
+
+func (e *HTTPError) Error() string {
+	return e.Provider + ": " + e.Status
+}
+
+// StatusCode returns the HTTP status code of the response.
+func (e *HTTPError) StatusCode() int {
+	return e.Code
+}
+
+// RetryAfter returns the delay the provider asked for before a retry.
+func (e *HTTPError) RetryAfter() time.Duration {
+	return e.After
+}
+
+// GCM sends messages to GCM for an app. Unlike gcmlib.Client, its errors
+// carry the status code and Retry-After header of failed responses.
+type GCM struct {
+	apiKey   string
+	endpoint string
+	client   *http.Client
+}
+
+// NewGCMClient creates a GCM client sending with the API key of an app.
+func NewGCMClient(apiKey string) *GCM {
+	return &GCM{apiKey: apiKey, endpoint: GCMEndpoint, client: gcmHTTPClient}
+}
+
+// Send sends a message to GCM. A response with a status other than 200 is an
+// *HTTPError; network errors are returned as is.
+func (c *GCM) Send(msg *gcmlib.Message) (*GCMResponse, error) {
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest("POST", c.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "key="+c.apiKey)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	retryAfter := parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())
+
+	if resp.StatusCode != http.StatusOK {
+		// drain the body so the connection is reused.
+		io.Copy(ioutil.Discard, resp.Body)
+		return nil, &HTTPError{Provider: ProviderGCM, Code: resp.StatusCode, Status: resp.Status, After: retryAfter}
+	}
+
+	res := new(gcmlib.Response)
+	if err := json.NewDecoder(resp.Body).Decode(res); err != nil {
+		return nil, fmt.Errorf("gcm: invalid response: %s", err)
+	}
+
+	return &GCMResponse{Response: res, RetryAfter: retryAfter}, nil
+}
+
+// parseRetryAfter parses a Retry-After header, a number of seconds or an HTTP
+// date, to the delay from now. It returns zero for an empty or invalid value.
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	if value == "" {
+		return 0
+	}
+
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+
+	date, err := http.ParseTime(value)
+	if err != nil || !date.After(now) {
+		return 0
+	}
+
+	return date.Sub(now)
+}
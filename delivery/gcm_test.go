@@ -0,0 +1,144 @@
+package delivery
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/gamegos/gcmlib"
+	"github.com/gamegos/scotty/config"
+)
+
+// gcmReply is a reply of the fake GCM server.
+type gcmReply struct {
+	status     int
+	retryAfter string
+	res        *gcmlib.Response
+}
+
+// gcmServer replies to GCM requests in order and records the tokens it was
+// sent.
+func gcmServer(t *testing.T, replies []gcmReply) (*GCM, *[][]string) {
+	var sent [][]string
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if auth := r.Header.Get("Authorization"); auth != "key=apikey" {
+			t.Errorf("Authorization header does not match. got %q", auth)
+		}
+
+		msg := new(gcmlib.Message)
+		if err := json.NewDecoder(r.Body).Decode(msg); err != nil {
+			t.Error(err)
+		}
+
+		reply := replies[len(sent)]
+		sent = append(sent, msg.RegistrationIDs)
+
+		if reply.retryAfter != "" {
+			w.Header().Set("Retry-After", reply.retryAfter)
+		}
+
+		w.WriteHeader(reply.status)
+		if reply.res != nil {
+			json.NewEncoder(w).Encode(reply.res)
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	client := NewGCMClient("apikey")
+	client.endpoint = srv.URL
+
+	return client, &sent
+}
+
+func TestGCMRetryAfter(t *testing.T) {
+	d, delays := testDeliverer(config.DefaultConfig().Delivery)
+
+	client, sent := gcmServer(t, []gcmReply{
+		{status: 503, retryAfter: "7"},
+		{status: 200, retryAfter: "3", res: &gcmlib.Response{Success: 1, Failure: 1, Results: []gcmlib.Result{{MessageID: "1"}, {Error: "Unavailable"}}}},
+		{status: 200, res: &gcmlib.Response{Success: 1, Results: []gcmlib.Result{{MessageID: "2"}}}},
+	})
+
+	res, err := d.SendGCM(ctx, "app", client, &gcmlib.Message{RegistrationIDs: []string{"t1", "t2"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res.Success != 2 || !reflect.DeepEqual(*sent, [][]string{{"t1", "t2"}, {"t1", "t2"}, {"t2"}}) {
+		t.Errorf("Expected the batch and then the token to be retried, got %+v after sending %v", res, *sent)
+	}
+
+	// Retry-After of the 503 response, then of the response to the batch.
+	expected := []time.Duration{7 * time.Second, 3 * time.Second}
+	if !reflect.DeepEqual(*delays, expected) {
+		t.Errorf("Delays do not match. got %v, expected %v", *delays, expected)
+	}
+}
+
+func TestGCMPermanentStatus(t *testing.T) {
+	d, _ := testDeliverer(config.DefaultConfig().Delivery)
+
+	client, sent := gcmServer(t, []gcmReply{{status: 400}})
+
+	_, err := d.SendGCM(ctx, "app", client, &gcmlib.Message{RegistrationIDs: []string{"t1"}})
+
+	deliveryErr, ok := err.(*Error)
+	if !ok || deliveryErr.Retryable || len(*sent) != 1 {
+		t.Fatalf("Expected a permanent error without retries, got %#v after %d sends", err, len(*sent))
+	}
+
+	if httpErr, ok := deliveryErr.Err.(*HTTPError); !ok || httpErr.StatusCode() != 400 {
+		t.Errorf("Expected an HTTP error with the status code, got %#v", deliveryErr.Err)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		value    string
+		expected time.Duration
+	}{
+		{"", 0},
+		{"120", 2 * time.Minute},
+		{"-1", 0},
+		{"Wed, 01 Jan 2020 00:00:30 GMT", 30 * time.Second},
+		{"Tue, 31 Dec 2019 23:59:00 GMT", 0},
+		{"soon", 0},
+	}
+
+	for _, test := range tests {
+		if got := parseRetryAfter(test.value, now); got != test.expected {
+			t.Errorf("parseRetryAfter(%q) = %v, expected %v", test.value, got, test.expected)
+		}
+	}
+}
+
+func TestGCMCircuitBreaker(t *testing.T) {
+	conf := config.DefaultConfig().Delivery
+	conf.MaxAttempts = 1
+	conf.BreakerThreshold = 2
+
+	d, _ := testDeliverer(conf)
+
+	// a revoked key, then a provider outage.
+	client, sent := gcmServer(t, []gcmReply{{status: 401}, {status: 500}})
+
+	msg := &gcmlib.Message{RegistrationIDs: []string{"t1"}}
+	for i := 0; i < 2; i++ {
+		d.SendGCM(ctx, "app", client, msg)
+	}
+
+	if circuits := d.Circuits("app"); len(circuits) != 1 || circuits[0].State != StateOpen || circuits[0].LastError != "gcm: 500 Internal Server Error" {
+		t.Fatalf("Expected an open circuit, got %+v", circuits)
+	}
+
+	_, err := d.SendGCM(ctx, "app", client, msg)
+	if deliveryErr, ok := err.(*Error); !ok || deliveryErr.Err != ErrCircuitOpen || len(*sent) != 2 {
+		t.Errorf("Expected to fail fast with an open circuit, got %v after %d sends", err, len(*sent))
+	}
+}
@@ -0,0 +1,132 @@
+// Package janitor removes devices that were not seen for longer than the
+// retention of their app, along with subscribers and channels left empty.
+package janitor
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/gamegos/scotty/config"
+	"github.com/gamegos/scotty/storage"
+)
+
+// Report describes what a sweep removed from an app.
+type Report struct {
+	AppID       string
+	Devices     int
+	Subscribers int
+	Channels    int
+}
+
+// Janitor periodically sweeps stale devices of all apps.
+type Janitor struct {
+	stg  storage.Storage
+	conf config.JanitorConfig
+	now  func() time.Time
+}
+
+// New creates a janitor.
+func New(stg storage.Storage, conf config.JanitorConfig) *Janitor {
+	return &Janitor{stg: stg, conf: conf, now: time.Now}
+}
+
+// Run sweeps every conf.Interval seconds until ctx is done. It returns
+// immediately if the interval is zero.
+func (j *Janitor) Run(ctx context.Context) {
+	if j.conf.Interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(time.Duration(j.conf.Interval) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		if _, err := j.Sweep(ctx); err != nil && ctx.Err() == nil {
+			log.Printf("janitor: sweep failed: %s", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Sweep removes stale devices of every app with a retention, in batches of
+// conf.BatchSize subscribers at most one per conf.BatchInterval milliseconds.
+// It logs and returns a report for each swept app.
+func (j *Janitor) Sweep(ctx context.Context) ([]*Report, error) {
+	apps, err := j.stg.GetApps(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var reports []*Report
+
+	for _, app := range apps {
+		retention := app.DeviceRetentionDays
+		if retention == 0 {
+			retention = j.conf.RetentionDays
+		}
+
+		if retention <= 0 {
+			continue
+		}
+
+		before := j.now().Add(-time.Duration(retention) * 24 * time.Hour)
+
+		report, err := j.sweepApp(ctx, app.ID, int(before.Unix()))
+		if report != nil {
+			log.Printf("janitor: app %s: removed %d devices, %d subscribers, %d channels",
+				report.AppID, report.Devices, report.Subscribers, report.Channels)
+			reports = append(reports, report)
+		}
+
+		if err != nil {
+			return reports, err
+		}
+	}
+
+	return reports, nil
+}
+
+// sweepApp prunes the subscribers of an app. The report is returned even if
+// the sweep fails halfway.
+func (j *Janitor) sweepApp(ctx context.Context, appID string, before int) (*Report, error) {
+	report := &Report{AppID: appID}
+
+	var throttle <-chan time.Time
+	if j.conf.BatchInterval > 0 {
+		ticker := time.NewTicker(time.Duration(j.conf.BatchInterval) * time.Millisecond)
+		defer ticker.Stop()
+		throttle = ticker.C
+	}
+
+	scanner := storage.NewSubscriberScanner(j.stg, appID, j.conf.BatchSize)
+	for scanner.Next(ctx) {
+		for _, subscriberID := range scanner.Subscribers() {
+			result, err := j.stg.PruneSubscriber(ctx, appID, subscriberID, before)
+			if err != nil {
+				return report, err
+			}
+
+			report.Devices += len(result.Devices)
+			report.Channels += len(result.Channels)
+			if result.SubscriberRemoved {
+				report.Subscribers++
+			}
+		}
+
+		if throttle != nil {
+			select {
+			case <-ctx.Done():
+				return report, ctx.Err()
+			case <-throttle:
+			}
+		}
+	}
+
+	return report, scanner.Err()
+}
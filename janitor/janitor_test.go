@@ -0,0 +1,110 @@
+package janitor
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/gamegos/scotty/config"
+	"github.com/gamegos/scotty/storage"
+	memstorage "github.com/gamegos/scotty/storage/drivers/memory"
+)
+
+var ctx = context.Background()
+
+func TestSweep(t *testing.T) {
+	stg := memstorage.New()
+	now := time.Unix(100*24*3600, 0)
+	day := 24 * 3600
+
+	apps := []*storage.App{
+		{ID: "app_default"},
+		{ID: "app_retention", DeviceRetentionDays: 10},
+	}
+
+	for _, app := range apps {
+		if err := stg.PutApp(ctx, app); err != nil {
+			t.Fatal(err)
+		}
+
+		devices := []struct {
+			subscriberID string
+			device       *storage.Device
+		}{
+			{"sub_stale", &storage.Device{Token: "t1", CreatedAt: 10 * day}},
+			{"sub_mixed", &storage.Device{Token: "t2", CreatedAt: 10 * day, LastSeen: 95 * day}},
+			{"sub_mixed", &storage.Device{Token: "t3", CreatedAt: 10 * day, LastSeen: 80 * day}},
+		}
+
+		for _, d := range devices {
+			if err := stg.AddSubscriberDevice(ctx, app.ID, d.subscriberID, d.device); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if err := stg.AddSubscriber(ctx, app.ID, "stale_only", []string{"sub_stale"}); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := stg.AddSubscriber(ctx, app.ID, "shared", []string{"sub_stale", "sub_mixed"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	j := New(stg, config.JanitorConfig{RetentionDays: 50, BatchSize: 1})
+	j.now = func() time.Time { return now }
+
+	reports, err := j.Sweep(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []*Report{
+		{AppID: "app_default", Devices: 1, Subscribers: 1, Channels: 1},
+		{AppID: "app_retention", Devices: 2, Subscribers: 1, Channels: 1},
+	}
+
+	if !reflect.DeepEqual(reports, expected) {
+		t.Errorf("Reports do not match. got %+v, expected %+v", reports, expected)
+	}
+
+	devices, err := stg.GetSubscriberDevices(ctx, "app_retention", "sub_mixed")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(devices) != 1 || devices[0].Token != "t2" {
+		t.Errorf("Remaining devices do not match. got %+v", devices)
+	}
+
+	members, err := stg.GetChannelSubscribers(ctx, "app_retention", "shared")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(members, []string{"sub_mixed"}) {
+		t.Errorf("Remaining channel subscribers do not match. got %v", members)
+	}
+}
+
+func TestSweepWithoutRetention(t *testing.T) {
+	stg := memstorage.New()
+
+	if err := stg.PutApp(ctx, &storage.App{ID: "app"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := stg.AddSubscriberDevice(ctx, "app", "sub", &storage.Device{Token: "t", CreatedAt: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	reports, err := New(stg, config.JanitorConfig{BatchSize: 10}).Sweep(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(reports) != 0 {
+		t.Errorf("Expected no reports, got %+v", reports)
+	}
+}
@@ -1,45 +1,246 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"fmt"
 	"log"
 	"os"
+	"os/signal"
 	"runtime"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/gamegos/scotty/config"
+	"github.com/gamegos/scotty/delivery"
+	"github.com/gamegos/scotty/janitor"
+	"github.com/gamegos/scotty/queue"
+	_ "github.com/gamegos/scotty/queue/drivers/redis"
 	"github.com/gamegos/scotty/server"
 	"github.com/gamegos/scotty/storage"
 	//_ "github.com/gamegos/scotty/storage/drivers/memory"
 	_ "github.com/gamegos/scotty/storage/drivers/redis"
+	"github.com/gamegos/scotty/worker"
 )
 
+const usage = `Usage: scotty [mode] [flags]
+
+Modes:
+  all        run the API server, the delivery worker and the scheduler (default)
+  api        run the API server, configured by [server]
+  worker     run the delivery worker, configured by [worker]
+  scheduler  run the scheduler removing stale devices, configured by [janitor]
+
+Run "scotty <mode> -h" for the flags of a mode.
+`
+
+// shutdownTimeout is the longest the API server waits for requests in flight
+// when stopping.
+const shutdownTimeout = 30 * time.Second
+
+// mode is a run mode: the components a process runs.
+type mode struct {
+	api       bool
+	worker    bool
+	scheduler bool
+}
+
+var modes = map[string]mode{
+	"all":       {api: true, worker: true, scheduler: true},
+	"api":       {api: true},
+	"worker":    {worker: true},
+	"scheduler": {scheduler: true},
+}
+
 func main() {
 	runtime.GOMAXPROCS(runtime.NumCPU())
 
-	confPath := flag.String("config", "", "Config file")
-	flag.Parse()
+	name := "all"
+	args := os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+
+	m, ok := modes[name]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown mode %q\n\n%s", name, usage)
+		os.Exit(2)
+	}
+
+	flags := flag.NewFlagSet("scotty "+name, flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprint(flags.Output(), usage+"\nFlags:\n")
+		flags.PrintDefaults()
+	}
+
+	confPath := flags.String("config", "", "Config file")
 
-	var conf *config.Config
-	if *confPath != "" {
-		confFile, err := os.Open(*confPath)
-		defer confFile.Close()
-		if err != nil {
-			log.Fatalf("could not load config file: %s, err: %s", confPath, err)
+	// flags override the config of the components of the mode.
+	var (
+		addr        string
+		concurrency int
+		interval    int
+	)
+
+	if m.api {
+		flags.StringVar(&addr, "addr", "", "Address the API server listens on, overrides server.addr")
+	}
+
+	if m.worker {
+		flags.IntVar(&concurrency, "concurrency", 0, "Number of batches the worker sends at once, overrides worker.concurrency")
+	}
+
+	if m.scheduler {
+		flags.IntVar(&interval, "janitor-interval", 0, "Seconds between removals of stale devices, overrides janitor.interval")
+	}
+
+	flags.Parse(args)
+
+	conf := loadConfig(*confPath)
+
+	flags.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "addr":
+			conf.Server.Addr = addr
+		case "concurrency":
+			conf.Worker.Concurrency = concurrency
+		case "janitor-interval":
+			conf.Janitor.Interval = interval
 		}
+	})
+
+	stg, err := storage.Init(conf.Storage.Driver, conf.Storage.Options)
+	if err != nil {
+		log.Fatalf("could not initialize storage: %s", err)
+	}
+
+	var q queue.Queue
+	if conf.Queue.Driver != "" {
+		if q, err = queue.Init(conf.Queue.Driver, conf.Queue.Options); err != nil {
+			log.Fatalf("could not initialize queue: %s", err)
+		}
+	}
+
+	// without a queue, batches are sent by the API server.
+	if m.worker && q == nil {
+		if !m.api {
+			log.Fatal("worker mode needs a queue, see [queue] in the config")
+		}
+		m.worker = false
+	}
 
-		c, err := config.Parse(confFile)
-		if err != nil {
-			log.Fatalf("could not parse config %s", err)
+	if m.scheduler && conf.Janitor.Interval <= 0 {
+		if !m.api && !m.worker {
+			log.Fatal("scheduler mode needs janitor.interval to be set")
 		}
-		conf = c
-	} else {
+		m.scheduler = false
+	}
+
+	deliverer := delivery.New(conf.Delivery)
+	deadLetterTTL := time.Duration(conf.Delivery.DeadLetterTTL) * time.Second
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// a worker stopped by a signal leaves its jobs to be reclaimed by others.
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	var wg sync.WaitGroup
+
+	if m.scheduler {
+		log.Printf("starting scotty scheduler, removing stale devices every %d seconds", conf.Janitor.Interval)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			janitor.New(stg, conf.Janitor).Run(ctx)
+		}()
+	}
+
+	if m.worker {
+		log.Printf("starting scotty worker with %d consumers", conf.Worker.Concurrency)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			worker.New(q, stg, deliverer, conf.Worker, deadLetterTTL).Run(ctx)
+		}()
+	}
+
+	// circuits of the deliveries of this process are read by the API servers
+	// of all processes from the storage.
+	if m.api || m.worker {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			deliverer.Report(ctx, stg, processName())
+		}()
+	}
+
+	var s *server.Server
+	serverErrs := make(chan error, 1)
+
+	if m.api {
+		log.Printf("starting scotty server on %s", conf.Server.Addr)
+		s = server.Init(stg, q, deliverer, conf)
+		go func() {
+			serverErrs <- s.Run()
+		}()
+	}
+
+	var serverErr error
+	select {
+	case sig := <-signals:
+		log.Printf("stopping on %s", sig)
+	case serverErr = <-serverErrs:
+		log.Printf("server stopped: %s", serverErr)
+	}
+
+	// requests in flight are finished before the other components stop.
+	if s != nil && serverErr == nil {
+		shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), shutdownTimeout)
+		if err := s.Shutdown(shutdownCtx); err != nil {
+			log.Printf("could not shut down server: %s", err)
+		}
+		cancelShutdown()
+	}
+
+	cancel()
+	wg.Wait()
+
+	if serverErr != nil {
+		os.Exit(1)
+	}
+}
+
+// processName names this process in reports shared with other processes.
+func processName() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "scotty"
+	}
+	return fmt.Sprintf("%s-%d", hostname, os.Getpid())
+}
+
+// loadConfig parses the config file at path, or returns the default config if
+// path is empty.
+func loadConfig(path string) *config.Config {
+	if path == "" {
 		log.Println("using default config")
-		conf = config.DefaultConfig()
+		return config.DefaultConfig()
 	}
 
-	stg := storage.Init(conf.Storage.Driver, conf.Storage.Options)
+	confFile, err := os.Open(path)
+	if err != nil {
+		log.Fatalf("could not load config file: %s, err: %s", path, err)
+	}
+	defer confFile.Close()
+
+	conf, err := config.Parse(confFile)
+	if err != nil {
+		log.Fatalf("could not parse config %s", err)
+	}
 
-	log.Printf("starting scotty server on %s", conf.Server.Addr)
-	s := server.Init(stg)
-	log.Fatal(s.Run(conf.Server.Addr))
+	return conf
 }
@@ -0,0 +1,93 @@
+package message
+
+import (
+	"sort"
+	"strings"
+)
+
+// DefaultLocale is the locale reported for devices that receive the title and
+// body of a message without a translation.
+const DefaultLocale = "default"
+
+// Translation is the title and body of a message in a locale.
+type Translation struct {
+	Title string `json:"title,omitempty"`
+	Body  string `json:"body,omitempty"`
+}
+
+// Localize returns the message with the title and body of the translation
+// best matching a device locale and without translations, and the locale of
+// that translation. DefaultLocale is returned if no translation matches.
+func (m *Message) Localize(locale string) (*Message, string) {
+	if len(m.Translations) == 0 {
+		return m, DefaultLocale
+	}
+
+	localized := *m
+	localized.Translations = nil
+
+	locales := make([]string, 0, len(m.Translations))
+	for l := range m.Translations {
+		locales = append(locales, l)
+	}
+	sort.Strings(locales)
+
+	match, ok := MatchLocale(locale, locales)
+	if !ok {
+		return &localized, DefaultLocale
+	}
+
+	translation := m.Translations[match]
+	if translation.Title != "" {
+		localized.Title = translation.Title
+	}
+	if translation.Body != "" {
+		localized.Body = translation.Body
+	}
+
+	return &localized, match
+}
+
+// MatchLocale returns the locale of available best matching locale: the same
+// locale, the language of locale (e.g. "pt" for "pt-BR"), or the first locale
+// of the same language (e.g. "pt-PT" for "pt-BR"). Locales are compared case
+// insensitively and '_' is the same as '-'.
+func MatchLocale(locale string, available []string) (string, bool) {
+	locale = normalizeLocale(locale)
+	if locale == "" {
+		return "", false
+	}
+
+	for _, l := range available {
+		if normalizeLocale(l) == locale {
+			return l, true
+		}
+	}
+
+	language := localeLanguage(locale)
+
+	for _, l := range available {
+		if normalizeLocale(l) == language {
+			return l, true
+		}
+	}
+
+	for _, l := range available {
+		if localeLanguage(normalizeLocale(l)) == language {
+			return l, true
+		}
+	}
+
+	return "", false
+}
+
+func normalizeLocale(locale string) string {
+	return strings.ToLower(strings.Replace(strings.TrimSpace(locale), "_", "-", -1))
+}
+
+func localeLanguage(locale string) string {
+	if i := strings.Index(locale, "-"); i >= 0 {
+		return locale[:i]
+	}
+	return locale
+}
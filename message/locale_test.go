@@ -0,0 +1,64 @@
+package message
+
+import "testing"
+
+func TestMatchLocale(t *testing.T) {
+	available := []string{"de", "en-GB", "pt-BR", "pt-PT", "tr"}
+
+	tests := []struct {
+		locale   string
+		expected string
+	}{
+		{"tr", "tr"},
+		{"tr_TR", "tr"},
+		{"EN-gb", "en-GB"},
+		{"en-US", "en-GB"},
+		{"pt-br", "pt-BR"},
+		{"pt", "pt-BR"},
+		{"de-AT", "de"},
+		{"fr-FR", ""},
+		{"", ""},
+	}
+
+	for _, test := range tests {
+		received, ok := MatchLocale(test.locale, available)
+		if received != test.expected || ok != (test.expected != "") {
+			t.Errorf("Locale %q matched %q, %v; expected %q", test.locale, received, ok, test.expected)
+		}
+	}
+}
+
+func TestLocalize(t *testing.T) {
+	msg := &Message{
+		Title: "Sale",
+		Body:  "50% off",
+		Translations: map[string]*Translation{
+			"tr": {Title: "İndirim", Body: "%50 indirim"},
+			"de": {Body: "50% Rabatt"},
+		},
+	}
+
+	localized, locale := msg.Localize("tr-TR")
+	if locale != "tr" || localized.Title != "İndirim" || localized.Body != "%50 indirim" || localized.Translations != nil {
+		t.Errorf("Turkish message does not match. got %q, %#v", locale, localized)
+	}
+
+	localized, locale = msg.Localize("de")
+	if locale != "de" || localized.Title != "Sale" || localized.Body != "50% Rabatt" {
+		t.Errorf("German message does not match. got %q, %#v", locale, localized)
+	}
+
+	localized, locale = msg.Localize("fr")
+	if locale != DefaultLocale || localized.Title != "Sale" || localized.Body != "50% off" || localized.Translations != nil {
+		t.Errorf("Default message does not match. got %q, %#v", locale, localized)
+	}
+
+	if msg.Title != "Sale" || len(msg.Translations) != 2 {
+		t.Error("Message was modified by Localize.")
+	}
+
+	msg.Translations[" "] = &Translation{Title: "Blank"}
+	if err := msg.Validate(); err == nil {
+		t.Error("Expected an error for a blank locale.")
+	}
+}
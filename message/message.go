@@ -0,0 +1,298 @@
+// Package message defines the platform independent notification model of
+// scotty and translates it into provider payloads.
+package message
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/gamegos/gcmlib"
+)
+
+// Platforms of devices. Devices of other platforms are sent to GCM.
+const (
+	PlatformGCM  = "gcm"
+	PlatformAPNS = "apns"
+)
+
+// maxPayloadSize is the maximum size of a JSON payload GCM and APNs accept.
+const maxPayloadSize = 4096
+
+// gcmMaxTTL is the maximum time to live GCM accepts, four weeks.
+const gcmMaxTTL = 4 * 7 * 24 * 60 * 60
+
+// Priorities of a message.
+const (
+	PriorityNormal = "normal"
+	PriorityHigh   = "high"
+)
+
+// Keys of the data payload holding the deep link and the image of a message.
+const (
+	DataDeepLink = "deepLink"
+	DataImage    = "image"
+)
+
+// Message is a notification sent to devices of any platform.
+type Message struct {
+	Title string `json:"title,omitempty"`
+	Body  string `json:"body,omitempty"`
+	// Image is the URL of an image shown in the notification.
+	Image string `json:"image,omitempty"`
+	Sound string `json:"sound,omitempty"`
+	Badge *int   `json:"badge,omitempty"`
+	// Data is passed to the app as custom keys of the payload.
+	Data map[string]interface{} `json:"data,omitempty"`
+	// DeepLink is the URL the app opens when the notification is tapped.
+	DeepLink string `json:"deepLink,omitempty"`
+	// Priority is PriorityNormal or PriorityHigh; providers use their default
+	// if it is empty.
+	Priority string `json:"priority,omitempty"`
+	// TTL is the number of seconds the provider keeps the message for offline
+	// devices. Zero delivers only to devices online now; nil uses the
+	// provider default.
+	TTL *int `json:"ttl,omitempty"`
+	// CollapseKey groups messages of which only the last one is shown.
+	CollapseKey string `json:"collapseKey,omitempty"`
+	// Translations are the titles and bodies by locale, e.g. "tr" or
+	// "pt-BR". Devices get the best match for their locale (see Localize).
+	Translations map[string]*Translation `json:"translations,omitempty"`
+
+	// GCM and APNS are merged into the translated payloads, replacing the
+	// translated values. Objects are merged recursively.
+	GCM  map[string]interface{} `json:"gcm,omitempty"`
+	APNS map[string]interface{} `json:"apns,omitempty"`
+}
+
+// APNSNotification is the payload and the headers of an APNs request.
+type APNSNotification struct {
+	// Payload is the JSON body, the "aps" dictionary and custom keys.
+	Payload map[string]interface{}
+	// Priority is the apns-priority header, 10 or 5.
+	Priority int
+	// TTL is the apns-expiration header relative to the time of sending, nil
+	// if it is not set.
+	TTL *int
+	// CollapseID is the apns-collapse-id header.
+	CollapseID string
+}
+
+// Validate checks the message and that its overrides can be merged into the
+// provider payloads.
+func (m *Message) Validate() error {
+	switch m.Priority {
+	case "", PriorityNormal, PriorityHigh:
+	default:
+		return errors.New("message: priority must be normal or high")
+	}
+
+	if m.TTL != nil && *m.TTL < 0 {
+		return errors.New("message: ttl must not be negative")
+	}
+
+	for locale, translation := range m.Translations {
+		if normalizeLocale(locale) == "" || translation == nil {
+			return errors.New("message: invalid translation: " + locale)
+		}
+	}
+
+	if _, err := m.GCMMessage(); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// ValidatePlatform checks the payload translated for devices of a platform
+// against the limits of its provider.
+func (m *Message) ValidatePlatform(platform string) error {
+	if platform == PlatformAPNS {
+		payload, err := json.Marshal(m.APNSNotification().Payload)
+		if err != nil {
+			return errors.New("message: invalid apns payload: " + err.Error())
+		}
+
+		if len(payload) > maxPayloadSize {
+			return fmt.Errorf("message: apns payload is %d bytes, more than %d", len(payload), maxPayloadSize)
+		}
+
+		return nil
+	}
+
+	msg, err := m.GCMMessage()
+	if err != nil {
+		return err
+	}
+
+	if msg.TimeToLive != nil && (*msg.TimeToLive < 0 || *msg.TimeToLive > gcmMaxTTL) {
+		return fmt.Errorf("message: gcm time to live must be between 0 and %d", gcmMaxTTL)
+	}
+
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		return errors.New("message: invalid gcm message: " + err.Error())
+	}
+
+	if len(payload) > maxPayloadSize {
+		return fmt.Errorf("message: gcm payload is %d bytes, more than %d", len(payload), maxPayloadSize)
+	}
+
+	// the message has no recipients yet.
+	msg.To = "placeholder"
+	if err := msg.Validate(); err != nil {
+		return errors.New("message: invalid gcm message: " + err.Error())
+	}
+
+	return nil
+}
+
+// GCMMessage translates the message into a GCM message without recipients.
+func (m *Message) GCMMessage() (*gcmlib.Message, error) {
+	msg := &gcmlib.Message{
+		CollapseKey: m.CollapseKey,
+		Priority:    m.Priority,
+		TimeToLive:  m.TTL,
+		Data:        m.data(),
+	}
+
+	if m.Title != "" || m.Body != "" || m.Sound != "" || m.Badge != nil {
+		msg.Notification = &gcmlib.Notification{
+			Title: m.Title,
+			Body:  m.Body,
+			Sound: m.Sound,
+		}
+
+		if m.Badge != nil {
+			msg.Notification.Badge = strconv.Itoa(*m.Badge)
+		}
+	}
+
+	if len(m.GCM) == 0 {
+		return msg, nil
+	}
+
+	var merged gcmlib.Message
+	if err := mergeJSON(msg, m.GCM, &merged); err != nil {
+		return nil, errors.New("message: invalid gcm override: " + err.Error())
+	}
+
+	return &merged, nil
+}
+
+// APNSNotification translates the message into an APNs notification.
+func (m *Message) APNSNotification() *APNSNotification {
+	aps := make(map[string]interface{})
+
+	if m.Title != "" || m.Body != "" {
+		alert := make(map[string]interface{})
+		if m.Title != "" {
+			alert["title"] = m.Title
+		}
+		if m.Body != "" {
+			alert["body"] = m.Body
+		}
+		aps["alert"] = alert
+	} else {
+		// a message without an alert is delivered silently to the app.
+		aps["content-available"] = 1
+	}
+
+	if m.Sound != "" {
+		aps["sound"] = m.Sound
+	}
+
+	if m.Badge != nil {
+		aps["badge"] = *m.Badge
+	}
+
+	if m.Image != "" {
+		// lets a notification service extension download the image.
+		aps["mutable-content"] = 1
+	}
+
+	payload := m.data()
+	if payload == nil {
+		payload = make(map[string]interface{})
+	}
+	payload["aps"] = aps
+
+	notification := &APNSNotification{
+		Payload:    merge(payload, m.APNS),
+		Priority:   10,
+		TTL:        m.TTL,
+		CollapseID: m.CollapseKey,
+	}
+
+	if m.Priority == PriorityNormal {
+		notification.Priority = 5
+	}
+
+	return notification
+}
+
+// data returns the custom data of the message with the deep link and the
+// image, or nil if there is none.
+func (m *Message) data() map[string]interface{} {
+	if len(m.Data) == 0 && m.DeepLink == "" && m.Image == "" {
+		return nil
+	}
+
+	data := make(map[string]interface{}, len(m.Data)+2)
+	for k, v := range m.Data {
+		data[k] = v
+	}
+
+	if m.DeepLink != "" {
+		data[DataDeepLink] = m.DeepLink
+	}
+
+	if m.Image != "" {
+		data[DataImage] = m.Image
+	}
+
+	return data
+}
+
+// mergeJSON merges override into the JSON encoding of v and decodes the
+// result into dst.
+func mergeJSON(v interface{}, override map[string]interface{}, dst interface{}) error {
+	encoded, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	var base map[string]interface{}
+	if err := json.Unmarshal(encoded, &base); err != nil {
+		return err
+	}
+
+	encoded, err = json.Marshal(merge(base, override))
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(encoded, dst)
+}
+
+// merge returns base with the keys of override replacing its keys. Objects in
+// both are merged recursively; base is modified but override is not.
+func merge(base map[string]interface{}, override map[string]interface{}) map[string]interface{} {
+	for k, v := range override {
+		overrideObj, ok := v.(map[string]interface{})
+		if !ok {
+			base[k] = v
+			continue
+		}
+
+		baseObj, ok := base[k].(map[string]interface{})
+		if !ok {
+			baseObj = make(map[string]interface{}, len(overrideObj))
+		}
+
+		base[k] = merge(baseObj, overrideObj)
+	}
+
+	return base
+}
@@ -0,0 +1,160 @@
+package message
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gamegos/gcmlib"
+)
+
+func intPtr(n int) *int {
+	return &n
+}
+
+func TestGCMMessage(t *testing.T) {
+	msg := &Message{
+		Title:       "Sale",
+		Body:        "50% off today",
+		Image:       "https://example.com/sale.png",
+		Badge:       intPtr(3),
+		Data:        map[string]interface{}{"campaign": "summer"},
+		DeepLink:    "myapp://sale",
+		Priority:    PriorityHigh,
+		TTL:         intPtr(3600),
+		CollapseKey: "sale",
+	}
+
+	received, err := msg.GCMMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := &gcmlib.Message{
+		CollapseKey: "sale",
+		Priority:    "high",
+		TimeToLive:  intPtr(3600),
+		Data: map[string]interface{}{
+			"campaign": "summer",
+			"deepLink": "myapp://sale",
+			"image":    "https://example.com/sale.png",
+		},
+		Notification: &gcmlib.Notification{Title: "Sale", Body: "50% off today", Badge: "3"},
+	}
+
+	if !reflect.DeepEqual(received, expected) {
+		t.Errorf("GCM message does not match. got %#v, expected %#v", received, expected)
+	}
+}
+
+func TestGCMOverride(t *testing.T) {
+	var msg Message
+	err := json.Unmarshal([]byte(`{
+		"title": "Sale",
+		"data": {"campaign": "summer"},
+		"gcm": {"notification": {"color": "#ff0000"}, "data": {"campaign": "android"}, "delay_while_idle": true}
+	}`), &msg)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	received, err := msg.GCMMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if received.Notification == nil || received.Notification.Title != "Sale" || received.Notification.Color != "#ff0000" {
+		t.Errorf("Notification does not match. got %#v", received.Notification)
+	}
+
+	if received.Data["campaign"] != "android" || !received.DelayWhileIdle {
+		t.Errorf("Overridden fields do not match. got %#v", received)
+	}
+
+	if msg.GCM["notification"].(map[string]interface{})["title"] != nil {
+		t.Error("Override was modified by the merge.")
+	}
+
+	msg.GCM = map[string]interface{}{"time_to_live": "forever"}
+	if err := msg.Validate(); err == nil {
+		t.Error("Expected an error for an invalid gcm override.")
+	}
+}
+
+func TestAPNSNotification(t *testing.T) {
+	msg := &Message{
+		Title:       "Sale",
+		Sound:       "default",
+		Badge:       intPtr(1),
+		Image:       "https://example.com/sale.png",
+		Data:        map[string]interface{}{"campaign": "summer"},
+		Priority:    PriorityNormal,
+		CollapseKey: "sale",
+		APNS:        map[string]interface{}{"aps": map[string]interface{}{"thread-id": "sales"}},
+	}
+
+	received := msg.APNSNotification()
+
+	expected := &APNSNotification{
+		Payload: map[string]interface{}{
+			"campaign": "summer",
+			"image":    "https://example.com/sale.png",
+			"aps": map[string]interface{}{
+				"alert":           map[string]interface{}{"title": "Sale"},
+				"sound":           "default",
+				"badge":           1,
+				"mutable-content": 1,
+				"thread-id":       "sales",
+			},
+		},
+		Priority:   5,
+		CollapseID: "sale",
+	}
+
+	if !reflect.DeepEqual(received, expected) {
+		t.Errorf("APNs notification does not match. got %#v, expected %#v", received, expected)
+	}
+
+	silent := (&Message{Data: map[string]interface{}{"sync": true}}).APNSNotification()
+	aps := silent.Payload["aps"].(map[string]interface{})
+	if aps["content-available"] != 1 || silent.Priority != 10 {
+		t.Errorf("Silent notification does not match. got %#v", silent)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []*Message{
+		{Priority: "urgent"},
+		{TTL: intPtr(-1)},
+	}
+
+	for _, msg := range tests {
+		if err := msg.Validate(); err == nil {
+			t.Errorf("Expected an error for %#v", msg)
+		}
+	}
+}
+
+func TestValidatePlatform(t *testing.T) {
+	msg := &Message{Title: "Sale", TTL: intPtr(3600)}
+
+	for _, platform := range []string{PlatformGCM, PlatformAPNS} {
+		if err := msg.ValidatePlatform(platform); err != nil {
+			t.Errorf("Unexpected error for %s: %v", platform, err)
+		}
+	}
+
+	msg.Body = strings.Repeat("a", maxPayloadSize)
+	for _, platform := range []string{PlatformGCM, PlatformAPNS} {
+		if err := msg.ValidatePlatform(platform); err == nil {
+			t.Errorf("Expected an error for a large %s payload.", platform)
+		}
+	}
+
+	msg = &Message{TTL: intPtr(gcmMaxTTL + 1)}
+	if err := msg.ValidatePlatform(PlatformGCM); err == nil {
+		t.Error("Expected an error for a gcm time to live of more than four weeks.")
+	}
+}
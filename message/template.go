@@ -0,0 +1,190 @@
+package message
+
+import (
+	"bytes"
+	"errors"
+	"sort"
+	"strings"
+)
+
+// LookupFunc returns the value of a template variable, ok is false if the
+// variable is not set.
+type LookupFunc func(name string) (value string, ok bool)
+
+// MissingVariableError is returned from Render when a variable without a
+// default is not set.
+type MissingVariableError struct {
+	Name string
+}
+
+func (e *MissingVariableError) Error() string {
+	return "message: variable " + e.Name + " is not set"
+}
+
+// Variables returns the names of the variables used in the message, sorted.
+// It returns an error if a variable is malformed.
+func (m *Message) Variables() ([]string, error) {
+	seen := make(map[string]struct{})
+
+	_, err := m.Render(func(name string) (string, bool) {
+		seen[name] = struct{}{}
+		return "", true
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(seen))
+	for name := range seen {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names, nil
+}
+
+// Render returns a copy of the message with the variables in its title, body,
+// image, deep link and the string values of its data replaced with their
+// values. Titles and bodies of translations are rendered too; provider
+// overrides are not.
+//
+// Variables are written as {{name}} or {{name|default}}; names consist of
+// letters, digits, '_', '-' and '.'. Values are inserted as they are and never
+// expanded again, so a recipient's value can not inject variables or change
+// other fields of the message.
+func (m *Message) Render(lookup LookupFunc) (*Message, error) {
+	rendered := *m
+
+	var err error
+	for _, field := range []*string{&rendered.Title, &rendered.Body, &rendered.Image, &rendered.DeepLink} {
+		if *field, err = expand(*field, lookup); err != nil {
+			return nil, err
+		}
+	}
+
+	if m.Translations != nil {
+		rendered.Translations = make(map[string]*Translation, len(m.Translations))
+		for locale, translation := range m.Translations {
+			if translation == nil {
+				continue
+			}
+
+			t := *translation
+			for _, field := range []*string{&t.Title, &t.Body} {
+				if *field, err = expand(*field, lookup); err != nil {
+					return nil, err
+				}
+			}
+			rendered.Translations[locale] = &t
+		}
+	}
+
+	if m.Data != nil {
+		data, err := renderValue(m.Data, lookup)
+		if err != nil {
+			return nil, err
+		}
+		rendered.Data = data.(map[string]interface{})
+	}
+
+	return &rendered, nil
+}
+
+// renderValue returns a copy of a decoded JSON value with the variables in its
+// strings expanded.
+func renderValue(v interface{}, lookup LookupFunc) (interface{}, error) {
+	switch v := v.(type) {
+	case string:
+		return expand(v, lookup)
+	case map[string]interface{}:
+		rendered := make(map[string]interface{}, len(v))
+		for k, value := range v {
+			r, err := renderValue(value, lookup)
+			if err != nil {
+				return nil, err
+			}
+			rendered[k] = r
+		}
+		return rendered, nil
+	case []interface{}:
+		rendered := make([]interface{}, len(v))
+		for i, value := range v {
+			r, err := renderValue(value, lookup)
+			if err != nil {
+				return nil, err
+			}
+			rendered[i] = r
+		}
+		return rendered, nil
+	}
+
+	return v, nil
+}
+
+// expand replaces the variables in s with their values.
+func expand(s string, lookup LookupFunc) (string, error) {
+	if !strings.Contains(s, "{{") {
+		return s, nil
+	}
+
+	var buf bytes.Buffer
+	for {
+		start := strings.Index(s, "{{")
+		if start < 0 {
+			buf.WriteString(s)
+			break
+		}
+
+		end := strings.Index(s[start:], "}}")
+		if end < 0 {
+			return "", errors.New("message: unterminated variable: " + s[start:])
+		}
+
+		buf.WriteString(s[:start])
+
+		name, def, hasDefault := parseVariable(s[start+2 : start+end])
+		if !validVariableName(name) {
+			return "", errors.New("message: invalid variable: " + s[start:start+end+2])
+		}
+
+		value, ok := lookup(name)
+		if !ok {
+			if !hasDefault {
+				return "", &MissingVariableError{name}
+			}
+			value = def
+		}
+		buf.WriteString(value)
+
+		s = s[start+end+2:]
+	}
+
+	return buf.String(), nil
+}
+
+// parseVariable splits the expression of a variable into its name and
+// default.
+func parseVariable(expr string) (name string, def string, hasDefault bool) {
+	if i := strings.Index(expr, "|"); i >= 0 {
+		return strings.TrimSpace(expr[:i]), strings.TrimSpace(expr[i+1:]), true
+	}
+	return strings.TrimSpace(expr), "", false
+}
+
+func validVariableName(name string) bool {
+	if name == "" {
+		return false
+	}
+
+	for _, c := range name {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '_' || c == '-' || c == '.':
+		default:
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,88 @@
+package message
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRender(t *testing.T) {
+	msg := &Message{
+		Title:    "Hi {{ name | there }}",
+		Body:     "Your order {{orderId}} shipped",
+		DeepLink: "myapp://orders/{{orderId}}",
+		Sound:    "{{sound}}",
+		Data: map[string]interface{}{
+			"orderId": "{{orderId}}",
+			"items":   []interface{}{"{{item}}", 2.0},
+		},
+	}
+
+	vars := map[string]string{"orderId": "42", "item": "{{orderId}}"}
+	lookup := func(name string) (string, bool) {
+		value, ok := vars[name]
+		return value, ok
+	}
+
+	received, err := msg.Render(lookup)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := &Message{
+		Title:    "Hi there",
+		Body:     "Your order 42 shipped",
+		DeepLink: "myapp://orders/42",
+		Sound:    "{{sound}}",
+		Data: map[string]interface{}{
+			"orderId": "42",
+			"items":   []interface{}{"{{orderId}}", 2.0},
+		},
+	}
+
+	if !reflect.DeepEqual(received, expected) {
+		t.Errorf("Rendered message does not match. got %#v, expected %#v", received, expected)
+	}
+
+	if msg.Data["orderId"] != "{{orderId}}" {
+		t.Error("Template was modified by rendering.")
+	}
+
+	translated := &Message{Translations: map[string]*Translation{"tr": {Body: "Siparişiniz {{orderId}} kargoda"}}}
+	received, err = translated.Render(lookup)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if body := received.Translations["tr"].Body; body != "Siparişiniz 42 kargoda" {
+		t.Errorf("Rendered translation does not match. got %q", body)
+	}
+
+	delete(vars, "orderId")
+	_, err = msg.Render(lookup)
+	if err, ok := err.(*MissingVariableError); !ok || err.Name != "orderId" {
+		t.Errorf("Expected a missing variable error for orderId, got %v", err)
+	}
+}
+
+func TestVariables(t *testing.T) {
+	msg := &Message{
+		Title: "Hi {{name|there}}",
+		Body:  "{{orderId}} {{name}}",
+		Data:  map[string]interface{}{"tier": "{{tags.tier}}"},
+	}
+
+	names, err := msg.Variables()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if expected := []string{"name", "orderId", "tags.tier"}; !reflect.DeepEqual(names, expected) {
+		t.Errorf("Variables do not match. got %v, expected %v", names, expected)
+	}
+
+	for _, title := range []string{"Hi {{name", "Hi {{}}", "Hi {{first name}}", "Hi {{name!}}"} {
+		if _, err := (&Message{Title: title}).Variables(); err == nil {
+			t.Errorf("Expected an error for %q", title)
+		}
+	}
+}
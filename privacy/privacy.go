@@ -0,0 +1,231 @@
+// Package privacy exports and erases all data tied to a subscriber id.
+package privacy
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"time"
+
+	"github.com/gamegos/scotty/storage"
+)
+
+// deadLetterScanCount is the page size of dead letter scans.
+const deadLetterScanCount = 100
+
+// Export is every piece of data stored for a subscriber.
+type Export struct {
+	SubscriberID string `json:"subscriberId"`
+	// ExportedAt is the unix timestamp of the export.
+	ExportedAt int               `json:"exportedAt"`
+	Devices    []*storage.Device `json:"devices"`
+	Channels   []string          `json:"channels"`
+	// Aliases are the ids merged into the subscriber.
+	Aliases     []string             `json:"aliases"`
+	Preferences *storage.Preferences `json:"preferences"`
+	// Segments are the ids of segments naming the subscriber as a recipient
+	// or an exception.
+	Segments []string `json:"segments"`
+	// DeadLetters are the messages that could not be delivered to the
+	// subscriber.
+	DeadLetters []*storage.DeadLetter `json:"deadLetters"`
+}
+
+// HashSubscriberID returns the hash of a subscriber id kept in tombstones.
+func HashSubscriberID(subscriberID string) string {
+	sum := sha256.Sum256([]byte(subscriberID))
+	return hex.EncodeToString(sum[:])
+}
+
+// ExportSubscriber collects the data stored for a subscriber.
+func ExportSubscriber(ctx context.Context, stg storage.Storage, appID string, subscriberID string) (*Export, error) {
+	devices, err := stg.GetSubscriberDevices(ctx, appID, subscriberID)
+	if err != nil {
+		return nil, err
+	}
+
+	channels, err := stg.GetSubscriberChannels(ctx, appID, subscriberID)
+	if err != nil {
+		return nil, err
+	}
+
+	aliases, err := stg.GetSubscriberAliases(ctx, appID, subscriberID)
+	if err != nil {
+		return nil, err
+	}
+
+	prefs, err := stg.GetPreferences(ctx, appID, subscriberID)
+	if err != nil {
+		return nil, err
+	}
+
+	segments, err := subscriberSegments(ctx, stg, appID, subscriberID)
+	if err != nil {
+		return nil, err
+	}
+
+	letters, err := subscriberDeadLetters(ctx, stg, appID, subscriberID)
+	if err != nil {
+		return nil, err
+	}
+
+	export := &Export{
+		SubscriberID: subscriberID,
+		ExportedAt:   int(time.Now().Unix()),
+		Devices:      devices,
+		Channels:     channels,
+		Aliases:      aliases,
+		Preferences:  prefs,
+		Segments:     make([]string, 0, len(segments)),
+		DeadLetters:  letters,
+	}
+
+	if export.DeadLetters == nil {
+		export.DeadLetters = []*storage.DeadLetter{}
+	}
+
+	if export.Devices == nil {
+		export.Devices = []*storage.Device{}
+	}
+
+	for _, segment := range segments {
+		export.Segments = append(export.Segments, segment.ID)
+	}
+
+	return export, nil
+}
+
+// EraseSubscriber removes the subscriber with its devices, channel
+// memberships, aliases, preferences and dead letters, removes its id from
+// segments and records a tombstone. A tombstone is recorded even if nothing was stored for the
+// subscriber, so every erasure request can be audited.
+func EraseSubscriber(ctx context.Context, stg storage.Storage, appID string, subscriberID string, reason string) (*storage.Tombstone, error) {
+	tombstone := &storage.Tombstone{
+		SubscriberHash: HashSubscriberID(subscriberID),
+		Reason:         reason,
+	}
+
+	devices, err := stg.GetSubscriberDevices(ctx, appID, subscriberID)
+	if err != nil {
+		return nil, err
+	}
+
+	channels, err := stg.GetSubscriberChannels(ctx, appID, subscriberID)
+	if err != nil {
+		return nil, err
+	}
+
+	aliases, err := stg.GetSubscriberAliases(ctx, appID, subscriberID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := stg.DeleteSubscriber(ctx, appID, subscriberID); err != nil && err != storage.ErrNotFound {
+		return nil, err
+	}
+
+	tombstone.Devices = len(devices)
+	tombstone.Channels = len(channels)
+	tombstone.Aliases = len(aliases)
+
+	segments, err := subscriberSegments(ctx, stg, appID, subscriberID)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, segment := range segments {
+		segment.Subscribers = without(segment.Subscribers, subscriberID)
+		segment.ExceptSubscribers = without(segment.ExceptSubscribers, subscriberID)
+
+		if err := stg.PutSegment(ctx, appID, segment); err != nil {
+			return nil, err
+		}
+
+		tombstone.Segments++
+	}
+
+	letters, err := subscriberDeadLetters(ctx, stg, appID, subscriberID)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(letters) > 0 {
+		letterIDs := make([]string, len(letters))
+		for i, letter := range letters {
+			letterIDs[i] = letter.ID
+		}
+
+		if tombstone.DeadLetters, err = stg.DeleteDeadLetters(ctx, appID, letterIDs); err != nil {
+			return nil, err
+		}
+	}
+
+	tombstone.ErasedAt = int(time.Now().Unix())
+
+	if err := stg.AddTombstone(ctx, appID, tombstone); err != nil {
+		return nil, err
+	}
+
+	return tombstone, nil
+}
+
+// subscriberSegments returns the segments naming the subscriber.
+func subscriberSegments(ctx context.Context, stg storage.Storage, appID string, subscriberID string) ([]*storage.Segment, error) {
+	segments, err := stg.GetSegments(ctx, appID)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []*storage.Segment
+	for _, segment := range segments {
+		if contains(segment.Subscribers, subscriberID) || contains(segment.ExceptSubscribers, subscriberID) {
+			result = append(result, segment)
+		}
+	}
+
+	return result, nil
+}
+
+// subscriberDeadLetters returns the dead letters of the subscriber.
+func subscriberDeadLetters(ctx context.Context, stg storage.Storage, appID string, subscriberID string) ([]*storage.DeadLetter, error) {
+	var result []*storage.DeadLetter
+
+	cursor := ""
+	for {
+		letters, next, err := stg.ScanDeadLetters(ctx, appID, cursor, deadLetterScanCount)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, letter := range letters {
+			if letter.SubscriberID == subscriberID {
+				result = append(result, letter)
+			}
+		}
+
+		if next == "" {
+			return result, nil
+		}
+		cursor = next
+	}
+}
+
+func contains(ids []string, id string) bool {
+	for _, v := range ids {
+		if v == id {
+			return true
+		}
+	}
+	return false
+}
+
+// without returns ids without id.
+func without(ids []string, id string) []string {
+	result := make([]string, 0, len(ids))
+	for _, v := range ids {
+		if v != id {
+			result = append(result, v)
+		}
+	}
+	return result
+}
@@ -0,0 +1,126 @@
+package privacy
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/gamegos/scotty/storage"
+	memstorage "github.com/gamegos/scotty/storage/drivers/memory"
+)
+
+var ctx = context.Background()
+
+func TestExportAndErase(t *testing.T) {
+	stg := memstorage.New()
+
+	device := &storage.Device{Platform: "gcm", Token: "t1", CreatedAt: 100, Locale: "tr"}
+	if err := stg.AddSubscriberDevice(ctx, "app", "sub_1", device); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := stg.AddSubscriber(ctx, "app", "chan", []string{"sub_1", "sub_2"}); err != nil {
+		t.Fatal(err)
+	}
+
+	segments := []*storage.Segment{
+		{ID: "named", Subscribers: []string{"sub_1", "sub_2"}},
+		{ID: "excluded", Channels: []string{"chan"}, ExceptSubscribers: []string{"sub_1"}},
+		{ID: "other", Channels: []string{"chan"}},
+	}
+
+	for _, segment := range segments {
+		if err := stg.PutSegment(ctx, "app", segment); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	letters := []*storage.DeadLetter{
+		{ID: "l1", SubscriberID: "sub_1", Token: "t1", ExpiresAt: int(time.Now().Unix()) + 100},
+		{ID: "l2", SubscriberID: "sub_2", Token: "t2", ExpiresAt: int(time.Now().Unix()) + 100},
+	}
+
+	if err := stg.PutDeadLetters(ctx, "app", letters); err != nil {
+		t.Fatal(err)
+	}
+
+	export, err := ExportSubscriber(ctx, stg, "app", "sub_1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(export.Devices, []*storage.Device{device}) {
+		t.Errorf("Exported devices do not match. got %#v", export.Devices)
+	}
+
+	if !reflect.DeepEqual(export.Channels, []string{"chan"}) {
+		t.Errorf("Exported channels do not match. got %v", export.Channels)
+	}
+
+	if !reflect.DeepEqual(export.Segments, []string{"excluded", "named"}) {
+		t.Errorf("Exported segments do not match. got %v", export.Segments)
+	}
+
+	if !reflect.DeepEqual(export.DeadLetters, letters[:1]) {
+		t.Errorf("Exported dead letters do not match. got %#v", export.DeadLetters)
+	}
+
+	tombstone, err := EraseSubscriber(ctx, stg, "app", "sub_1", "user request")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if tombstone.SubscriberHash != HashSubscriberID("sub_1") || tombstone.Devices != 1 || tombstone.Channels != 1 || tombstone.Segments != 2 || tombstone.DeadLetters != 1 {
+		t.Errorf("Tombstone does not match. got %#v", tombstone)
+	}
+
+	export, err = ExportSubscriber(ctx, stg, "app", "sub_1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(export.Devices) != 0 || len(export.Channels) != 0 || len(export.Segments) != 0 || len(export.DeadLetters) != 0 {
+		t.Errorf("Expected nothing left after erasure, got %#v", export)
+	}
+
+	segment, err := stg.GetSegment(ctx, "app", "named")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(segment.Subscribers, []string{"sub_2"}) {
+		t.Errorf("Segment subscribers do not match. got %v", segment.Subscribers)
+	}
+
+	tombstones, err := stg.GetTombstones(ctx, "app")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(tombstones, []*storage.Tombstone{tombstone}) {
+		t.Errorf("Stored tombstones do not match. got %#v", tombstones)
+	}
+}
+
+func TestEraseUnknownSubscriber(t *testing.T) {
+	stg := memstorage.New()
+
+	tombstone, err := EraseSubscriber(ctx, stg, "app", "nobody", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if tombstone.Devices != 0 || tombstone.Channels != 0 || tombstone.Segments != 0 {
+		t.Errorf("Expected an empty tombstone, got %#v", tombstone)
+	}
+
+	tombstones, err := stg.GetTombstones(ctx, "app")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(tombstones) != 1 {
+		t.Errorf("Expected a recorded tombstone, got %#v", tombstones)
+	}
+}
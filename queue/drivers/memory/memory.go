@@ -0,0 +1,204 @@
+package memory
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gamegos/scotty/queue"
+	"github.com/gamegos/scotty/storage"
+)
+
+// MemQueue keeps jobs in memory. Jobs are lost when the process exits and
+// are not shared with other processes, so it is meant for tests and single
+// process deployments.
+type MemQueue struct {
+	mu  sync.Mutex
+	seq int
+	// ready are the jobs not received yet, oldest first.
+	ready []*entry
+	// jobid -> job received but not acknowledged yet
+	pending map[string]*entry
+	// notify is closed and replaced when a job is pushed.
+	notify chan struct{}
+	// now returns the current time of idle times.
+	now func() time.Time
+}
+
+type entry struct {
+	seq        int
+	id         string
+	data       []byte
+	consumer   string
+	receivedAt time.Time
+	deliveries int
+}
+
+func init() {
+	queue.Register("memory", initDriver)
+}
+
+func initDriver(options map[string]interface{}) (queue.Queue, error) {
+	// memory driver has no options, decode only to warn about unknown keys.
+	if err := storage.DecodeOptions(options, &struct{}{}); err != nil {
+		return nil, err
+	}
+
+	return New(), nil
+}
+
+// New initializes memory queue driver.
+func New() *MemQueue {
+	return &MemQueue{
+		pending: make(map[string]*entry),
+		notify:  make(chan struct{}),
+		now:     time.Now,
+	}
+}
+
+// Push adds a job to the queue.
+func (q *MemQueue) Push(ctx context.Context, data []byte) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.seq++
+	e := &entry{
+		seq:  q.seq,
+		id:   strconv.Itoa(q.seq),
+		data: append([]byte(nil), data...),
+	}
+	q.ready = append(q.ready, e)
+
+	close(q.notify)
+	q.notify = make(chan struct{})
+
+	return e.id, nil
+}
+
+// Receive receives at most count new jobs for a consumer, waiting at most wait
+// for a push if there are none.
+func (q *MemQueue) Receive(ctx context.Context, consumer string, count int, wait time.Duration) ([]*queue.Job, error) {
+	if count <= 0 {
+		count = 1
+	}
+
+	var timeout <-chan time.Time
+	if wait > 0 {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		q.mu.Lock()
+		if len(q.ready) > 0 {
+			jobs := q.receive(consumer, count)
+			q.mu.Unlock()
+			return jobs, nil
+		}
+		notify := q.notify
+		q.mu.Unlock()
+
+		if timeout == nil {
+			return nil, nil
+		}
+
+		select {
+		case <-notify:
+		case <-timeout:
+			return nil, nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// receive moves at most count ready jobs to consumer. q.mu must be locked.
+func (q *MemQueue) receive(consumer string, count int) []*queue.Job {
+	if count > len(q.ready) {
+		count = len(q.ready)
+	}
+
+	jobs := make([]*queue.Job, count)
+	for i, e := range q.ready[:count] {
+		q.pending[e.id] = e
+		jobs[i] = q.deliver(e, consumer)
+	}
+	q.ready = q.ready[count:]
+
+	return jobs
+}
+
+// deliver assigns a job to consumer. q.mu must be locked.
+func (q *MemQueue) deliver(e *entry, consumer string) *queue.Job {
+	e.consumer = consumer
+	e.receivedAt = q.now()
+	e.deliveries++
+
+	return &queue.Job{
+		ID:         e.id,
+		Data:       append([]byte(nil), e.data...),
+		Deliveries: e.deliveries,
+	}
+}
+
+// Ack acknowledges jobs.
+func (q *MemQueue) Ack(ctx context.Context, jobIDs ...string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for _, jobID := range jobIDs {
+		delete(q.pending, jobID)
+	}
+
+	return nil
+}
+
+// Reclaim moves at most count jobs pending for at least minIdle to consumer,
+// oldest first.
+func (q *MemQueue) Reclaim(ctx context.Context, consumer string, minIdle time.Duration, count int) ([]*queue.Job, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	now := q.now()
+
+	var idle []*entry
+	for _, e := range q.pending {
+		if now.Sub(e.receivedAt) >= minIdle {
+			idle = append(idle, e)
+		}
+	}
+
+	sort.Slice(idle, func(i, j int) bool {
+		return idle[i].seq < idle[j].seq
+	})
+
+	if count > 0 && len(idle) > count {
+		idle = idle[:count]
+	}
+
+	jobs := make([]*queue.Job, len(idle))
+	for i, e := range idle {
+		jobs[i] = q.deliver(e, consumer)
+	}
+
+	return jobs, nil
+}
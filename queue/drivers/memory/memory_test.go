@@ -0,0 +1,14 @@
+package memory
+
+import (
+	"testing"
+
+	"github.com/gamegos/scotty/queue"
+	"github.com/gamegos/scotty/queue/queuetest"
+)
+
+func TestConformance(t *testing.T) {
+	queuetest.Run(t, func(t *testing.T) queue.Queue {
+		return New()
+	})
+}
@@ -0,0 +1,330 @@
+// Package redis implements a queue on a Redis stream. Jobs are entries of
+// the stream read by a consumer group, so each job is received by a single
+// consumer among all the processes sharing the stream; it needs Redis 6.2 or
+// later.
+package redis
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gamegos/scotty/queue"
+	"github.com/gamegos/scotty/storage"
+	storageredis "github.com/gamegos/scotty/storage/drivers/redis"
+	redigo "github.com/garyburd/redigo/redis"
+)
+
+func init() {
+	queue.Register("redis", initDriver)
+}
+
+// Config holds config data for the queue. Connection options are the ones of
+// the Redis storage driver.
+type Config struct {
+	storageredis.Config
+
+	// Stream is the key of the stream and Group is the name of the consumer
+	// group workers read it with.
+	Stream string
+	Group  string
+}
+
+// RedisQueue is a queue on a Redis stream.
+type RedisQueue struct {
+	pool        *redigo.Pool
+	stream      string
+	group       string
+	readTimeout time.Duration
+}
+
+// DefaultConfig returns the config used for options that are not set.
+func DefaultConfig() *Config {
+	return &Config{
+		Config: *storageredis.DefaultConfig(),
+		Stream: "scotty.deliveries",
+		Group:  "scotty.workers",
+	}
+}
+
+// Validate checks that the config can be used to connect to Redis.
+func (conf *Config) Validate() error {
+	if err := conf.Config.Validate(); err != nil {
+		return err
+	}
+
+	if conf.Stream == "" {
+		return errors.New("stream must not be empty")
+	}
+
+	if conf.Group == "" {
+		return errors.New("group must not be empty")
+	}
+
+	return nil
+}
+
+func initDriver(options map[string]interface{}) (queue.Queue, error) {
+	conf := DefaultConfig()
+
+	if err := storage.DecodeOptions(options, conf); err != nil {
+		return nil, fmt.Errorf("invalid config: %s", err)
+	}
+
+	if err := conf.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid config: %s", err)
+	}
+
+	return New(conf), nil
+}
+
+// New initializes the queue with the given config. The stream and the
+// consumer group are created when they are first read.
+func New(conf *Config) *RedisQueue {
+	return &RedisQueue{
+		pool:        storageredis.NewPool(&conf.Config),
+		stream:      conf.Stream,
+		group:       conf.Group,
+		readTimeout: conf.ReadTimeout,
+	}
+}
+
+// do runs a command on a pooled connection. A blocking command waits up to
+// block on top of the read timeout.
+func (q *RedisQueue) do(ctx context.Context, block time.Duration, commandName string, args ...interface{}) (interface{}, error) {
+	conn, err := q.pool.GetContext(ctx)
+	if err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, ctxErr
+		}
+		return nil, err
+	}
+	defer conn.Close()
+
+	timeout := q.readTimeout
+	if timeout > 0 || block > 0 {
+		timeout += block
+	}
+
+	if deadline, ok := ctx.Deadline(); ok && (timeout == 0 || time.Until(deadline) < timeout) {
+		timeout = time.Until(deadline)
+		if timeout <= 0 {
+			return nil, context.DeadlineExceeded
+		}
+	}
+
+	var reply interface{}
+	if timeout > 0 {
+		reply, err = redigo.DoWithTimeout(conn, timeout, commandName, args...)
+	} else {
+		reply, err = conn.Do(commandName, args...)
+	}
+
+	if err != nil && ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+
+	return reply, err
+}
+
+// doGroup runs a command reading the consumer group, creating the group and
+// the stream first if they do not exist.
+func (q *RedisQueue) doGroup(ctx context.Context, block time.Duration, commandName string, args ...interface{}) (interface{}, error) {
+	reply, err := q.do(ctx, block, commandName, args...)
+	if err == nil || !strings.HasPrefix(err.Error(), "NOGROUP") {
+		return reply, err
+	}
+
+	_, err = q.do(ctx, 0, "XGROUP", "CREATE", q.stream, q.group, "0", "MKSTREAM")
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return nil, err
+	}
+
+	return q.do(ctx, block, commandName, args...)
+}
+
+// Push adds a job to the stream.
+func (q *RedisQueue) Push(ctx context.Context, data []byte) (string, error) {
+	return redigo.String(q.do(ctx, 0, "XADD", q.stream, "*", "data", data))
+}
+
+// Receive reads at most count new jobs for a consumer of the group, blocking
+// at most wait for a push if there are none.
+func (q *RedisQueue) Receive(ctx context.Context, consumer string, count int, wait time.Duration) ([]*queue.Job, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if count <= 0 {
+		count = 1
+	}
+
+	args := []interface{}{"GROUP", q.group, consumer, "COUNT", count}
+	if wait > 0 {
+		args = append(args, "BLOCK", int64(wait/time.Millisecond))
+	}
+	args = append(args, "STREAMS", q.stream, ">")
+
+	reply, err := redigo.Values(q.doGroup(ctx, wait, "XREADGROUP", args...))
+	if err == redigo.ErrNil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// reply is a list of [stream, entries] pairs for the single stream read.
+	var entries []interface{}
+	for _, s := range reply {
+		stream, err := redigo.Values(s, nil)
+		if err != nil || len(stream) != 2 {
+			return nil, fmt.Errorf("queue:redis: unexpected reply %v", s)
+		}
+
+		if entries, err = redigo.Values(stream[1], nil); err != nil {
+			return nil, err
+		}
+	}
+
+	jobs, _, err := parseEntries(entries, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, job := range jobs {
+		job.Deliveries = 1
+	}
+
+	return jobs, nil
+}
+
+// Ack acknowledges jobs and deletes them from the stream.
+func (q *RedisQueue) Ack(ctx context.Context, jobIDs ...string) error {
+	if len(jobIDs) == 0 {
+		return ctx.Err()
+	}
+
+	args := redigo.Args{}.Add(q.stream, q.group).AddFlat(jobIDs)
+	if _, err := q.do(ctx, 0, "XACK", args...); err != nil {
+		return err
+	}
+
+	_, err := q.do(ctx, 0, "XDEL", redigo.Args{}.Add(q.stream).AddFlat(jobIDs)...)
+	return err
+}
+
+// Reclaim claims at most count jobs pending for at least minIdle with any
+// consumer of the group, oldest first.
+func (q *RedisQueue) Reclaim(ctx context.Context, consumer string, minIdle time.Duration, count int) ([]*queue.Job, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if count <= 0 {
+		count = defaultReclaimCount
+	}
+
+	idle := int64(minIdle / time.Millisecond)
+
+	// pending entries are [id, consumer, idle, deliveries] lists.
+	pending, err := redigo.Values(q.doGroup(ctx, 0, "XPENDING", q.stream, q.group, "IDLE", idle, "-", "+", count))
+	if err != nil || len(pending) == 0 {
+		return nil, err
+	}
+
+	ids := make([]string, 0, len(pending))
+	deliveries := make(map[string]int, len(pending))
+	args := redigo.Args{}.Add(q.stream, q.group, consumer, idle)
+	for _, p := range pending {
+		var id string
+		var deliveryCount int
+		values, err := redigo.Values(p, nil)
+		if err == nil {
+			_, err = redigo.Scan(values, &id, nil, nil, &deliveryCount)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		ids = append(ids, id)
+		deliveries[id] = deliveryCount
+		args = args.Add(id)
+	}
+
+	// XCLAIM checks minIdle again, so a job claimed by another consumer in
+	// the meantime is not returned.
+	entries, err := redigo.Values(q.do(ctx, 0, "XCLAIM", args...))
+	if err != nil {
+		return nil, err
+	}
+
+	jobs, deleted, err := parseEntries(entries, ids)
+	if err != nil {
+		return nil, err
+	}
+
+	// entries deleted while pending would be claimed again and again.
+	if err := q.Ack(ctx, deleted...); err != nil {
+		return nil, err
+	}
+
+	for _, job := range jobs {
+		job.Deliveries = deliveries[job.ID] + 1
+	}
+
+	return jobs, nil
+}
+
+// defaultReclaimCount is the number of jobs reclaimed if count is not set.
+const defaultReclaimCount = 10
+
+// parseEntries converts [id, [field, value, ...]] stream entries to jobs,
+// and returns the ids of entries deleted from the stream while pending
+// separately. Deleted entries have no fields, or are nil in XCLAIM replies
+// before Redis 7; ids are the ids claimed, a nil entry is known by its
+// position only if every id was claimed.
+func parseEntries(entries []interface{}, ids []string) ([]*queue.Job, []string, error) {
+	jobs := make([]*queue.Job, 0, len(entries))
+	var deleted []string
+
+	for i, e := range entries {
+		if e == nil {
+			if len(entries) == len(ids) {
+				deleted = append(deleted, ids[i])
+			}
+			continue
+		}
+
+		entry, err := redigo.Values(e, nil)
+		if err != nil || len(entry) != 2 {
+			return nil, nil, fmt.Errorf("queue:redis: unexpected entry %v", e)
+		}
+
+		id, err := redigo.String(entry[0], nil)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if entry[1] == nil {
+			deleted = append(deleted, id)
+			continue
+		}
+
+		fields, err := redigo.StringMap(entry[1], nil)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		data, ok := fields["data"]
+		if !ok {
+			deleted = append(deleted, id)
+			continue
+		}
+
+		jobs = append(jobs, &queue.Job{ID: id, Data: []byte(data)})
+	}
+
+	return jobs, deleted, nil
+}
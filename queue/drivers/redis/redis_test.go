@@ -0,0 +1,85 @@
+package redis
+
+import (
+	"context"
+	"os"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gamegos/scotty/queue"
+	"github.com/gamegos/scotty/queue/queuetest"
+)
+
+// Conformance tests need a running Redis server. Set SCOTTY_TEST_REDIS_ADDR
+// to its address to run them, e.g. SCOTTY_TEST_REDIS_ADDR=:6379.
+func TestConformance(t *testing.T) {
+	addr := os.Getenv("SCOTTY_TEST_REDIS_ADDR")
+	if addr == "" {
+		t.Skip("SCOTTY_TEST_REDIS_ADDR is not set")
+	}
+
+	queuetest.Run(t, func(t *testing.T) queue.Queue {
+		conf := DefaultConfig()
+		conf.Addr = addr
+		conf.Stream = "scotty.test." + strconv.FormatInt(time.Now().UnixNano(), 10)
+		q := New(conf)
+
+		t.Cleanup(func() {
+			q.do(context.Background(), 0, "DEL", conf.Stream)
+		})
+
+		return q
+	})
+}
+
+func TestInitDriver(t *testing.T) {
+	q, err := initDriver(map[string]interface{}{
+		"addr":   "localhost:6380",
+		"stream": "deliveries",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rq := q.(*RedisQueue)
+	if rq.stream != "deliveries" || rq.group != "scotty.workers" {
+		t.Errorf("Queue config does not match. got stream %q group %q", rq.stream, rq.group)
+	}
+
+	if _, err := initDriver(map[string]interface{}{"group": ""}); err == nil {
+		t.Error("Expected an error for an empty group")
+	}
+}
+
+func TestParseEntries(t *testing.T) {
+	entries := []interface{}{
+		[]interface{}{[]byte("1-0"), []interface{}{[]byte("data"), []byte("job")}},
+		nil,
+		[]interface{}{[]byte("3-0"), nil},
+	}
+
+	jobs, deleted, err := parseEntries(entries, []string{"1-0", "2-0", "3-0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(jobs) != 1 || jobs[0].ID != "1-0" || string(jobs[0].Data) != "job" {
+		t.Errorf("Jobs do not match. got %+v", jobs)
+	}
+
+	if expected := []string{"2-0", "3-0"}; !reflect.DeepEqual(deleted, expected) {
+		t.Errorf("Deleted entries do not match. got %v, expected %v", deleted, expected)
+	}
+
+	// a nil entry is not known if some ids were not claimed.
+	_, deleted, err = parseEntries(entries, []string{"1-0", "2-0", "3-0", "4-0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if expected := []string{"3-0"}; !reflect.DeepEqual(deleted, expected) {
+		t.Errorf("Deleted entries do not match. got %v, expected %v", deleted, expected)
+	}
+}
@@ -0,0 +1,62 @@
+// Package queue distributes jobs among workers. A job is received by a single
+// consumer and stays pending until it is acknowledged; jobs left pending for
+// too long, e.g. by a crashed worker, can be reclaimed by other consumers.
+package queue
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Job is a job received from a queue.
+type Job struct {
+	ID   string
+	Data []byte
+	// Deliveries is the number of times the job was received, including
+	// this one.
+	Deliveries int
+}
+
+// Queue is implemented by queue drivers. They must be safe for concurrent use
+// by the consumers of a process and of other processes sharing the queue.
+type Queue interface {
+	// Push adds a job to the queue and returns its id.
+	Push(ctx context.Context, data []byte) (string, error)
+
+	// Receive receives at most count new jobs for a consumer, waiting at
+	// most wait for a job if there are none. The jobs are pending with the
+	// consumer until they are acknowledged.
+	Receive(ctx context.Context, consumer string, count int, wait time.Duration) ([]*Job, error)
+
+	// Ack acknowledges jobs, which removes them from the queue.
+	Ack(ctx context.Context, jobIDs ...string) error
+
+	// Reclaim moves at most count jobs pending for at least minIdle with any
+	// consumer to consumer and returns them.
+	Reclaim(ctx context.Context, consumer string, minIdle time.Duration, count int) ([]*Job, error)
+}
+
+type driverFactory func(options map[string]interface{}) (Queue, error)
+
+var drivers = make(map[string]driverFactory)
+
+func Register(driverType string, factory driverFactory) {
+	drivers[driverType] = factory
+}
+
+// Init initializes the queue driver registered as driverType with the given
+// options.
+func Init(driverType string, options map[string]interface{}) (Queue, error) {
+	factory, ok := drivers[driverType]
+	if !ok {
+		return nil, fmt.Errorf("queue: unknown driver %q", driverType)
+	}
+
+	q, err := factory(options)
+	if err != nil {
+		return nil, fmt.Errorf("queue:%s: %s", driverType, err)
+	}
+
+	return q, nil
+}
@@ -0,0 +1,182 @@
+// Package queuetest provides a conformance test suite for queue drivers.
+//
+// A driver runs the suite from its own tests:
+//
+//	func TestConformance(t *testing.T) {
+//		queuetest.Run(t, func(t *testing.T) queue.Queue {
+//			return New()
+//		})
+//	}
+package queuetest
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/gamegos/scotty/queue"
+)
+
+// Factory returns an empty queue to run a single test against. It may skip
+// the test if the queue is not available.
+type Factory func(t *testing.T) queue.Queue
+
+var ctx = context.Background()
+
+// Run runs the full queue.Queue contract against the queues returned by
+// newQueue.
+func Run(t *testing.T, newQueue Factory) {
+	tests := []struct {
+		name string
+		fn   func(t *testing.T, q queue.Queue)
+	}{
+		{"PushReceiveAck", testPushReceiveAck},
+		{"ReceiveWait", testReceiveWait},
+		{"ReceiveCanceled", testReceiveCanceled},
+		{"Reclaim", testReclaim},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.fn(t, newQueue(t))
+		})
+	}
+}
+
+func testPushReceiveAck(t *testing.T, q queue.Queue) {
+	for _, data := range []string{"first", "second", "third"} {
+		if _, err := q.Push(ctx, []byte(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	jobs, err := q.Receive(ctx, "c1", 2, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(jobs) != 2 || string(jobs[0].Data) != "first" || string(jobs[1].Data) != "second" {
+		t.Fatalf("Received jobs do not match. got %+v", jobs)
+	}
+
+	if jobs[0].Deliveries != 1 || jobs[0].ID == "" {
+		t.Errorf("Expected a first delivery with an id, got %+v", jobs[0])
+	}
+
+	// a job is received by a single consumer.
+	others, err := q.Receive(ctx, "c2", 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(others) != 1 || string(others[0].Data) != "third" {
+		t.Errorf("Received jobs of another consumer do not match. got %+v", others)
+	}
+
+	if err := q.Ack(ctx, jobs[0].ID, jobs[1].ID, others[0].ID); err != nil {
+		t.Fatal(err)
+	}
+
+	jobs, err = q.Receive(ctx, "c1", 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(jobs) != 0 {
+		t.Errorf("Expected no jobs left, got %+v", jobs)
+	}
+
+	jobs, err = q.Reclaim(ctx, "c1", 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(jobs) != 0 {
+		t.Errorf("Expected no pending jobs after ack, got %+v", jobs)
+	}
+}
+
+func testReceiveWait(t *testing.T, q queue.Queue) {
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		q.Push(ctx, []byte("late"))
+	}()
+
+	jobs, err := q.Receive(ctx, "c1", 1, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(jobs) != 1 || string(jobs[0].Data) != "late" {
+		t.Errorf("Expected to wait for a pushed job, got %+v", jobs)
+	}
+}
+
+func testReceiveCanceled(t *testing.T, q queue.Queue) {
+	canceledCtx, cancel := context.WithCancel(ctx)
+	cancel()
+
+	if _, err := q.Receive(canceledCtx, "c1", 1, time.Second); err != context.Canceled {
+		t.Errorf("Expected context.Canceled, got %v", err)
+	}
+}
+
+func testReclaim(t *testing.T, q queue.Queue) {
+	if _, err := q.Push(ctx, []byte("stuck")); err != nil {
+		t.Fatal(err)
+	}
+
+	jobs, err := q.Receive(ctx, "crashed", 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(jobs) != 1 {
+		t.Fatalf("Expected a job, got %+v", jobs)
+	}
+
+	reclaimed, err := q.Reclaim(ctx, "c2", time.Hour, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(reclaimed) != 0 {
+		t.Errorf("Expected no jobs idle for an hour, got %+v", reclaimed)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+
+	reclaimed, err = q.Reclaim(ctx, "c2", 20*time.Millisecond, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(reclaimed) != 1 || reclaimed[0].ID != jobs[0].ID || string(reclaimed[0].Data) != "stuck" || reclaimed[0].Deliveries != 2 {
+		t.Fatalf("Reclaimed jobs do not match. got %+v", reclaimed)
+	}
+
+	// a reclaimed job is idle again only after minIdle.
+	reclaimed, err = q.Reclaim(ctx, "c3", 20*time.Millisecond, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(reclaimed) != 0 {
+		t.Errorf("Expected a just reclaimed job not to be idle, got %+v", reclaimed)
+	}
+
+	if err := q.Ack(ctx, jobs[0].ID); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+
+	reclaimed, err = q.Reclaim(ctx, "c3", 20*time.Millisecond, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(reclaimed) != 0 {
+		t.Errorf("Expected no pending jobs after ack, got %+v", reclaimed)
+	}
+}
@@ -1,7 +1,19 @@
 package context
 
-import "github.com/gamegos/scotty/storage"
+import (
+	"time"
+
+	"github.com/gamegos/scotty/delivery"
+	"github.com/gamegos/scotty/queue"
+	"github.com/gamegos/scotty/storage"
+)
 
 type Context struct {
 	Storage storage.Storage
+	// Queue is the queue batches of publish requests are sent through, nil
+	// if they are sent with Delivery while handling the request.
+	Queue    queue.Queue
+	Delivery *delivery.Deliverer
+	// DeadLetterTTL is the time failed deliveries are kept.
+	DeadLetterTTL time.Duration
 }
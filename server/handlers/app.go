@@ -2,6 +2,7 @@ package handlers
 
 import (
 	"encoding/json"
+	"errors"
 	"net/http"
 	"time"
 
@@ -13,9 +14,37 @@ import (
 
 // addDeviceRequest holds the structure of new device request.
 type addDeviceRequest struct {
-	SubscriberID string `json:"subscriberId"`
-	Platform     string `json:"platform"`
-	Token        string `json:"token"`
+	SubscriberID string            `json:"subscriberId"`
+	Platform     string            `json:"platform"`
+	Token        string            `json:"token"`
+	AppVersion   string            `json:"appVersion"`
+	OSVersion    string            `json:"osVersion"`
+	Locale       string            `json:"locale"`
+	Timezone     string            `json:"timezone"`
+	Model        string            `json:"model"`
+	Tags         map[string]string `json:"tags"`
+}
+
+// deviceOwnerResponse holds the owner of a device token.
+type deviceOwnerResponse struct {
+	SubscriberID string          `json:"subscriberId"`
+	Device       *storage.Device `json:"device"`
+}
+
+// validateCategories checks that the categories of an app have unique ids.
+func validateCategories(categories []storage.Category) error {
+	seen := make(map[string]struct{}, len(categories))
+	for _, category := range categories {
+		if category.ID == "" {
+			return errors.New("Category id is required.")
+		}
+
+		if _, ok := seen[category.ID]; ok {
+			return errors.New("Duplicate category: " + category.ID)
+		}
+		seen[category.ID] = struct{}{}
+	}
+	return nil
 }
 
 func CreateApp(jw jsend.JResponseWriter, r *http.Request, ctx *context.Context) {
@@ -28,10 +57,15 @@ func CreateApp(jw jsend.JResponseWriter, r *http.Request, ctx *context.Context)
 		return
 	}
 
-	err := ctx.Storage.PutApp(app)
+	if err := validateCategories(app.Categories); err != nil {
+		jw.Status(400).Message(err.Error()).Send()
+		return
+	}
+
+	err := ctx.Storage.PutApp(r.Context(), app)
 
 	if err != nil {
-		jw.Status(500).Message(err.Error()).Send()
+		writeStorageError(jw, err, "App not found.")
 		return
 	}
 
@@ -42,12 +76,8 @@ func UpdateApp(jw jsend.JResponseWriter, r *http.Request, ctx *context.Context)
 	vars := mux.Vars(r)
 	appID := vars["appId"]
 
-	if app, err := ctx.Storage.GetApp(appID); app == nil {
-		if err != nil {
-			jw.Status(500).Message(err.Error())
-		} else {
-			jw.Status(404).Message("App not found.")
-		}
+	if _, err := ctx.Storage.GetApp(r.Context(), appID); err != nil {
+		writeStorageError(jw, err, "App not found.")
 		return
 	}
 
@@ -59,15 +89,20 @@ func UpdateApp(jw jsend.JResponseWriter, r *http.Request, ctx *context.Context)
 		return
 	}
 
+	if err := validateCategories(app.Categories); err != nil {
+		jw.Status(400).Message(err.Error()).Send()
+		return
+	}
+
 	if appID != app.ID {
 		jw.Status(400).Message("AppID mismatch").Send()
 		return
 	}
 
-	err := ctx.Storage.PutApp(app)
+	err := ctx.Storage.PutApp(r.Context(), app)
 
 	if err != nil {
-		jw.Status(500).Message(err.Error()).Send()
+		writeStorageError(jw, err, "App not found.")
 		return
 	}
 
@@ -78,15 +113,10 @@ func GetApp(jw jsend.JResponseWriter, r *http.Request, ctx *context.Context) {
 	vars := mux.Vars(r)
 	appID := vars["appId"]
 
-	app, err := ctx.Storage.GetApp(appID)
+	app, err := ctx.Storage.GetApp(r.Context(), appID)
 
 	if err != nil {
-		jw.Status(500).Message(err.Error())
-		return
-	}
-
-	if app == nil {
-		jw.Status(404).Message("App not found.")
+		writeStorageError(jw, err, "App not found.")
 		return
 	}
 
@@ -106,26 +136,67 @@ func AddDevice(jw jsend.JResponseWriter, r *http.Request, ctx *context.Context)
 		return
 	}
 
-	if app, err := ctx.Storage.GetApp(appID); app == nil {
-		if err != nil {
-			jw.Status(500).Message(err.Error())
-		} else {
-			jw.Status(404).Message("App not found.")
-		}
+	if postData.SubscriberID == "" || postData.Token == "" {
+		jw.Status(400).Message("subscriberId and token are required.").Send()
 		return
 	}
 
+	if _, err := ctx.Storage.GetApp(r.Context(), appID); err != nil {
+		writeStorageError(jw, err, "App not found.")
+		return
+	}
+
+	now := int(time.Now().Unix())
 	device := storage.Device{
-		Platform:  postData.Platform,
-		Token:     postData.Token,
-		CreatedAt: int(time.Now().Unix()),
+		Platform:   postData.Platform,
+		Token:      postData.Token,
+		CreatedAt:  now,
+		AppVersion: postData.AppVersion,
+		OSVersion:  postData.OSVersion,
+		Locale:     postData.Locale,
+		Timezone:   postData.Timezone,
+		Model:      postData.Model,
+		Tags:       postData.Tags,
+		LastSeen:   now,
+	}
+
+	// a re-registered device keeps its creation time, metadata is replaced.
+	_, existing, err := ctx.Storage.GetDeviceOwner(r.Context(), appID, postData.Token)
+	if err == nil {
+		device.CreatedAt = existing.CreatedAt
+	} else if err != storage.ErrNotFound {
+		writeStorageError(jw, err, "App not found.")
+		return
 	}
-	err := ctx.Storage.AddSubscriberDevice(appID, postData.SubscriberID, &device)
+
+	err = ctx.Storage.AddSubscriberDevice(r.Context(), appID, postData.SubscriberID, &device)
 
 	if err != nil {
-		jw.Status(500).Message(err.Error()).Send()
+		writeStorageError(jw, err, "App not found.")
 		return
 	}
 
 	jw.Status(201).Send()
 }
+
+func GetDevice(jw jsend.JResponseWriter, r *http.Request, ctx *context.Context) {
+	vars := mux.Vars(r)
+	appID := vars["appId"]
+	token := vars["token"]
+
+	if _, err := ctx.Storage.GetApp(r.Context(), appID); err != nil {
+		writeStorageError(jw, err, "App not found.")
+		return
+	}
+
+	subscriberID, device, err := ctx.Storage.GetDeviceOwner(r.Context(), appID, token)
+	if err != nil {
+		writeStorageError(jw, err, "Device not found.")
+		return
+	}
+
+	jw.Data(&deviceOwnerResponse{
+		SubscriberID: subscriberID,
+		Device:       device,
+	})
+}
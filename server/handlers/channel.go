@@ -28,19 +28,15 @@ func AddSubscriber(jw jsend.JResponseWriter, r *http.Request, ctx *context.Conte
 		return
 	}
 
-	if app, err := ctx.Storage.GetApp(appID); app == nil {
-		if err != nil {
-			jw.Status(500).Message(err.Error())
-		} else {
-			jw.Status(404).Message("App not found.")
-		}
+	if _, err := ctx.Storage.GetApp(r.Context(), appID); err != nil {
+		writeStorageError(jw, err, "App not found.")
 		return
 	}
 
-	err := ctx.Storage.AddSubscriber(appID, channelID, f.SubscriberIds)
+	err := ctx.Storage.AddSubscriber(r.Context(), appID, channelID, f.SubscriberIds)
 
 	if err != nil {
-		jw.Status(500).Message(err.Error()).Send()
+		writeStorageError(jw, err, "Channel not found.")
 		return
 	}
 
@@ -62,19 +58,15 @@ func AddChannel(jw jsend.JResponseWriter, r *http.Request, ctx *context.Context)
 
 	m := f.(map[string]interface{})
 
-	if app, err := ctx.Storage.GetApp(appID); app == nil {
-		if err != nil {
-			jw.Status(500).Message(err.Error())
-		} else {
-			jw.Status(404).Message("App not found.")
-		}
+	if _, err := ctx.Storage.GetApp(r.Context(), appID); err != nil {
+		writeStorageError(jw, err, "App not found.")
 		return
 	}
 
-	err := ctx.Storage.AddChannel(appID, m["id"].(string))
+	err := ctx.Storage.AddChannel(r.Context(), appID, m["id"].(string))
 
 	if err != nil {
-		jw.Status(500).Message(err.Error()).Send()
+		writeStorageError(jw, err, "Channel not found.")
 		return
 	}
 
@@ -86,10 +78,10 @@ func DeleteChannel(jw jsend.JResponseWriter, r *http.Request, ctx *context.Conte
 	appID := vars["appId"]
 	channelID := vars["channelId"]
 
-	err := ctx.Storage.DeleteChannel(appID, channelID)
+	err := ctx.Storage.DeleteChannel(r.Context(), appID, channelID)
 
 	if err != nil {
-		jw.Status(500).Message(err.Error()).Send()
+		writeStorageError(jw, err, "Channel not found.")
 		return
 	}
 
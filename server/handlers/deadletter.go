@@ -0,0 +1,435 @@
+package handlers
+
+import (
+	gocontext "context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gamegos/gcmlib"
+	"github.com/gamegos/jsend"
+	"github.com/gamegos/scotty/delivery"
+	"github.com/gamegos/scotty/message"
+	"github.com/gamegos/scotty/server/context"
+	"github.com/gamegos/scotty/storage"
+	"github.com/gamegos/scotty/worker"
+	"github.com/gorilla/mux"
+)
+
+// defaultDeadLettersPageSize and maxDeadLettersPageSize limit the count of
+// dead letter list requests.
+const (
+	defaultDeadLettersPageSize = 100
+	maxDeadLettersPageSize     = 1000
+)
+
+// deadLettersPageResponse holds a page of dead letters and the cursor of the
+// next page, which is empty on the last page.
+type deadLettersPageResponse struct {
+	DeadLetters []*storage.DeadLetter `json:"deadLetters"`
+	Cursor      string                `json:"cursor"`
+}
+
+// purgeResult is the result of a purge request.
+type purgeResult struct {
+	Deleted int `json:"deleted"`
+}
+
+// replayRequest selects the dead letters to replay: the ones in IDs, or all
+// of the app if IDs is empty, narrowed to a transaction by TransactionID.
+// Message replaces the messages of the dead letters if it is set.
+type replayRequest struct {
+	IDs           []string         `json:"ids"`
+	TransactionID string           `json:"transactionId"`
+	Message       *message.Message `json:"message"`
+}
+
+// replayResult is the result of a replay request.
+type replayResult struct {
+	// Replayed is the number of dead letters sent. Delivered ones are
+	// deleted; the ones that failed again are kept with their new error,
+	// unless their tokens turned out to be invalid.
+	Replayed  int `json:"replayed"`
+	Delivered int `json:"delivered"`
+	Failed    int `json:"failed"`
+}
+
+// eachDeadLetter calls fn with every dead letter of an app, or of a
+// transaction if transactionID is not empty.
+func eachDeadLetter(ctx gocontext.Context, stg storage.Storage, appID string, transactionID string, fn func(letter *storage.DeadLetter) error) error {
+	cursor := ""
+	for {
+		letters, next, err := stg.ScanDeadLetters(ctx, appID, cursor, defaultDeadLettersPageSize)
+		if err != nil {
+			return err
+		}
+
+		for _, letter := range letters {
+			if transactionID != "" && letter.TransactionID != transactionID {
+				continue
+			}
+
+			if err := fn(letter); err != nil {
+				return err
+			}
+		}
+
+		if next == "" {
+			return nil
+		}
+		cursor = next
+	}
+}
+
+func GetDeadLetters(jw jsend.JResponseWriter, r *http.Request, ctx *context.Context) {
+	vars := mux.Vars(r)
+	appID := vars["appId"]
+	query := r.URL.Query()
+
+	count := defaultDeadLettersPageSize
+	if value := query.Get("count"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 || n > maxDeadLettersPageSize {
+			jw.Status(400).Message("count must be between 1 and " + strconv.Itoa(maxDeadLettersPageSize) + ".").Send()
+			return
+		}
+		count = n
+	}
+
+	if _, err := ctx.Storage.GetApp(r.Context(), appID); err != nil {
+		writeStorageError(jw, err, "App not found.")
+		return
+	}
+
+	letters, next, err := ctx.Storage.ScanDeadLetters(r.Context(), appID, query.Get("cursor"), count)
+	if err != nil {
+		writeStorageError(jw, err, "App not found.")
+		return
+	}
+
+	response := &deadLettersPageResponse{
+		DeadLetters: []*storage.DeadLetter{},
+		Cursor:      next,
+	}
+
+	transactionID := query.Get("transactionId")
+	for _, letter := range letters {
+		if transactionID == "" || letter.TransactionID == transactionID {
+			response.DeadLetters = append(response.DeadLetters, letter)
+		}
+	}
+
+	jw.Data(response)
+}
+
+func GetDeadLetter(jw jsend.JResponseWriter, r *http.Request, ctx *context.Context) {
+	vars := mux.Vars(r)
+
+	letter, err := ctx.Storage.GetDeadLetter(r.Context(), vars["appId"], vars["letterId"])
+	if err != nil {
+		writeStorageError(jw, err, "Dead letter not found.")
+		return
+	}
+
+	jw.Data(letter)
+}
+
+func DeleteDeadLetter(jw jsend.JResponseWriter, r *http.Request, ctx *context.Context) {
+	vars := mux.Vars(r)
+
+	deleted, err := ctx.Storage.DeleteDeadLetters(r.Context(), vars["appId"], []string{vars["letterId"]})
+	if err != nil {
+		writeStorageError(jw, err, "Dead letter not found.")
+		return
+	}
+
+	if deleted == 0 {
+		jw.Status(404).Message("Dead letter not found.").Send()
+		return
+	}
+
+	jw.Status(200).Send()
+}
+
+func PurgeDeadLetters(jw jsend.JResponseWriter, r *http.Request, ctx *context.Context) {
+	vars := mux.Vars(r)
+	appID := vars["appId"]
+
+	if _, err := ctx.Storage.GetApp(r.Context(), appID); err != nil {
+		writeStorageError(jw, err, "App not found.")
+		return
+	}
+
+	// dead letters are deleted after the scan, so none is skipped.
+	var letterIDs []string
+	err := eachDeadLetter(r.Context(), ctx.Storage, appID, r.URL.Query().Get("transactionId"), func(letter *storage.DeadLetter) error {
+		letterIDs = append(letterIDs, letter.ID)
+		return nil
+	})
+
+	if err != nil {
+		writeStorageError(jw, err, "App not found.")
+		return
+	}
+
+	result := &purgeResult{}
+	for len(letterIDs) > 0 {
+		n := len(letterIDs)
+		if n > maxDeadLettersPageSize {
+			n = maxDeadLettersPageSize
+		}
+
+		deleted, err := ctx.Storage.DeleteDeadLetters(r.Context(), appID, letterIDs[:n])
+		if err != nil {
+			writeStorageError(jw, err, "App not found.")
+			return
+		}
+
+		result.Deleted += deleted
+		letterIDs = letterIDs[n:]
+	}
+
+	jw.Data(result)
+}
+
+func ReplayDeadLetters(jw jsend.JResponseWriter, r *http.Request, ctx *context.Context) {
+	vars := mux.Vars(r)
+
+	var req replayRequest
+
+	decoder := json.NewDecoder(r.Body)
+
+	if err := decoder.Decode(&req); err != nil && err != io.EOF {
+		jw.Status(400).Message(err.Error()).Send()
+		return
+	}
+
+	if req.Message != nil {
+		if err := req.Message.Validate(); err != nil {
+			jw.Status(400).Message("Invalid message: " + err.Error()).Send()
+			return
+		}
+
+		if err := req.Message.ValidatePlatform(message.PlatformGCM); err != nil {
+			jw.Status(400).Message("Invalid message: " + err.Error()).Send()
+			return
+		}
+	}
+
+	app, err := ctx.Storage.GetApp(r.Context(), vars["appId"])
+	if err != nil {
+		writeStorageError(jw, err, "App not found.")
+		return
+	}
+
+	// replays use the current credentials of the app.
+	replayer := &replayer{
+		ctx:       sendContext(r),
+		stg:       ctx.Storage,
+		deliverer: ctx.Delivery,
+		appID:     app.ID,
+		client:    delivery.NewGCMClient(app.GCM.APIKey),
+		message:   req.Message,
+	}
+
+	if len(req.IDs) > 0 {
+		err = replayer.addIDs(req.IDs, req.TransactionID)
+	} else {
+		err = eachDeadLetter(replayer.ctx, ctx.Storage, app.ID, req.TransactionID, replayer.add)
+	}
+
+	if err == nil {
+		err = replayer.flushAll()
+	}
+
+	// dead letters are deleted after the scan, so none is skipped.
+	if deleteErr := replayer.deleteReplayed(); err == nil {
+		err = deleteErr
+	}
+
+	if sendErr, ok := err.(*sendError); ok {
+		writeSendError(jw, sendErr, strconv.Itoa(replayer.result.Replayed)+" dead letters replayed")
+		return
+	}
+
+	if err != nil {
+		writeStorageError(jw, err, "Dead letter not found.")
+		return
+	}
+
+	jw.Data(&replayer.result)
+}
+
+// replayer sends dead letters to GCM in batches of gcmMaxRecipients dead
+// letters with the same message.
+type replayer struct {
+	ctx       gocontext.Context
+	stg       storage.Storage
+	deliverer *delivery.Deliverer
+	appID     string
+	client    delivery.GCMClient
+	// message replaces the messages of the dead letters if it is not nil.
+	message *message.Message
+	batches map[string]*replayBatch
+	// replayed are the ids of the dead letters to delete.
+	replayed []string
+	result   replayResult
+}
+
+// replayBatch is a GCM message and the dead letters collected for it.
+type replayBatch struct {
+	msg     *gcmlib.Message
+	letters []*storage.DeadLetter
+}
+
+// addIDs adds the dead letters with the given ids, which must belong to the
+// transaction if transactionID is not empty.
+func (rp *replayer) addIDs(letterIDs []string, transactionID string) error {
+	for _, letterID := range letterIDs {
+		letter, err := rp.stg.GetDeadLetter(rp.ctx, rp.appID, letterID)
+		if err != nil {
+			return err
+		}
+
+		if transactionID != "" && letter.TransactionID != transactionID {
+			return storage.ErrNotFound
+		}
+
+		if err := rp.add(letter); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// add adds a dead letter, sending its batch when it is full.
+func (rp *replayer) add(letter *storage.DeadLetter) error {
+	if rp.batches == nil {
+		rp.batches = make(map[string]*replayBatch)
+	}
+
+	if rp.message != nil {
+		letter.Message = rp.message
+	}
+
+	key, err := json.Marshal(letter.Message)
+	if err != nil {
+		return err
+	}
+
+	batch, ok := rp.batches[string(key)]
+	if !ok {
+		if len(rp.batches) == maxPendingBatches {
+			if err := rp.flushAll(); err != nil {
+				return err
+			}
+		}
+
+		gcmMsg, err := letter.Message.GCMMessage()
+		if err != nil {
+			return &sendError{err}
+		}
+
+		batch = &replayBatch{msg: gcmMsg}
+		rp.batches[string(key)] = batch
+	}
+
+	batch.letters = append(batch.letters, letter)
+
+	if len(batch.letters) == gcmMaxRecipients {
+		return rp.flush(batch)
+	}
+
+	return nil
+}
+
+// flushAll sends the dead letters of all batches.
+func (rp *replayer) flushAll() error {
+	for key, batch := range rp.batches {
+		if err := rp.flush(batch); err != nil {
+			return err
+		}
+		delete(rp.batches, key)
+	}
+
+	return nil
+}
+
+// flush sends the collected dead letters of a batch. Dead letters that fail
+// again are updated, the others are marked for deletion.
+func (rp *replayer) flush(batch *replayBatch) error {
+	letters := batch.letters
+	batch.letters = nil
+
+	if len(letters) == 0 {
+		return nil
+	}
+
+	msg := *batch.msg
+	msg.RegistrationIDs = make([]string, len(letters))
+	for i, letter := range letters {
+		msg.RegistrationIDs[i] = letter.Token
+	}
+
+	res, gcmErr := rp.deliverer.SendGCM(rp.ctx, rp.appID, rp.client, &msg)
+	failures := worker.Failures(res, gcmErr, len(letters))
+
+	now := int(time.Now().Unix())
+	var failed []*storage.DeadLetter
+
+	for i, letter := range letters {
+		rp.result.Replayed++
+
+		if failure, ok := failures[i]; ok {
+			letter.Error = failure
+			letter.Attempts++
+			letter.FailedAt = now
+			failed = append(failed, letter)
+			rp.result.Failed++
+			continue
+		}
+
+		rp.replayed = append(rp.replayed, letter.ID)
+
+		// results of invalid tokens are not failures worth keeping.
+		if len(res.Results) == len(letters) && res.Results[i].Error != "" {
+			rp.result.Failed++
+		} else {
+			rp.result.Delivered++
+		}
+	}
+
+	if len(failed) > 0 {
+		if err := rp.stg.PutDeadLetters(rp.ctx, rp.appID, failed); err != nil {
+			return err
+		}
+	}
+
+	if gcmErr != nil {
+		return &sendError{gcmErr}
+	}
+
+	return nil
+}
+
+// deleteReplayed deletes the dead letters that were delivered or will never
+// be.
+func (rp *replayer) deleteReplayed() error {
+	for len(rp.replayed) > 0 {
+		n := len(rp.replayed)
+		if n > maxDeadLettersPageSize {
+			n = maxDeadLettersPageSize
+		}
+
+		if _, err := rp.stg.DeleteDeadLetters(rp.ctx, rp.appID, rp.replayed[:n]); err != nil {
+			return err
+		}
+
+		rp.replayed = rp.replayed[n:]
+	}
+
+	return nil
+}
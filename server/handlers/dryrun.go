@@ -0,0 +1,165 @@
+package handlers
+
+import (
+	gocontext "context"
+
+	"github.com/gamegos/scotty/audience"
+	"github.com/gamegos/scotty/message"
+	"github.com/gamegos/scotty/storage"
+)
+
+// maxDryRunErrors is the number of different validation errors a dry run
+// reports for each platform.
+const maxDryRunErrors = 10
+
+// Reasons recipients of a dry run are suppressed.
+const (
+	suppressedOptOuts             = "optOuts"
+	suppressedRenderErrors        = "renderErrors"
+	suppressedUnsupportedPlatform = "unsupportedPlatform"
+)
+
+// dryRunReport describes what a publish would do, without sending anything.
+type dryRunReport struct {
+	// Subscribers is the number of subscribers having recipient devices and
+	// Devices is the number of those devices.
+	Subscribers int `json:"subscribers"`
+	Devices     int `json:"devices"`
+	// Platforms counts the recipient devices by the platform they would be
+	// sent with, Locales counts the devices the message would be sent to by
+	// the locale of their translation.
+	Platforms map[string]int `json:"platforms"`
+	Locales   map[string]int `json:"locales"`
+	// Suppressed counts the subscribers that opted out of the category or the
+	// channels of the publish, the devices the template could not be rendered
+	// for and the devices of platforms that can not be sent to yet.
+	Suppressed map[string]int `json:"suppressed"`
+	// Errors are the validation errors of the payloads by platform.
+	Errors map[string][]string `json:"errors"`
+}
+
+// dryRunPublish expands the audiences as publish does and reports the
+// recipients and the validation errors of the payloads they would be sent.
+func dryRunPublish(ctx gocontext.Context, stg storage.Storage, appID string, auds []*audience.Audience, msg *message.Message, vars *templateVariables) (*dryRunReport, error) {
+	report := &dryRunReport{
+		Platforms:  make(map[string]int),
+		Locales:    make(map[string]int),
+		Suppressed: make(map[string]int),
+		Errors:     make(map[string][]string),
+	}
+
+	// platforms and locales the message was validated for, if it is not
+	// rendered.
+	validated := make(map[string]struct{})
+
+	err := audience.ExpandUnion(ctx, stg, appID, auds, func(subscriberIDs []string, match audience.MatchFunc) error {
+		return stg.GetSubscribersDevices(ctx, appID, subscriberIDs, func(subscriberID string, devices []*storage.Device) error {
+			matched := 0
+
+			for _, device := range devices {
+				if !match(subscriberID, device) {
+					continue
+				}
+				matched++
+
+				platform := message.PlatformGCM
+				if device.Platform == message.PlatformAPNS {
+					platform = message.PlatformAPNS
+				}
+				report.Platforms[platform]++
+
+				deviceMsg, locale, err := deviceMessage(msg, vars, subscriberID, device)
+				if err != nil {
+					report.Suppressed[suppressedRenderErrors]++
+					report.addError(platform, err)
+					continue
+				}
+
+				// an invalid rendered message is not sent to its device. An
+				// invalid message that is not rendered is not sent at all,
+				// so it is validated once for each platform and locale.
+				key := platform + ":" + locale
+				if _, ok := validated[key]; !ok {
+					err := deviceMsg.ValidatePlatform(platform)
+					if err != nil {
+						report.addError(platform, err)
+					}
+
+					if vars == nil {
+						validated[key] = struct{}{}
+					} else if err != nil {
+						report.Suppressed[suppressedRenderErrors]++
+						continue
+					}
+				}
+
+				// there is no APNs provider yet.
+				if platform == message.PlatformAPNS {
+					report.Suppressed[suppressedUnsupportedPlatform]++
+					continue
+				}
+
+				report.Locales[locale]++
+			}
+
+			if matched > 0 {
+				report.Subscribers++
+				report.Devices += matched
+			}
+
+			return nil
+		})
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	// subscribers reached when preferences are ignored opted out.
+	candidates := make([]*audience.Audience, len(auds))
+	for i, aud := range auds {
+		candidate := *aud
+		candidate.IgnorePreferences = true
+		candidates[i] = &candidate
+	}
+
+	subscribers := 0
+	err = audience.ExpandUnion(ctx, stg, appID, candidates, func(subscriberIDs []string, match audience.MatchFunc) error {
+		return stg.GetSubscribersDevices(ctx, appID, subscriberIDs, func(subscriberID string, devices []*storage.Device) error {
+			for _, device := range devices {
+				if match(subscriberID, device) {
+					subscribers++
+					return nil
+				}
+			}
+			return nil
+		})
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	if subscribers > report.Subscribers {
+		report.Suppressed[suppressedOptOuts] = subscribers - report.Subscribers
+	}
+
+	return report, nil
+}
+
+// addError adds a validation error of a platform unless it was already added
+// or maxDryRunErrors were added.
+func (r *dryRunReport) addError(platform string, err error) {
+	errs := r.Errors[platform]
+	if len(errs) == maxDryRunErrors {
+		return
+	}
+
+	for _, e := range errs {
+		if e == err.Error() {
+			return
+		}
+	}
+
+	r.Errors[platform] = append(errs, err.Error())
+}
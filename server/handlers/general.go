@@ -1,16 +1,106 @@
 package handlers
 
 import (
+	gocontext "context"
 	"net/http"
+	"time"
 
 	"github.com/gamegos/jsend"
+	"github.com/gamegos/scotty/delivery"
 	"github.com/gamegos/scotty/server/context"
+	"github.com/gamegos/scotty/storage"
+	"github.com/gorilla/mux"
 )
 
+// healthResponse holds the health of the server. Status is "degraded" while
+// a circuit of an app is not closed, and Circuits are those circuits.
+type healthResponse struct {
+	Status   string              `json:"status"`
+	Circuits []*delivery.Circuit `json:"circuits"`
+}
+
+// statusResponse holds the delivery status of an app.
+type statusResponse struct {
+	Circuits []*delivery.Circuit `json:"circuits"`
+}
+
+// GetHealth reports the server healthy even if circuits are open, as they are
+// caused by providers or credentials of apps. Circuits are read from the
+// storage, where the processes delivering report them.
 func GetHealth(jw jsend.JResponseWriter, r *http.Request, ctx *context.Context) {
-	jw.Status(200).Data("ok")
+	circuits, err := ctx.Storage.GetCircuits(r.Context(), "")
+	if err != nil {
+		writeStorageError(jw, err, "")
+		return
+	}
+
+	response := &healthResponse{
+		Status:   "ok",
+		Circuits: []*delivery.Circuit{},
+	}
+
+	for _, circuit := range circuits {
+		if circuit.State != delivery.StateClosed {
+			response.Status = "degraded"
+			response.Circuits = append(response.Circuits, circuit)
+		}
+	}
+
+	jw.Status(200).Data(response)
+}
+
+func GetStatus(jw jsend.JResponseWriter, r *http.Request, ctx *context.Context) {
+	appID := mux.Vars(r)["appId"]
+
+	if _, err := ctx.Storage.GetApp(r.Context(), appID); err != nil {
+		writeStorageError(jw, err, "App not found.")
+		return
+	}
+
+	circuits, err := ctx.Storage.GetCircuits(r.Context(), appID)
+	if err != nil {
+		writeStorageError(jw, err, "")
+		return
+	}
+
+	jw.Data(&statusResponse{
+		Circuits: circuits,
+	})
 }
 
 func NotfoundHandler(jw jsend.JResponseWriter, r *http.Request, ctx *context.Context) {
 	jw.Status(404).Message("route not found")
 }
+
+// detachedContext carries the values of a request context without its
+// deadline and cancellation.
+type detachedContext struct {
+	gocontext.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}       { return nil }
+func (detachedContext) Err() error                  { return nil }
+
+// sendContext returns the context of the sends of a request. Sends are not
+// limited by the request timeout nor canceled if the client goes away, as a
+// publish stopped halfway would leave its recipients partly sent to.
+func sendContext(r *http.Request) gocontext.Context {
+	return detachedContext{r.Context()}
+}
+
+// writeStorageError writes the response for an error returned from the
+// storage. storage.ErrNotFound results in 404 with notFoundMessage, an expired
+// or canceled request context in 503 and other errors in 500.
+func writeStorageError(jw jsend.JResponseWriter, err error, notFoundMessage string) {
+	switch err {
+	case storage.ErrNotFound:
+		jw.Status(404).Message(notFoundMessage)
+	case gocontext.DeadlineExceeded:
+		jw.Status(503).Message("Request timed out.")
+	case gocontext.Canceled:
+		jw.Status(503).Message("Request canceled.")
+	default:
+		jw.Status(500).Message(err.Error())
+	}
+}
@@ -0,0 +1,78 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/gamegos/jsend"
+	"github.com/gamegos/scotty/server/context"
+	"github.com/gamegos/scotty/storage"
+	"github.com/gorilla/mux"
+)
+
+func GetPreferences(jw jsend.JResponseWriter, r *http.Request, ctx *context.Context) {
+	vars := mux.Vars(r)
+	appID := vars["appId"]
+	subscriberID := vars["subscriberId"]
+
+	if _, err := ctx.Storage.GetApp(r.Context(), appID); err != nil {
+		writeStorageError(jw, err, "App not found.")
+		return
+	}
+
+	prefs, err := ctx.Storage.GetPreferences(r.Context(), appID, subscriberID)
+	if err != nil {
+		writeStorageError(jw, err, "Subscriber not found.")
+		return
+	}
+
+	if prefs.Categories == nil {
+		prefs.Categories = map[string]bool{}
+	}
+
+	if prefs.Channels == nil {
+		prefs.Channels = map[string]bool{}
+	}
+
+	jw.Data(prefs)
+}
+
+func UpdatePreferences(jw jsend.JResponseWriter, r *http.Request, ctx *context.Context) {
+	vars := mux.Vars(r)
+	appID := vars["appId"]
+	subscriberID := vars["subscriberId"]
+
+	var prefs *storage.Preferences
+
+	decoder := json.NewDecoder(r.Body)
+
+	if err := decoder.Decode(&prefs); err != nil {
+		jw.Status(400).Message(err.Error()).Send()
+		return
+	}
+
+	if prefs == nil {
+		jw.Status(400).Message("Preferences are required.").Send()
+		return
+	}
+
+	app, err := ctx.Storage.GetApp(r.Context(), appID)
+	if err != nil {
+		writeStorageError(jw, err, "App not found.")
+		return
+	}
+
+	for categoryID := range prefs.Categories {
+		if _, ok := app.Category(categoryID); !ok {
+			jw.Status(400).Message("Unknown category: " + categoryID).Send()
+			return
+		}
+	}
+
+	if err := ctx.Storage.PutPreferences(r.Context(), appID, subscriberID, prefs); err != nil {
+		writeStorageError(jw, err, "App not found.")
+		return
+	}
+
+	jw.Status(200).Send()
+}
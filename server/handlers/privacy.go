@@ -0,0 +1,96 @@
+package handlers
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+
+	"github.com/gamegos/jsend"
+	"github.com/gamegos/scotty/privacy"
+	"github.com/gamegos/scotty/server/context"
+	"github.com/gamegos/scotty/storage"
+	"github.com/gorilla/mux"
+)
+
+// eraseRequest is the optional body of an erasure request.
+type eraseRequest struct {
+	Reason string `json:"reason"`
+}
+
+func ExportSubscriber(jw jsend.JResponseWriter, r *http.Request, ctx *context.Context) {
+	vars := mux.Vars(r)
+	appID := vars["appId"]
+	subscriberID := vars["subscriberId"]
+
+	if _, err := ctx.Storage.GetApp(r.Context(), appID); err != nil {
+		writeStorageError(jw, err, "App not found.")
+		return
+	}
+
+	export, err := privacy.ExportSubscriber(r.Context(), ctx.Storage, appID, subscriberID)
+	if err != nil {
+		writeStorageError(jw, err, "Subscriber not found.")
+		return
+	}
+
+	jw.Data(export)
+}
+
+func EraseSubscriber(jw jsend.JResponseWriter, r *http.Request, ctx *context.Context) {
+	vars := mux.Vars(r)
+	appID := vars["appId"]
+	subscriberID := vars["subscriberId"]
+
+	var req eraseRequest
+
+	decoder := json.NewDecoder(r.Body)
+
+	if err := decoder.Decode(&req); err != nil && err != io.EOF {
+		jw.Status(400).Message(err.Error()).Send()
+		return
+	}
+
+	if _, err := ctx.Storage.GetApp(r.Context(), appID); err != nil {
+		writeStorageError(jw, err, "App not found.")
+		return
+	}
+
+	tombstone, err := privacy.EraseSubscriber(r.Context(), ctx.Storage, appID, subscriberID, req.Reason)
+	if err != nil {
+		writeStorageError(jw, err, "Subscriber not found.")
+		return
+	}
+
+	jw.Data(tombstone)
+}
+
+func GetTombstones(jw jsend.JResponseWriter, r *http.Request, ctx *context.Context) {
+	vars := mux.Vars(r)
+	appID := vars["appId"]
+
+	if _, err := ctx.Storage.GetApp(r.Context(), appID); err != nil {
+		writeStorageError(jw, err, "App not found.")
+		return
+	}
+
+	tombstones, err := ctx.Storage.GetTombstones(r.Context(), appID)
+	if err != nil {
+		writeStorageError(jw, err, "App not found.")
+		return
+	}
+
+	result := []*storage.Tombstone{}
+
+	if subscriberID := r.URL.Query().Get("subscriberId"); subscriberID != "" {
+		hash := privacy.HashSubscriberID(subscriberID)
+		for _, tombstone := range tombstones {
+			if tombstone.SubscriberHash == hash {
+				result = append(result, tombstone)
+			}
+		}
+	} else if tombstones != nil {
+		result = tombstones
+	}
+
+	jw.Data(result)
+}
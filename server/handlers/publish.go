@@ -1,30 +1,121 @@
 package handlers
 
 import (
+	gocontext "context"
 	"encoding/json"
 	"log"
 	"net/http"
+	"strconv"
+	"sync"
+	"time"
 
 	"github.com/gamegos/gcmlib"
 	"github.com/gamegos/jsend"
+	"github.com/gamegos/scotty/audience"
+	"github.com/gamegos/scotty/delivery"
+	"github.com/gamegos/scotty/message"
+	"github.com/gamegos/scotty/queue"
 	"github.com/gamegos/scotty/server/context"
+	"github.com/gamegos/scotty/storage"
+	"github.com/gamegos/scotty/worker"
 	"github.com/gorilla/mux"
 )
 
+// gcmMaxRecipients is the maximum number of registration ids GCM accepts in a
+// single request.
+const gcmMaxRecipients = 1000
+
+// maxPendingBatches is the number of batches with different rendered messages
+// a publish worker collects before sending them, so messages rendered for
+// every recipient are not all held in memory.
+const maxPendingBatches = 100
+
+// publishWorkers is the number of workers resolving devices and sending
+// messages of a single publish request.
+const publishWorkers = 4
+
 // publishRequest represents http body of "publish" requests.
 type publishRequest struct {
-	Subscribers []string `json:"subscribers"`
-	Channels    []string `json:"channels"`
-	Message     *gcmlib.Message
+	Subscribers       []string         `json:"subscribers"`
+	Channels          []string         `json:"channels"`
+	Segments          []string         `json:"segments"`
+	IntersectChannels []string         `json:"intersectChannels"`
+	ExceptChannels    []string         `json:"exceptChannels"`
+	ExceptSubscribers []string         `json:"exceptSubscribers"`
+	Filter            string           `json:"filter"`
+	Category          string           `json:"category"`
+	Message           *message.Message `json:"message"`
+	// TemplateID is a template sent instead of Message. Variables are shared
+	// by all recipients and RecipientVariables are set per subscriber.
+	TemplateID         string                       `json:"templateId"`
+	Variables          map[string]string            `json:"variables"`
+	RecipientVariables map[string]map[string]string `json:"recipientVariables"`
+}
+
+// publishResult is the result of a publish request.
+type publishResult struct {
+	// TransactionID identifies the publish in its dead letters.
+	TransactionID string `json:"transactionId"`
+	// Responses are the responses of GCM to the batches sent.
+	Responses []*gcmlib.Response `json:"responses"`
+	// Devices is the number of devices the message was sent to and Locales
+	// counts them by the locale of the translation they were sent.
+	Devices int            `json:"devices"`
+	Locales map[string]int `json:"locales"`
+	// Skipped is the number of devices skipped because the template could
+	// not be rendered for them, e.g. for a variable that is not set, or
+	// because there is no provider for their platform yet, as for APNs.
+	Skipped int `json:"skipped"`
+	// DeadLetters is the number of devices the message could not be
+	// delivered to, recorded as dead letters.
+	DeadLetters int `json:"deadLetters"`
+	// Jobs is the number of batches added to the queue of the workers if
+	// there is one. Batches are sent by the workers then, so there are no
+	// responses and failed deliveries are recorded by the workers.
+	Jobs int `json:"jobs"`
+}
+
+// merge adds the counts and responses of other to the result.
+func (r *publishResult) merge(other *publishResult) {
+	r.Responses = append(r.Responses, other.Responses...)
+	r.Devices += other.Devices
+	r.Skipped += other.Skipped
+	r.DeadLetters += other.DeadLetters
+	r.Jobs += other.Jobs
+
+	for locale, n := range other.Locales {
+		if r.Locales == nil {
+			r.Locales = make(map[string]int)
+		}
+		r.Locales[locale] += n
+	}
+}
+
+// renderError is an error rendering the message of a device, which is skipped.
+type renderError struct {
+	err error
+}
+
+func (e *renderError) Error() string {
+	return e.err.Error()
+}
+
+// sendError is an error returned from GCM while sending a batch.
+type sendError struct {
+	err error
+}
+
+func (e *sendError) Error() string {
+	return e.err.Error()
 }
 
 func PublishMessage(jw jsend.JResponseWriter, r *http.Request, ctx *context.Context) {
 	vars := mux.Vars(r)
 
-	app, err := ctx.Storage.GetApp(vars["appId"])
-	if app == nil {
-		log.Println("App not found:", app, err)
-		jw.Status(404).Message("App not found").Send()
+	app, err := ctx.Storage.GetApp(r.Context(), vars["appId"])
+	if err != nil {
+		log.Println("Could not get app, ", err)
+		writeStorageError(jw, err, "App not found")
 		return
 	}
 
@@ -37,41 +128,527 @@ func PublishMessage(jw jsend.JResponseWriter, r *http.Request, ctx *context.Cont
 		return
 	}
 
-	deviceTokens := make([]string, 0, len(publishReq.Subscribers))
+	dryRun := false
+	if value := r.URL.Query().Get("dryRun"); value != "" {
+		if dryRun, err = strconv.ParseBool(value); err != nil {
+			jw.Status(400).Message("dryRun must be true or false.").Send()
+			return
+		}
+	}
+
+	msg, variables, ok := publishMessage(jw, r, ctx, app.ID, publishReq)
+	if !ok {
+		return
+	}
+
+	auds, ok := publishAudiences(jw, r, ctx, app, publishReq)
+	if !ok {
+		return
+	}
 
-	for _, subscriberID := range publishReq.Subscribers {
-		log.Println(subscriberID)
-		subscriberDevices, err := ctx.Storage.GetSubscriberDevices(app.ID, subscriberID)
+	if dryRun {
+		report, err := dryRunPublish(r.Context(), ctx.Storage, app.ID, auds, msg, variables)
 		if err != nil {
-			log.Println("Error, ", err)
+			log.Println("Could not expand recipients, ", err)
+			writeStorageError(jw, err, "App not found")
+			return
 		}
 
-		for _, device := range subscriberDevices {
-			deviceTokens = append(deviceTokens, device.Token)
+		jw.Data(report).Send()
+		return
+	}
+
+	// rendered messages are validated for each device.
+	if variables == nil {
+		if err := msg.ValidatePlatform(message.PlatformGCM); err != nil {
+			jw.Status(400).Message("Invalid message: " + err.Error()).Send()
+			return
 		}
+	}
 
-		log.Printf("Devices %#v\n", deviceTokens)
+	transactionID, err := worker.NewID()
+	if err != nil {
+		jw.Status(500).Message(err.Error()).Send()
+		return
 	}
 
-	client := gcmlib.NewClient(gcmlib.Config{
-		APIKey: app.GCM.APIKey,
-	})
+	client := delivery.NewGCMClient(app.GCM.APIKey)
 
-	msg := publishReq.Message
-	msg.RegistrationIDs = deviceTokens
+	result, err := publish(sendContext(r), ctx, app.ID, transactionID, auds, client, msg, variables)
 
-	if err := msg.Validate(); err != nil {
-		jw.Status(400).Message(err.Error()).Send()
+	if sendErr, ok := err.(*sendError); ok {
+		writeSendError(jw, sendErr, "transaction "+transactionID)
 		return
 	}
 
-	result, gcmErr := client.Send(msg)
-	log.Printf("GCM Request: %#v, %#v\n", result, err)
+	if err != nil {
+		log.Println("Could not expand recipients, ", err)
+		writeStorageError(jw, err, "App not found")
+		return
+	}
 
-	if gcmErr != nil {
-		jw.Status(400).Message(gcmErr.Error()).Send()
+	if result.Devices == 0 {
+		jw.Status(400).Message("No devices found for the recipients.").Send()
+		return
+	}
+
+	// batches added to the queue are yet to be sent.
+	if ctx.Queue != nil {
+		jw.Status(202).Data(result).Send()
 		return
 	}
 
 	jw.Data(result).Send()
 }
+
+// writeSendError writes the response of a batch that could not be sent. The
+// status is 503 if retries of a temporary failure ran out, 400 otherwise.
+// detail is appended to the message.
+func writeSendError(jw jsend.JResponseWriter, sendErr *sendError, detail string) {
+	text := sendErr.Error() + " (" + detail + ")"
+
+	if deliveryErr, ok := sendErr.err.(*delivery.Error); ok && deliveryErr.Retryable {
+		jw.Status(503).Message(text).Send()
+		return
+	}
+
+	jw.Status(400).Message(text).Send()
+}
+
+// publishMessage returns the message of a publish request: its message or its
+// template. vars are the variables to render the template with, nil if the
+// message has none. It writes the error response and returns false if the
+// request is invalid.
+func publishMessage(jw jsend.JResponseWriter, r *http.Request, ctx *context.Context, appID string, publishReq *publishRequest) (*message.Message, *templateVariables, bool) {
+	msg := publishReq.Message
+
+	if publishReq.TemplateID != "" {
+		if msg != nil {
+			jw.Status(400).Message("Only one of message and templateId is allowed.").Send()
+			return nil, nil, false
+		}
+
+		template, err := ctx.Storage.GetTemplate(r.Context(), appID, publishReq.TemplateID)
+		if err != nil {
+			writeStorageError(jw, err, "Template not found: "+publishReq.TemplateID)
+			return nil, nil, false
+		}
+		msg = template.Message
+	}
+
+	if msg == nil {
+		jw.Status(400).Message("Message is required.").Send()
+		return nil, nil, false
+	}
+
+	if err := msg.Validate(); err != nil {
+		jw.Status(400).Message("Invalid message: " + err.Error()).Send()
+		return nil, nil, false
+	}
+
+	if publishReq.TemplateID == "" {
+		return msg, nil, true
+	}
+
+	names, err := msg.Variables()
+	if err != nil {
+		jw.Status(400).Message("Invalid message: " + err.Error()).Send()
+		return nil, nil, false
+	}
+
+	if len(names) == 0 {
+		return msg, nil, true
+	}
+
+	return msg, &templateVariables{
+		shared:     publishReq.Variables,
+		recipients: publishReq.RecipientVariables,
+	}, true
+}
+
+// publishAudiences builds the audiences of a publish request: one for its
+// subscribers and channels and one for each of its segments. Intersected and
+// excluded channels, excluded subscribers, the filter and the category of the
+// request apply to all of them. It writes the error response and returns false if the
+// request is invalid.
+func publishAudiences(jw jsend.JResponseWriter, r *http.Request, ctx *context.Context, app *storage.App, publishReq *publishRequest) ([]*audience.Audience, bool) {
+	appID := app.ID
+
+	restriction := &audience.Audience{
+		IntersectChannels: publishReq.IntersectChannels,
+		ExceptChannels:    publishReq.ExceptChannels,
+		ExceptSubscribers: publishReq.ExceptSubscribers,
+	}
+
+	if publishReq.Filter != "" {
+		var err error
+		if restriction.Filter, err = audience.ParseFilter(publishReq.Filter); err != nil {
+			jw.Status(400).Message("Invalid filter: " + err.Error()).Send()
+			return nil, false
+		}
+	}
+
+	if publishReq.Category != "" {
+		category, ok := app.Category(publishReq.Category)
+		if !ok {
+			jw.Status(400).Message("Unknown category: " + publishReq.Category).Send()
+			return nil, false
+		}
+		restriction.Category = category
+	}
+
+	var auds []*audience.Audience
+
+	if len(publishReq.Subscribers) > 0 || len(publishReq.Channels) > 0 {
+		auds = append(auds, &audience.Audience{
+			Subscribers: publishReq.Subscribers,
+			Channels:    publishReq.Channels,
+		})
+	}
+
+	for _, segmentID := range publishReq.Segments {
+		segment, err := ctx.Storage.GetSegment(r.Context(), appID, segmentID)
+		if err != nil {
+			writeStorageError(jw, err, "Segment not found: "+segmentID)
+			return nil, false
+		}
+
+		aud, err := audience.FromSegment(segment)
+		if err != nil {
+			jw.Status(500).Message("Invalid segment " + segmentID + ": " + err.Error()).Send()
+			return nil, false
+		}
+
+		auds = append(auds, aud)
+	}
+
+	// intersected channels or a filter alone define the audience.
+	if len(auds) == 0 {
+		auds = append(auds, &audience.Audience{})
+	}
+
+	for _, aud := range auds {
+		aud.Restrict(restriction)
+
+		if err := aud.ResolveAliases(r.Context(), ctx.Storage, appID); err != nil {
+			writeStorageError(jw, err, "App not found.")
+			return nil, false
+		}
+	}
+
+	return auds, true
+}
+
+// publishPage is a page of subscribers to publish to and the function
+// selecting their recipient devices.
+type publishPage struct {
+	subscriberIDs []string
+	match         audience.MatchFunc
+}
+
+// publish expands the audience and sends the message to its devices. Pages of
+// subscribers are consumed by publishWorkers workers while the audience is
+// being expanded, so the whole audience is never held in memory. The message
+// is localized for each device, and rendered if vars is not nil. Deliveries
+// that fail are recorded as dead letters of the transaction. Batches are
+// added to the queue of env instead of being sent if it has one.
+func publish(ctx gocontext.Context, env *context.Context, appID string, transactionID string, auds []*audience.Audience, client delivery.GCMClient, msg *message.Message, vars *templateVariables) (*publishResult, error) {
+	stg := env.Storage
+
+	ctx, cancel := gocontext.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		mu       sync.Mutex
+		result   publishResult
+		firstErr error
+	)
+
+	fail := func(err error) {
+		mu.Lock()
+		if firstErr == nil {
+			firstErr = err
+		}
+		mu.Unlock()
+		cancel()
+	}
+
+	pages := make(chan publishPage)
+
+	go func() {
+		defer close(pages)
+
+		err := audience.ExpandUnion(ctx, stg, appID, auds, func(subscriberIDs []string, match audience.MatchFunc) error {
+			select {
+			case pages <- publishPage{subscriberIDs, match}:
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		})
+
+		if err != nil {
+			fail(err)
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < publishWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			sender := &batchSender{
+				ctx:           ctx,
+				stg:           stg,
+				queue:         env.Queue,
+				deliverer:     env.Delivery,
+				appID:         appID,
+				transactionID: transactionID,
+				deadLetterTTL: env.DeadLetterTTL,
+				client:        client,
+				msg:           msg,
+				vars:          vars,
+			}
+			for page := range pages {
+				sender.match = page.match
+				err := stg.GetSubscribersDevices(ctx, appID, page.subscriberIDs, sender.add)
+				if err != nil {
+					fail(err)
+					return
+				}
+			}
+
+			if err := sender.flushAll(); err != nil {
+				fail(err)
+				return
+			}
+
+			mu.Lock()
+			result.merge(&sender.result)
+			mu.Unlock()
+		}()
+	}
+
+	wg.Wait()
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	result.TransactionID = transactionID
+
+	return &result, firstErr
+}
+
+// batchSender collects device tokens and sends them to GCM in batches of
+// gcmMaxRecipients devices receiving the same rendered message.
+type batchSender struct {
+	ctx           gocontext.Context
+	stg           storage.Storage
+	queue         queue.Queue
+	deliverer     *delivery.Deliverer
+	appID         string
+	transactionID string
+	deadLetterTTL time.Duration
+	client        delivery.GCMClient
+	msg           *message.Message
+	vars          *templateVariables
+	match         audience.MatchFunc
+	batches       map[string]*gcmBatch
+	result        publishResult
+}
+
+// gcmBatch is a message in a locale and the tokens collected for it with their
+// subscribers.
+type gcmBatch struct {
+	source      *message.Message
+	locale      string
+	tokens      []string
+	subscribers []string
+}
+
+// add adds the recipient devices of a subscriber, sending a batch when it is
+// full.
+func (s *batchSender) add(subscriberID string, devices []*storage.Device) error {
+	for _, device := range devices {
+		if !s.match(subscriberID, device) {
+			continue
+		}
+
+		// APNs devices are counted as skipped, there is no APNs provider
+		// yet.
+		if device.Platform == message.PlatformAPNS {
+			s.result.Skipped++
+			continue
+		}
+
+		batch, err := s.batch(subscriberID, device)
+		if _, ok := err.(*renderError); ok {
+			log.Printf("Skipping device of %s: %s\n", subscriberID, err)
+			s.result.Skipped++
+			continue
+		}
+
+		if err != nil {
+			return err
+		}
+
+		batch.tokens = append(batch.tokens, device.Token)
+		batch.subscribers = append(batch.subscribers, subscriberID)
+
+		if len(batch.tokens) == gcmMaxRecipients {
+			if err := s.flush(batch); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// batch returns the batch of the message of a device, creating it if needed.
+func (s *batchSender) batch(subscriberID string, device *storage.Device) (*gcmBatch, error) {
+	if s.batches == nil {
+		s.batches = make(map[string]*gcmBatch)
+	}
+
+	msg, locale, err := deviceMessage(s.msg, s.vars, subscriberID, device)
+	if err != nil {
+		return nil, &renderError{err}
+	}
+
+	key := locale
+
+	if s.vars != nil {
+		encoded, err := json.Marshal(msg)
+		if err != nil {
+			return nil, err
+		}
+		key = locale + ":" + string(encoded)
+	}
+
+	if batch, ok := s.batches[key]; ok {
+		return batch, nil
+	}
+
+	// rendered messages are validated for each batch, others before
+	// publishing.
+	if s.vars != nil {
+		if err := msg.ValidatePlatform(message.PlatformGCM); err != nil {
+			return nil, &renderError{err}
+		}
+	}
+
+	if len(s.batches) == maxPendingBatches {
+		if err := s.flushAll(); err != nil {
+			return nil, err
+		}
+	}
+
+	batch := &gcmBatch{source: msg, locale: locale}
+	s.batches[key] = batch
+
+	return batch, nil
+}
+
+// deviceMessage returns the message of a device localized to its locale and,
+// if vars is not nil, rendered with its variables, and the locale of its
+// translation.
+func deviceMessage(msg *message.Message, vars *templateVariables, subscriberID string, device *storage.Device) (*message.Message, string, error) {
+	msg, locale := msg.Localize(device.Locale)
+	if vars == nil {
+		return msg, locale, nil
+	}
+
+	rendered, err := msg.Render(vars.lookup(subscriberID, device))
+	return rendered, locale, err
+}
+
+// flushAll sends the tokens of all batches.
+func (s *batchSender) flushAll() error {
+	for key, batch := range s.batches {
+		if err := s.flush(batch); err != nil {
+			return err
+		}
+		delete(s.batches, key)
+	}
+
+	return nil
+}
+
+// flush sends the collected tokens of a batch, or adds them to the queue of the
+// workers if there is one.
+func (s *batchSender) flush(batch *gcmBatch) error {
+	if len(batch.tokens) == 0 {
+		return nil
+	}
+
+	job := &worker.Job{
+		AppID:         s.appID,
+		TransactionID: s.transactionID,
+		Locale:        batch.locale,
+		Message:       batch.source,
+		Tokens:        batch.tokens,
+		Subscribers:   batch.subscribers,
+	}
+	batch.tokens, batch.subscribers = nil, nil
+
+	var err error
+	if s.queue != nil {
+		err = s.push(job)
+	} else {
+		err = s.send(job)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	sent := len(job.Tokens)
+	s.result.Devices += sent
+
+	if s.result.Locales == nil {
+		s.result.Locales = make(map[string]int)
+	}
+	s.result.Locales[batch.locale] += sent
+
+	return nil
+}
+
+// push validates a job and adds it to the queue of the workers.
+func (s *batchSender) push(job *worker.Job) error {
+	if _, err := job.GCMMessage(); err != nil {
+		return &sendError{err}
+	}
+
+	if _, err := worker.Push(s.ctx, s.queue, job); err != nil {
+		return err
+	}
+
+	s.result.Jobs++
+
+	return nil
+}
+
+// send sends a job to GCM and records its failed deliveries as dead letters.
+// A dead letter that can not be recorded is logged, so the publish goes on.
+func (s *batchSender) send(job *worker.Job) error {
+	result, failures, gcmErr := worker.Send(s.ctx, s.deliverer, s.client, job)
+	log.Printf("GCM Request: %#v, %#v\n", result, gcmErr)
+
+	if len(failures) > 0 {
+		n, err := worker.RecordDeadLetters(s.ctx, s.stg, job, failures, 1, s.deadLetterTTL)
+		if err != nil {
+			log.Printf("Could not record %d dead letters of transaction %s: %s\n", len(failures), s.transactionID, err)
+		}
+		s.result.DeadLetters += n
+	}
+
+	if gcmErr != nil {
+		return &sendError{gcmErr}
+	}
+
+	s.result.Responses = append(s.result.Responses, result)
+
+	return nil
+}
@@ -0,0 +1,184 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/gamegos/jsend"
+	"github.com/gamegos/scotty/audience"
+	"github.com/gamegos/scotty/server/context"
+	"github.com/gamegos/scotty/storage"
+	"github.com/gorilla/mux"
+)
+
+// validateSegment checks that a segment has an id and a valid audience.
+func validateSegment(segment *storage.Segment) error {
+	if segment.ID == "" {
+		return errors.New("Segment id is required.")
+	}
+
+	aud, err := audience.FromSegment(segment)
+	if err != nil {
+		return errors.New("Invalid filter: " + err.Error())
+	}
+
+	if aud.IsEmpty() {
+		return errors.New("Segment must have subscribers, channels, intersectChannels or a filter.")
+	}
+
+	return nil
+}
+
+// decodeSegment decodes and validates the segment in a request body. It
+// writes the error response and returns nil if the segment is invalid.
+func decodeSegment(jw jsend.JResponseWriter, r *http.Request) *storage.Segment {
+	var segment *storage.Segment
+
+	decoder := json.NewDecoder(r.Body)
+
+	if err := decoder.Decode(&segment); err != nil {
+		jw.Status(400).Message(err.Error()).Send()
+		return nil
+	}
+
+	if segment == nil {
+		jw.Status(400).Message("Segment is required.").Send()
+		return nil
+	}
+
+	if err := validateSegment(segment); err != nil {
+		jw.Status(400).Message(err.Error()).Send()
+		return nil
+	}
+
+	return segment
+}
+
+func CreateSegment(jw jsend.JResponseWriter, r *http.Request, ctx *context.Context) {
+	vars := mux.Vars(r)
+	appID := vars["appId"]
+
+	segment := decodeSegment(jw, r)
+	if segment == nil {
+		return
+	}
+
+	if _, err := ctx.Storage.GetApp(r.Context(), appID); err != nil {
+		writeStorageError(jw, err, "App not found.")
+		return
+	}
+
+	if err := ctx.Storage.PutSegment(r.Context(), appID, segment); err != nil {
+		writeStorageError(jw, err, "App not found.")
+		return
+	}
+
+	jw.Status(201).Send()
+}
+
+func UpdateSegment(jw jsend.JResponseWriter, r *http.Request, ctx *context.Context) {
+	vars := mux.Vars(r)
+	appID := vars["appId"]
+	segmentID := vars["segmentId"]
+
+	segment := decodeSegment(jw, r)
+	if segment == nil {
+		return
+	}
+
+	if segmentID != segment.ID {
+		jw.Status(400).Message("SegmentID mismatch").Send()
+		return
+	}
+
+	if _, err := ctx.Storage.GetSegment(r.Context(), appID, segmentID); err != nil {
+		writeStorageError(jw, err, "Segment not found.")
+		return
+	}
+
+	if err := ctx.Storage.PutSegment(r.Context(), appID, segment); err != nil {
+		writeStorageError(jw, err, "Segment not found.")
+		return
+	}
+
+	jw.Status(200).Send()
+}
+
+func GetSegment(jw jsend.JResponseWriter, r *http.Request, ctx *context.Context) {
+	vars := mux.Vars(r)
+	appID := vars["appId"]
+	segmentID := vars["segmentId"]
+
+	segment, err := ctx.Storage.GetSegment(r.Context(), appID, segmentID)
+	if err != nil {
+		writeStorageError(jw, err, "Segment not found.")
+		return
+	}
+
+	jw.Data(segment)
+}
+
+func GetSegments(jw jsend.JResponseWriter, r *http.Request, ctx *context.Context) {
+	vars := mux.Vars(r)
+	appID := vars["appId"]
+
+	if _, err := ctx.Storage.GetApp(r.Context(), appID); err != nil {
+		writeStorageError(jw, err, "App not found.")
+		return
+	}
+
+	segments, err := ctx.Storage.GetSegments(r.Context(), appID)
+	if err != nil {
+		writeStorageError(jw, err, "App not found.")
+		return
+	}
+
+	jw.Data(segments)
+}
+
+func DeleteSegment(jw jsend.JResponseWriter, r *http.Request, ctx *context.Context) {
+	vars := mux.Vars(r)
+	appID := vars["appId"]
+	segmentID := vars["segmentId"]
+
+	if err := ctx.Storage.DeleteSegment(r.Context(), appID, segmentID); err != nil {
+		writeStorageError(jw, err, "Segment not found.")
+		return
+	}
+
+	jw.Status(200).Send()
+}
+
+// CountSegment estimates the number of subscribers and devices a publish to a
+// segment would reach.
+func CountSegment(jw jsend.JResponseWriter, r *http.Request, ctx *context.Context) {
+	vars := mux.Vars(r)
+	appID := vars["appId"]
+	segmentID := vars["segmentId"]
+
+	segment, err := ctx.Storage.GetSegment(r.Context(), appID, segmentID)
+	if err != nil {
+		writeStorageError(jw, err, "Segment not found.")
+		return
+	}
+
+	aud, err := audience.FromSegment(segment)
+	if err != nil {
+		jw.Status(500).Message("Invalid segment: " + err.Error()).Send()
+		return
+	}
+
+	if err := aud.ResolveAliases(r.Context(), ctx.Storage, appID); err != nil {
+		writeStorageError(jw, err, "App not found.")
+		return
+	}
+
+	size, err := audience.Count(r.Context(), ctx.Storage, appID, aud)
+	if err != nil {
+		writeStorageError(jw, err, "App not found.")
+		return
+	}
+
+	jw.Data(size)
+}
@@ -0,0 +1,186 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/gamegos/jsend"
+	"github.com/gamegos/scotty/server/context"
+	"github.com/gamegos/scotty/storage"
+	"github.com/gorilla/mux"
+)
+
+// defaultSubscribersPageSize and maxSubscribersPageSize limit the count of
+// subscriber list requests.
+const (
+	defaultSubscribersPageSize = 100
+	maxSubscribersPageSize     = 1000
+)
+
+// subscriberResponse holds a subscriber with its devices and channels.
+type subscriberResponse struct {
+	ID string `json:"id"`
+	// CreatedAt is the creation time of the oldest device.
+	CreatedAt int               `json:"createdAt,omitempty"`
+	Devices   []*storage.Device `json:"devices"`
+	Channels  []string          `json:"channels"`
+	// Aliases are the ids merged into the subscriber.
+	Aliases []string `json:"aliases"`
+}
+
+// mergeRequest holds the subscriber another subscriber is merged into.
+type mergeRequest struct {
+	Into string `json:"into"`
+}
+
+// subscribersPageResponse holds a page of subscriber ids and the cursor of
+// the next page, which is empty on the last page.
+type subscribersPageResponse struct {
+	Subscribers []string `json:"subscribers"`
+	Cursor      string   `json:"cursor"`
+}
+
+func GetSubscriber(jw jsend.JResponseWriter, r *http.Request, ctx *context.Context) {
+	vars := mux.Vars(r)
+	appID := vars["appId"]
+	subscriberID := vars["subscriberId"]
+
+	if _, err := ctx.Storage.GetApp(r.Context(), appID); err != nil {
+		writeStorageError(jw, err, "App not found.")
+		return
+	}
+
+	devices, err := ctx.Storage.GetSubscriberDevices(r.Context(), appID, subscriberID)
+	if err != nil {
+		writeStorageError(jw, err, "Subscriber not found.")
+		return
+	}
+
+	channels, err := ctx.Storage.GetSubscriberChannels(r.Context(), appID, subscriberID)
+	if err != nil {
+		writeStorageError(jw, err, "Subscriber not found.")
+		return
+	}
+
+	aliases, err := ctx.Storage.GetSubscriberAliases(r.Context(), appID, subscriberID)
+	if err != nil {
+		writeStorageError(jw, err, "Subscriber not found.")
+		return
+	}
+
+	if len(devices) == 0 && len(channels) == 0 {
+		jw.Status(404).Message("Subscriber not found.").Send()
+		return
+	}
+
+	response := &subscriberResponse{
+		ID:       subscriberID,
+		Devices:  devices,
+		Channels: channels,
+		Aliases:  aliases,
+	}
+
+	if response.Devices == nil {
+		response.Devices = []*storage.Device{}
+	}
+
+	for _, device := range devices {
+		if response.CreatedAt == 0 || device.CreatedAt < response.CreatedAt {
+			response.CreatedAt = device.CreatedAt
+		}
+	}
+
+	jw.Data(response)
+}
+
+func GetSubscribers(jw jsend.JResponseWriter, r *http.Request, ctx *context.Context) {
+	vars := mux.Vars(r)
+	appID := vars["appId"]
+	query := r.URL.Query()
+
+	count := defaultSubscribersPageSize
+	if value := query.Get("count"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 || n > maxSubscribersPageSize {
+			jw.Status(400).Message("count must be between 1 and " + strconv.Itoa(maxSubscribersPageSize) + ".").Send()
+			return
+		}
+		count = n
+	}
+
+	if _, err := ctx.Storage.GetApp(r.Context(), appID); err != nil {
+		writeStorageError(jw, err, "App not found.")
+		return
+	}
+
+	subscribers, next, err := ctx.Storage.ScanSubscribers(r.Context(), appID, query.Get("cursor"), count)
+	if err != nil {
+		writeStorageError(jw, err, "App not found.")
+		return
+	}
+
+	if subscribers == nil {
+		subscribers = []string{}
+	}
+
+	jw.Data(&subscribersPageResponse{
+		Subscribers: subscribers,
+		Cursor:      next,
+	})
+}
+
+func DeleteSubscriber(jw jsend.JResponseWriter, r *http.Request, ctx *context.Context) {
+	vars := mux.Vars(r)
+	appID := vars["appId"]
+	subscriberID := vars["subscriberId"]
+
+	if _, err := ctx.Storage.GetApp(r.Context(), appID); err != nil {
+		writeStorageError(jw, err, "App not found.")
+		return
+	}
+
+	if err := ctx.Storage.DeleteSubscriber(r.Context(), appID, subscriberID); err != nil {
+		writeStorageError(jw, err, "Subscriber not found.")
+		return
+	}
+
+	jw.Status(200).Send()
+}
+
+func MergeSubscriber(jw jsend.JResponseWriter, r *http.Request, ctx *context.Context) {
+	vars := mux.Vars(r)
+	appID := vars["appId"]
+	subscriberID := vars["subscriberId"]
+
+	var req mergeRequest
+
+	decoder := json.NewDecoder(r.Body)
+
+	if err := decoder.Decode(&req); err != nil {
+		jw.Status(400).Message(err.Error()).Send()
+		return
+	}
+
+	if req.Into == "" {
+		jw.Status(400).Message("into is required.").Send()
+		return
+	}
+
+	if req.Into == subscriberID {
+		jw.Status(400).Message("A subscriber can not be merged into itself.").Send()
+		return
+	}
+
+	if _, err := ctx.Storage.GetApp(r.Context(), appID); err != nil {
+		writeStorageError(jw, err, "App not found.")
+		return
+	}
+
+	if err := ctx.Storage.MergeSubscriber(r.Context(), appID, subscriberID, req.Into); err != nil {
+		writeStorageError(jw, err, "Subscriber not found.")
+		return
+	}
+
+	jw.Status(200).Send()
+}
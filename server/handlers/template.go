@@ -0,0 +1,188 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/gamegos/jsend"
+	"github.com/gamegos/scotty/message"
+	"github.com/gamegos/scotty/server/context"
+	"github.com/gamegos/scotty/storage"
+	"github.com/gorilla/mux"
+)
+
+// validateTemplate checks that a template has an id and a valid message.
+func validateTemplate(template *storage.Template) error {
+	if template.ID == "" {
+		return errors.New("Template id is required.")
+	}
+
+	if template.Message == nil {
+		return errors.New("Template message is required.")
+	}
+
+	if err := template.Message.Validate(); err != nil {
+		return errors.New("Invalid message: " + err.Error())
+	}
+
+	if _, err := template.Message.Variables(); err != nil {
+		return errors.New("Invalid message: " + err.Error())
+	}
+
+	return nil
+}
+
+// decodeTemplate decodes and validates the template in a request body. It
+// writes the error response and returns nil if the template is invalid.
+func decodeTemplate(jw jsend.JResponseWriter, r *http.Request) *storage.Template {
+	var template *storage.Template
+
+	decoder := json.NewDecoder(r.Body)
+
+	if err := decoder.Decode(&template); err != nil {
+		jw.Status(400).Message(err.Error()).Send()
+		return nil
+	}
+
+	if template == nil {
+		jw.Status(400).Message("Template is required.").Send()
+		return nil
+	}
+
+	if err := validateTemplate(template); err != nil {
+		jw.Status(400).Message(err.Error()).Send()
+		return nil
+	}
+
+	return template
+}
+
+func CreateTemplate(jw jsend.JResponseWriter, r *http.Request, ctx *context.Context) {
+	vars := mux.Vars(r)
+	appID := vars["appId"]
+
+	template := decodeTemplate(jw, r)
+	if template == nil {
+		return
+	}
+
+	if _, err := ctx.Storage.GetApp(r.Context(), appID); err != nil {
+		writeStorageError(jw, err, "App not found.")
+		return
+	}
+
+	if err := ctx.Storage.PutTemplate(r.Context(), appID, template); err != nil {
+		writeStorageError(jw, err, "App not found.")
+		return
+	}
+
+	jw.Status(201).Send()
+}
+
+func UpdateTemplate(jw jsend.JResponseWriter, r *http.Request, ctx *context.Context) {
+	vars := mux.Vars(r)
+	appID := vars["appId"]
+	templateID := vars["templateId"]
+
+	template := decodeTemplate(jw, r)
+	if template == nil {
+		return
+	}
+
+	if templateID != template.ID {
+		jw.Status(400).Message("TemplateID mismatch").Send()
+		return
+	}
+
+	if _, err := ctx.Storage.GetTemplate(r.Context(), appID, templateID); err != nil {
+		writeStorageError(jw, err, "Template not found.")
+		return
+	}
+
+	if err := ctx.Storage.PutTemplate(r.Context(), appID, template); err != nil {
+		writeStorageError(jw, err, "Template not found.")
+		return
+	}
+
+	jw.Status(200).Send()
+}
+
+func GetTemplate(jw jsend.JResponseWriter, r *http.Request, ctx *context.Context) {
+	vars := mux.Vars(r)
+	appID := vars["appId"]
+	templateID := vars["templateId"]
+
+	template, err := ctx.Storage.GetTemplate(r.Context(), appID, templateID)
+	if err != nil {
+		writeStorageError(jw, err, "Template not found.")
+		return
+	}
+
+	jw.Data(template)
+}
+
+func GetTemplates(jw jsend.JResponseWriter, r *http.Request, ctx *context.Context) {
+	vars := mux.Vars(r)
+	appID := vars["appId"]
+
+	if _, err := ctx.Storage.GetApp(r.Context(), appID); err != nil {
+		writeStorageError(jw, err, "App not found.")
+		return
+	}
+
+	templates, err := ctx.Storage.GetTemplates(r.Context(), appID)
+	if err != nil {
+		writeStorageError(jw, err, "App not found.")
+		return
+	}
+
+	jw.Data(templates)
+}
+
+func DeleteTemplate(jw jsend.JResponseWriter, r *http.Request, ctx *context.Context) {
+	vars := mux.Vars(r)
+	appID := vars["appId"]
+	templateID := vars["templateId"]
+
+	if err := ctx.Storage.DeleteTemplate(r.Context(), appID, templateID); err != nil {
+		writeStorageError(jw, err, "Template not found.")
+		return
+	}
+
+	jw.Status(200).Send()
+}
+
+// templateVariables are the variables of a publish request rendering a
+// template.
+type templateVariables struct {
+	// shared are the variables of every recipient.
+	shared map[string]string
+	// recipients are the variables of each subscriber.
+	recipients map[string]map[string]string
+}
+
+// lookup returns the variables of a device. The variables of its subscriber
+// come first, then "subscriberId" and the device attributes (see
+// storage.Device.Attribute) except the token, then the shared variables.
+// Attributes without a value are not set.
+func (v *templateVariables) lookup(subscriberID string, device *storage.Device) message.LookupFunc {
+	return func(name string) (string, bool) {
+		if value, ok := v.recipients[subscriberID][name]; ok {
+			return value, true
+		}
+
+		if name == "subscriberId" {
+			return subscriberID, true
+		}
+
+		if name != "token" {
+			if value, ok := device.Attribute(name); ok && value != "" {
+				return value, true
+			}
+		}
+
+		value, ok := v.shared[name]
+		return value, ok
+	}
+}
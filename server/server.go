@@ -1,9 +1,14 @@
 package server
 
 import (
+	gocontext "context"
 	"net/http"
+	"time"
 
 	"github.com/gamegos/jsend"
+	"github.com/gamegos/scotty/config"
+	"github.com/gamegos/scotty/delivery"
+	"github.com/gamegos/scotty/queue"
 	"github.com/gamegos/scotty/server/context"
 	"github.com/gamegos/scotty/server/handlers"
 	"github.com/gamegos/scotty/storage"
@@ -13,42 +18,65 @@ import (
 type Server struct {
 	router *mux.Router
 	ctx    *context.Context
-	//addr   string
+	srv    *http.Server
 }
 
-// Init initializes a scotty http server.
-func Init(stg storage.Storage) *Server {
+// Init initializes a scotty http server. Publish requests send their batches
+// through q, or with deliverer if q is nil.
+func Init(stg storage.Storage, q queue.Queue, deliverer *delivery.Deliverer, conf *config.Config) *Server {
 	s := &Server{}
-	//s.addr = addr
-	s.ctx = &context.Context{stg}
-	s.router = initRouter(s.ctx)
+	s.ctx = &context.Context{
+		Storage:       stg,
+		Queue:         q,
+		Delivery:      deliverer,
+		DeadLetterTTL: time.Duration(conf.Delivery.DeadLetterTTL) * time.Second,
+	}
+	s.router = initRouter(s.ctx, time.Duration(conf.Server.RequestTimeout)*time.Second)
+	s.srv = &http.Server{Addr: conf.Server.Addr, Handler: s.router}
 
 	return s
 }
 
-// Run starts a scotty http server.
-func (s *Server) Run(addr string) error {
-	return http.ListenAndServe(addr, s.router)
+// Run starts a scotty http server. It returns nil once the server is shut
+// down.
+func (s *Server) Run() error {
+	if err := s.srv.ListenAndServe(); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+// Shutdown stops the server from accepting requests and waits for the ones in
+// flight until ctx is done.
+func (s *Server) Shutdown(ctx gocontext.Context) error {
+	return s.srv.Shutdown(ctx)
 }
 
 type handlerFunc func(w jsend.JResponseWriter, r *http.Request, ctx *context.Context)
 
 type mainHandler struct {
-	ctx *context.Context
-	f   handlerFunc
+	ctx     *context.Context
+	f       handlerFunc
+	timeout time.Duration
 }
 
 func (h *mainHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if h.timeout > 0 {
+		reqCtx, cancel := gocontext.WithTimeout(r.Context(), h.timeout)
+		defer cancel()
+		r = r.WithContext(reqCtx)
+	}
+
 	jw := jsend.Wrap(w)
 	h.f(jw, r, h.ctx)
 	jw.Send()
 }
 
 // initRouter creates and returns the router.
-func initRouter(ctx *context.Context) *mux.Router {
+func initRouter(ctx *context.Context, timeout time.Duration) *mux.Router {
 	router := mux.NewRouter().StrictSlash(true)
 	wrap := func(f handlerFunc) *mainHandler {
-		return &mainHandler{ctx, f}
+		return &mainHandler{ctx, f, timeout}
 	}
 
 	router.
@@ -63,6 +91,12 @@ func initRouter(ctx *context.Context) *mux.Router {
 		Name("Get App").
 		Handler(wrap(handlers.GetApp))
 
+	router.
+		Methods("GET").
+		Path("/apps/{appId}/status").
+		Name("Get Delivery Status of App").
+		Handler(wrap(handlers.GetStatus))
+
 	router.
 		Methods("POST").
 		Path("/apps").
@@ -75,12 +109,168 @@ func initRouter(ctx *context.Context) *mux.Router {
 		Name("Update App").
 		Handler(wrap(handlers.UpdateApp))
 
+	router.
+		Methods("GET").
+		Path("/apps/{appId}/segments").
+		Name("Get Segments of App").
+		Handler(wrap(handlers.GetSegments))
+
+	router.
+		Methods("POST").
+		Path("/apps/{appId}/segments").
+		Name("Create Segment").
+		Handler(wrap(handlers.CreateSegment))
+
+	router.
+		Methods("GET").
+		Path("/apps/{appId}/segments/{segmentId}").
+		Name("Get Segment").
+		Handler(wrap(handlers.GetSegment))
+
+	router.
+		Methods("PUT").
+		Path("/apps/{appId}/segments/{segmentId}").
+		Name("Update Segment").
+		Handler(wrap(handlers.UpdateSegment))
+
+	router.
+		Methods("DELETE").
+		Path("/apps/{appId}/segments/{segmentId}").
+		Name("Delete Segment").
+		Handler(wrap(handlers.DeleteSegment))
+
+	router.
+		Methods("GET").
+		Path("/apps/{appId}/segments/{segmentId}/count").
+		Name("Count Segment").
+		Handler(wrap(handlers.CountSegment))
+
+	router.
+		Methods("GET").
+		Path("/apps/{appId}/templates").
+		Name("Get Templates of App").
+		Handler(wrap(handlers.GetTemplates))
+
+	router.
+		Methods("POST").
+		Path("/apps/{appId}/templates").
+		Name("Create Template").
+		Handler(wrap(handlers.CreateTemplate))
+
+	router.
+		Methods("GET").
+		Path("/apps/{appId}/templates/{templateId}").
+		Name("Get Template").
+		Handler(wrap(handlers.GetTemplate))
+
+	router.
+		Methods("PUT").
+		Path("/apps/{appId}/templates/{templateId}").
+		Name("Update Template").
+		Handler(wrap(handlers.UpdateTemplate))
+
+	router.
+		Methods("DELETE").
+		Path("/apps/{appId}/templates/{templateId}").
+		Name("Delete Template").
+		Handler(wrap(handlers.DeleteTemplate))
+
+	router.
+		Methods("GET").
+		Path("/apps/{appId}/deadletters").
+		Name("Get Dead Letters of App").
+		Handler(wrap(handlers.GetDeadLetters))
+
+	router.
+		Methods("DELETE").
+		Path("/apps/{appId}/deadletters").
+		Name("Purge Dead Letters of App").
+		Handler(wrap(handlers.PurgeDeadLetters))
+
+	router.
+		Methods("POST").
+		Path("/apps/{appId}/deadletters/replay").
+		Name("Replay Dead Letters").
+		Handler(wrap(handlers.ReplayDeadLetters))
+
+	router.
+		Methods("GET").
+		Path("/apps/{appId}/deadletters/{letterId}").
+		Name("Get Dead Letter").
+		Handler(wrap(handlers.GetDeadLetter))
+
+	router.
+		Methods("DELETE").
+		Path("/apps/{appId}/deadletters/{letterId}").
+		Name("Delete Dead Letter").
+		Handler(wrap(handlers.DeleteDeadLetter))
+
 	router.
 		Methods("POST").
 		Path("/apps/{appId}/devices").
 		Name("Add Device to Subscriber").
 		Handler(wrap(handlers.AddDevice))
 
+	router.
+		Methods("GET").
+		Path("/apps/{appId}/subscribers").
+		Name("Get Subscribers of App").
+		Handler(wrap(handlers.GetSubscribers))
+
+	router.
+		Methods("GET").
+		Path("/apps/{appId}/subscribers/{subscriberId}").
+		Name("Get Subscriber").
+		Handler(wrap(handlers.GetSubscriber))
+
+	router.
+		Methods("DELETE").
+		Path("/apps/{appId}/subscribers/{subscriberId}").
+		Name("Delete Subscriber").
+		Handler(wrap(handlers.DeleteSubscriber))
+
+	router.
+		Methods("POST").
+		Path("/apps/{appId}/subscribers/{subscriberId}/merge").
+		Name("Merge Subscriber").
+		Handler(wrap(handlers.MergeSubscriber))
+
+	router.
+		Methods("GET").
+		Path("/apps/{appId}/subscribers/{subscriberId}/preferences").
+		Name("Get Subscriber Preferences").
+		Handler(wrap(handlers.GetPreferences))
+
+	router.
+		Methods("PUT").
+		Path("/apps/{appId}/subscribers/{subscriberId}/preferences").
+		Name("Update Subscriber Preferences").
+		Handler(wrap(handlers.UpdatePreferences))
+
+	router.
+		Methods("GET").
+		Path("/apps/{appId}/subscribers/{subscriberId}/export").
+		Name("Export Subscriber").
+		Handler(wrap(handlers.ExportSubscriber))
+
+	router.
+		Methods("POST").
+		Path("/apps/{appId}/subscribers/{subscriberId}/erase").
+		Name("Erase Subscriber").
+		Handler(wrap(handlers.EraseSubscriber))
+
+	router.
+		Methods("GET").
+		Path("/apps/{appId}/tombstones").
+		Name("Get Tombstones of App").
+		Handler(wrap(handlers.GetTombstones))
+
+	router.
+		Methods("GET").
+		Path("/apps/{appId}/devices/{token}").
+		Name("Get Device Owner").
+		Handler(wrap(handlers.GetDevice))
+
 	router.
 		Methods("POST").
 		Path("/apps/{appId}/channels").
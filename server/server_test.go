@@ -1,14 +1,21 @@
 package server
 
 import (
+	"context"
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/gamegos/scotty/config"
+	"github.com/gamegos/scotty/delivery"
+	"github.com/gamegos/scotty/message"
+	memqueue "github.com/gamegos/scotty/queue/drivers/memory"
 	"github.com/gamegos/scotty/storage"
 	memstorage "github.com/gamegos/scotty/storage/drivers/memory"
+	"github.com/gamegos/scotty/worker"
 )
 
 var appID = "testapp"
@@ -26,7 +33,11 @@ var updatedData = `
 		"gcm": {
 				"projectId": "updatedprojectid",
 				"apiKey": "updatedapikey"
-		}
+		},
+		"categories": [
+				{"id": "promotions", "name": "Promotions"},
+				{"id": "beta", "optIn": true}
+		]
 }`
 
 type jsonResponse struct {
@@ -41,7 +52,8 @@ var (
 
 func init() {
 	stg := memstorage.New()
-	testServer = Init(stg)
+	conf := config.DefaultConfig()
+	testServer = Init(stg, nil, delivery.New(conf.Delivery), conf)
 }
 
 func apiCall(method string, urlStr string, bodyStr string) (*httptest.ResponseRecorder, error) {
@@ -115,8 +127,75 @@ func TestGetApp(t *testing.T) {
 	}
 }
 
+func TestGetMissingApp(t *testing.T) {
+	res, err := apiCall("GET", "/apps/nosuchapp", "")
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	if res.Code != http.StatusNotFound {
+		t.Error("Expected 404 for missing app, got", res.Code)
+	}
+}
+
+func TestStatus(t *testing.T) {
+	res, err := apiCall("GET", "/health", "")
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	if res.Code != http.StatusOK || !strings.Contains(res.Body.String(), `"status":"ok"`) {
+		t.Error("Expected a healthy server.", res.Code, res.Body)
+	}
+
+	res, err = apiCall("GET", "/apps/"+appID+"/status", "")
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	if res.Code != http.StatusOK || !strings.Contains(res.Body.String(), `"circuits":[]`) {
+		t.Error("Expected no circuits of an app without deliveries.", res.Code, res.Body)
+	}
+
+	res, err = apiCall("GET", "/apps/nosuchapp/status", "")
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	if res.Code != http.StatusNotFound {
+		t.Error("Expected 404 for the status of a missing app, got", res.Code)
+	}
+
+	// circuits of worker processes are reported through the storage.
+	now := int(time.Now().Unix())
+	circuit := &storage.Circuit{AppID: appID, Provider: delivery.ProviderGCM, Process: "worker-1", State: delivery.StateOpen, Failures: 5, ReportedAt: now, ExpiresAt: now + 60}
+	if err := testServer.ctx.Storage.PutCircuits(context.Background(), []*storage.Circuit{circuit}); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		circuit.State, circuit.Failures = delivery.StateClosed, 0
+		testServer.ctx.Storage.PutCircuits(context.Background(), []*storage.Circuit{circuit})
+	}()
+
+	res, _ = apiCall("GET", "/health", "")
+
+	if !strings.Contains(res.Body.String(), `"status":"degraded"`) || !strings.Contains(res.Body.String(), `"process":"worker-1"`) {
+		t.Error("Expected a degraded server with the circuit of the worker.", res.Code, res.Body)
+	}
+
+	res, _ = apiCall("GET", "/apps/"+appID+"/status", "")
+
+	if res.Code != http.StatusOK || !strings.Contains(res.Body.String(), `"state":"open"`) {
+		t.Error("Expected the open circuit of the worker.", res.Code, res.Body)
+	}
+}
+
 func TestAddDevice(t *testing.T) {
-	postBody := `{"subscriberId": "randomSubId", "platform": "gcm", "token": "foo123"}`
+	postBody := `{"subscriberId": "randomSubId", "platform": "gcm", "token": "foo123", "locale": "tr-TR", "tags": {"tier": "premium"}}`
 	res, err := apiCall("POST", "/apps/"+appID+"/devices", postBody)
 
 	if err != nil {
@@ -128,6 +207,41 @@ func TestAddDevice(t *testing.T) {
 	}
 }
 
+func TestGetDevice(t *testing.T) {
+	res, err := apiCall("GET", "/apps/"+appID+"/devices/foo123", "")
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	var response jsonResponse
+
+	decoder := json.NewDecoder(res.Body)
+
+	if err := decoder.Decode(&response); err != nil {
+		t.Error(err)
+		return
+	}
+
+	var owner struct {
+		SubscriberID string          `json:"subscriberId"`
+		Device       *storage.Device `json:"device"`
+	}
+
+	if err := json.Unmarshal(response.Data, &owner); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if owner.SubscriberID != "randomSubId" {
+		t.Error("Device owner does not match.", owner.SubscriberID)
+	}
+
+	if owner.Device == nil || owner.Device.Locale != "tr-TR" || owner.Device.Tags["tier"] != "premium" {
+		t.Error("Device metadata was not stored.")
+	}
+}
+
 func TestAddChannel(t *testing.T) {
 	postBody := `{"id": "` + channelID + `"}`
 	res, err := apiCall("POST", "/apps/"+appID+"/channels", postBody)
@@ -154,6 +268,699 @@ func TestAddSubscriber(t *testing.T) {
 	}
 }
 
+func TestGetSubscriber(t *testing.T) {
+	res, err := apiCall("GET", "/apps/"+appID+"/subscribers/randomSubId", "")
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	var response jsonResponse
+
+	decoder := json.NewDecoder(res.Body)
+
+	if err := decoder.Decode(&response); err != nil {
+		t.Error(err)
+		return
+	}
+
+	var subscriber struct {
+		ID       string            `json:"id"`
+		Devices  []*storage.Device `json:"devices"`
+		Channels []string          `json:"channels"`
+	}
+
+	if err := json.Unmarshal(response.Data, &subscriber); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if subscriber.ID != "randomSubId" || len(subscriber.Devices) != 1 || subscriber.Devices[0].Token != "foo123" {
+		t.Errorf("Subscriber does not match. got %+v", subscriber)
+	}
+
+	res, err = apiCall("GET", "/apps/"+appID+"/subscribers/nosuchsubscriber", "")
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	if res.Code != http.StatusNotFound {
+		t.Error("Expected 404 for missing subscriber, got", res.Code)
+	}
+}
+
+func TestGetSubscribers(t *testing.T) {
+	res, err := apiCall("GET", "/apps/"+appID+"/subscribers?count=10", "")
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	var response jsonResponse
+
+	decoder := json.NewDecoder(res.Body)
+
+	if err := decoder.Decode(&response); err != nil {
+		t.Error(err)
+		return
+	}
+
+	var page struct {
+		Subscribers []string `json:"subscribers"`
+		Cursor      string   `json:"cursor"`
+	}
+
+	if err := json.Unmarshal(response.Data, &page); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if len(page.Subscribers) != 1 || page.Subscribers[0] != "randomSubId" || page.Cursor != "" {
+		t.Errorf("Subscribers page does not match. got %+v", page)
+	}
+
+	res, err = apiCall("GET", "/apps/"+appID+"/subscribers?count=0", "")
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	if res.Code != http.StatusBadRequest {
+		t.Error("Expected 400 for invalid count, got", res.Code)
+	}
+}
+
+func TestPublishWithoutDevices(t *testing.T) {
+	postBody := `{"channels": ["` + channelID + `"], "message": {"data": {"foo": "bar"}}}`
+	res, err := apiCall("POST", "/apps/"+appID+"/publish", postBody)
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	if res.Code != http.StatusBadRequest {
+		t.Error("Expected 400 for recipients without devices, got", res.Code)
+	}
+}
+
+func TestPublishDryRun(t *testing.T) {
+	postBody := `{"subscribers": ["randomSubId"], "message": {"title": "Sale", "translations": {"tr": {"title": "İndirim"}}}}`
+	res, err := apiCall("POST", "/apps/"+appID+"/publish?dryRun=true", postBody)
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	if res.Code != http.StatusOK {
+		t.Error("Dry run failed.", res.Code, res.Body)
+	}
+
+	var response jsonResponse
+
+	decoder := json.NewDecoder(res.Body)
+
+	if err := decoder.Decode(&response); err != nil {
+		t.Error(err)
+		return
+	}
+
+	var report struct {
+		Subscribers int                 `json:"subscribers"`
+		Devices     int                 `json:"devices"`
+		Platforms   map[string]int      `json:"platforms"`
+		Locales     map[string]int      `json:"locales"`
+		Suppressed  map[string]int      `json:"suppressed"`
+		Errors      map[string][]string `json:"errors"`
+	}
+
+	if err := json.Unmarshal(response.Data, &report); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if report.Subscribers != 1 || report.Devices != 1 || report.Platforms["gcm"] != 1 || report.Locales["tr"] != 1 || len(report.Errors) != 0 {
+		t.Errorf("Dry run report does not match. got %+v", report)
+	}
+
+	// randomSubId did not opt in to beta.
+	postBody = `{"subscribers": ["randomSubId"], "category": "beta", "message": {"title": "Beta"}}`
+	res, err = apiCall("POST", "/apps/"+appID+"/publish?dryRun=true", postBody)
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	response = jsonResponse{}
+	decoder = json.NewDecoder(res.Body)
+
+	if err := decoder.Decode(&response); err != nil {
+		t.Error(err)
+		return
+	}
+
+	report.Suppressed = nil
+	if err := json.Unmarshal(response.Data, &report); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if report.Subscribers != 0 || report.Suppressed["optOuts"] != 1 {
+		t.Errorf("Dry run report with category does not match. got %+v", report)
+	}
+
+	res, err = apiCall("POST", "/apps/"+appID+"/publish?dryRun=maybe", postBody)
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	if res.Code != http.StatusBadRequest {
+		t.Error("Expected 400 for invalid dryRun, got", res.Code)
+	}
+}
+
+func TestPublishQueue(t *testing.T) {
+	q := memqueue.New()
+	testServer.ctx.Queue = q
+	defer func() { testServer.ctx.Queue = nil }()
+
+	// APNs devices are skipped until there is a provider for them.
+	stg := testServer.ctx.Storage
+	if err := stg.AddSubscriberDevice(context.Background(), appID, "apnsSubId", &storage.Device{Platform: "apns", Token: "apnstoken"}); err != nil {
+		t.Fatal(err)
+	}
+	defer stg.DeleteSubscriber(context.Background(), appID, "apnsSubId")
+
+	postBody := `{"subscribers": ["randomSubId", "apnsSubId"], "message": {"title": "Sale", "translations": {"tr": {"title": "İndirim"}}}}`
+	res, err := apiCall("POST", "/apps/"+appID+"/publish", postBody)
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	if res.Code != http.StatusAccepted {
+		t.Fatal("Expected 202 for publish through a queue, got", res.Code, res.Body)
+	}
+
+	var response struct {
+		Data struct {
+			TransactionID string `json:"transactionId"`
+			Devices       int    `json:"devices"`
+			Skipped       int    `json:"skipped"`
+			Jobs          int    `json:"jobs"`
+		} `json:"data"`
+	}
+
+	if err := json.NewDecoder(res.Body).Decode(&response); err != nil {
+		t.Fatal(err)
+	}
+
+	if response.Data.Devices != 1 || response.Data.Skipped != 1 || response.Data.Jobs != 1 {
+		t.Errorf("Publish result does not match. got %+v", response.Data)
+	}
+
+	jobs, err := q.Receive(context.Background(), "test", 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(jobs) != 1 {
+		t.Fatalf("Expected a queued job, got %d", len(jobs))
+	}
+
+	var job worker.Job
+	if err := json.Unmarshal(jobs[0].Data, &job); err != nil {
+		t.Fatal(err)
+	}
+
+	if job.AppID != appID || job.TransactionID != response.Data.TransactionID || job.Locale != "tr" ||
+		job.Message.Title != "İndirim" || len(job.Subscribers) != 1 || job.Subscribers[0] != "randomSubId" || len(job.Tokens) != 1 {
+		t.Errorf("Queued job does not match. got %+v", job)
+	}
+}
+
+func TestPublishInvalidMessage(t *testing.T) {
+	postBody := `{"channels": ["` + channelID + `"], "message": {"title": "Hello", "priority": "urgent"}}`
+	res, err := apiCall("POST", "/apps/"+appID+"/publish", postBody)
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	if res.Code != http.StatusBadRequest {
+		t.Error("Expected 400 for invalid message, got", res.Code)
+	}
+}
+
+func TestCreateSegment(t *testing.T) {
+	postBody := `{"id": "turkish", "name": "Turkish", "subscribers": ["randomSubId", "foo"], "filter": "locale == \"tr-TR\""}`
+	res, err := apiCall("POST", "/apps/"+appID+"/segments", postBody)
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	if res.Code != http.StatusCreated {
+		t.Error("Segment could not be created.", res.Code, res.Body)
+	}
+
+	res, err = apiCall("POST", "/apps/"+appID+"/segments", `{"id": "invalid", "filter": "locale =="}`)
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	if res.Code != http.StatusBadRequest {
+		t.Error("Expected 400 for invalid segment, got", res.Code)
+	}
+}
+
+func TestCountSegment(t *testing.T) {
+	res, err := apiCall("GET", "/apps/"+appID+"/segments/turkish/count", "")
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	var response jsonResponse
+
+	decoder := json.NewDecoder(res.Body)
+
+	if err := decoder.Decode(&response); err != nil {
+		t.Error(err)
+		return
+	}
+
+	var size struct {
+		Subscribers int `json:"subscribers"`
+		Devices     int `json:"devices"`
+	}
+
+	if err := json.Unmarshal(response.Data, &size); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if size.Subscribers != 1 || size.Devices != 1 {
+		t.Errorf("Segment size does not match. got %+v", size)
+	}
+}
+
+func TestPublishMissingSegment(t *testing.T) {
+	postBody := `{"segments": ["nosuchsegment"], "message": {"data": {"foo": "bar"}}}`
+	res, err := apiCall("POST", "/apps/"+appID+"/publish", postBody)
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	if res.Code != http.StatusNotFound {
+		t.Error("Expected 404 for missing segment, got", res.Code)
+	}
+}
+
+func TestTemplates(t *testing.T) {
+	postBody := `{"id": "shipped", "name": "Order shipped", "message": {"title": "Hi {{name|there}}", "body": "Your order {{orderId}} shipped"}}`
+	res, err := apiCall("POST", "/apps/"+appID+"/templates", postBody)
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	if res.Code != http.StatusCreated {
+		t.Error("Template could not be created.", res.Code, res.Body)
+	}
+
+	res, err = apiCall("POST", "/apps/"+appID+"/templates", `{"id": "invalid", "message": {"title": "Hi {{name"}}`)
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	if res.Code != http.StatusBadRequest {
+		t.Error("Expected 400 for invalid template, got", res.Code)
+	}
+
+	res, err = apiCall("GET", "/apps/"+appID+"/templates/shipped", "")
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	var response jsonResponse
+
+	decoder := json.NewDecoder(res.Body)
+
+	if err := decoder.Decode(&response); err != nil {
+		t.Error(err)
+		return
+	}
+
+	var template storage.Template
+
+	if err := json.Unmarshal(response.Data, &template); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if template.Name != "Order shipped" || template.Message == nil || template.Message.Body != "Your order {{orderId}} shipped" {
+		t.Errorf("Template does not match. got %+v", template)
+	}
+
+	postBody = `{"channels": ["` + channelID + `"], "templateId": "shipped", "message": {"title": "Hello"}}`
+	res, err = apiCall("POST", "/apps/"+appID+"/publish", postBody)
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	if res.Code != http.StatusBadRequest {
+		t.Error("Expected 400 for publish with a message and a template, got", res.Code)
+	}
+
+	postBody = `{"channels": ["` + channelID + `"], "templateId": "nosuchtemplate"}`
+	res, err = apiCall("POST", "/apps/"+appID+"/publish", postBody)
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	if res.Code != http.StatusNotFound {
+		t.Error("Expected 404 for publish with a missing template, got", res.Code)
+	}
+
+	res, err = apiCall("DELETE", "/apps/"+appID+"/templates/shipped", "")
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	if res.Code != http.StatusOK {
+		t.Error("Template could not be deleted.", res.Code)
+	}
+}
+
+func TestDeadLetters(t *testing.T) {
+	expiresAt := int(time.Now().Unix()) + 100
+	letters := []*storage.DeadLetter{
+		{ID: "letter1", TransactionID: "tx1", SubscriberID: "foo", Platform: "gcm", Token: "t1", Message: &message.Message{Title: "Hi"}, Error: "MismatchSenderId", Attempts: 1, ExpiresAt: expiresAt},
+		{ID: "letter2", TransactionID: "tx2", SubscriberID: "bar", Platform: "gcm", Token: "t2", Message: &message.Message{Title: "Hi"}, Error: "MismatchSenderId", Attempts: 1, ExpiresAt: expiresAt},
+		{ID: "letter3", TransactionID: "tx2", SubscriberID: "bar", Platform: "gcm", Token: "t3", Message: &message.Message{Title: "Hi"}, Error: "MismatchSenderId", Attempts: 1, ExpiresAt: expiresAt},
+	}
+
+	if err := testServer.ctx.Storage.PutDeadLetters(context.Background(), appID, letters); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := apiCall("GET", "/apps/"+appID+"/deadletters?transactionId=tx2", "")
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	var page struct {
+		Data struct {
+			DeadLetters []*storage.DeadLetter `json:"deadLetters"`
+		} `json:"data"`
+	}
+
+	if err := json.NewDecoder(res.Body).Decode(&page); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(page.Data.DeadLetters) != 2 || page.Data.DeadLetters[0].ID != "letter2" {
+		t.Errorf("Dead letters do not match. got %+v", page.Data.DeadLetters)
+	}
+
+	res, err = apiCall("GET", "/apps/"+appID+"/deadletters/letter1", "")
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	if res.Code != http.StatusOK {
+		t.Error("Dead letter could not be found.", res.Code)
+	}
+
+	res, err = apiCall("POST", "/apps/"+appID+"/deadletters/replay", `{"ids": ["nosuchletter"]}`)
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	if res.Code != http.StatusNotFound {
+		t.Error("Expected 404 for replay of a missing dead letter, got", res.Code)
+	}
+
+	res, err = apiCall("POST", "/apps/"+appID+"/deadletters/replay", `{"message": {"priority": "urgent"}}`)
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	if res.Code != http.StatusBadRequest {
+		t.Error("Expected 400 for replay with an invalid message, got", res.Code)
+	}
+
+	res, err = apiCall("DELETE", "/apps/"+appID+"/deadletters?transactionId=tx2", "")
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	if res.Code != http.StatusOK || !strings.Contains(res.Body.String(), `"deleted":2`) {
+		t.Error("Dead letters could not be purged.", res.Code, res.Body)
+	}
+
+	res, err = apiCall("DELETE", "/apps/"+appID+"/deadletters/letter1", "")
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	if res.Code != http.StatusOK {
+		t.Error("Dead letter could not be deleted.", res.Code)
+	}
+
+	res, err = apiCall("GET", "/apps/"+appID+"/deadletters/letter1", "")
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	if res.Code != http.StatusNotFound {
+		t.Error("Expected 404 for a deleted dead letter, got", res.Code)
+	}
+}
+
+func TestDeleteSegment(t *testing.T) {
+	res, err := apiCall("DELETE", "/apps/"+appID+"/segments/turkish", "")
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	if res.Code != http.StatusOK {
+		t.Error("Segment could not be deleted.")
+	}
+
+	res, err = apiCall("GET", "/apps/"+appID+"/segments/turkish", "")
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	if res.Code != http.StatusNotFound {
+		t.Error("Expected 404 for deleted segment, got", res.Code)
+	}
+}
+
+func TestDeleteSubscriber(t *testing.T) {
+	res, err := apiCall("DELETE", "/apps/"+appID+"/subscribers/foo", "")
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	if res.Code != http.StatusOK {
+		t.Error("Subscriber could not be deleted.", res.Code)
+	}
+
+	res, err = apiCall("GET", "/apps/"+appID+"/subscribers/foo", "")
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	if res.Code != http.StatusNotFound {
+		t.Error("Expected 404 for deleted subscriber, got", res.Code)
+	}
+
+	res, err = apiCall("DELETE", "/apps/nosuchapp/subscribers/foo", "")
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	if res.Code != http.StatusNotFound || !strings.Contains(res.Body.String(), "App not found.") {
+		t.Error("Expected 404 for a subscriber of a missing app, got", res.Code, res.Body)
+	}
+}
+
+func TestEraseSubscriber(t *testing.T) {
+	res, err := apiCall("GET", "/apps/"+appID+"/subscribers/bar/export", "")
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	if res.Code != http.StatusOK {
+		t.Error("Subscriber could not be exported.", res.Code)
+	}
+
+	res, err = apiCall("POST", "/apps/"+appID+"/subscribers/bar/erase", `{"reason": "user request"}`)
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	if res.Code != http.StatusOK {
+		t.Error("Subscriber could not be erased.", res.Code)
+	}
+
+	res, err = apiCall("GET", "/apps/"+appID+"/tombstones?subscriberId=bar", "")
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	var body struct {
+		Data []struct {
+			Channels int    `json:"channels"`
+			Reason   string `json:"reason"`
+		} `json:"data"`
+	}
+
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(body.Data) != 1 || body.Data[0].Channels != 1 || body.Data[0].Reason != "user request" {
+		t.Errorf("Tombstones do not match. got %+v", body.Data)
+	}
+}
+
+func TestPreferences(t *testing.T) {
+	res, err := apiCall("PUT", "/apps/"+appID+"/subscribers/randomSubId/preferences", `{"categories": {"nosuchcategory": false}}`)
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	if res.Code != http.StatusBadRequest {
+		t.Error("Expected 400 for unknown category, got", res.Code)
+	}
+
+	putBody := `{"categories": {"promotions": false}, "channels": {"` + channelID + `": false}}`
+	res, err = apiCall("PUT", "/apps/"+appID+"/subscribers/randomSubId/preferences", putBody)
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	if res.Code != http.StatusOK {
+		t.Error("Preferences could not be updated.", res.Code)
+	}
+
+	res, err = apiCall("GET", "/apps/"+appID+"/subscribers/randomSubId/preferences", "")
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	var body struct {
+		Data storage.Preferences `json:"data"`
+	}
+
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+
+	if choice, ok := body.Data.Categories["promotions"]; !ok || choice {
+		t.Errorf("Preferences do not match. got %+v", body.Data)
+	}
+
+	postBody := `{"subscribers": ["randomSubId"], "category": "nosuchcategory", "message": {"data": {"foo": "bar"}}}`
+	res, err = apiCall("POST", "/apps/"+appID+"/publish", postBody)
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	if res.Code != http.StatusBadRequest {
+		t.Error("Expected 400 for publish with unknown category, got", res.Code)
+	}
+}
+
+func TestMergeSubscriber(t *testing.T) {
+	postBody := `{"subscriberId": "anonymousId", "platform": "gcm", "token": "anon123"}`
+	res, err := apiCall("POST", "/apps/"+appID+"/devices", postBody)
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	if res.Code != http.StatusCreated {
+		t.Error("Subscriber device could not be added.")
+	}
+
+	res, err = apiCall("POST", "/apps/"+appID+"/subscribers/anonymousId/merge", `{"into": "randomSubId"}`)
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	if res.Code != http.StatusOK {
+		t.Error("Subscriber could not be merged.", res.Code)
+	}
+
+	res, err = apiCall("GET", "/apps/"+appID+"/subscribers/randomSubId", "")
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	var body struct {
+		Data struct {
+			Devices []*storage.Device `json:"devices"`
+			Aliases []string          `json:"aliases"`
+		} `json:"data"`
+	}
+
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(body.Data.Devices) != 2 {
+		t.Errorf("Expected 2 devices after merge, got %d", len(body.Data.Devices))
+	}
+
+	if len(body.Data.Aliases) != 1 || body.Data.Aliases[0] != "anonymousId" {
+		t.Errorf("Aliases do not match. got %v, expected [anonymousId]", body.Data.Aliases)
+	}
+
+	res, err = apiCall("POST", "/apps/"+appID+"/subscribers/anonymousId/merge", `{"into": "randomSubId"}`)
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	if res.Code != http.StatusNotFound {
+		t.Error("Expected 404 for merged subscriber, got", res.Code)
+	}
+}
+
 func TestDeleteChannel(t *testing.T) {
 	res, err := apiCall("DELETE", "/apps/"+appID+"/channels/"+channelID, "")
 
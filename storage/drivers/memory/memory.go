@@ -1,113 +1,1123 @@
 package memory
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
 
 	"github.com/gamegos/scotty/storage"
 )
 
 // MemStorage records and retrieves data from memory.
 type MemStorage struct {
-	// appid+channelid -> []subscribers
-	chans map[string][]string
+	mu sync.RWMutex
+	// appid -> channelid -> set of subscribers
+	chans map[string]map[string]map[string]struct{}
 	// appid -> *storage.App
 	apps map[string]*storage.App
-	// appid+subscriberId -> Device
-	devs map[string][]*storage.Device
-	// appid -> [subs1, subs2,...]
-	subs map[string][]string
+	// appid -> segmentid -> *storage.Segment
+	segs map[string]map[string]*storage.Segment
+	// appid -> templateid -> encoded *storage.Template
+	tmpls map[string]map[string][]byte
+	// appid -> letterid -> encoded *storage.DeadLetter
+	dead map[string]map[string][]byte
+	// appid -> provider+process -> circuit
+	circuits map[string]map[string]storage.Circuit
+	// appid -> subscriberId -> devices
+	devs map[string]map[string][]*storage.Device
+	// appid -> set of subscribers
+	subs map[string]map[string]struct{}
+	// appid -> token -> subscriberId
+	tokens map[string]map[string]string
+	// appid -> alias -> subscriberId
+	aliases map[string]map[string]string
+	// appid -> subscriberId -> set of its aliases
+	aliasesOf map[string]map[string]map[string]struct{}
+	// appid -> subscriberId -> preferences
+	prefs map[string]map[string]*storage.Preferences
+	// appid -> erasure records
+	tombs map[string][]*storage.Tombstone
 }
 
+// defaultScanCount is the page size of scans without a count, the same as
+// Redis' default.
+const defaultScanCount = 10
+
 func init() {
 	storage.Register("memory", initDriver)
 }
 
-func initDriver(c map[string]interface{}) storage.Storage {
-	return New()
+func initDriver(options map[string]interface{}) (storage.Storage, error) {
+	// memory driver has no options, decode only to warn about unknown keys.
+	if err := storage.DecodeOptions(options, &struct{}{}); err != nil {
+		return nil, err
+	}
+
+	return New(), nil
 }
 
 // New initializes memory storage driver.
 func New() *MemStorage {
 	return &MemStorage{
-		chans: make(map[string][]string),
-		apps:  make(map[string]*storage.App),
-		devs:  make(map[string][]*storage.Device),
-		subs:  make(map[string][]string),
+		chans:     make(map[string]map[string]map[string]struct{}),
+		apps:      make(map[string]*storage.App),
+		segs:      make(map[string]map[string]*storage.Segment),
+		tmpls:     make(map[string]map[string][]byte),
+		dead:      make(map[string]map[string][]byte),
+		circuits:  make(map[string]map[string]storage.Circuit),
+		devs:      make(map[string]map[string][]*storage.Device),
+		subs:      make(map[string]map[string]struct{}),
+		tokens:    make(map[string]map[string]string),
+		aliases:   make(map[string]map[string]string),
+		aliasesOf: make(map[string]map[string]map[string]struct{}),
+		prefs:     make(map[string]map[string]*storage.Preferences),
+		tombs:     make(map[string][]*storage.Tombstone),
 	}
 }
 
 // PutApp creates a new app or updates existing one.
-func (stg *MemStorage) PutApp(app *storage.App) error {
-	stg.apps[app.ID] = app
+func (stg *MemStorage) PutApp(ctx context.Context, app *storage.App) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	stg.mu.Lock()
+	defer stg.mu.Unlock()
+
+	appCopy := *app
+	stg.apps[app.ID] = &appCopy
 
 	return nil
 }
 
 // GetApp gets an app's data.
-func (stg *MemStorage) GetApp(appID string) (*storage.App, error) {
+func (stg *MemStorage) GetApp(ctx context.Context, appID string) (*storage.App, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	stg.mu.RLock()
+	defer stg.mu.RUnlock()
+
 	app, ok := stg.apps[appID]
 
 	if !ok {
-		return nil, nil
+		return nil, storage.ErrNotFound
 	}
 
-	return app, nil
+	appCopy := *app
+	return &appCopy, nil
 }
 
-// AddSubscriber adds new subscriber to channel.
-func (stg *MemStorage) AddSubscriber(appID string, channelID string, subscriberIDs []string) error {
-	key := appID + "." + channelID
-	_, ok := stg.chans[key]
+// GetApps gets all apps, ordered by id.
+func (stg *MemStorage) GetApps(ctx context.Context) ([]*storage.App, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	stg.mu.RLock()
+	defer stg.mu.RUnlock()
+
+	apps := make([]*storage.App, 0, len(stg.apps))
+	for _, app := range stg.apps {
+		appCopy := *app
+		apps = append(apps, &appCopy)
+	}
+
+	sort.Slice(apps, func(i, j int) bool {
+		return apps[i].ID < apps[j].ID
+	})
+
+	return apps, nil
+}
+
+// PutSegment creates a new segment or updates existing one.
+func (stg *MemStorage) PutSegment(ctx context.Context, appID string, segment *storage.Segment) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	stg.mu.Lock()
+	defer stg.mu.Unlock()
+
+	segments, ok := stg.segs[appID]
 	if !ok {
-		stg.chans[key] = []string{}
+		segments = make(map[string]*storage.Segment)
+		stg.segs[appID] = segments
 	}
 
-	stg.chans[key] = append(stg.chans[key], subscriberIDs...)
+	segments[segment.ID] = copySegment(segment)
 
 	return nil
 }
 
-// AddChannel adds new channel to app.
-func (stg *MemStorage) AddChannel(appID string, channelID string) error {
-	key := appID + "." + channelID
-	_, ok := stg.chans[key]
+// GetSegment gets a segment of an app.
+func (stg *MemStorage) GetSegment(ctx context.Context, appID string, segmentID string) (*storage.Segment, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	stg.mu.RLock()
+	defer stg.mu.RUnlock()
+
+	segment, ok := stg.segs[appID][segmentID]
+	if !ok {
+		return nil, storage.ErrNotFound
+	}
+
+	return copySegment(segment), nil
+}
+
+// GetSegments gets all segments of an app, ordered by id.
+func (stg *MemStorage) GetSegments(ctx context.Context, appID string) ([]*storage.Segment, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	stg.mu.RLock()
+	defer stg.mu.RUnlock()
+
+	segments := make([]*storage.Segment, 0, len(stg.segs[appID]))
+	for _, segment := range stg.segs[appID] {
+		segments = append(segments, copySegment(segment))
+	}
+
+	sort.Slice(segments, func(i, j int) bool {
+		return segments[i].ID < segments[j].ID
+	})
+
+	return segments, nil
+}
+
+// DeleteSegment deletes a segment of an app.
+func (stg *MemStorage) DeleteSegment(ctx context.Context, appID string, segmentID string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	stg.mu.Lock()
+	defer stg.mu.Unlock()
+
+	if _, ok := stg.segs[appID][segmentID]; !ok {
+		return storage.ErrNotFound
+	}
+
+	delete(stg.segs[appID], segmentID)
+
+	return nil
+}
+
+// copySegment returns a copy of a segment that shares no slices with it.
+func copySegment(segment *storage.Segment) *storage.Segment {
+	segmentCopy := *segment
+	segmentCopy.Subscribers = copyStrings(segment.Subscribers)
+	segmentCopy.Channels = copyStrings(segment.Channels)
+	segmentCopy.IntersectChannels = copyStrings(segment.IntersectChannels)
+	segmentCopy.ExceptChannels = copyStrings(segment.ExceptChannels)
+	segmentCopy.ExceptSubscribers = copyStrings(segment.ExceptSubscribers)
+	return &segmentCopy
+}
+
+// PutTemplate creates a new template or updates existing one.
+func (stg *MemStorage) PutTemplate(ctx context.Context, appID string, template *storage.Template) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	// templates are kept encoded, so they share no maps with the callers.
+	templateData, err := json.Marshal(template)
+	if err != nil {
+		return err
+	}
+
+	stg.mu.Lock()
+	defer stg.mu.Unlock()
+
+	templates, ok := stg.tmpls[appID]
+	if !ok {
+		templates = make(map[string][]byte)
+		stg.tmpls[appID] = templates
+	}
+
+	templates[template.ID] = templateData
+
+	return nil
+}
+
+// GetTemplate gets a template of an app.
+func (stg *MemStorage) GetTemplate(ctx context.Context, appID string, templateID string) (*storage.Template, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	stg.mu.RLock()
+	defer stg.mu.RUnlock()
+
+	templateData, ok := stg.tmpls[appID][templateID]
+	if !ok {
+		return nil, storage.ErrNotFound
+	}
+
+	return decodeTemplate(templateData)
+}
+
+// GetTemplates gets all templates of an app, ordered by id.
+func (stg *MemStorage) GetTemplates(ctx context.Context, appID string) ([]*storage.Template, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	stg.mu.RLock()
+	defer stg.mu.RUnlock()
+
+	templates := make([]*storage.Template, 0, len(stg.tmpls[appID]))
+	for _, templateData := range stg.tmpls[appID] {
+		template, err := decodeTemplate(templateData)
+		if err != nil {
+			return nil, err
+		}
+		templates = append(templates, template)
+	}
+
+	sort.Slice(templates, func(i, j int) bool {
+		return templates[i].ID < templates[j].ID
+	})
+
+	return templates, nil
+}
+
+// DeleteTemplate deletes a template of an app.
+func (stg *MemStorage) DeleteTemplate(ctx context.Context, appID string, templateID string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	stg.mu.Lock()
+	defer stg.mu.Unlock()
+
+	if _, ok := stg.tmpls[appID][templateID]; !ok {
+		return storage.ErrNotFound
+	}
+
+	delete(stg.tmpls[appID], templateID)
+
+	return nil
+}
+
+func decodeTemplate(templateData []byte) (*storage.Template, error) {
+	var template *storage.Template
+	if err := json.Unmarshal(templateData, &template); err != nil {
+		return nil, err
+	}
+	return template, nil
+}
+
+// PutDeadLetters records dead letters, replacing the ones with the same ids.
+// Expired dead letters of the app are removed.
+func (stg *MemStorage) PutDeadLetters(ctx context.Context, appID string, letters []*storage.DeadLetter) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	// dead letters are kept encoded as templates are.
+	encoded := make([][]byte, len(letters))
+	for i, letter := range letters {
+		letterData, err := json.Marshal(letter)
+		if err != nil {
+			return err
+		}
+		encoded[i] = letterData
+	}
+
+	stg.mu.Lock()
+	defer stg.mu.Unlock()
+
+	if _, err := stg.deadLetters(appID); err != nil {
+		return err
+	}
+
+	dead, ok := stg.dead[appID]
 	if !ok {
-		stg.chans[key] = []string{}
+		dead = make(map[string][]byte)
+		stg.dead[appID] = dead
+	}
+
+	now := int(time.Now().Unix())
+	for i, letter := range letters {
+		if letter.ExpiresAt > now {
+			dead[letter.ID] = encoded[i]
+		}
 	}
 
 	return nil
 }
 
+// GetDeadLetter gets a dead letter of an app.
+func (stg *MemStorage) GetDeadLetter(ctx context.Context, appID string, letterID string) (*storage.DeadLetter, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	stg.mu.RLock()
+	defer stg.mu.RUnlock()
+
+	letterData, ok := stg.dead[appID][letterID]
+	if !ok {
+		return nil, storage.ErrNotFound
+	}
+
+	letter, err := decodeDeadLetter(letterData)
+	if err != nil {
+		return nil, err
+	}
+
+	if letter.ExpiresAt <= int(time.Now().Unix()) {
+		return nil, storage.ErrNotFound
+	}
+
+	return letter, nil
+}
+
+// ScanDeadLetters gets a page of the dead letters of an app, in the order they
+// expire. Cursors are offsets in that order.
+func (stg *MemStorage) ScanDeadLetters(ctx context.Context, appID string, cursor string, count int) ([]*storage.DeadLetter, string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, "", err
+	}
+
+	if count <= 0 {
+		count = defaultScanCount
+	}
+
+	start := 0
+	if cursor != "" {
+		var err error
+		if start, err = strconv.Atoi(cursor); err != nil || start < 0 {
+			return nil, "", errors.New("memory: invalid dead letter cursor")
+		}
+	}
+
+	stg.mu.Lock()
+	defer stg.mu.Unlock()
+
+	letters, err := stg.deadLetters(appID)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if start >= len(letters) {
+		return nil, "", nil
+	}
+
+	end := start + count
+	if end >= len(letters) {
+		return letters[start:], "", nil
+	}
+
+	return letters[start:end], strconv.Itoa(end), nil
+}
+
+// DeleteDeadLetters deletes dead letters of an app.
+func (stg *MemStorage) DeleteDeadLetters(ctx context.Context, appID string, letterIDs []string) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	stg.mu.Lock()
+	defer stg.mu.Unlock()
+
+	if _, err := stg.deadLetters(appID); err != nil {
+		return 0, err
+	}
+
+	deleted := 0
+	for _, letterID := range letterIDs {
+		if _, ok := stg.dead[appID][letterID]; ok {
+			delete(stg.dead[appID], letterID)
+			deleted++
+		}
+	}
+
+	return deleted, nil
+}
+
+// deadLetters removes the expired dead letters of an app and returns the
+// others in the order they expire. stg.mu must be locked for writing.
+func (stg *MemStorage) deadLetters(appID string) ([]*storage.DeadLetter, error) {
+	now := int(time.Now().Unix())
+
+	letters := make([]*storage.DeadLetter, 0, len(stg.dead[appID]))
+	for letterID, letterData := range stg.dead[appID] {
+		letter, err := decodeDeadLetter(letterData)
+		if err != nil {
+			return nil, err
+		}
+
+		if letter.ExpiresAt <= now {
+			delete(stg.dead[appID], letterID)
+			continue
+		}
+
+		letters = append(letters, letter)
+	}
+
+	sort.Slice(letters, func(i, j int) bool {
+		if letters[i].ExpiresAt != letters[j].ExpiresAt {
+			return letters[i].ExpiresAt < letters[j].ExpiresAt
+		}
+		return letters[i].ID < letters[j].ID
+	})
+
+	return letters, nil
+}
+
+// PutCircuits records the circuits reported by processes, replacing earlier
+// reports of the same app, provider and process.
+func (stg *MemStorage) PutCircuits(ctx context.Context, circuits []*storage.Circuit) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	stg.mu.Lock()
+	defer stg.mu.Unlock()
+
+	for _, circuit := range circuits {
+		appCircuits, ok := stg.circuits[circuit.AppID]
+		if !ok {
+			appCircuits = make(map[string]storage.Circuit)
+			stg.circuits[circuit.AppID] = appCircuits
+		}
+		appCircuits[circuit.Provider+"/"+circuit.Process] = *circuit
+	}
+
+	return nil
+}
+
+// GetCircuits gets the circuits reported for an app, or for all apps if appID
+// is empty. Expired reports are skipped.
+func (stg *MemStorage) GetCircuits(ctx context.Context, appID string) ([]*storage.Circuit, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	stg.mu.RLock()
+	defer stg.mu.RUnlock()
+
+	now := int(time.Now().Unix())
+	circuits := []*storage.Circuit{}
+
+	for circuitAppID, appCircuits := range stg.circuits {
+		if appID != "" && circuitAppID != appID {
+			continue
+		}
+
+		for _, circuit := range appCircuits {
+			if circuit.ExpiresAt > now {
+				c := circuit
+				circuits = append(circuits, &c)
+			}
+		}
+	}
+
+	sort.Slice(circuits, func(i, j int) bool {
+		a, b := circuits[i], circuits[j]
+		if a.AppID != b.AppID {
+			return a.AppID < b.AppID
+		}
+		if a.Provider != b.Provider {
+			return a.Provider < b.Provider
+		}
+		return a.Process < b.Process
+	})
+
+	return circuits, nil
+}
+
+func decodeDeadLetter(letterData []byte) (*storage.DeadLetter, error) {
+	var letter *storage.DeadLetter
+	if err := json.Unmarshal(letterData, &letter); err != nil {
+		return nil, err
+	}
+	return letter, nil
+}
+
+func copyStrings(values []string) []string {
+	if values == nil {
+		return nil
+	}
+	return append([]string(nil), values...)
+}
+
+// AddSubscriber adds new subscriber to channel.
+func (stg *MemStorage) AddSubscriber(ctx context.Context, appID string, channelID string, subscriberIDs []string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	stg.mu.Lock()
+	defer stg.mu.Unlock()
+
+	members := stg.addChannel(appID, channelID)
+	for _, subscriberID := range subscriberIDs {
+		members[subscriberID] = struct{}{}
+	}
+
+	return nil
+}
+
+// AddChannel adds new channel to app.
+func (stg *MemStorage) AddChannel(ctx context.Context, appID string, channelID string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	stg.mu.Lock()
+	defer stg.mu.Unlock()
+
+	stg.addChannel(appID, channelID)
+
+	return nil
+}
+
+// addChannel creates the channel if it does not exist and returns its
+// members. Callers must hold the write lock.
+func (stg *MemStorage) addChannel(appID string, channelID string) map[string]struct{} {
+	chans, ok := stg.chans[appID]
+	if !ok {
+		chans = make(map[string]map[string]struct{})
+		stg.chans[appID] = chans
+	}
+
+	members, ok := chans[channelID]
+	if !ok {
+		members = make(map[string]struct{})
+		chans[channelID] = members
+	}
+
+	return members
+}
+
 // DeleteChannel deletes channel and its subscribers from app.
-func (stg *MemStorage) DeleteChannel(appID string, channelID string) error {
-	key := appID + "." + channelID
-	delete(stg.chans, key)
+func (stg *MemStorage) DeleteChannel(ctx context.Context, appID string, channelID string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	stg.mu.Lock()
+	defer stg.mu.Unlock()
+
+	delete(stg.chans[appID], channelID)
 
 	return nil
 }
 
-// AddSubscriberDevice adds new device to subscriber.
-func (stg *MemStorage) AddSubscriberDevice(appID string, subscriberID string, device *storage.Device) error {
-	key := appID + "." + subscriberID
+// AddSubscriberDevice adds new device to subscriber. A device with the same
+// token is moved from its previous owner.
+func (stg *MemStorage) AddSubscriberDevice(ctx context.Context, appID string, subscriberID string, device *storage.Device) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	stg.mu.Lock()
+	defer stg.mu.Unlock()
 
-	stg.devs[key] = append(stg.devs[key], device)
+	stg.putDevice(appID, subscriberID, copyDevice(device))
 
 	return nil
 }
 
 // UpdateDeviceToken updates token of a subscriber's device.
-func (stg *MemStorage) UpdateDeviceToken(appID string, subscriberID string, oldDeviceToken string, newDeviceToken string) error {
+func (stg *MemStorage) UpdateDeviceToken(ctx context.Context, appID string, subscriberID string, oldDeviceToken string, newDeviceToken string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 
-	key := appID + "." + subscriberID
-	devices, ok := stg.devs[key]
+	stg.mu.Lock()
+	defer stg.mu.Unlock()
 
+	device := stg.removeDevice(appID, subscriberID, oldDeviceToken)
+	if device == nil {
+		return storage.ErrNotFound
+	}
+
+	device.Token = newDeviceToken
+	stg.putDevice(appID, subscriberID, device)
+
+	return nil
+}
+
+// GetDeviceOwner gets the subscriber that owns a device token.
+func (stg *MemStorage) GetDeviceOwner(ctx context.Context, appID string, token string) (string, *storage.Device, error) {
+	if err := ctx.Err(); err != nil {
+		return "", nil, err
+	}
+
+	stg.mu.RLock()
+	defer stg.mu.RUnlock()
+
+	subscriberID, ok := stg.tokens[appID][token]
 	if !ok {
-		return errors.New("Device not found.")
+		return "", nil, storage.ErrNotFound
+	}
+
+	for _, device := range stg.devs[appID][subscriberID] {
+		if device.Token == token {
+			return subscriberID, copyDevice(device), nil
+		}
+	}
+
+	return "", nil, storage.ErrNotFound
+}
+
+// GetSubscriberChannels gets the channels a subscriber is a member of.
+func (stg *MemStorage) GetSubscriberChannels(ctx context.Context, appID string, subscriberID string) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	stg.mu.RLock()
+	defer stg.mu.RUnlock()
+
+	channels := []string{}
+	stg.eachSubscriberChannel(appID, subscriberID, func(channelID string, members map[string]struct{}) {
+		channels = append(channels, channelID)
+	})
+
+	sort.Strings(channels)
+
+	return channels, nil
+}
+
+// DeleteSubscriber deletes a subscriber with its devices, channel
+// memberships, aliases and preferences.
+func (stg *MemStorage) DeleteSubscriber(ctx context.Context, appID string, subscriberID string) error {
+	if err := ctx.Err(); err != nil {
+		return err
 	}
 
+	stg.mu.Lock()
+	defer stg.mu.Unlock()
+
+	devices := stg.devs[appID][subscriberID]
+	found := len(devices) > 0
+
 	for _, device := range devices {
-		if device.Token == oldDeviceToken {
-			device.Token = newDeviceToken
+		delete(stg.tokens[appID], device.Token)
+	}
+	delete(stg.devs[appID], subscriberID)
+
+	if _, ok := stg.subs[appID][subscriberID]; ok {
+		delete(stg.subs[appID], subscriberID)
+		found = true
+	}
+
+	stg.eachSubscriberChannel(appID, subscriberID, func(channelID string, members map[string]struct{}) {
+		delete(members, subscriberID)
+		found = true
+	})
+
+	if _, ok := stg.aliases[appID][subscriberID]; ok {
+		stg.deleteAlias(appID, subscriberID)
+		found = true
+	}
+
+	for _, alias := range stg.subscriberAliases(appID, subscriberID) {
+		stg.deleteAlias(appID, alias)
+		found = true
+	}
+
+	if _, ok := stg.prefs[appID][subscriberID]; ok {
+		delete(stg.prefs[appID], subscriberID)
+		found = true
+	}
+
+	if !found {
+		return storage.ErrNotFound
+	}
+
+	return nil
+}
+
+// MergeSubscriber moves the devices and channel memberships of source to
+// target and makes source and its aliases aliases of target. Preferences of
+// source are moved if target has none.
+func (stg *MemStorage) MergeSubscriber(ctx context.Context, appID string, sourceID string, targetID string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	stg.mu.Lock()
+	defer stg.mu.Unlock()
+
+	devices := stg.devs[appID][sourceID]
+	found := len(devices) > 0
+
+	delete(stg.devs[appID], sourceID)
+	delete(stg.subs[appID], sourceID)
+	for _, device := range devices {
+		stg.putDevice(appID, targetID, device)
+	}
+
+	stg.eachSubscriberChannel(appID, sourceID, func(channelID string, members map[string]struct{}) {
+		delete(members, sourceID)
+		members[targetID] = struct{}{}
+		found = true
+	})
+
+	if !found {
+		return storage.ErrNotFound
+	}
+
+	for _, alias := range stg.subscriberAliases(appID, sourceID) {
+		if alias == targetID {
+			stg.deleteAlias(appID, alias)
+			continue
+		}
+		stg.setAlias(appID, alias, targetID)
+	}
+	stg.setAlias(appID, sourceID, targetID)
+
+	if prefs, ok := stg.prefs[appID][sourceID]; ok {
+		delete(stg.prefs[appID], sourceID)
+		if _, ok := stg.prefs[appID][targetID]; !ok {
+			stg.prefs[appID][targetID] = prefs
+		}
+	}
+
+	return nil
+}
+
+// ResolveAliases maps the aliases among subscriberIDs to their subscribers.
+func (stg *MemStorage) ResolveAliases(ctx context.Context, appID string, subscriberIDs []string) (map[string]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	stg.mu.RLock()
+	defer stg.mu.RUnlock()
+
+	result := make(map[string]string)
+	for _, subscriberID := range subscriberIDs {
+		if target, ok := stg.aliases[appID][subscriberID]; ok {
+			result[subscriberID] = target
+		}
+	}
+
+	return result, nil
+}
+
+// GetSubscriberAliases gets the ids merged into a subscriber.
+func (stg *MemStorage) GetSubscriberAliases(ctx context.Context, appID string, subscriberID string) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	stg.mu.RLock()
+	defer stg.mu.RUnlock()
+
+	aliases := stg.subscriberAliases(appID, subscriberID)
+	sort.Strings(aliases)
+
+	return aliases, nil
+}
+
+// PutPreferences replaces the preferences of a subscriber.
+func (stg *MemStorage) PutPreferences(ctx context.Context, appID string, subscriberID string, prefs *storage.Preferences) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	stg.mu.Lock()
+	defer stg.mu.Unlock()
+
+	appPrefs, ok := stg.prefs[appID]
+	if !ok {
+		appPrefs = make(map[string]*storage.Preferences)
+		stg.prefs[appID] = appPrefs
+	}
+	appPrefs[subscriberID] = copyPreferences(prefs)
+
+	return nil
+}
+
+// GetPreferences gets the preferences of a subscriber.
+func (stg *MemStorage) GetPreferences(ctx context.Context, appID string, subscriberID string) (*storage.Preferences, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	stg.mu.RLock()
+	defer stg.mu.RUnlock()
+
+	prefs, ok := stg.prefs[appID][subscriberID]
+	if !ok {
+		return &storage.Preferences{}, nil
+	}
+
+	return copyPreferences(prefs), nil
+}
+
+// FilterCategoryChoices returns the subscribers that opted in to or out of a
+// category.
+func (stg *MemStorage) FilterCategoryChoices(ctx context.Context, appID string, categoryID string, optIn bool, subscriberIDs []string) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	stg.mu.RLock()
+	defer stg.mu.RUnlock()
+
+	result := make([]string, 0, len(subscriberIDs))
+	for _, subscriberID := range subscriberIDs {
+		prefs, ok := stg.prefs[appID][subscriberID]
+		if !ok {
+			continue
+		}
+
+		if choice, ok := prefs.Categories[categoryID]; ok && choice == optIn {
+			result = append(result, subscriberID)
+		}
+	}
+
+	return result, nil
+}
+
+// FilterChannelOptOuts returns the subscribers that opted out of a channel.
+func (stg *MemStorage) FilterChannelOptOuts(ctx context.Context, appID string, channelID string, subscriberIDs []string) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	stg.mu.RLock()
+	defer stg.mu.RUnlock()
+
+	result := make([]string, 0, len(subscriberIDs))
+	for _, subscriberID := range subscriberIDs {
+		prefs, ok := stg.prefs[appID][subscriberID]
+		if !ok {
+			continue
+		}
+
+		if choice, ok := prefs.Channels[channelID]; ok && !choice {
+			result = append(result, subscriberID)
+		}
+	}
+
+	return result, nil
+}
+
+func copyPreferences(prefs *storage.Preferences) *storage.Preferences {
+	return &storage.Preferences{
+		Categories: copyChoices(prefs.Categories),
+		Channels:   copyChoices(prefs.Channels),
+	}
+}
+
+func copyChoices(choices map[string]bool) map[string]bool {
+	if choices == nil {
+		return nil
+	}
+
+	result := make(map[string]bool, len(choices))
+	for id, choice := range choices {
+		result[id] = choice
+	}
+	return result
+}
+
+// subscriberAliases returns the aliases of a subscriber in no particular
+// order. Callers must hold the lock.
+func (stg *MemStorage) subscriberAliases(appID string, subscriberID string) []string {
+	aliases := []string{}
+	for alias := range stg.aliasesOf[appID][subscriberID] {
+		aliases = append(aliases, alias)
+	}
+	return aliases
+}
+
+// setAlias makes alias an alias of subscriberID, replacing its previous
+// target. Callers must hold the write lock.
+func (stg *MemStorage) setAlias(appID string, alias string, subscriberID string) {
+	stg.deleteAlias(appID, alias)
+
+	aliases, ok := stg.aliases[appID]
+	if !ok {
+		aliases = make(map[string]string)
+		stg.aliases[appID] = aliases
+	}
+	aliases[alias] = subscriberID
+
+	aliasesOf, ok := stg.aliasesOf[appID]
+	if !ok {
+		aliasesOf = make(map[string]map[string]struct{})
+		stg.aliasesOf[appID] = aliasesOf
+	}
+
+	set, ok := aliasesOf[subscriberID]
+	if !ok {
+		set = make(map[string]struct{})
+		aliasesOf[subscriberID] = set
+	}
+	set[alias] = struct{}{}
+}
+
+// deleteAlias deletes an alias and its reverse index entry. Callers must hold
+// the write lock.
+func (stg *MemStorage) deleteAlias(appID string, alias string) {
+	target, ok := stg.aliases[appID][alias]
+	if !ok {
+		return
+	}
+
+	delete(stg.aliases[appID], alias)
+
+	set := stg.aliasesOf[appID][target]
+	delete(set, alias)
+	if len(set) == 0 {
+		delete(stg.aliasesOf[appID], target)
+	}
+}
+
+// eachSubscriberChannel calls fn with the channels of an app the subscriber
+// is a member of. Callers must hold the lock.
+func (stg *MemStorage) eachSubscriberChannel(appID string, subscriberID string, fn func(channelID string, members map[string]struct{})) {
+	for channelID, members := range stg.chans[appID] {
+		if _, ok := members[subscriberID]; ok {
+			fn(channelID, members)
+		}
+	}
+}
+
+// AddTombstone records the erasure of a subscriber.
+func (stg *MemStorage) AddTombstone(ctx context.Context, appID string, tombstone *storage.Tombstone) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	stg.mu.Lock()
+	defer stg.mu.Unlock()
+
+	tombstoneCopy := *tombstone
+	stg.tombs[appID] = append(stg.tombs[appID], &tombstoneCopy)
+
+	return nil
+}
+
+// GetTombstones gets the erasure records of an app, oldest first.
+func (stg *MemStorage) GetTombstones(ctx context.Context, appID string) ([]*storage.Tombstone, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	stg.mu.RLock()
+	defer stg.mu.RUnlock()
+
+	tombstones := make([]*storage.Tombstone, 0, len(stg.tombs[appID]))
+	for _, tombstone := range stg.tombs[appID] {
+		tombstoneCopy := *tombstone
+		tombstones = append(tombstones, &tombstoneCopy)
+	}
+
+	return tombstones, nil
+}
+
+// PruneSubscriber deletes the devices of a subscriber last seen before the
+// unix timestamp before, and the subscriber if it is left without devices.
+func (stg *MemStorage) PruneSubscriber(ctx context.Context, appID string, subscriberID string, before int) (*storage.PruneResult, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	stg.mu.Lock()
+	defer stg.mu.Unlock()
+
+	result := &storage.PruneResult{}
+
+	var kept []*storage.Device
+	for _, device := range stg.devs[appID][subscriberID] {
+		if device.SeenAt() >= before {
+			kept = append(kept, device)
+			continue
+		}
+
+		result.Devices = append(result.Devices, device)
+		delete(stg.tokens[appID], device.Token)
+	}
+
+	if len(kept) > 0 {
+		stg.devs[appID][subscriberID] = kept
+		return result, nil
+	}
+
+	delete(stg.devs[appID], subscriberID)
+
+	if _, ok := stg.subs[appID][subscriberID]; !ok {
+		return result, nil
+	}
+
+	delete(stg.subs[appID], subscriberID)
+	delete(stg.prefs[appID], subscriberID)
+	result.SubscriberRemoved = true
+
+	stg.eachSubscriberChannel(appID, subscriberID, func(channelID string, members map[string]struct{}) {
+		delete(members, subscriberID)
+		if len(members) == 0 {
+			delete(stg.chans[appID], channelID)
+			result.Channels = append(result.Channels, channelID)
+		}
+	})
+
+	sort.Strings(result.Channels)
+
+	return result, nil
+}
+
+// putDevice stores device under subscriber and updates the token index,
+// removing the token from its previous owner. Callers must hold the write
+// lock.
+func (stg *MemStorage) putDevice(appID string, subscriberID string, device *storage.Device) {
+	subs, ok := stg.subs[appID]
+	if !ok {
+		subs = make(map[string]struct{})
+		stg.subs[appID] = subs
+	}
+	subs[subscriberID] = struct{}{}
+
+	tokens, ok := stg.tokens[appID]
+	if !ok {
+		tokens = make(map[string]string)
+		stg.tokens[appID] = tokens
+	}
+
+	if owner, ok := tokens[device.Token]; ok {
+		stg.removeDevice(appID, owner, device.Token)
+	}
+
+	devs, ok := stg.devs[appID]
+	if !ok {
+		devs = make(map[string][]*storage.Device)
+		stg.devs[appID] = devs
+	}
+
+	devs[subscriberID] = append(devs[subscriberID], device)
+	tokens[device.Token] = subscriberID
+}
+
+// removeDevice removes the device with token from subscriber and returns it,
+// or nil if the subscriber has no such device. Callers must hold the write
+// lock.
+func (stg *MemStorage) removeDevice(appID string, subscriberID string, token string) *storage.Device {
+	devices := stg.devs[appID][subscriberID]
+
+	for i, device := range devices {
+		if device.Token == token {
+			stg.devs[appID][subscriberID] = append(devices[:i:i], devices[i+1:]...)
+			delete(stg.tokens[appID], token)
+			return device
 		}
 	}
 
@@ -115,17 +1125,254 @@ func (stg *MemStorage) UpdateDeviceToken(appID string, subscriberID string, oldD
 }
 
 // GetChannelSubscribers gets subscribers of a channel.
-func (stg *MemStorage) GetChannelSubscribers(appID string, channelID string) ([]string, error) {
+func (stg *MemStorage) GetChannelSubscribers(ctx context.Context, appID string, channelID string) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	stg.mu.RLock()
+	defer stg.mu.RUnlock()
+
+	members := stg.chans[appID][channelID]
+
+	subscribers := make([]string, 0, len(members))
+	for subscriberID := range members {
+		subscribers = append(subscribers, subscriberID)
+	}
+
+	return subscribers, nil
+}
+
+// ScanChannelSubscribers gets a page of channel subscribers starting at
+// cursor. Members are scanned in sorted order and the cursor is the last
+// member of the previous page.
+func (stg *MemStorage) ScanChannelSubscribers(ctx context.Context, appID string, channelID string, cursor string, count int) ([]string, string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, "", err
+	}
+
+	stg.mu.RLock()
+	defer stg.mu.RUnlock()
 
-	key := appID + "." + channelID
-	return stg.chans[key], nil
+	page, next := scanSet(stg.chans[appID][channelID], cursor, count)
+
+	return page, next, nil
+}
+
+// ScanChannelsIntersection gets a page of the subscribers that are members of
+// every channel of channelIDs and of none of exceptChannelIDs. The set is
+// computed on each page and scanned as in ScanChannelSubscribers.
+func (stg *MemStorage) ScanChannelsIntersection(ctx context.Context, appID string, channelIDs []string, exceptChannelIDs []string, cursor string, count int) ([]string, string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, "", err
+	}
+
+	if len(channelIDs) == 0 {
+		return nil, "", errors.New("memory: intersection of no channels")
+	}
+
+	stg.mu.RLock()
+	defer stg.mu.RUnlock()
+
+	result := make(map[string]struct{})
+
+members:
+	for subscriberID := range stg.chans[appID][channelIDs[0]] {
+		for _, channelID := range channelIDs[1:] {
+			if _, ok := stg.chans[appID][channelID][subscriberID]; !ok {
+				continue members
+			}
+		}
+
+		for _, channelID := range exceptChannelIDs {
+			if _, ok := stg.chans[appID][channelID][subscriberID]; ok {
+				continue members
+			}
+		}
+
+		result[subscriberID] = struct{}{}
+	}
+
+	page, next := scanSet(result, cursor, count)
+
+	return page, next, nil
+}
+
+// ScanSubscribers gets a page of the subscribers that registered a device to
+// an app.
+func (stg *MemStorage) ScanSubscribers(ctx context.Context, appID string, cursor string, count int) ([]string, string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, "", err
+	}
+
+	stg.mu.RLock()
+	defer stg.mu.RUnlock()
+
+	page, next := scanSet(stg.subs[appID], cursor, count)
+
+	return page, next, nil
+}
+
+// ScanAttributeSubscribers gets a page of the subscribers that have a device
+// with the attribute set to value. Memory driver keeps no indexes, it scans
+// all subscribers of the app.
+func (stg *MemStorage) ScanAttributeSubscribers(ctx context.Context, appID string, attribute string, value string, cursor string, count int) ([]string, string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, "", err
+	}
+
+	stg.mu.RLock()
+	defer stg.mu.RUnlock()
+
+	matching := make(map[string]struct{})
+	for subscriberID := range stg.subs[appID] {
+		if stg.hasAttribute(appID, subscriberID, attribute, value) {
+			matching[subscriberID] = struct{}{}
+		}
+	}
+
+	page, next := scanSet(matching, cursor, count)
+
+	return page, next, nil
+}
+
+// FilterAttributeSubscribers returns the subscribers that have a device with
+// the attribute set to value.
+func (stg *MemStorage) FilterAttributeSubscribers(ctx context.Context, appID string, attribute string, value string, subscriberIDs []string) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	stg.mu.RLock()
+	defer stg.mu.RUnlock()
+
+	result := make([]string, 0, len(subscriberIDs))
+	for _, subscriberID := range subscriberIDs {
+		if stg.hasAttribute(appID, subscriberID, attribute, value) {
+			result = append(result, subscriberID)
+		}
+	}
+
+	return result, nil
+}
+
+// hasAttribute reports whether the subscriber has a device with the attribute
+// set to value. Callers must hold the lock.
+func (stg *MemStorage) hasAttribute(appID string, subscriberID string, attribute string, value string) bool {
+	for _, device := range stg.devs[appID][subscriberID] {
+		if v, _ := device.Attribute(attribute); v == value {
+			return true
+		}
+	}
+
+	return false
+}
+
+// scanSet returns a page of count members of set in sorted order, starting
+// after cursor. The cursor of the next page is the last member of the page,
+// or empty if the scan is complete.
+func scanSet(set map[string]struct{}, cursor string, count int) ([]string, string) {
+	if count <= 0 {
+		count = defaultScanCount
+	}
+
+	sorted := make([]string, 0, len(set))
+	for member := range set {
+		sorted = append(sorted, member)
+	}
+	sort.Strings(sorted)
+
+	start := 0
+	if cursor != "" {
+		start = sort.Search(len(sorted), func(i int) bool { return sorted[i] > cursor })
+	}
+
+	end := start + count
+	if end >= len(sorted) {
+		return sorted[start:], ""
+	}
+
+	return sorted[start:end], sorted[end-1]
+}
+
+// FilterChannelMembers returns the subscribers that are members of the
+// channel.
+func (stg *MemStorage) FilterChannelMembers(ctx context.Context, appID string, channelID string, subscriberIDs []string) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	stg.mu.RLock()
+	defer stg.mu.RUnlock()
+
+	members := stg.chans[appID][channelID]
+	result := make([]string, 0, len(subscriberIDs))
+	for _, subscriberID := range subscriberIDs {
+		if _, ok := members[subscriberID]; ok {
+			result = append(result, subscriberID)
+		}
+	}
+
+	return result, nil
 }
 
 // GetSubscriberDevices gets devices of a subscriber.
-func (stg *MemStorage) GetSubscriberDevices(appID string, subscriberID string) ([]*storage.Device, error) {
+func (stg *MemStorage) GetSubscriberDevices(ctx context.Context, appID string, subscriberID string) ([]*storage.Device, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	stg.mu.RLock()
+	defer stg.mu.RUnlock()
+
+	devices := make([]*storage.Device, 0, len(stg.devs[appID][subscriberID]))
+	for _, device := range stg.devs[appID][subscriberID] {
+		devices = append(devices, copyDevice(device))
+	}
+
+	return devices, nil
+}
+
+// GetSubscribersDevices resolves devices of many subscribers at once.
+func (stg *MemStorage) GetSubscribersDevices(ctx context.Context, appID string, subscriberIDs []string, fn storage.DevicesFunc) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	// copy devices in a single lock section and call fn without holding the
+	// lock, so fn may use the storage.
+	stg.mu.RLock()
+	resolved := make([][]*storage.Device, len(subscriberIDs))
+	for i, subscriberID := range subscriberIDs {
+		devs := stg.devs[appID][subscriberID]
+		devices := make([]*storage.Device, len(devs))
+		for j, device := range devs {
+			devices[j] = copyDevice(device)
+		}
+		resolved[i] = devices
+	}
+	stg.mu.RUnlock()
 
-	key := appID + "." + subscriberID
-	device, _ := stg.devs[key]
+	for i, subscriberID := range subscriberIDs {
+		if err := fn(subscriberID, resolved[i]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// copyDevice returns a deep copy of device, so stored devices are not shared
+// with callers.
+func copyDevice(device *storage.Device) *storage.Device {
+	deviceCopy := *device
+
+	if device.Tags != nil {
+		deviceCopy.Tags = make(map[string]string, len(device.Tags))
+		for k, v := range device.Tags {
+			deviceCopy.Tags[k] = v
+		}
+	}
 
-	return device, nil
+	return &deviceCopy
 }
@@ -1,12 +1,14 @@
 package memory
 
 import (
+	"context"
 	"os"
 	"reflect"
 	"sort"
 	"testing"
 
 	"github.com/gamegos/scotty/storage"
+	"github.com/gamegos/scotty/storage/storagetest"
 )
 
 var appID = "fritestapp"
@@ -15,6 +17,8 @@ var subscriberIDs = []string{"sub_foo", "sub_bar"}
 
 var stg storage.Storage
 
+var ctx = context.Background()
+
 func TestMain(m *testing.M) {
 	stg = New()
 	os.Exit(m.Run())
@@ -30,7 +34,7 @@ func TestPutApp(t *testing.T) {
 		},
 	}
 
-	err := stg.PutApp(app)
+	err := stg.PutApp(ctx, app)
 
 	if err != nil {
 		t.Error(err)
@@ -39,7 +43,7 @@ func TestPutApp(t *testing.T) {
 
 func TestGetApp(t *testing.T) {
 
-	_, err := stg.GetApp(appID)
+	_, err := stg.GetApp(ctx, appID)
 
 	if err != nil {
 		t.Error(err)
@@ -48,7 +52,7 @@ func TestGetApp(t *testing.T) {
 
 func TestAddChannel(t *testing.T) {
 
-	err := stg.AddChannel(appID, channelID)
+	err := stg.AddChannel(ctx, appID, channelID)
 
 	if err != nil {
 		t.Error(err)
@@ -57,7 +61,7 @@ func TestAddChannel(t *testing.T) {
 
 func TestAddSubscriber(t *testing.T) {
 
-	err := stg.AddSubscriber(appID, channelID, subscriberIDs)
+	err := stg.AddSubscriber(ctx, appID, channelID, subscriberIDs)
 
 	if err != nil {
 		t.Error(err)
@@ -66,7 +70,7 @@ func TestAddSubscriber(t *testing.T) {
 
 func TestGetChannelSubscribers(t *testing.T) {
 
-	receivedSubscribers, err := stg.GetChannelSubscribers(appID, channelID)
+	receivedSubscribers, err := stg.GetChannelSubscribers(ctx, appID, channelID)
 
 	if err != nil {
 		t.Error(err)
@@ -82,14 +86,15 @@ func TestGetChannelSubscribers(t *testing.T) {
 
 func TestAddSubscriberDevice(t *testing.T) {
 
-	device := storage.Device{
-		Platform:  "gcm",
-		Token:     "footoken",
-		CreatedAt: 1436546411,
-	}
-
 	for _, subscriberID := range subscriberIDs {
-		err := stg.AddSubscriberDevice(appID, subscriberID, &device)
+		// a token belongs to a single subscriber.
+		device := storage.Device{
+			Platform:  "gcm",
+			Token:     subscriberID + "_footoken",
+			CreatedAt: 1436546411,
+		}
+
+		err := stg.AddSubscriberDevice(ctx, appID, subscriberID, &device)
 
 		if err != nil {
 			t.Error(err)
@@ -100,7 +105,7 @@ func TestAddSubscriberDevice(t *testing.T) {
 func TestUpdateDeviceToken(t *testing.T) {
 
 	for _, subscriberID := range subscriberIDs {
-		err := stg.UpdateDeviceToken(appID, subscriberID, "footoken", "bartoken")
+		err := stg.UpdateDeviceToken(ctx, appID, subscriberID, subscriberID+"_footoken", subscriberID+"_bartoken")
 
 		if err != nil {
 			t.Error(err)
@@ -112,11 +117,11 @@ func TestGetSubscriberDevices(t *testing.T) {
 
 	expectedDevice := storage.Device{
 		Platform:  "gcm",
-		Token:     "bartoken",
+		Token:     subscriberIDs[0] + "_bartoken",
 		CreatedAt: 1436546411,
 	}
 
-	devices, err := stg.GetSubscriberDevices(appID, subscriberIDs[0])
+	devices, err := stg.GetSubscriberDevices(ctx, appID, subscriberIDs[0])
 
 	if err != nil {
 		t.Error(err)
@@ -131,9 +136,15 @@ func TestGetSubscriberDevices(t *testing.T) {
 
 func TestDeleteChannel(t *testing.T) {
 
-	err := stg.DeleteChannel(appID, channelID)
+	err := stg.DeleteChannel(ctx, appID, channelID)
 
 	if err != nil {
 		t.Error(err)
 	}
 }
+
+func TestConformance(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storage.Storage {
+		return New()
+	})
+}
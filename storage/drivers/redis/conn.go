@@ -1,6 +1,10 @@
 package redis
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
 	"time"
 
 	"github.com/gamegos/scotty/storage"
@@ -19,17 +23,33 @@ type Config struct {
 	MaxActive   int
 	IdleTimeout int
 	Wait        bool
+
+	// Connection timeouts, e.g. "500ms". Zero means no timeout. A context
+	// deadline shorter than ReadTimeout overrides it for a single command.
+	ConnectTimeout time.Duration
+	ReadTimeout    time.Duration
+	WriteTimeout   time.Duration
 }
 
 // New initializes storage with the given config.
 func New(conf *Config) *RedisStorage {
-	pool := &redigo.Pool{
+	return &RedisStorage{pool: NewPool(conf), readTimeout: conf.ReadTimeout}
+}
+
+// NewPool creates a pool of connections to Redis with the given config, so
+// other Redis backed components share its options.
+func NewPool(conf *Config) *redigo.Pool {
+	return &redigo.Pool{
 		MaxIdle:     conf.MaxIdle,
 		MaxActive:   conf.MaxActive,
 		IdleTimeout: time.Duration(conf.IdleTimeout) * time.Second,
 		Wait:        conf.Wait,
 		Dial: func() (redigo.Conn, error) {
-			c, err := redigo.Dial(conf.Network, conf.Addr)
+			c, err := redigo.Dial(conf.Network, conf.Addr,
+				redigo.DialConnectTimeout(conf.ConnectTimeout),
+				redigo.DialReadTimeout(conf.ReadTimeout),
+				redigo.DialWriteTimeout(conf.WriteTimeout),
+			)
 			if err != nil {
 				return nil, err
 			}
@@ -41,51 +61,170 @@ func New(conf *Config) *RedisStorage {
 			return err
 		},
 	}
-
-	return &RedisStorage{pool}
 }
 
-func initDriver(config map[string]interface{}) storage.Storage {
-	conf, err := configFromMap(config)
+func initDriver(options map[string]interface{}) (storage.Storage, error) {
+	conf, err := configFromMap(options)
 	if err != nil {
-		panic("adapter:redis: invalid config. " + err.Error())
+		return nil, fmt.Errorf("invalid config: %s", err)
 	}
 
-	return New(conf)
+	stg := New(conf)
+
+	// until the migration completes, subscriber channels are also looked up
+	// in the channels of their app.
+	go func() {
+		if err := stg.MigrateSubscriberChannels(context.Background()); err != nil {
+			log.Printf("storage:redis: subscriber channels migration failed: %s", err)
+		}
+	}()
+
+	return stg, nil
 }
 
-func configFromMap(data map[string]interface{}) (*Config, error) {
-	conf := &Config{
+// DefaultConfig returns the config used for options that are not set.
+func DefaultConfig() *Config {
+	return &Config{
 		Network:     "tcp",
 		Addr:        ":6379",
 		MaxIdle:     1000,
 		MaxActive:   10000,
 		IdleTimeout: 60,
 	}
+}
+
+// Validate checks that the config can be used to connect to Redis.
+func (conf *Config) Validate() error {
+	switch conf.Network {
+	case "tcp", "tcp4", "tcp6", "unix":
+	default:
+		return fmt.Errorf("unsupported network %q", conf.Network)
+	}
 
-	if v, ok := data["network"]; ok {
-		conf.Network = v.(string)
+	if conf.Addr == "" {
+		return errors.New("addr must not be empty")
 	}
 
-	if v, ok := data["addr"]; ok {
-		conf.Addr = v.(string)
+	if conf.MaxIdle < 0 {
+		return errors.New("maxIdle must not be negative")
 	}
 
-	if v, ok := data["maxIdle"]; ok {
-		conf.MaxIdle = int(v.(int64))
+	if conf.MaxActive < 0 {
+		return errors.New("maxActive must not be negative")
 	}
 
-	if v, ok := data["maxActive"]; ok {
-		conf.MaxActive = int(v.(int64))
+	if conf.IdleTimeout < 0 {
+		return errors.New("idleTimeout must not be negative")
 	}
 
-	if v, ok := data["idleTimeout"]; ok {
-		conf.IdleTimeout = int(v.(int64))
+	if conf.ConnectTimeout < 0 || conf.ReadTimeout < 0 || conf.WriteTimeout < 0 {
+		return errors.New("timeouts must not be negative")
+	}
+
+	return nil
+}
+
+func configFromMap(data map[string]interface{}) (*Config, error) {
+	conf := DefaultConfig()
+
+	if err := storage.DecodeOptions(data, conf); err != nil {
+		return nil, err
 	}
 
-	if v, ok := data["wait"]; ok {
-		conf.Wait = v.(bool)
+	if err := conf.Validate(); err != nil {
+		return nil, err
 	}
 
 	return conf, nil
 }
+
+// ctxConn is a pooled connection that runs commands within the deadline of
+// ctx. Cancellation is checked before each command; a command that is already
+// running is bounded by the deadline or ReadTimeout only.
+type ctxConn struct {
+	redigo.Conn
+	ctx         context.Context
+	readTimeout time.Duration
+}
+
+// getConn gets a connection from the pool bound to ctx.
+func (stg *RedisStorage) getConn(ctx context.Context) (*ctxConn, error) {
+	conn, err := stg.pool.GetContext(ctx)
+	if err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, ctxErr
+		}
+		return nil, err
+	}
+
+	return &ctxConn{conn, ctx, stg.readTimeout}, nil
+}
+
+// Do sends a command and waits for its reply.
+func (c *ctxConn) Do(commandName string, args ...interface{}) (interface{}, error) {
+	timeout, err := c.timeout()
+	if err != nil {
+		return nil, err
+	}
+
+	var reply interface{}
+	if timeout > 0 {
+		reply, err = redigo.DoWithTimeout(c.Conn, timeout, commandName, args...)
+	} else {
+		reply, err = c.Conn.Do(commandName, args...)
+	}
+
+	return reply, c.wrapErr(err)
+}
+
+// Receive receives a single reply of a pipelined command.
+func (c *ctxConn) Receive() (interface{}, error) {
+	timeout, err := c.timeout()
+	if err != nil {
+		return nil, err
+	}
+
+	var reply interface{}
+	if timeout > 0 {
+		reply, err = redigo.ReceiveWithTimeout(c.Conn, timeout)
+	} else {
+		reply, err = c.Conn.Receive()
+	}
+
+	return reply, c.wrapErr(err)
+}
+
+// timeout returns the time left until the context deadline, capped by the
+// configured read timeout. It returns zero when the context has no deadline so
+// the connection's own read timeout applies.
+func (c *ctxConn) timeout() (time.Duration, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	deadline, ok := c.ctx.Deadline()
+	if !ok {
+		return 0, nil
+	}
+
+	timeout := time.Until(deadline)
+	if timeout <= 0 {
+		return 0, context.DeadlineExceeded
+	}
+
+	if c.readTimeout > 0 && c.readTimeout < timeout {
+		timeout = c.readTimeout
+	}
+
+	return timeout, nil
+}
+
+// wrapErr reports the context error instead of a network timeout caused by
+// the context deadline.
+func (c *ctxConn) wrapErr(err error) error {
+	if err != nil && c.ctx.Err() != nil {
+		return c.ctx.Err()
+	}
+
+	return err
+}
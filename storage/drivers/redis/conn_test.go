@@ -0,0 +1,47 @@
+package redis
+
+import "testing"
+
+func TestConfigFromMap(t *testing.T) {
+	// keys as written in the sample config.toml
+	conf, err := configFromMap(map[string]interface{}{
+		"Network":     "unix",
+		"Addr":        "/tmp/redis.sock",
+		"MaxIdle":     int64(10),
+		"MaxActive":   int64(20),
+		"IdleTimeout": int64(30),
+		"wait":        true,
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := Config{
+		Network:     "unix",
+		Addr:        "/tmp/redis.sock",
+		MaxIdle:     10,
+		MaxActive:   20,
+		IdleTimeout: 30,
+		Wait:        true,
+	}
+
+	if *conf != expected {
+		t.Errorf("Config does not match. got %#v, expected %#v", *conf, expected)
+	}
+}
+
+func TestConfigFromMapInvalid(t *testing.T) {
+	invalid := []map[string]interface{}{
+		{"MaxIdle": "1000"},
+		{"MaxActive": int64(-1)},
+		{"Network": "udp"},
+		{"Addr": ""},
+	}
+
+	for _, data := range invalid {
+		if _, err := configFromMap(data); err == nil {
+			t.Errorf("Expected error for options %v", data)
+		}
+	}
+}
@@ -1,8 +1,17 @@
 package redis
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/gamegos/scotty/storage"
 	redigo "github.com/garyburd/redigo/redis"
@@ -10,222 +19,1650 @@ import (
 
 // RedisStorage records and retrieves data from Redis storage.
 type RedisStorage struct {
-	pool *redigo.Pool
+	pool        *redigo.Pool
+	readTimeout time.Duration
+	// channelsMigrated is 1 once the subscriber channels migration is known
+	// to be done.
+	channelsMigrated int32
 }
 
-// AddSubscriber adds new subscriber to channel.
-func (stg *RedisStorage) AddSubscriber(appID string, channelID string, subscriberIDs []string) error {
-	conn := stg.pool.Get()
+// AddSubscriber adds new subscriber to channel. The channel is created in the
+// same transaction.
+func (stg *RedisStorage) AddSubscriber(ctx context.Context, appID string, channelID string, subscriberIDs []string) error {
+	conn, err := stg.getConn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	cmds := []command{
+		{"SADD", []interface{}{keyAppChannels(appID), channelID}},
+	}
+
+	if len(subscriberIDs) > 0 {
+		params := make([]interface{}, 0, len(subscriberIDs)+1)
+		params = append(params, keyChannelSubscribers(appID, channelID))
+		for _, subscriberID := range subscriberIDs {
+			params = append(params, subscriberID)
+		}
+
+		cmds = append(cmds, command{"SADD", params})
+
+		// channels of each subscriber are kept for the scripts changing its
+		// memberships.
+		for _, subscriberID := range subscriberIDs {
+			cmds = append(cmds, command{"SADD", []interface{}{keySubscriberChannels(appID, subscriberID), channelID}})
+		}
+	}
+
+	_, err = multi(conn, cmds...)
+
+	return err
+}
+
+// AddChannel adds new channel to app.
+func (stg *RedisStorage) AddChannel(ctx context.Context, appID string, channelID string) error {
+	conn, err := stg.getConn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	channelsKey := keyAppChannels(appID)
+	_, err = conn.Do("SADD", channelsKey, channelID)
+
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// DeleteChannel deletes channel and its subscribers from app. The channel is
+// removed from the channels sets of its subscribers first; one left in the
+// set of a subscriber added meanwhile is ignored.
+func (stg *RedisStorage) DeleteChannel(ctx context.Context, appID string, channelID string) error {
+	conn, err := stg.getConn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	subscriberIDs, err := redigo.Strings(conn.Do("SMEMBERS", keyChannelSubscribers(appID, channelID)))
+	if err != nil {
+		return err
+	}
+
+	for start := 0; start < len(subscriberIDs); start += pipelineSize {
+		end := start + pipelineSize
+		if end > len(subscriberIDs) {
+			end = len(subscriberIDs)
+		}
+
+		cmds := make([]command, 0, end-start)
+		for _, subscriberID := range subscriberIDs[start:end] {
+			cmds = append(cmds, command{"SREM", []interface{}{keySubscriberChannels(appID, subscriberID), channelID}})
+		}
+
+		if _, err := multi(conn, cmds...); err != nil {
+			return err
+		}
+	}
+
+	_, err = multi(conn,
+		command{"SREM", []interface{}{keyAppChannels(appID), channelID}},
+		command{"DEL", []interface{}{keyChannelSubscribers(appID, channelID)}},
+	)
+
+	return err
+}
+
+// AddSubscriberDevice adds new device to subscriber. The device and the token
+// index are updated atomically by a script.
+func (stg *RedisStorage) AddSubscriberDevice(ctx context.Context, appID string, subscriberID string, device *storage.Device) error {
+	conn, err := stg.getConn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	deviceData, err := json.Marshal(device)
+	if err != nil {
+		return err
+	}
+
+	_, err = doScript(conn, addDeviceScript, func() ([]interface{}, error) {
+		owner, previous, err := tokenOwner(conn, appID, device.Token)
+		if err != nil {
+			return nil, err
+		}
+
+		devicesKey := keySubscriberDevices(appID, subscriberID)
+		ownerKey := devicesKey
+		if owner != "" {
+			ownerKey = keySubscriberDevices(appID, owner)
+		}
+
+		indexKeys, indexArgs, err := attributeIndexes(appID, previous, deviceData)
+		if err != nil {
+			return nil, err
+		}
+
+		args := []interface{}{4 + len(indexKeys), keyAppTokens(appID), keyAppSubscribers(appID), devicesKey, ownerKey}
+		args = append(args, indexKeys...)
+		args = append(args, subscriberID, device.Token, deviceData, owner)
+		return append(args, indexArgs...), nil
+	})
+
+	return err
+}
+
+// UpdateDeviceToken updates token of a subscriber's device. The device is
+// moved to the new token atomically by a script.
+func (stg *RedisStorage) UpdateDeviceToken(ctx context.Context, appID string, subscriberID string, oldDeviceToken string, newDeviceToken string) error {
+	conn, err := stg.getConn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	updated, err := redigo.Bool(doScript(conn, updateDeviceTokenScript, func() ([]interface{}, error) {
+		owner, previous, err := tokenOwner(conn, appID, newDeviceToken)
+		if err != nil {
+			return nil, err
+		}
+
+		devicesKey := keySubscriberDevices(appID, subscriberID)
+		ownerKey := devicesKey
+		if owner != "" {
+			ownerKey = keySubscriberDevices(appID, owner)
+		}
+
+		indexKeys, indexArgs, err := attributeIndexes(appID, previous)
+		if err != nil {
+			return nil, err
+		}
+
+		args := []interface{}{3 + len(indexKeys), keyAppTokens(appID), devicesKey, ownerKey}
+		args = append(args, indexKeys...)
+		args = append(args, subscriberID, oldDeviceToken, newDeviceToken, owner)
+		return append(args, indexArgs...), nil
+	}))
+
+	if err != nil {
+		return err
+	}
+
+	if !updated {
+		return storage.ErrNotFound
+	}
+
+	return nil
+}
+
+// GetDeviceOwner gets the subscriber that owns a device token and the device.
+func (stg *RedisStorage) GetDeviceOwner(ctx context.Context, appID string, token string) (string, *storage.Device, error) {
+	conn, err := stg.getConn(ctx)
+	if err != nil {
+		return "", nil, err
+	}
+	defer conn.Close()
+
+	subscriberID, err := redigo.String(conn.Do("HGET", keyAppTokens(appID), token))
+	if err == redigo.ErrNil {
+		return "", nil, storage.ErrNotFound
+	}
+
+	if err != nil {
+		return "", nil, err
+	}
+
+	deviceData, err := redigo.Bytes(conn.Do("HGET", keySubscriberDevices(appID, subscriberID), token))
+	if err == redigo.ErrNil {
+		return "", nil, storage.ErrNotFound
+	}
+
+	if err != nil {
+		return "", nil, err
+	}
+
+	var device storage.Device
+	if err := json.Unmarshal(deviceData, &device); err != nil {
+		return "", nil, err
+	}
+
+	return subscriberID, &device, nil
+}
+
+// GetChannelSubscribers gets subscribers of a channel.
+func (stg *RedisStorage) GetChannelSubscribers(ctx context.Context, appID string, channelID string) ([]string, error) {
+	conn, err := stg.getConn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	key := keyChannelSubscribers(appID, channelID)
+	subscribers, err := redigo.Strings(conn.Do("SMEMBERS", key))
+
+	if err != nil {
+		return nil, err
+	}
+
+	return subscribers, nil
+}
+
+// ScanChannelSubscribers gets a page of channel subscribers with SSCAN.
+func (stg *RedisStorage) ScanChannelSubscribers(ctx context.Context, appID string, channelID string, cursor string, count int) ([]string, string, error) {
+	return stg.scan(ctx, "SSCAN", keyChannelSubscribers(appID, channelID), cursor, count)
+}
+
+// ScanChannelsIntersection stores the result set in a temporary key with
+// SINTERSTORE and SDIFFSTORE on the first page and scans it with SSCAN. The
+// cursor carries the id of the temporary key, which expires after
+// intersectionTTL unless the scan goes on, and is deleted when the scan ends.
+func (stg *RedisStorage) ScanChannelsIntersection(ctx context.Context, appID string, channelIDs []string, exceptChannelIDs []string, cursor string, count int) ([]string, string, error) {
+	if len(channelIDs) == 0 {
+		return nil, "", errors.New("redis: intersection of no channels")
+	}
+
+	var id, setCursor string
+
+	if cursor == "" {
+		var err error
+		if id, err = stg.storeIntersection(ctx, appID, channelIDs, exceptChannelIDs); err != nil {
+			return nil, "", err
+		}
+	} else {
+		i := strings.LastIndex(cursor, ":")
+		if i < 0 {
+			return nil, "", fmt.Errorf("redis: invalid intersection cursor %q", cursor)
+		}
+		id, setCursor = cursor[:i], cursor[i+1:]
+
+		if err := stg.touchIntersection(ctx, appID, id); err != nil {
+			return nil, "", err
+		}
+	}
+
+	key := keyIntersection(appID, id)
+
+	members, next, err := stg.scan(ctx, "SSCAN", key, setCursor, count)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if next == "" {
+		conn, err := stg.getConn(ctx)
+		if err != nil {
+			return nil, "", err
+		}
+		defer conn.Close()
+
+		if _, err := conn.Do("DEL", key); err != nil {
+			return nil, "", err
+		}
+
+		return members, "", nil
+	}
+
+	return members, id + ":" + next, nil
+}
+
+// storeIntersection stores the result set of an intersection scan in a new
+// temporary key and returns its id.
+func (stg *RedisStorage) storeIntersection(ctx context.Context, appID string, channelIDs []string, exceptChannelIDs []string) (string, error) {
+	conn, err := stg.getConn(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	id := hex.EncodeToString(b)
+
+	keys := make([]interface{}, 0, len(channelIDs)+len(exceptChannelIDs)+1)
+	keys = append(keys, keyIntersection(appID, id))
+	for _, channelID := range channelIDs {
+		keys = append(keys, keyChannelSubscribers(appID, channelID))
+	}
+	for _, channelID := range exceptChannelIDs {
+		keys = append(keys, keyChannelSubscribers(appID, channelID))
+	}
+
+	args := append([]interface{}{len(keys)}, keys...)
+	args = append(args, len(channelIDs), int(intersectionTTL/time.Second))
+
+	if _, err := intersectionScript.Do(conn, args...); err != nil {
+		return "", err
+	}
+
+	return id, nil
+}
+
+// touchIntersection extends the expiry of a temporary intersection key. It
+// fails if the key expired, since the rest of the scan would be lost.
+func (stg *RedisStorage) touchIntersection(ctx context.Context, appID string, id string) error {
+	conn, err := stg.getConn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	ok, err := redigo.Bool(conn.Do("EXPIRE", keyIntersection(appID, id), int(intersectionTTL/time.Second)))
+	if err != nil {
+		return err
+	}
+
+	if !ok {
+		return errors.New("redis: intersection scan expired")
+	}
+
+	return nil
+}
+
+// ScanSubscribers gets a page of the subscribers of an app with SSCAN.
+func (stg *RedisStorage) ScanSubscribers(ctx context.Context, appID string, cursor string, count int) ([]string, string, error) {
+	return stg.scan(ctx, "SSCAN", keyAppSubscribers(appID), cursor, count)
+}
+
+// ScanAttributeSubscribers gets a page of the subscribers in an attribute
+// index with HSCAN.
+func (stg *RedisStorage) ScanAttributeSubscribers(ctx context.Context, appID string, attribute string, value string, cursor string, count int) ([]string, string, error) {
+	return stg.scan(ctx, "HSCAN", keyAttributeIndex(appID, attribute, value), cursor, count)
+}
+
+// FilterAttributeSubscribers returns the subscribers in an attribute index,
+// checked with pipelined HEXISTS commands.
+func (stg *RedisStorage) FilterAttributeSubscribers(ctx context.Context, appID string, attribute string, value string, subscriberIDs []string) ([]string, error) {
+	return stg.filter(ctx, "HEXISTS", keyAttributeIndex(appID, attribute, value), subscriberIDs)
+}
+
+// scan runs a SSCAN or HSCAN command and returns the members or hash fields
+// of the page.
+func (stg *RedisStorage) scan(ctx context.Context, cmd string, key string, cursor string, count int) ([]string, string, error) {
+	conn, err := stg.getConn(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+	defer conn.Close()
+
+	if cursor == "" {
+		cursor = "0"
+	}
+
+	args := []interface{}{key, cursor}
+	if count > 0 {
+		args = append(args, "COUNT", count)
+	}
+
+	values, err := redigo.Values(conn.Do(cmd, args...))
+	if err != nil {
+		return nil, "", err
+	}
+
+	var members []string
+	if _, err := redigo.Scan(values, &cursor, &members); err != nil {
+		return nil, "", err
+	}
+
+	// HSCAN returns field and value pairs.
+	if cmd == "HSCAN" {
+		fields := make([]string, 0, len(members)/2)
+		for i := 0; i < len(members); i += 2 {
+			fields = append(fields, members[i])
+		}
+		members = fields
+	}
+
+	if cursor == "0" {
+		cursor = ""
+	}
+
+	return members, cursor, nil
+}
+
+// FilterChannelMembers returns the subscribers that are members of the
+// channel, checked with pipelined SISMEMBER commands.
+func (stg *RedisStorage) FilterChannelMembers(ctx context.Context, appID string, channelID string, subscriberIDs []string) ([]string, error) {
+	return stg.filter(ctx, "SISMEMBER", keyChannelSubscribers(appID, channelID), subscriberIDs)
+}
+
+// filter returns the subscribers for which a SISMEMBER or HEXISTS command on
+// key replies true. Commands are pipelined in batches of pipelineSize.
+func (stg *RedisStorage) filter(ctx context.Context, cmd string, key string, subscriberIDs []string) ([]string, error) {
+	conn, err := stg.getConn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	result := make([]string, 0, len(subscriberIDs))
+
+	for start := 0; start < len(subscriberIDs); start += pipelineSize {
+		end := start + pipelineSize
+		if end > len(subscriberIDs) {
+			end = len(subscriberIDs)
+		}
+		batch := subscriberIDs[start:end]
+
+		for _, subscriberID := range batch {
+			if err := conn.Send(cmd, key, subscriberID); err != nil {
+				return nil, err
+			}
+		}
+
+		if err := conn.Flush(); err != nil {
+			return nil, err
+		}
+
+		for _, subscriberID := range batch {
+			found, err := redigo.Bool(conn.Receive())
+			if err != nil {
+				return nil, err
+			}
+
+			if found {
+				result = append(result, subscriberID)
+			}
+		}
+	}
+
+	return result, nil
+}
+
+// GetSubscriberChannels gets the channels a subscriber is a member of. The
+// channels set of the subscriber is checked with pipelined SISMEMBER
+// commands, as it may list channels deleted since.
+func (stg *RedisStorage) GetSubscriberChannels(ctx context.Context, appID string, subscriberID string) ([]string, error) {
+	conn, err := stg.getConn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	channelIDs, err := stg.subscriberChannelIDs(conn, appID, subscriberID)
+	if err != nil {
+		return nil, err
+	}
+
+	channels, err := memberChannels(conn, appID, subscriberID, channelIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Strings(channels)
+
+	return channels, nil
+}
+
+// memberChannels returns the channels among channelIDs the subscriber is a
+// member of, checked with SISMEMBER in batches of pipelineSize.
+func memberChannels(conn redigo.Conn, appID string, subscriberID string, channelIDs []string) ([]string, error) {
+	channels := []string{}
+
+	for start := 0; start < len(channelIDs); start += pipelineSize {
+		end := start + pipelineSize
+		if end > len(channelIDs) {
+			end = len(channelIDs)
+		}
+		batch := channelIDs[start:end]
+
+		for _, channelID := range batch {
+			if err := conn.Send("SISMEMBER", keyChannelSubscribers(appID, channelID), subscriberID); err != nil {
+				return nil, err
+			}
+		}
+
+		if err := conn.Flush(); err != nil {
+			return nil, err
+		}
+
+		for _, channelID := range batch {
+			member, err := redigo.Bool(conn.Receive())
+			if err != nil {
+				return nil, err
+			}
+
+			if member {
+				channels = append(channels, channelID)
+			}
+		}
+	}
+
+	return channels, nil
+}
+
+// subscriberChannelIDs returns the channels set of a subscriber. Sets are
+// kept since the subscriber channels migration, see
+// MigrateSubscriberChannels; until it completes the channels of the app the
+// subscriber is a member of are added, found with SSCAN.
+func (stg *RedisStorage) subscriberChannelIDs(conn redigo.Conn, appID string, subscriberID string) ([]string, error) {
+	channelIDs, err := redigo.Strings(conn.Do("SMEMBERS", keySubscriberChannels(appID, subscriberID)))
+	if err != nil {
+		return nil, err
+	}
+
+	migrated, err := stg.subscriberChannelsMigrated(conn)
+	if err != nil || migrated {
+		return channelIDs, err
+	}
+
+	listed := make(map[string]bool, len(channelIDs))
+	for _, channelID := range channelIDs {
+		listed[channelID] = true
+	}
+
+	err = scanAll(conn, keyAppChannels(appID), func(page []string) error {
+		members, err := memberChannels(conn, appID, subscriberID, page)
+		if err != nil {
+			return err
+		}
+
+		// SSCAN may return a member more than once.
+		for _, channelID := range members {
+			if !listed[channelID] {
+				listed[channelID] = true
+				channelIDs = append(channelIDs, channelID)
+			}
+		}
+
+		return nil
+	})
+
+	return channelIDs, err
+}
+
+// subscriberChannelsMigration is the member of the migrations set recording
+// that the channels sets of subscribers were built.
+const subscriberChannelsMigration = "subscriber-channels"
+
+// MigrateSubscriberChannels builds the channels sets of subscribers from the
+// channels of each app, for channels joined before the sets were kept. It
+// runs once; it returns at once if the migration is recorded as done.
+func (stg *RedisStorage) MigrateSubscriberChannels(ctx context.Context) error {
+	conn, err := stg.getConn(ctx)
+	if err != nil {
+		return err
+	}
 	defer conn.Close()
 
-	err := stg.AddChannel(appID, channelID)
+	migrated, err := stg.subscriberChannelsMigrated(conn)
+	if err != nil || migrated {
+		return err
+	}
+
+	appIDs, err := redigo.Strings(conn.Do("HKEYS", keyApps()))
+	if err != nil {
+		return err
+	}
+
+	for _, appID := range appIDs {
+		err := scanAll(conn, keyAppChannels(appID), func(channelIDs []string) error {
+			for _, channelID := range channelIDs {
+				err := scanAll(conn, keyChannelSubscribers(appID, channelID), func(subscriberIDs []string) error {
+					for _, subscriberID := range subscriberIDs {
+						if err := conn.Send("SADD", keySubscriberChannels(appID, subscriberID), channelID); err != nil {
+							return err
+						}
+					}
+
+					if err := conn.Flush(); err != nil {
+						return err
+					}
+
+					for range subscriberIDs {
+						if _, err := conn.Receive(); err != nil {
+							return err
+						}
+					}
+
+					return nil
+				})
+				if err != nil {
+					return err
+				}
+			}
+
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if _, err := conn.Do("SADD", keyMigrations(), subscriberChannelsMigration); err != nil {
+		return err
+	}
+
+	atomic.StoreInt32(&stg.channelsMigrated, 1)
+
+	return nil
+}
+
+// subscriberChannelsMigrated reports whether MigrateSubscriberChannels
+// completed, remembering it once it did.
+func (stg *RedisStorage) subscriberChannelsMigrated(conn redigo.Conn) (bool, error) {
+	if atomic.LoadInt32(&stg.channelsMigrated) == 1 {
+		return true, nil
+	}
+
+	migrated, err := redigo.Bool(conn.Do("SISMEMBER", keyMigrations(), subscriberChannelsMigration))
+	if migrated {
+		atomic.StoreInt32(&stg.channelsMigrated, 1)
+	}
+
+	return migrated, err
+}
+
+// scanAll calls fn with each page of the members of a set, read with SSCAN
+// pages of pipelineSize.
+func scanAll(conn redigo.Conn, key string, fn func(members []string) error) error {
+	cursor := "0"
+	for {
+		values, err := redigo.Values(conn.Do("SSCAN", key, cursor, "COUNT", pipelineSize))
+		if err != nil {
+			return err
+		}
+
+		var members []string
+		if _, err := redigo.Scan(values, &cursor, &members); err != nil {
+			return err
+		}
+
+		if len(members) > 0 {
+			if err := fn(members); err != nil {
+				return err
+			}
+		}
+
+		if cursor == "0" {
+			return nil
+		}
+	}
+}
+
+// DeleteSubscriber deletes a subscriber with its devices, channel
+// memberships, aliases and preferences in a single script.
+func (stg *RedisStorage) DeleteSubscriber(ctx context.Context, appID string, subscriberID string) error {
+	conn, err := stg.getConn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	found, err := redigo.Int(doScript(conn, deleteSubscriberScript, func() ([]interface{}, error) {
+		channelKeys, channelIDs, indexKeys, indexArgs, err := stg.subscriberScriptData(conn, appID, subscriberID)
+		if err != nil {
+			return nil, err
+		}
+
+		aliasesKey := keySubscriberAliases(appID, subscriberID)
+		target, targetAliasesKey, err := aliasTarget(conn, appID, subscriberID, aliasesKey)
+		if err != nil {
+			return nil, err
+		}
+
+		args := []interface{}{
+			8 + len(channelKeys) + len(indexKeys),
+			keySubscriberDevices(appID, subscriberID), keyAppTokens(appID), keyAppSubscribers(appID), keySubscriberChannels(appID, subscriberID),
+			keyAppAliases(appID), aliasesKey, keyAppPreferences(appID), targetAliasesKey,
+		}
+		args = append(args, channelKeys...)
+		args = append(args, indexKeys...)
+		args = append(args, subscriberID, target, keyPreferenceIndexPrefix(appID), len(channelIDs))
+		args = append(args, channelIDs...)
+		return append(args, indexArgs...), nil
+	}))
+	if err != nil {
+		return err
+	}
+
+	if found == 0 {
+		return storage.ErrNotFound
+	}
+
+	return nil
+}
+
+// MergeSubscriber moves the devices and channel memberships of source to
+// target and records the aliases in a single script.
+func (stg *RedisStorage) MergeSubscriber(ctx context.Context, appID string, sourceID string, targetID string) error {
+	conn, err := stg.getConn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	merged, err := redigo.Int(doScript(conn, mergeSubscriberScript, func() ([]interface{}, error) {
+		channelKeys, channelIDs, indexKeys, indexArgs, err := stg.subscriberScriptData(conn, appID, sourceID)
+		if err != nil {
+			return nil, err
+		}
+
+		sourceAliasesKey := keySubscriberAliases(appID, sourceID)
+		previous, previousAliasesKey, err := aliasTarget(conn, appID, sourceID, sourceAliasesKey)
+		if err != nil {
+			return nil, err
+		}
+
+		args := []interface{}{
+			11 + len(channelKeys) + len(indexKeys),
+			keySubscriberDevices(appID, sourceID), keySubscriberDevices(appID, targetID),
+			keyAppTokens(appID), keyAppSubscribers(appID), keySubscriberChannels(appID, sourceID),
+			keyAppAliases(appID), sourceAliasesKey, keySubscriberAliases(appID, targetID),
+			keyAppPreferences(appID), keySubscriberChannels(appID, targetID), previousAliasesKey,
+		}
+		args = append(args, channelKeys...)
+		args = append(args, indexKeys...)
+		args = append(args, sourceID, targetID, previous, keyPreferenceIndexPrefix(appID), len(channelIDs))
+		args = append(args, channelIDs...)
+		return append(args, indexArgs...), nil
+	}))
+	if err != nil {
+		return err
+	}
+
+	if merged == 0 {
+		return storage.ErrNotFound
+	}
+
+	return nil
+}
+
+// ResolveAliases maps the aliases among subscriberIDs to their subscribers
+// with HMGET in batches of pipelineSize.
+func (stg *RedisStorage) ResolveAliases(ctx context.Context, appID string, subscriberIDs []string) (map[string]string, error) {
+	conn, err := stg.getConn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	result := make(map[string]string)
+
+	for start := 0; start < len(subscriberIDs); start += pipelineSize {
+		end := start + pipelineSize
+		if end > len(subscriberIDs) {
+			end = len(subscriberIDs)
+		}
+		batch := subscriberIDs[start:end]
+
+		args := make([]interface{}, 0, len(batch)+1)
+		args = append(args, keyAppAliases(appID))
+		for _, subscriberID := range batch {
+			args = append(args, subscriberID)
+		}
+
+		targets, err := redigo.Values(conn.Do("HMGET", args...))
+		if err != nil {
+			return nil, err
+		}
+
+		for i, target := range targets {
+			if target == nil {
+				continue
+			}
+
+			targetID, err := redigo.String(target, nil)
+			if err != nil {
+				return nil, err
+			}
+			result[batch[i]] = targetID
+		}
+	}
+
+	return result, nil
+}
+
+// GetSubscriberAliases gets the ids merged into a subscriber.
+func (stg *RedisStorage) GetSubscriberAliases(ctx context.Context, appID string, subscriberID string) ([]string, error) {
+	conn, err := stg.getConn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	aliases, err := redigo.Strings(conn.Do("SMEMBERS", keySubscriberAliases(appID, subscriberID)))
+	if err != nil {
+		return nil, err
+	}
+
+	if aliases == nil {
+		aliases = []string{}
+	}
+	sort.Strings(aliases)
+
+	return aliases, nil
+}
+
+// PutPreferences replaces the preferences of a subscriber and their indexes
+// in a single script.
+func (stg *RedisStorage) PutPreferences(ctx context.Context, appID string, subscriberID string, prefs *storage.Preferences) error {
+	conn, err := stg.getConn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	prefsData, err := json.Marshal(prefs)
+	if err != nil {
+		return err
+	}
+
+	_, err = putPreferencesScript.Do(conn, keyAppPreferences(appID), subscriberID, prefsData, keyPreferenceIndexPrefix(appID))
+
+	return err
+}
+
+// GetPreferences gets the preferences of a subscriber.
+func (stg *RedisStorage) GetPreferences(ctx context.Context, appID string, subscriberID string) (*storage.Preferences, error) {
+	conn, err := stg.getConn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	prefs := &storage.Preferences{}
+
+	prefsData, err := redigo.Bytes(conn.Do("HGET", keyAppPreferences(appID), subscriberID))
+	if err == redigo.ErrNil {
+		return prefs, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(prefsData, prefs); err != nil {
+		return nil, err
+	}
+
+	return prefs, nil
+}
+
+// FilterCategoryChoices returns the subscribers in the opt-in or opt-out set
+// of a category, checked with pipelined SISMEMBER commands.
+func (stg *RedisStorage) FilterCategoryChoices(ctx context.Context, appID string, categoryID string, optIn bool, subscriberIDs []string) ([]string, error) {
+	return stg.filter(ctx, "SISMEMBER", keyCategoryChoices(appID, categoryID, optIn), subscriberIDs)
+}
+
+// FilterChannelOptOuts returns the subscribers in the opt-out set of a
+// channel, checked with pipelined SISMEMBER commands.
+func (stg *RedisStorage) FilterChannelOptOuts(ctx context.Context, appID string, channelID string, subscriberIDs []string) ([]string, error) {
+	return stg.filter(ctx, "SISMEMBER", keyChannelOptOuts(appID, channelID), subscriberIDs)
+}
+
+// AddTombstone records the erasure of a subscriber.
+func (stg *RedisStorage) AddTombstone(ctx context.Context, appID string, tombstone *storage.Tombstone) error {
+	conn, err := stg.getConn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	data, err := json.Marshal(tombstone)
+	if err != nil {
+		return err
+	}
+
+	if _, err := conn.Do("RPUSH", keyAppTombstones(appID), data); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// GetTombstones gets the erasure records of an app, oldest first.
+func (stg *RedisStorage) GetTombstones(ctx context.Context, appID string) ([]*storage.Tombstone, error) {
+	conn, err := stg.getConn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	values, err := redigo.ByteSlices(conn.Do("LRANGE", keyAppTombstones(appID), 0, -1))
+	if err != nil {
+		return nil, err
+	}
+
+	tombstones := make([]*storage.Tombstone, 0, len(values))
+	for _, value := range values {
+		var tombstone *storage.Tombstone
+		if err := json.Unmarshal(value, &tombstone); err != nil {
+			return nil, err
+		}
+		tombstones = append(tombstones, tombstone)
+	}
+
+	return tombstones, nil
+}
+
+// PruneSubscriber deletes the devices of a subscriber last seen before the
+// unix timestamp before, and the subscriber if it is left without devices, in
+// a single script.
+func (stg *RedisStorage) PruneSubscriber(ctx context.Context, appID string, subscriberID string, before int) (*storage.PruneResult, error) {
+	conn, err := stg.getConn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	values, err := redigo.Values(doScript(conn, pruneSubscriberScript, func() ([]interface{}, error) {
+		channelKeys, channelIDs, indexKeys, indexArgs, err := stg.subscriberScriptData(conn, appID, subscriberID)
+		if err != nil {
+			return nil, err
+		}
+
+		args := []interface{}{
+			6 + len(channelKeys) + len(indexKeys),
+			keySubscriberDevices(appID, subscriberID), keyAppTokens(appID), keyAppSubscribers(appID), keyAppChannels(appID),
+			keyAppPreferences(appID), keySubscriberChannels(appID, subscriberID),
+		}
+		args = append(args, channelKeys...)
+		args = append(args, indexKeys...)
+		args = append(args, subscriberID, before, keyPreferenceIndexPrefix(appID), len(channelIDs))
+		args = append(args, channelIDs...)
+		return append(args, indexArgs...), nil
+	}))
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		devices           [][]byte
+		subscriberRemoved int
+		channels          []string
+	)
+
+	if _, err := redigo.Scan(values, &devices, &subscriberRemoved, &channels); err != nil {
+		return nil, err
+	}
+
+	result := &storage.PruneResult{
+		SubscriberRemoved: subscriberRemoved == 1,
+		Channels:          channels,
+	}
+
+	for _, data := range devices {
+		var device *storage.Device
+		if err := json.Unmarshal(data, &device); err != nil {
+			return nil, err
+		}
+		result.Devices = append(result.Devices, device)
+	}
+
+	sort.Strings(result.Channels)
+
+	return result, nil
+}
+
+// GetSubscriberDevices gets devices of a subscriber.
+func (stg *RedisStorage) GetSubscriberDevices(ctx context.Context, appID string, subscriberID string) ([]*storage.Device, error) {
+	conn, err := stg.getConn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	key := keySubscriberDevices(appID, subscriberID)
+
+	devices, err := redigo.StringMap(conn.Do("HGETALL", key))
+	if err != nil {
+		return nil, err
+	}
+
+	return decodeDevices(devices)
+}
+
+// decodeDevices decodes the HGETALL reply of a subscriber's devices hash.
+func decodeDevices(data map[string]string) ([]*storage.Device, error) {
+	devices := make([]*storage.Device, 0, len(data))
+	for _, deviceData := range data {
+		var device storage.Device
+		if err := json.Unmarshal([]byte(deviceData), &device); err != nil {
+			return nil, err
+		}
+		devices = append(devices, &device)
+	}
+
+	return devices, nil
+}
 
+// GetSubscribersDevices resolves devices of many subscribers at once. Devices
+// are fetched with pipelined HGETALL commands in batches of pipelineSize, so a
+// single connection and round trip serves a whole batch.
+func (stg *RedisStorage) GetSubscribersDevices(ctx context.Context, appID string, subscriberIDs []string, fn storage.DevicesFunc) error {
+	conn, err := stg.getConn(ctx)
 	if err != nil {
 		return err
 	}
+	defer conn.Close()
 
-	subscribersKey := keyChannelSubscribers(appID, channelID)
-	tmpParams := append([]string{subscribersKey}, subscriberIDs...)
+	for start := 0; start < len(subscriberIDs); start += pipelineSize {
+		end := start + pipelineSize
+		if end > len(subscriberIDs) {
+			end = len(subscriberIDs)
+		}
+		batch := subscriberIDs[start:end]
 
-	params := make([]interface{}, len(tmpParams))
-	for i, v := range tmpParams {
-		params[i] = v
+		for _, subscriberID := range batch {
+			if err := conn.Send("HGETALL", keySubscriberDevices(appID, subscriberID)); err != nil {
+				return err
+			}
+		}
+
+		if err := conn.Flush(); err != nil {
+			return err
+		}
+
+		// all replies of the batch are received before calling fn, so the
+		// connection is left in a clean state if fn fails.
+		replies := make([]map[string]string, len(batch))
+		for i := range batch {
+			replies[i], err = redigo.StringMap(conn.Receive())
+			if err != nil {
+				return err
+			}
+		}
+
+		for i, subscriberID := range batch {
+			devices, err := decodeDevices(replies[i])
+			if err != nil {
+				return err
+			}
+
+			if err := fn(subscriberID, devices); err != nil {
+				return err
+			}
+		}
 	}
 
-	_, err = conn.Do("SADD", params...)
+	return nil
+}
+
+// PutApp creates a new app or updates existing one.
+func (stg *RedisStorage) PutApp(ctx context.Context, app *storage.App) error {
+	conn, err := stg.getConn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
 
+	appID := app.ID
+	appData, err := json.Marshal(app)
 	if err != nil {
 		return err
 	}
 
+	if _, err := conn.Do("HSET", keyApps(), appID, appData); err != nil {
+		return err
+	}
+
 	return nil
 }
 
-// AddChannel adds new channel to app.
-func (stg *RedisStorage) AddChannel(appID string, channelID string) error {
-	conn := stg.pool.Get()
+// GetApp gets an app's data.
+func (stg *RedisStorage) GetApp(ctx context.Context, appID string) (*storage.App, error) {
+	conn, err := stg.getConn(ctx)
+	if err != nil {
+		return nil, err
+	}
 	defer conn.Close()
 
-	channelsKey := keyAppChannels(appID)
-	_, err := conn.Do("SADD", channelsKey, channelID)
+	value, err := redigo.Bytes(conn.Do("HGET", keyApps(), appID))
+	if err == redigo.ErrNil {
+		return nil, storage.ErrNotFound
+	}
 
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	return nil
+	var app *storage.App
+	if err := json.Unmarshal(value, &app); err != nil {
+		return nil, err
+	}
+
+	return app, nil
 }
 
-// DeleteChannel deletes channel and its subscribers from app.
-func (stg *RedisStorage) DeleteChannel(appID string, channelID string) error {
-	conn := stg.pool.Get()
+// GetApps gets all apps, ordered by id.
+func (stg *RedisStorage) GetApps(ctx context.Context) ([]*storage.App, error) {
+	conn, err := stg.getConn(ctx)
+	if err != nil {
+		return nil, err
+	}
 	defer conn.Close()
 
-	channelsKey := keyAppChannels(appID)
-	_, err := conn.Do("SREM", channelsKey, channelID)
+	values, err := redigo.StringMap(conn.Do("HGETALL", keyApps()))
+	if err != nil {
+		return nil, err
+	}
+
+	apps := make([]*storage.App, 0, len(values))
+	for _, value := range values {
+		var app *storage.App
+		if err := json.Unmarshal([]byte(value), &app); err != nil {
+			return nil, err
+		}
+		apps = append(apps, app)
+	}
 
+	sort.Slice(apps, func(i, j int) bool {
+		return apps[i].ID < apps[j].ID
+	})
+
+	return apps, nil
+}
+
+// PutSegment creates a new segment or updates existing one.
+func (stg *RedisStorage) PutSegment(ctx context.Context, appID string, segment *storage.Segment) error {
+	conn, err := stg.getConn(ctx)
 	if err != nil {
 		return err
 	}
+	defer conn.Close()
 
-	channelKey := keyChannelSubscribers(appID, channelID)
-	_, err = conn.Do("DEL", channelKey)
-
+	segmentData, err := json.Marshal(segment)
 	if err != nil {
 		return err
 	}
 
+	if _, err := conn.Do("HSET", keyAppSegments(appID), segment.ID, segmentData); err != nil {
+		return err
+	}
+
 	return nil
 }
 
-// AddSubscriberDevice adds new device to subscriber.
-func (stg *RedisStorage) AddSubscriberDevice(appID string, subscriberID string, device *storage.Device) error {
-	conn := stg.pool.Get()
+// GetSegment gets a segment of an app.
+func (stg *RedisStorage) GetSegment(ctx context.Context, appID string, segmentID string) (*storage.Segment, error) {
+	conn, err := stg.getConn(ctx)
+	if err != nil {
+		return nil, err
+	}
 	defer conn.Close()
 
-	subscribersKey := keyAppSubscribers(appID)
-	_, err := conn.Do("SADD", subscribersKey, subscriberID)
+	value, err := redigo.Bytes(conn.Do("HGET", keyAppSegments(appID), segmentID))
+	if err == redigo.ErrNil {
+		return nil, storage.ErrNotFound
+	}
 
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	devicesKey := keySubscriberDevices(appID, subscriberID)
-	jstring, _ := json.Marshal(device)
-	// todo: multiple devices with same platform and token should not be added
-	_, err = conn.Do("HSET", devicesKey, device.Token, jstring)
-
-	if err != nil {
-		return err
+	var segment *storage.Segment
+	if err := json.Unmarshal(value, &segment); err != nil {
+		return nil, err
 	}
 
-	return nil
+	return segment, nil
 }
 
-// UpdateDeviceToken updates token of a subscriber's device.
-func (stg *RedisStorage) UpdateDeviceToken(appID string, subscriberID string, oldDeviceToken string, newDeviceToken string) error {
-	conn := stg.pool.Get()
+// GetSegments gets all segments of an app, ordered by id.
+func (stg *RedisStorage) GetSegments(ctx context.Context, appID string) ([]*storage.Segment, error) {
+	conn, err := stg.getConn(ctx)
+	if err != nil {
+		return nil, err
+	}
 	defer conn.Close()
 
-	key := keySubscriberDevices(appID, subscriberID)
-	deviceData, err := redigo.String(conn.Do("HGET", key, oldDeviceToken))
+	values, err := redigo.StringMap(conn.Do("HGETALL", keyAppSegments(appID)))
+	if err != nil {
+		return nil, err
+	}
+
+	segments := make([]*storage.Segment, 0, len(values))
+	for _, value := range values {
+		var segment *storage.Segment
+		if err := json.Unmarshal([]byte(value), &segment); err != nil {
+			return nil, err
+		}
+		segments = append(segments, segment)
+	}
 
+	sort.Slice(segments, func(i, j int) bool {
+		return segments[i].ID < segments[j].ID
+	})
+
+	return segments, nil
+}
+
+// DeleteSegment deletes a segment of an app.
+func (stg *RedisStorage) DeleteSegment(ctx context.Context, appID string, segmentID string) error {
+	conn, err := stg.getConn(ctx)
 	if err != nil {
 		return err
 	}
+	defer conn.Close()
 
-	_, err = conn.Do("HDEL", key, oldDeviceToken)
-
+	deleted, err := redigo.Int(conn.Do("HDEL", keyAppSegments(appID), segmentID))
 	if err != nil {
 		return err
 	}
 
-	var device storage.Device
-	decoder := json.NewDecoder(strings.NewReader(deviceData))
+	if deleted == 0 {
+		return storage.ErrNotFound
+	}
+
+	return nil
+}
 
-	if err := decoder.Decode(&device); err != nil {
+// PutTemplate creates a new template or updates existing one.
+func (stg *RedisStorage) PutTemplate(ctx context.Context, appID string, template *storage.Template) error {
+	conn, err := stg.getConn(ctx)
+	if err != nil {
 		return err
 	}
+	defer conn.Close()
 
-	device.Token = newDeviceToken
-	err = stg.AddSubscriberDevice(appID, subscriberID, &device)
-
+	templateData, err := json.Marshal(template)
 	if err != nil {
 		return err
 	}
 
+	if _, err := conn.Do("HSET", keyAppTemplates(appID), template.ID, templateData); err != nil {
+		return err
+	}
+
 	return nil
 }
 
-// GetChannelSubscribers gets subscribers of a channel.
-func (stg *RedisStorage) GetChannelSubscribers(appID string, channelID string) ([]string, error) {
-	conn := stg.pool.Get()
+// GetTemplate gets a template of an app.
+func (stg *RedisStorage) GetTemplate(ctx context.Context, appID string, templateID string) (*storage.Template, error) {
+	conn, err := stg.getConn(ctx)
+	if err != nil {
+		return nil, err
+	}
 	defer conn.Close()
 
-	key := keyChannelSubscribers(appID, channelID)
-	subscribers, err := redigo.Strings(conn.Do("SMEMBERS", key))
+	value, err := redigo.Bytes(conn.Do("HGET", keyAppTemplates(appID), templateID))
+	if err == redigo.ErrNil {
+		return nil, storage.ErrNotFound
+	}
 
 	if err != nil {
 		return nil, err
 	}
 
-	return subscribers, nil
+	var template *storage.Template
+	if err := json.Unmarshal(value, &template); err != nil {
+		return nil, err
+	}
+
+	return template, nil
 }
 
-// GetSubscriberDevices gets devices of a subscriber.
-func (stg *RedisStorage) GetSubscriberDevices(appID string, subscriberID string) ([]*storage.Device, error) {
-	conn := stg.pool.Get()
+// GetTemplates gets all templates of an app, ordered by id.
+func (stg *RedisStorage) GetTemplates(ctx context.Context, appID string) ([]*storage.Template, error) {
+	conn, err := stg.getConn(ctx)
+	if err != nil {
+		return nil, err
+	}
 	defer conn.Close()
 
-	key := keySubscriberDevices(appID, subscriberID)
-
-	var devices map[string]string
-	devices, err := redigo.StringMap(conn.Do("HGETALL", key))
+	values, err := redigo.StringMap(conn.Do("HGETALL", keyAppTemplates(appID)))
 	if err != nil {
 		return nil, err
 	}
 
-	var device storage.Device
-	var response []*storage.Device
-	for _, deviceData := range devices {
-		decoder := json.NewDecoder(strings.NewReader(deviceData))
-		decoder.Decode(&device)
-		response = append(response, &device)
+	templates := make([]*storage.Template, 0, len(values))
+	for _, value := range values {
+		var template *storage.Template
+		if err := json.Unmarshal([]byte(value), &template); err != nil {
+			return nil, err
+		}
+		templates = append(templates, template)
 	}
 
-	return response, nil
+	sort.Slice(templates, func(i, j int) bool {
+		return templates[i].ID < templates[j].ID
+	})
+
+	return templates, nil
 }
 
-// PutApp creates a new app or updates existing one.
-func (stg *RedisStorage) PutApp(app *storage.App) error {
-	conn := stg.pool.Get()
+// DeleteTemplate deletes a template of an app.
+func (stg *RedisStorage) DeleteTemplate(ctx context.Context, appID string, templateID string) error {
+	conn, err := stg.getConn(ctx)
+	if err != nil {
+		return err
+	}
 	defer conn.Close()
 
-	appID := app.ID
-	appData, err := json.Marshal(app)
+	deleted, err := redigo.Int(conn.Do("HDEL", keyAppTemplates(appID), templateID))
 	if err != nil {
 		return err
 	}
 
-	if _, err := conn.Do("HSET", keyApps(), appID, appData); err != nil {
-		return err
+	if deleted == 0 {
+		return storage.ErrNotFound
 	}
 
 	return nil
 }
 
-// GetApp gets an app's data.
-func (stg *RedisStorage) GetApp(appID string) (*storage.App, error) {
-	conn := stg.pool.Get()
+// PutDeadLetters records dead letters, replacing the ones with the same ids.
+// Each dead letter is kept in its own key expiring at its ExpiresAt, and
+// indexed in a sorted set scored by it.
+func (stg *RedisStorage) PutDeadLetters(ctx context.Context, appID string, letters []*storage.DeadLetter) error {
+	conn, err := stg.getConn(ctx)
+	if err != nil {
+		return err
+	}
 	defer conn.Close()
 
-	value, err := redigo.Bytes(conn.Do("HGET", keyApps(), appID))
+	now := int(time.Now().Unix())
+	cmds := []command{{"ZREMRANGEBYSCORE", []interface{}{keyAppDeadLetters(appID), "-inf", now}}}
+
+	for _, letter := range letters {
+		if letter.ExpiresAt <= now {
+			continue
+		}
+
+		letterData, err := json.Marshal(letter)
+		if err != nil {
+			return err
+		}
+
+		key := keyAppDeadLetter(appID, letter.ID)
+		cmds = append(cmds,
+			command{"SET", []interface{}{key, letterData}},
+			command{"EXPIREAT", []interface{}{key, letter.ExpiresAt}},
+			command{"ZADD", []interface{}{keyAppDeadLetters(appID), letter.ExpiresAt, letter.ID}},
+		)
+	}
+
+	_, err = multi(conn, cmds...)
+	return err
+}
+
+// GetDeadLetter gets a dead letter of an app.
+func (stg *RedisStorage) GetDeadLetter(ctx context.Context, appID string, letterID string) (*storage.DeadLetter, error) {
+	conn, err := stg.getConn(ctx)
 	if err != nil {
 		return nil, err
 	}
+	defer conn.Close()
 
-	var app *storage.App
-	if err := json.Unmarshal(value, &app); err != nil {
+	value, err := redigo.Bytes(conn.Do("GET", keyAppDeadLetter(appID, letterID)))
+	if err == redigo.ErrNil {
+		return nil, storage.ErrNotFound
+	}
+
+	if err != nil {
 		return nil, err
 	}
 
-	return app, nil
+	var letter *storage.DeadLetter
+	if err := json.Unmarshal(value, &letter); err != nil {
+		return nil, err
+	}
+
+	return letter, nil
+}
+
+// ScanDeadLetters gets a page of the dead letters of an app, in the order they
+// expire. Cursors are offsets in the sorted set indexing them.
+func (stg *RedisStorage) ScanDeadLetters(ctx context.Context, appID string, cursor string, count int) ([]*storage.DeadLetter, string, error) {
+	if count <= 0 {
+		count = defaultScanCount
+	}
+
+	start := 0
+	if cursor != "" {
+		var err error
+		if start, err = strconv.Atoi(cursor); err != nil || start < 0 {
+			return nil, "", errors.New("redis: invalid dead letter cursor")
+		}
+	}
+
+	conn, err := stg.getConn(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+	defer conn.Close()
+
+	now := int(time.Now().Unix())
+	if _, err := conn.Do("ZREMRANGEBYSCORE", keyAppDeadLetters(appID), "-inf", now); err != nil {
+		return nil, "", err
+	}
+
+	letterIDs, err := redigo.Strings(conn.Do("ZRANGE", keyAppDeadLetters(appID), start, start+count-1))
+	if err != nil {
+		return nil, "", err
+	}
+
+	if len(letterIDs) == 0 {
+		return nil, "", nil
+	}
+
+	keys := make([]interface{}, len(letterIDs))
+	for i, letterID := range letterIDs {
+		keys[i] = keyAppDeadLetter(appID, letterID)
+	}
+
+	values, err := redigo.ByteSlices(conn.Do("MGET", keys...))
+	if err != nil {
+		return nil, "", err
+	}
+
+	letters := make([]*storage.DeadLetter, 0, len(values))
+	for _, value := range values {
+		// the key expired before the index was cleaned up.
+		if value == nil {
+			continue
+		}
+
+		var letter *storage.DeadLetter
+		if err := json.Unmarshal(value, &letter); err != nil {
+			return nil, "", err
+		}
+		letters = append(letters, letter)
+	}
+
+	next := ""
+	if len(letterIDs) == count {
+		next = strconv.Itoa(start + count)
+	}
+
+	return letters, next, nil
+}
+
+// DeleteDeadLetters deletes dead letters of an app.
+func (stg *RedisStorage) DeleteDeadLetters(ctx context.Context, appID string, letterIDs []string) (int, error) {
+	if len(letterIDs) == 0 {
+		return 0, nil
+	}
+
+	conn, err := stg.getConn(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	keys := make([]interface{}, len(letterIDs))
+	members := make([]interface{}, 0, len(letterIDs)+1)
+	members = append(members, keyAppDeadLetters(appID))
+	for i, letterID := range letterIDs {
+		keys[i] = keyAppDeadLetter(appID, letterID)
+		members = append(members, letterID)
+	}
+
+	replies, err := multi(conn,
+		command{"DEL", keys},
+		command{"ZREM", members},
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	return redigo.Int(replies[0], nil)
+}
+
+// PutCircuits records the circuits reported by processes, replacing earlier
+// reports of the same app, provider and process. The circuits of an app are
+// kept in a hash by provider and process, and the apps having circuits in a
+// set.
+func (stg *RedisStorage) PutCircuits(ctx context.Context, circuits []*storage.Circuit) error {
+	if len(circuits) == 0 {
+		return nil
+	}
+
+	conn, err := stg.getConn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	cmds := make([]command, 0, len(circuits)*2)
+	for _, circuit := range circuits {
+		circuitData, err := json.Marshal(circuit)
+		if err != nil {
+			return err
+		}
+
+		cmds = append(cmds,
+			command{"HSET", []interface{}{keyAppCircuits(circuit.AppID), circuit.Provider + "/" + circuit.Process, circuitData}},
+			command{"SADD", []interface{}{keyCircuitApps(), circuit.AppID}},
+		)
+	}
+
+	_, err = multi(conn, cmds...)
+	return err
+}
+
+// GetCircuits gets the circuits reported for an app, or for all apps if appID
+// is empty. Expired reports are skipped and removed.
+func (stg *RedisStorage) GetCircuits(ctx context.Context, appID string) ([]*storage.Circuit, error) {
+	conn, err := stg.getConn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	appIDs := []string{appID}
+	if appID == "" {
+		if appIDs, err = redigo.Strings(conn.Do("SMEMBERS", keyCircuitApps())); err != nil {
+			return nil, err
+		}
+	}
+
+	now := int(time.Now().Unix())
+	circuits := []*storage.Circuit{}
+
+	for _, circuitAppID := range appIDs {
+		values, err := redigo.StringMap(conn.Do("HGETALL", keyAppCircuits(circuitAppID)))
+		if err != nil {
+			return nil, err
+		}
+
+		expired := []interface{}{keyAppCircuits(circuitAppID)}
+		for field, value := range values {
+			var circuit *storage.Circuit
+			if err := json.Unmarshal([]byte(value), &circuit); err != nil {
+				return nil, err
+			}
+
+			if circuit.ExpiresAt <= now {
+				expired = append(expired, field)
+				continue
+			}
+			circuits = append(circuits, circuit)
+		}
+
+		if len(expired) > 1 {
+			if _, err := conn.Do("HDEL", expired...); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	sort.Slice(circuits, func(i, j int) bool {
+		a, b := circuits[i], circuits[j]
+		if a.AppID != b.AppID {
+			return a.AppID < b.AppID
+		}
+		if a.Provider != b.Provider {
+			return a.Provider < b.Provider
+		}
+		return a.Process < b.Process
+	})
+
+	return circuits, nil
 }
 
 const redisPrefix = "scotty"
 
+// pipelineSize is the maximum number of commands sent in a single pipeline.
+const pipelineSize = 500
+
+// defaultScanCount is the page size of dead letter scans without a count, the
+// same as the default of SSCAN.
+const defaultScanCount = 10
+
+// intersectionTTL is the time a temporary intersection set is kept between
+// two pages of a scan.
+const intersectionTTL = 10 * time.Minute
+
+// keyPartEscaper escapes the separator of key parts, so parts containing dots
+// do not collide with other keys; see keyPart in preferencesLib. Parts
+// without dots or backslashes are kept as they are.
+var keyPartEscaper = strings.NewReplacer(`\`, `\\`, ".", `\.`)
+
 func buildKey(part ...string) string {
-	return redisPrefix + ":" + strings.Join(part, ".")
+	escaped := make([]string, len(part))
+	for i, p := range part {
+		escaped[i] = keyPartEscaper.Replace(p)
+	}
+	return redisPrefix + ":" + strings.Join(escaped, ".")
 }
 
 func keyApps() string {
 	return buildKey("apps")
 }
 
+func keyMigrations() string {
+	return buildKey("migrations")
+}
+
 func keyAppSubscribers(appID string) string {
 	return buildKey("apps", appID, "subs")
 }
 
+func keyAppSegments(appID string) string {
+	return buildKey("apps", appID, "segments")
+}
+
+func keyAppTemplates(appID string) string {
+	return buildKey("apps", appID, "templates")
+}
+
+func keyAppDeadLetters(appID string) string {
+	return buildKey("apps", appID, "deadletters")
+}
+
+func keyAppDeadLetter(appID string, letterID string) string {
+	return buildKey("apps", appID, "deadletters", letterID)
+}
+
+func keyAppCircuits(appID string) string {
+	return buildKey("apps", appID, "circuits")
+}
+
+func keyCircuitApps() string {
+	return buildKey("circuits")
+}
+
+func keyAppTombstones(appID string) string {
+	return buildKey("apps", appID, "tombstones")
+}
+
 func keyAppChannels(appID string) string {
 	return buildKey("apps", appID, "chans")
 }
@@ -237,3 +1674,48 @@ func keyChannelSubscribers(appID, channelID string) string {
 func keySubscriberDevices(appID, subscriberID string) string {
 	return buildKey("apps", appID, "subs", subscriberID, "devs")
 }
+
+func keySubscriberChannels(appID, subscriberID string) string {
+	return buildKey("apps", appID, "subs", subscriberID, "chans")
+}
+
+func keySubscriberAliases(appID, subscriberID string) string {
+	return buildKey("apps", appID, "subs", subscriberID, "aliases")
+}
+
+func keyAppAliases(appID string) string {
+	return buildKey("apps", appID, "aliases")
+}
+
+func keyAppPreferences(appID string) string {
+	return buildKey("apps", appID, "prefs")
+}
+
+func keyCategoryChoices(appID, categoryID string, optIn bool) string {
+	if optIn {
+		return buildKey("apps", appID, "prefs", "cats", categoryID, "in")
+	}
+	return buildKey("apps", appID, "prefs", "cats", categoryID, "out")
+}
+
+func keyChannelOptOuts(appID, channelID string) string {
+	return buildKey("apps", appID, "prefs", "chans", channelID, "out")
+}
+
+// keyPreferenceIndexPrefix returns the part of keyCategoryChoices and
+// keyChannelOptOuts before "cats" and "chans".
+func keyPreferenceIndexPrefix(appID string) string {
+	return buildKey("apps", appID, "prefs", "")
+}
+
+func keyAppTokens(appID string) string {
+	return buildKey("apps", appID, "tokens")
+}
+
+func keyAttributeIndex(appID, attribute, value string) string {
+	return buildKey("apps", appID, "idx", attribute, value)
+}
+
+func keyIntersection(appID, id string) string {
+	return buildKey("apps", appID, "tmp", id)
+}
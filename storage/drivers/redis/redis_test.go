@@ -0,0 +1,102 @@
+package redis
+
+import (
+	"context"
+	"os"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gamegos/scotty/storage"
+	"github.com/gamegos/scotty/storage/storagetest"
+	redigo "github.com/garyburd/redigo/redis"
+)
+
+// Conformance tests need a running Redis server. Set SCOTTY_TEST_REDIS_ADDR
+// to its address to run them, e.g. SCOTTY_TEST_REDIS_ADDR=:6379.
+func TestConformance(t *testing.T) {
+	addr := os.Getenv("SCOTTY_TEST_REDIS_ADDR")
+	if addr == "" {
+		t.Skip("SCOTTY_TEST_REDIS_ADDR is not set")
+	}
+
+	conf := DefaultConfig()
+	conf.Addr = addr
+	stg := New(conf)
+
+	storagetest.Run(t, func(t *testing.T) storage.Storage {
+		return stg
+	})
+}
+
+func TestMigrateSubscriberChannels(t *testing.T) {
+	addr := os.Getenv("SCOTTY_TEST_REDIS_ADDR")
+	if addr == "" {
+		t.Skip("SCOTTY_TEST_REDIS_ADDR is not set")
+	}
+
+	conf := DefaultConfig()
+	conf.Addr = addr
+	stg := New(conf)
+
+	ctx := context.Background()
+	appID := "migration" + strconv.FormatInt(time.Now().UnixNano(), 10)
+
+	conn, err := stg.getConn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// a channel joined before the channels sets of subscribers were kept.
+	_, err = multi(conn,
+		command{"SREM", []interface{}{keyMigrations(), subscriberChannelsMigration}},
+		command{"HSET", []interface{}{keyApps(), appID, "{}"}},
+		command{"SADD", []interface{}{keyAppChannels(appID), "c"}},
+		command{"SADD", []interface{}{keyChannelSubscribers(appID, "c"), "u1"}},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	channels, err := stg.GetSubscriberChannels(ctx, appID, "u1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(channels, []string{"c"}) {
+		t.Errorf("Expected the channel to be found before the migration, got %v", channels)
+	}
+
+	if err := stg.MigrateSubscriberChannels(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	members, err := redigo.Strings(conn.Do("SMEMBERS", keySubscriberChannels(appID, "u1")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(members, []string{"c"}) {
+		t.Errorf("Channels set does not match after the migration. got %v", members)
+	}
+
+	if err := stg.DeleteSubscriber(ctx, appID, "u1"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBuildKey(t *testing.T) {
+	if key := keySubscriberDevices("app", "u1"); key != "scotty:apps.app.subs.u1.devs" {
+		t.Errorf("Key of plain ids changed, got %q", key)
+	}
+
+	if keySubscriberChannels("app", "x") == keyAppChannels("app.subs.x") {
+		t.Error("Keys of dotted ids collide")
+	}
+
+	if key := buildKey("a.b", `c\`); key != `scotty:a\.b.c\\` {
+		t.Errorf("Key parts are not escaped, got %q", key)
+	}
+}
@@ -0,0 +1,699 @@
+package redis
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/gamegos/scotty/storage"
+	redigo "github.com/garyburd/redigo/redis"
+)
+
+// Device scripts keep the token index (token -> subscriber id) and the
+// attribute indexes consistent with subscriber devices hashes. Keys of
+// previous token owners and of attribute indexes depend on data, so the
+// caller reads the data before the script runs and passes the keys in KEYS.
+// The script checks the data again and returns nil if it changed; the caller
+// runs it again then, see doScript.
+//
+// An attribute index is a hash of subscriber id -> number of the subscriber's
+// devices with the attribute value, so each subscriber is listed once.
+
+// deviceIndexLib is prepended to device scripts. loadIndexes reads the
+// attribute index keys, which are the last m keys, and the indexed
+// attributes from ARGV[idx...]. indexed reports whether the keys of the
+// devices encoded in datas were passed, and reindex adds delta to the
+// attribute index counters of the device encoded in data.
+//
+// ARGV[idx]: m, number of attribute index keys
+// ARGV[idx+1...idx+2m]: pairs of attribute name and value of the keys
+// ARGV[idx+2m+1...]: pairs of attribute name and device field name
+const deviceIndexLib = `
+local indexes = {}
+local attributes = {}
+
+local function loadIndexes(idx)
+	local m = tonumber(ARGV[idx])
+	local first = #KEYS - m
+	for i = 1, m do
+		local attribute, value = ARGV[idx + 2 * i - 1], ARGV[idx + 2 * i]
+		indexes[attribute] = indexes[attribute] or {}
+		indexes[attribute][value] = KEYS[first + i]
+	end
+
+	for i = idx + 2 * m + 1, #ARGV, 2 do
+		attributes[#attributes + 1] = {ARGV[i], ARGV[i + 1]}
+	end
+end
+
+local function indexKeys(data)
+	local keys = {}
+	local device = cjson.decode(data)
+	for _, attribute in ipairs(attributes) do
+		local value = device[attribute[2]]
+		if type(value) == 'string' and value ~= '' then
+			local key = indexes[attribute[1]] and indexes[attribute[1]][value]
+			if not key then
+				return nil
+			end
+			keys[#keys + 1] = key
+		end
+	end
+	return keys
+end
+
+local function indexed(datas)
+	for _, data in ipairs(datas) do
+		if data and not indexKeys(data) then
+			return false
+		end
+	end
+	return true
+end
+
+local function reindex(subscriber, data, delta)
+	if not data then
+		return
+	end
+
+	for _, key in ipairs(indexKeys(data)) do
+		if redis.call('HINCRBY', key, subscriber, delta) <= 0 then
+			redis.call('HDEL', key, subscriber)
+		end
+	end
+end
+`
+
+// preferencesLib is prepended to scripts changing subscriber preferences.
+// Preferences are kept in a hash of subscriber id -> JSON, indexed by sets of
+// the subscribers that opted in to or out of each category and of those that
+// opted out of each channel. indexPreferences adds the subscriber to the
+// sets of the preferences encoded in data, or removes it if add is false.
+// keyPart escapes category and channel ids as buildKey does.
+//
+// prefix: preference index key prefix
+const preferencesLib = `
+local function keyPart(id)
+	return (string.gsub(id, '[\\.]', '\\%0'))
+end
+
+local function indexPreferences(prefix, subscriber, data, add)
+	if not data then
+		return
+	end
+
+	local cmd = add and 'SADD' or 'SREM'
+	local prefs = cjson.decode(data)
+
+	if type(prefs.categories) == 'table' then
+		for category, optIn in pairs(prefs.categories) do
+			local choice = optIn == true and '.in' or '.out'
+			redis.call(cmd, prefix .. 'cats.' .. keyPart(category) .. choice, subscriber)
+		end
+	end
+
+	if type(prefs.channels) == 'table' then
+		for channel, optIn in pairs(prefs.channels) do
+			if optIn ~= true then
+				redis.call(cmd, prefix .. 'chans.' .. keyPart(channel) .. '.out', subscriber)
+			end
+		end
+	end
+end
+`
+
+// putPreferencesScript replaces the preferences of a subscriber.
+//
+// KEYS[1]: app preferences hash
+// ARGV[1]: subscriber id
+// ARGV[2]: preferences data
+// ARGV[3]: preference index key prefix
+var putPreferencesScript = redigo.NewScript(1, preferencesLib+`
+indexPreferences(ARGV[3], ARGV[1], redis.call('HGET', KEYS[1], ARGV[1]), false)
+redis.call('HSET', KEYS[1], ARGV[1], ARGV[2])
+indexPreferences(ARGV[3], ARGV[1], ARGV[2], true)
+`)
+
+// addDeviceScript stores a device and moves its token from the previous
+// owner. It returns 1, or nil if the previous owner or its device changed.
+//
+// KEYS[1]: app token index hash
+// KEYS[2]: app subscribers set
+// KEYS[3]: subscriber devices hash
+// KEYS[4]: previous owner devices hash, or KEYS[3] if there is none
+// KEYS[5...]: attribute index keys, see deviceIndexLib
+// ARGV[1]: subscriber id
+// ARGV[2]: token
+// ARGV[3]: device data
+// ARGV[4]: previous owner read by the caller, or empty
+// ARGV[5...]: attribute indexes, see deviceIndexLib
+var addDeviceScript = redigo.NewScript(-1, deviceIndexLib+`
+loadIndexes(5)
+
+local owner = redis.call('HGET', KEYS[1], ARGV[2])
+if (owner or '') ~= ARGV[4] then
+	return false
+end
+
+local previous = owner and redis.call('HGET', KEYS[4], ARGV[2])
+if not indexed({previous, ARGV[3]}) then
+	return false
+end
+
+if owner then
+	reindex(owner, previous, -1)
+	redis.call('HDEL', KEYS[4], ARGV[2])
+end
+
+redis.call('HSET', KEYS[1], ARGV[2], ARGV[1])
+redis.call('SADD', KEYS[2], ARGV[1])
+redis.call('HSET', KEYS[3], ARGV[2], ARGV[3])
+reindex(ARGV[1], ARGV[3], 1)
+
+return 1
+`)
+
+// updateDeviceTokenScript moves a device to a new token in a subscriber's
+// devices hash, replacing any device with the new token. It returns 0 if
+// there is no device with the old token, 1 if it was moved, or nil if the
+// owner of the new token or its device changed.
+//
+// KEYS[1]: app token index hash
+// KEYS[2]: subscriber devices hash
+// KEYS[3]: devices hash of the new token's owner, or KEYS[2] if there is none
+// KEYS[4...]: attribute index keys, see deviceIndexLib
+// ARGV[1]: subscriber id
+// ARGV[2]: old token
+// ARGV[3]: new token
+// ARGV[4]: owner of the new token read by the caller, or empty
+// ARGV[5...]: attribute indexes, see deviceIndexLib
+var updateDeviceTokenScript = redigo.NewScript(-1, deviceIndexLib+`
+loadIndexes(5)
+
+local data = redis.call('HGET', KEYS[2], ARGV[2])
+if not data then
+	return 0
+end
+
+local owner = redis.call('HGET', KEYS[1], ARGV[3])
+if (owner or '') ~= ARGV[4] then
+	return false
+end
+
+if owner and ARGV[2] ~= ARGV[3] then
+	local previous = redis.call('HGET', KEYS[3], ARGV[3])
+	if not indexed({previous}) then
+		return false
+	end
+
+	reindex(owner, previous, -1)
+	redis.call('HDEL', KEYS[3], ARGV[3])
+end
+
+local device = cjson.decode(data)
+device.Token = ARGV[3]
+
+redis.call('HDEL', KEYS[2], ARGV[2])
+redis.call('HDEL', KEYS[1], ARGV[2])
+redis.call('HSET', KEYS[2], ARGV[3], cjson.encode(device))
+redis.call('HSET', KEYS[1], ARGV[3], ARGV[1])
+
+return 1
+`)
+
+// intersectionScript stores the members of every channel in KEYS[2...n+1]
+// that are not members of any channel in the rest of the keys to KEYS[1],
+// which expires after ARGV[2] seconds. It returns the number of members.
+//
+// KEYS[1]: temporary result set
+// KEYS[2...]: channel subscribers sets to intersect, then to subtract
+// ARGV[1]: n, number of sets to intersect
+// ARGV[2]: expiry of the result set in seconds
+var intersectionScript = redigo.NewScript(-1, `
+local n = tonumber(ARGV[1])
+
+redis.call('SINTERSTORE', KEYS[1], unpack(KEYS, 2, n + 1))
+if #KEYS > n + 1 then
+	redis.call('SDIFFSTORE', KEYS[1], KEYS[1], unpack(KEYS, n + 2))
+end
+redis.call('EXPIRE', KEYS[1], ARGV[2])
+
+return redis.call('SCARD', KEYS[1])
+`)
+
+// channelsLib is prepended to scripts changing the channel memberships of a
+// subscriber. The channels of a subscriber are kept in a set, which may list
+// channels deleted since. Scripts get the subscribers set keys of those
+// channels as KEYS and their ids as ARGV, read by the caller before the
+// script runs, see subscriberChannelIDs. channelsChanged reports whether the subscriber channels set
+// KEYS[set] has a channel that is not among the n ids from ARGV[arg], i.e.
+// the subscriber joined a channel since; the script returns nil then and the
+// caller runs it again, see doScript.
+const channelsLib = `
+local function channelsChanged(set, arg, n)
+	local passed = {}
+	for i = arg, arg + n - 1 do
+		passed[ARGV[i]] = true
+	end
+
+	for _, channel in ipairs(redis.call('SMEMBERS', KEYS[set])) do
+		if not passed[channel] then
+			return true
+		end
+	end
+
+	return false
+end
+`
+
+// pruneSubscriberScript deletes the devices of a subscriber last seen before
+// a timestamp. A subscriber left without devices is removed from the app and
+// its channels with its preferences, and channels left empty are deleted. It
+// returns the removed devices, 1 if the subscriber was removed or 0, and the
+// deleted channels, or nil if the channels or the devices of the subscriber
+// changed, see channelsLib and deviceIndexLib.
+//
+// KEYS[1]: subscriber devices hash
+// KEYS[2]: app token index hash
+// KEYS[3]: app subscribers set
+// KEYS[4]: app channels set
+// KEYS[5]: app preferences hash
+// KEYS[6]: subscriber channels set
+// KEYS[7...6+n]: channel subscribers sets of the subscriber's channels
+// KEYS[7+n...]: attribute index keys of the subscriber's devices, see
+// deviceIndexLib
+// ARGV[1]: subscriber id
+// ARGV[2]: unix timestamp
+// ARGV[3]: preference index key prefix, see preferencesLib
+// ARGV[4]: n, number of channels of the subscriber
+// ARGV[5...4+n]: channel ids of the channel subscribers sets
+// ARGV[5+n...]: attribute indexes, see deviceIndexLib
+var pruneSubscriberScript = redigo.NewScript(-1, deviceIndexLib+preferencesLib+channelsLib+`
+local n = tonumber(ARGV[4])
+loadIndexes(5 + n)
+if channelsChanged(6, 5, n) or not indexed(redis.call('HVALS', KEYS[1])) then
+	return false
+end
+
+local before = tonumber(ARGV[2])
+local removed = {}
+
+local devices = redis.call('HGETALL', KEYS[1])
+for i = 1, #devices, 2 do
+	local device = cjson.decode(devices[i + 1])
+	local seen = device.LastSeen
+	if not seen or seen == 0 then
+		seen = device.CreatedAt or 0
+	end
+
+	if seen < before then
+		reindex(ARGV[1], devices[i + 1], -1)
+		redis.call('HDEL', KEYS[1], devices[i])
+		if redis.call('HGET', KEYS[2], devices[i]) == ARGV[1] then
+			redis.call('HDEL', KEYS[2], devices[i])
+		end
+		removed[#removed + 1] = devices[i + 1]
+	end
+end
+
+if redis.call('EXISTS', KEYS[1]) == 1 or redis.call('SREM', KEYS[3], ARGV[1]) == 0 then
+	return {removed, 0, {}}
+end
+
+indexPreferences(ARGV[3], ARGV[1], redis.call('HGET', KEYS[5], ARGV[1]), false)
+redis.call('HDEL', KEYS[5], ARGV[1])
+
+local channels = {}
+for i = 1, n do
+	local key = KEYS[6 + i]
+	if redis.call('SREM', key, ARGV[1]) == 1 and redis.call('SCARD', key) == 0 then
+		redis.call('SREM', KEYS[4], ARGV[4 + i])
+		channels[#channels + 1] = ARGV[4 + i]
+	end
+end
+redis.call('DEL', KEYS[6])
+
+return {removed, 1, channels}
+`)
+
+// deleteSubscriberScript deletes a subscriber with its devices, channel
+// memberships, aliases and preferences. It returns 0 if nothing was deleted,
+// or nil if the channels or the devices of the subscriber changed, see
+// channelsLib and deviceIndexLib.
+//
+// KEYS[1]: subscriber devices hash
+// KEYS[2]: app token index hash
+// KEYS[3]: app subscribers set
+// KEYS[4]: subscriber channels set
+// KEYS[5]: app aliases hash
+// KEYS[6]: subscriber aliases set
+// KEYS[7]: app preferences hash
+// KEYS[8]: aliases set of the subscriber the subscriber is an alias of, or
+// KEYS[6] if it is not an alias
+// KEYS[9...8+n]: channel subscribers sets of the subscriber's channels
+// KEYS[9+n...]: attribute index keys of the subscriber's devices, see
+// deviceIndexLib
+// ARGV[1]: subscriber id
+// ARGV[2]: subscriber the subscriber is an alias of read by the caller, or
+// empty
+// ARGV[3]: preference index key prefix, see preferencesLib
+// ARGV[4]: n, number of channels of the subscriber
+// ARGV[5...4+n]: channel ids of the channel subscribers sets
+// ARGV[5+n...]: attribute indexes, see deviceIndexLib
+var deleteSubscriberScript = redigo.NewScript(-1, deviceIndexLib+preferencesLib+channelsLib+`
+local n = tonumber(ARGV[4])
+loadIndexes(5 + n)
+if channelsChanged(4, 5, n) or not indexed(redis.call('HVALS', KEYS[1])) then
+	return false
+end
+
+local target = redis.call('HGET', KEYS[5], ARGV[1])
+if (target or '') ~= ARGV[2] then
+	return false
+end
+
+local found = 0
+
+local devices = redis.call('HGETALL', KEYS[1])
+for i = 1, #devices, 2 do
+	reindex(ARGV[1], devices[i + 1], -1)
+	if redis.call('HGET', KEYS[2], devices[i]) == ARGV[1] then
+		redis.call('HDEL', KEYS[2], devices[i])
+	end
+	found = 1
+end
+redis.call('DEL', KEYS[1])
+
+if redis.call('SREM', KEYS[3], ARGV[1]) == 1 then
+	found = 1
+end
+
+for i = 1, n do
+	if redis.call('SREM', KEYS[8 + i], ARGV[1]) == 1 then
+		found = 1
+	end
+end
+redis.call('DEL', KEYS[4])
+
+if target then
+	redis.call('HDEL', KEYS[5], ARGV[1])
+	redis.call('SREM', KEYS[8], ARGV[1])
+	found = 1
+end
+
+for _, alias in ipairs(redis.call('SMEMBERS', KEYS[6])) do
+	redis.call('HDEL', KEYS[5], alias)
+	found = 1
+end
+redis.call('DEL', KEYS[6])
+
+local prefs = redis.call('HGET', KEYS[7], ARGV[1])
+if prefs then
+	indexPreferences(ARGV[3], ARGV[1], prefs, false)
+	redis.call('HDEL', KEYS[7], ARGV[1])
+	found = 1
+end
+
+return found
+`)
+
+// mergeSubscriberScript moves the devices and channel memberships of a source
+// subscriber to a target subscriber, and makes the source and its aliases
+// aliases of the target. Preferences of the source are moved if the target
+// has none. It returns 0 if the source has no devices or channels, or nil if
+// the channels or the devices of the source changed, see channelsLib and
+// deviceIndexLib.
+//
+// KEYS[1]: source devices hash
+// KEYS[2]: target devices hash
+// KEYS[3]: app token index hash
+// KEYS[4]: app subscribers set
+// KEYS[5]: source channels set
+// KEYS[6]: app aliases hash
+// KEYS[7]: source aliases set
+// KEYS[8]: target aliases set
+// KEYS[9]: app preferences hash
+// KEYS[10]: target channels set
+// KEYS[11]: aliases set of the subscriber the source is an alias of, or
+// KEYS[7] if it is not an alias
+// KEYS[12...11+n]: channel subscribers sets of the source's channels
+// KEYS[12+n...]: attribute index keys of the source's devices, see
+// deviceIndexLib
+// ARGV[1]: source subscriber id
+// ARGV[2]: target subscriber id
+// ARGV[3]: subscriber the source is an alias of read by the caller, or empty
+// ARGV[4]: preference index key prefix, see preferencesLib
+// ARGV[5]: n, number of channels of the source
+// ARGV[6...5+n]: channel ids of the channel subscribers sets
+// ARGV[6+n...]: attribute indexes, see deviceIndexLib
+var mergeSubscriberScript = redigo.NewScript(-1, deviceIndexLib+preferencesLib+channelsLib+`
+local n = tonumber(ARGV[5])
+loadIndexes(6 + n)
+if channelsChanged(5, 6, n) or not indexed(redis.call('HVALS', KEYS[1])) then
+	return false
+end
+
+local previous = redis.call('HGET', KEYS[6], ARGV[1])
+if (previous or '') ~= ARGV[3] then
+	return false
+end
+
+local found = 0
+
+local devices = redis.call('HGETALL', KEYS[1])
+for i = 1, #devices, 2 do
+	reindex(ARGV[1], devices[i + 1], -1)
+	reindex(ARGV[2], devices[i + 1], 1)
+	redis.call('HSET', KEYS[2], devices[i], devices[i + 1])
+	redis.call('HSET', KEYS[3], devices[i], ARGV[2])
+	found = 1
+end
+redis.call('DEL', KEYS[1])
+
+if found == 1 then
+	redis.call('SREM', KEYS[4], ARGV[1])
+	redis.call('SADD', KEYS[4], ARGV[2])
+end
+
+for i = 1, n do
+	local key = KEYS[11 + i]
+	if redis.call('SREM', key, ARGV[1]) == 1 then
+		redis.call('SADD', key, ARGV[2])
+		redis.call('SADD', KEYS[10], ARGV[5 + i])
+		found = 1
+	end
+end
+redis.call('DEL', KEYS[5])
+
+if found == 0 then
+	return 0
+end
+
+if previous then
+	redis.call('SREM', KEYS[11], ARGV[1])
+end
+
+for _, alias in ipairs(redis.call('SMEMBERS', KEYS[7])) do
+	if alias == ARGV[2] then
+		redis.call('HDEL', KEYS[6], alias)
+	else
+		redis.call('HSET', KEYS[6], alias, ARGV[2])
+		redis.call('SADD', KEYS[8], alias)
+	end
+end
+redis.call('DEL', KEYS[7])
+
+redis.call('HSET', KEYS[6], ARGV[1], ARGV[2])
+redis.call('SADD', KEYS[8], ARGV[1])
+
+local prefs = redis.call('HGET', KEYS[9], ARGV[1])
+if prefs then
+	indexPreferences(ARGV[4], ARGV[1], prefs, false)
+	redis.call('HDEL', KEYS[9], ARGV[1])
+	if redis.call('HEXISTS', KEYS[9], ARGV[2]) == 0 then
+		redis.call('HSET', KEYS[9], ARGV[2], prefs)
+		indexPreferences(ARGV[4], ARGV[2], prefs, true)
+	end
+end
+
+return 1
+`)
+
+// attributeIndexes returns the keys of the attribute indexes of the devices
+// encoded in datas, and the ARGV tail of scripts using deviceIndexLib. Nil
+// datas are skipped.
+func attributeIndexes(appID string, datas ...[]byte) ([]interface{}, []interface{}, error) {
+	attributes := make([]string, 0, len(storage.IndexedAttributes))
+	for attribute := range storage.IndexedAttributes {
+		attributes = append(attributes, attribute)
+	}
+	sort.Strings(attributes)
+
+	var keys, values []interface{}
+	seen := make(map[string]bool)
+	for _, data := range datas {
+		if data == nil {
+			continue
+		}
+
+		// devices are decoded as the scripts decode them.
+		var device map[string]interface{}
+		if err := json.Unmarshal(data, &device); err != nil {
+			return nil, nil, err
+		}
+
+		for _, attribute := range attributes {
+			value, _ := device[storage.IndexedAttributes[attribute]].(string)
+			key := keyAttributeIndex(appID, attribute, value)
+			if value == "" || seen[key] {
+				continue
+			}
+
+			seen[key] = true
+			keys = append(keys, key)
+			values = append(values, attribute, value)
+		}
+	}
+
+	args := append([]interface{}{len(keys)}, values...)
+	for _, attribute := range attributes {
+		args = append(args, attribute, storage.IndexedAttributes[attribute])
+	}
+
+	return keys, args, nil
+}
+
+// tokenOwner reads the subscriber that owns a token and its device data for
+// scripts moving tokens. owner is empty if the token has none.
+func tokenOwner(conn redigo.Conn, appID string, token string) (owner string, data []byte, err error) {
+	owner, err = redigo.String(conn.Do("HGET", keyAppTokens(appID), token))
+	if err == redigo.ErrNil {
+		return "", nil, nil
+	}
+	if err != nil {
+		return "", nil, err
+	}
+
+	data, err = redigo.Bytes(conn.Do("HGET", keySubscriberDevices(appID, owner), token))
+	if err == redigo.ErrNil {
+		return owner, nil, nil
+	}
+
+	return owner, data, err
+}
+
+// aliasTarget reads the subscriber that subscriberID is an alias of and the
+// key of its aliases set for scripts changing aliases. If subscriberID is not
+// an alias, target is empty and aliasesKey is fallbackKey.
+func aliasTarget(conn redigo.Conn, appID string, subscriberID string, fallbackKey string) (target string, aliasesKey string, err error) {
+	target, err = redigo.String(conn.Do("HGET", keyAppAliases(appID), subscriberID))
+	if err == redigo.ErrNil {
+		return "", fallbackKey, nil
+	}
+	if err != nil {
+		return "", "", err
+	}
+
+	return target, keySubscriberAliases(appID, target), nil
+}
+
+// subscriberDevicesData reads the encoded devices of a subscriber for scripts
+// reindexing them.
+func subscriberDevicesData(conn redigo.Conn, appID string, subscriberID string) ([][]byte, error) {
+	return redigo.ByteSlices(conn.Do("HVALS", keySubscriberDevices(appID, subscriberID)))
+}
+
+// subscriberChannels reads the channels of a subscriber for scripts using
+// channelsLib: the keys of their subscribers sets and their ids.
+func (stg *RedisStorage) subscriberChannels(conn redigo.Conn, appID string, subscriberID string) ([]interface{}, []interface{}, error) {
+	ids, err := stg.subscriberChannelIDs(conn, appID, subscriberID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	channelKeys := make([]interface{}, len(ids))
+	channelIDs := make([]interface{}, len(ids))
+	for i, channelID := range ids {
+		channelKeys[i] = keyChannelSubscribers(appID, channelID)
+		channelIDs[i] = channelID
+	}
+
+	return channelKeys, channelIDs, nil
+}
+
+// subscriberScriptData reads the channels and the attribute index keys of a
+// subscriber's devices for scripts using channelsLib and deviceIndexLib.
+func (stg *RedisStorage) subscriberScriptData(conn redigo.Conn, appID string, subscriberID string) (channelKeys, channelIDs, indexKeys, indexArgs []interface{}, err error) {
+	if channelKeys, channelIDs, err = stg.subscriberChannels(conn, appID, subscriberID); err != nil {
+		return nil, nil, nil, nil, err
+	}
+
+	datas, err := subscriberDevicesData(conn, appID, subscriberID)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+
+	indexKeys, indexArgs, err = attributeIndexes(appID, datas...)
+	return channelKeys, channelIDs, indexKeys, indexArgs, err
+}
+
+// maxScriptRetries is the number of times a script is run while the data its
+// keys were read from changes.
+const maxScriptRetries = 5
+
+// errScriptKeysChanged is returned if the data the keys of a script were read
+// from kept changing while it ran.
+var errScriptKeysChanged = errors.New("redis: keys of script changed concurrently")
+
+// doScript runs a script that returns nil if the data the caller read its
+// keys from changed before it ran. args reads the data and returns the
+// arguments of the script again for each run.
+func doScript(conn redigo.Conn, script *redigo.Script, args func() ([]interface{}, error)) (interface{}, error) {
+	for i := 0; i < maxScriptRetries; i++ {
+		scriptArgs, err := args()
+		if err != nil {
+			return nil, err
+		}
+
+		reply, err := script.Do(conn, scriptArgs...)
+		if err != nil || reply != nil {
+			return reply, err
+		}
+	}
+
+	return nil, errScriptKeysChanged
+}
+
+// command is a Redis command queued in a transaction.
+type command struct {
+	name string
+	args []interface{}
+}
+
+// multi runs cmds in a MULTI/EXEC transaction sent in a single round trip and
+// returns their replies. An error reply of any command is returned as error.
+func multi(conn redigo.Conn, cmds ...command) ([]interface{}, error) {
+	if err := conn.Send("MULTI"); err != nil {
+		return nil, err
+	}
+
+	for _, cmd := range cmds {
+		if err := conn.Send(cmd.name, cmd.args...); err != nil {
+			return nil, err
+		}
+	}
+
+	replies, err := redigo.Values(conn.Do("EXEC"))
+	if err != nil {
+		return nil, err
+	}
+
+	for i, reply := range replies {
+		if err, ok := reply.(redigo.Error); ok {
+			return nil, fmt.Errorf("%s: %s", cmds[i].name, err)
+		}
+	}
+
+	return replies, nil
+}
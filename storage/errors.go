@@ -0,0 +1,7 @@
+package storage
+
+import "errors"
+
+// ErrNotFound is returned when the requested record does not exist in the
+// storage.
+var ErrNotFound = errors.New("storage: not found")
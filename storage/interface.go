@@ -1,36 +1,198 @@
 package storage
 
+import "context"
+
+// Storage is implemented by storage drivers.
+//
+// Every method takes a context as its first argument. Drivers must return
+// ctx.Err() when the context is done before the operation starts and should
+// honor its deadline while talking to the backend.
 type Storage interface {
 	// App methods
 
 	// PutApp creates a new app or updates existing one.
-	PutApp(app *App) error
+	PutApp(ctx context.Context, app *App) error
 
 	// GetApp gets an app's data.
-	GetApp(appID string) (*App, error)
+	GetApp(ctx context.Context, appID string) (*App, error)
+
+	// GetApps gets all apps, ordered by id.
+	GetApps(ctx context.Context) ([]*App, error)
+
+	// Segment methods
+
+	// PutSegment creates a new segment or updates existing one.
+	PutSegment(ctx context.Context, appID string, segment *Segment) error
+
+	// GetSegment gets a segment of an app.
+	GetSegment(ctx context.Context, appID string, segmentID string) (*Segment, error)
+
+	// GetSegments gets all segments of an app, ordered by id.
+	GetSegments(ctx context.Context, appID string) ([]*Segment, error)
+
+	// DeleteSegment deletes a segment of an app.
+	DeleteSegment(ctx context.Context, appID string, segmentID string) error
+
+	// Template methods
+
+	// PutTemplate creates a new template or updates existing one.
+	PutTemplate(ctx context.Context, appID string, template *Template) error
+
+	// GetTemplate gets a template of an app.
+	GetTemplate(ctx context.Context, appID string, templateID string) (*Template, error)
+
+	// GetTemplates gets all templates of an app, ordered by id.
+	GetTemplates(ctx context.Context, appID string) ([]*Template, error)
+
+	// DeleteTemplate deletes a template of an app.
+	DeleteTemplate(ctx context.Context, appID string, templateID string) error
+
+	// Dead letter methods
+
+	// PutDeadLetters records dead letters, replacing the ones with the same
+	// ids. Dead letters are removed once their ExpiresAt passes.
+	PutDeadLetters(ctx context.Context, appID string, letters []*DeadLetter) error
+
+	// GetDeadLetter gets a dead letter of an app.
+	GetDeadLetter(ctx context.Context, appID string, letterID string) (*DeadLetter, error)
+
+	// ScanDeadLetters gets a page of the dead letters of an app, in the order
+	// they expire. Cursors work as in ScanChannelSubscribers; dead letters
+	// deleted during a scan may cause others to be skipped.
+	ScanDeadLetters(ctx context.Context, appID string, cursor string, count int) (letters []*DeadLetter, next string, err error)
+
+	// DeleteDeadLetters deletes dead letters of an app and returns the number
+	// of dead letters deleted.
+	DeleteDeadLetters(ctx context.Context, appID string, letterIDs []string) (int, error)
+
+	// Circuit methods
+
+	// PutCircuits records the circuits reported by processes, replacing the
+	// earlier reports of the same app, provider and process. Reports are
+	// removed once their ExpiresAt passes.
+	PutCircuits(ctx context.Context, circuits []*Circuit) error
+
+	// GetCircuits gets the circuits reported for an app, or for all apps if
+	// appID is empty, ordered by app, provider and process.
+	GetCircuits(ctx context.Context, appID string) ([]*Circuit, error)
 
 	// Subscriber methods
 
-	// AddSubscriberDevice adds new device to subscriber.
-	AddSubscriberDevice(appID string, subscriberID string, device *Device) error
+	// AddSubscriberDevice adds new device to subscriber. A token belongs to a
+	// single subscriber; adding a device with a token of another subscriber
+	// moves the device to this subscriber.
+	AddSubscriberDevice(ctx context.Context, appID string, subscriberID string, device *Device) error
 
-	// UpdateDeviceToken updates token of a subscriber's device.
-	UpdateDeviceToken(appID string, subscriberID string, oldDeviceToken string, newDeviceToken string) error
+	// UpdateDeviceToken updates token of a subscriber's device. A device of any
+	// subscriber with the new token is replaced.
+	UpdateDeviceToken(ctx context.Context, appID string, subscriberID string, oldDeviceToken string, newDeviceToken string) error
+
+	// GetDeviceOwner gets the subscriber that owns a device token and the
+	// device.
+	GetDeviceOwner(ctx context.Context, appID string, token string) (subscriberID string, device *Device, err error)
+
+	// GetSubscriberChannels gets the channels a subscriber is a member of,
+	// ordered by id.
+	GetSubscriberChannels(ctx context.Context, appID string, subscriberID string) ([]string, error)
+
+	// DeleteSubscriber atomically deletes a subscriber with its devices,
+	// channel memberships, aliases and preferences. It returns ErrNotFound if
+	// the app has no trace of the subscriber.
+	DeleteSubscriber(ctx context.Context, appID string, subscriberID string) error
+
+	// MergeSubscriber atomically moves the devices and channel memberships of
+	// source to target, and makes source and the aliases of source aliases
+	// of target. Preferences of source are moved if target has none. It
+	// returns ErrNotFound if source has no devices or channels.
+	MergeSubscriber(ctx context.Context, appID string, sourceID string, targetID string) error
+
+	// ResolveAliases maps the aliases among subscriberIDs to the subscribers
+	// they were merged into. Ids that are not aliases are left out.
+	ResolveAliases(ctx context.Context, appID string, subscriberIDs []string) (map[string]string, error)
+
+	// GetSubscriberAliases gets the ids merged into a subscriber, ordered by
+	// id.
+	GetSubscriberAliases(ctx context.Context, appID string, subscriberID string) ([]string, error)
+
+	// PutPreferences atomically replaces the preferences of a subscriber.
+	PutPreferences(ctx context.Context, appID string, subscriberID string, prefs *Preferences) error
+
+	// GetPreferences gets the preferences of a subscriber. A subscriber
+	// without preferences has empty ones.
+	GetPreferences(ctx context.Context, appID string, subscriberID string) (*Preferences, error)
+
+	// FilterCategoryChoices returns the subscribers of subscriberIDs that
+	// opted in to a category if optIn is true, or opted out of it otherwise,
+	// in the same order.
+	FilterCategoryChoices(ctx context.Context, appID string, categoryID string, optIn bool, subscriberIDs []string) ([]string, error)
+
+	// FilterChannelOptOuts returns the subscribers of subscriberIDs that opted
+	// out of a channel, in the same order.
+	FilterChannelOptOuts(ctx context.Context, appID string, channelID string, subscriberIDs []string) ([]string, error)
+
+	// AddTombstone records the erasure of a subscriber.
+	AddTombstone(ctx context.Context, appID string, tombstone *Tombstone) error
+
+	// GetTombstones gets the erasure records of an app, oldest first.
+	GetTombstones(ctx context.Context, appID string) ([]*Tombstone, error)
+
+	// PruneSubscriber atomically deletes the devices of a subscriber last seen
+	// (see Device.SeenAt) before the unix timestamp before. A subscriber left
+	// without devices is removed from the app and from its channels with its
+	// preferences, and channels left empty by that are deleted.
+	PruneSubscriber(ctx context.Context, appID string, subscriberID string, before int) (*PruneResult, error)
 
 	// GetSubscriberDevices gets devices of a subscriber.
-	GetSubscriberDevices(appID string, subscriberID string) ([]*Device, error)
+	GetSubscriberDevices(ctx context.Context, appID string, subscriberID string) ([]*Device, error)
+
+	// ScanSubscribers gets a page of the subscribers that registered a device
+	// to an app. Cursors work as in ScanChannelSubscribers.
+	ScanSubscribers(ctx context.Context, appID string, cursor string, count int) (subscriberIDs []string, next string, err error)
+
+	// ScanAttributeSubscribers gets a page of the subscribers that have a
+	// device with the indexed attribute set to value. attribute is a key of
+	// IndexedAttributes. Cursors work as in ScanChannelSubscribers.
+	ScanAttributeSubscribers(ctx context.Context, appID string, attribute string, value string, cursor string, count int) (subscriberIDs []string, next string, err error)
+
+	// FilterAttributeSubscribers returns the subscribers of subscriberIDs that
+	// have a device with the indexed attribute set to value, in the same order.
+	FilterAttributeSubscribers(ctx context.Context, appID string, attribute string, value string, subscriberIDs []string) ([]string, error)
+
+	// GetSubscribersDevices resolves devices of many subscribers at once. fn is
+	// called with the devices of each subscriber in the order of subscriberIDs,
+	// including subscribers without devices. Resolution stops at the first
+	// error returned from fn, and that error is returned.
+	GetSubscribersDevices(ctx context.Context, appID string, subscriberIDs []string, fn DevicesFunc) error
 
 	// Channel methods
 
 	// AddSubscriber adds new subscriber to channel.
-	AddSubscriber(appID string, channelID string, subscriberIDs []string) error
+	AddSubscriber(ctx context.Context, appID string, channelID string, subscriberIDs []string) error
 
 	// AddChannel adds new channel to app.
-	AddChannel(appID string, channelID string) error
+	AddChannel(ctx context.Context, appID string, channelID string) error
 
 	// DeleteChannel deletes channel and its subscribers from app.
-	DeleteChannel(appID string, channelID string) error
+	DeleteChannel(ctx context.Context, appID string, channelID string) error
+
+	// GetChannelSubscribers gets subscribers of a channel. It loads the whole
+	// channel at once; use ScanChannelSubscribers for large channels.
+	GetChannelSubscribers(ctx context.Context, appID string, channelID string) ([]string, error)
+
+	// ScanChannelSubscribers gets a page of channel subscribers starting at
+	// cursor. An empty cursor starts a new scan and an empty next cursor ends
+	// it. count is a hint for the page size; pages may be empty before the
+	// scan ends. A subscriber may be returned more than once if the channel is
+	// modified during the scan.
+	ScanChannelSubscribers(ctx context.Context, appID string, channelID string, cursor string, count int) (subscriberIDs []string, next string, err error)
+
+	// ScanChannelsIntersection gets a page of the subscribers that are members
+	// of every channel of channelIDs and of none of exceptChannelIDs, as
+	// SINTER and SDIFF would compute them. channelIDs must not be empty.
+	// Cursors work as in ScanChannelSubscribers.
+	ScanChannelsIntersection(ctx context.Context, appID string, channelIDs []string, exceptChannelIDs []string, cursor string, count int) (subscriberIDs []string, next string, err error)
 
-	// GetChannelSubscribers gets subscribers of a channel.
-	GetChannelSubscribers(appID string, channelID string) ([]string, error)
+	// FilterChannelMembers returns the subscribers of subscriberIDs that are
+	// members of the channel, in the same order.
+	FilterChannelMembers(ctx context.Context, appID string, channelID string, subscriberIDs []string) ([]string, error)
 }
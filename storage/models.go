@@ -1,9 +1,51 @@
 package storage
 
+import (
+	"strconv"
+	"strings"
+
+	"github.com/gamegos/scotty/message"
+)
+
 // App holds app data.
 type App struct {
 	ID  string    `json:"id"`
 	GCM GCMConfig `json:"gcm"`
+
+	// DeviceRetentionDays is the number of days devices are kept after they
+	// were last seen. Zero uses the default of the janitor.
+	DeviceRetentionDays int `json:"deviceRetentionDays,omitempty"`
+
+	// Categories are the kinds of notifications the app sends, which
+	// subscribers can opt in to or out of.
+	Categories []Category `json:"categories,omitempty"`
+}
+
+// Category returns the category of the app with the id.
+func (app *App) Category(id string) (*Category, bool) {
+	for i := range app.Categories {
+		if app.Categories[i].ID == id {
+			return &app.Categories[i], true
+		}
+	}
+	return nil, false
+}
+
+// Category is a kind of notification, e.g. "promotions" or "order_updates".
+type Category struct {
+	ID   string `json:"id"`
+	Name string `json:"name,omitempty"`
+	// OptIn categories are only sent to subscribers that opted in, others
+	// are sent to every subscriber that did not opt out.
+	OptIn bool `json:"optIn,omitempty"`
+}
+
+// Preferences are the choices of a subscriber by category and channel id;
+// true opts in and false opts out. Subscribers are members of their channels,
+// so only opting out of a channel has an effect.
+type Preferences struct {
+	Categories map[string]bool `json:"categories"`
+	Channels   map[string]bool `json:"channels"`
 }
 
 // GCMConfig holds GCM(Google Cloud Messaging) data.
@@ -12,9 +54,173 @@ type GCMConfig struct {
 	ProjectID string `json:"projectId"`
 }
 
+// Segment is a saved audience definition. Recipients are the subscribers and
+// members of Channels that are members of every IntersectChannels, are not
+// members of ExceptChannels or in ExceptSubscribers, and have devices
+// matching Filter. Without Subscribers and Channels, IntersectChannels or all
+// subscribers of the app are the base of the audience.
+type Segment struct {
+	ID                string   `json:"id"`
+	Name              string   `json:"name"`
+	Subscribers       []string `json:"subscribers,omitempty"`
+	Channels          []string `json:"channels,omitempty"`
+	IntersectChannels []string `json:"intersectChannels,omitempty"`
+	ExceptChannels    []string `json:"exceptChannels,omitempty"`
+	ExceptSubscribers []string `json:"exceptSubscribers,omitempty"`
+	Filter            string   `json:"filter,omitempty"`
+}
+
+// Template is a stored message with variables that are rendered for each
+// recipient when it is published.
+type Template struct {
+	ID      string           `json:"id"`
+	Name    string           `json:"name"`
+	Message *message.Message `json:"message"`
+}
+
+// DeadLetter records a message that could not be delivered to a device, so it
+// can be inspected and replayed until it expires.
+type DeadLetter struct {
+	ID string `json:"id"`
+	// TransactionID is the id of the publish that sent the message.
+	TransactionID string `json:"transactionId"`
+	SubscriberID  string `json:"subscriberId"`
+	Platform      string `json:"platform"`
+	Token         string `json:"token"`
+	// Message is the message sent to the device, localized and rendered.
+	Message *message.Message `json:"message"`
+	// Error is the error of the last attempt, Attempts is the number of
+	// publishes and replays that failed.
+	Error    string `json:"error"`
+	Attempts int    `json:"attempts"`
+	// FailedAt is the unix timestamp of the last failure and ExpiresAt is the
+	// unix timestamp the dead letter is removed at.
+	FailedAt  int `json:"failedAt"`
+	ExpiresAt int `json:"expiresAt"`
+}
+
+// Circuit is the state of the circuit breaker of an app and a provider in a
+// scotty process, as reported by the process. Each process delivering has its
+// own circuit breakers.
+type Circuit struct {
+	AppID    string `json:"appId"`
+	Provider string `json:"provider"`
+	Process  string `json:"process,omitempty"`
+	State    string `json:"state"`
+	// Failures is the number of consecutive failures and LastError is the
+	// error of the last one.
+	Failures  int    `json:"failures"`
+	LastError string `json:"lastError,omitempty"`
+	// OpenedAt is the unix timestamp the circuit last opened at and ProbeAt
+	// is the one a probe is let through after, if it is open.
+	OpenedAt int `json:"openedAt,omitempty"`
+	ProbeAt  int `json:"probeAt,omitempty"`
+	// ReportedAt is the unix timestamp the process reported the circuit at.
+	// The report is removed at ExpiresAt unless the process reports again,
+	// e.g. if it stopped.
+	ReportedAt int `json:"reportedAt,omitempty"`
+	ExpiresAt  int `json:"expiresAt,omitempty"`
+}
+
+// Tombstone records the erasure of a subscriber. The subscriber id is only
+// kept as a hash, so an erasure can be proven for a given id without storing
+// it.
+type Tombstone struct {
+	// SubscriberHash is the hex encoded SHA-256 hash of the subscriber id.
+	SubscriberHash string `json:"subscriberHash"`
+	// ErasedAt is the unix timestamp of the erasure.
+	ErasedAt int `json:"erasedAt"`
+	// Devices, Channels, Aliases, Segments and DeadLetters are the numbers of
+	// devices, channel memberships, aliases, segment references and dead
+	// letters removed.
+	Devices     int    `json:"devices"`
+	Channels    int    `json:"channels"`
+	Aliases     int    `json:"aliases"`
+	Segments    int    `json:"segments"`
+	DeadLetters int    `json:"deadLetters"`
+	Reason      string `json:"reason,omitempty"`
+}
+
 // Device holds device data.
 type Device struct {
 	Platform  string
 	Token     string
 	CreatedAt int
+
+	// Metadata reported by the device on each registration.
+	AppVersion string            `json:",omitempty"`
+	OSVersion  string            `json:",omitempty"`
+	Locale     string            `json:",omitempty"`
+	Timezone   string            `json:",omitempty"`
+	Model      string            `json:",omitempty"`
+	Tags       map[string]string `json:",omitempty"`
+
+	// LastSeen is the unix timestamp of the last registration.
+	LastSeen int `json:",omitempty"`
+}
+
+// SeenAt returns the unix timestamp of the last registration of the device,
+// or of its creation if it was registered before LastSeen was recorded.
+func (d *Device) SeenAt() int {
+	if d.LastSeen != 0 {
+		return d.LastSeen
+	}
+	return d.CreatedAt
+}
+
+// PruneResult describes what PruneSubscriber removed.
+type PruneResult struct {
+	// Devices are the removed devices.
+	Devices []*Device
+	// SubscriberRemoved is true if the subscriber was left without devices
+	// and removed from the app and its channels.
+	SubscriberRemoved bool
+	// Channels are the channels deleted because they were left empty.
+	Channels []string
+}
+
+// DevicesFunc receives devices of a subscriber during bulk resolution.
+type DevicesFunc func(subscriberID string, devices []*Device) error
+
+// IndexedAttributes maps the device attributes that drivers keep secondary
+// indexes for to the names of Device fields holding them.
+var IndexedAttributes = map[string]string{
+	"platform":   "Platform",
+	"appVersion": "AppVersion",
+	"osVersion":  "OSVersion",
+	"locale":     "Locale",
+	"timezone":   "Timezone",
+	"model":      "Model",
+}
+
+// Attribute returns the value of a device attribute by its API name, e.g.
+// "appVersion" or "tags.tier" for a tag. Missing values are returned as empty
+// strings; ok is false if the attribute is unknown.
+func (d *Device) Attribute(name string) (value string, ok bool) {
+	switch name {
+	case "platform":
+		return d.Platform, true
+	case "token":
+		return d.Token, true
+	case "appVersion":
+		return d.AppVersion, true
+	case "osVersion":
+		return d.OSVersion, true
+	case "locale":
+		return d.Locale, true
+	case "timezone":
+		return d.Timezone, true
+	case "model":
+		return d.Model, true
+	case "createdAt":
+		return strconv.Itoa(d.CreatedAt), true
+	case "lastSeen":
+		return strconv.Itoa(d.LastSeen), true
+	}
+
+	if strings.HasPrefix(name, "tags.") && len(name) > len("tags.") {
+		return d.Tags[name[len("tags."):]], true
+	}
+
+	return "", false
 }
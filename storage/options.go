@@ -0,0 +1,180 @@
+package storage
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DecodeOptions decodes driver options into the struct pointed to by out.
+//
+// Keys are matched against exported field names case-insensitively, so
+// "maxIdle", "MaxIdle" and "maxidle" all set the MaxIdle field. Values are
+// converted to the field's type; a value that can not be represented in the
+// field's type is reported as an error. Unknown keys are logged and ignored.
+// Fields of embedded structs are decoded as fields of out, unless out has a
+// field with the same name.
+func DecodeOptions(options map[string]interface{}, out interface{}) error {
+	rv := reflect.ValueOf(out)
+	if rv.Kind() != reflect.Ptr || rv.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("storage: options target must be a pointer to struct, got %T", out)
+	}
+	rv = rv.Elem()
+
+	fields := make(map[string][]int)
+	optionFields(rv.Type(), nil, fields)
+
+	keys := make([]string, 0, len(options))
+	for key := range options {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	seen := make(map[string]string)
+	for _, key := range keys {
+		name := strings.ToLower(key)
+		index, ok := fields[name]
+		if !ok {
+			log.Printf("storage: ignoring unknown option %q", key)
+			continue
+		}
+
+		if prev, dup := seen[name]; dup {
+			return fmt.Errorf("storage: options %q and %q set the same field", prev, key)
+		}
+		seen[name] = key
+
+		if err := setOption(rv.FieldByIndex(index), options[key]); err != nil {
+			return fmt.Errorf("storage: option %q: %s", key, err)
+		}
+	}
+
+	return nil
+}
+
+// optionFields adds the exported fields of struct type t to fields by their
+// lower case names, with their indexes prefixed by index. Fields of embedded
+// structs are added after the fields of t, so the fields of t win.
+func optionFields(t reflect.Type, index []int, fields map[string][]int) {
+	var embedded []int
+
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.Anonymous && f.Type.Kind() == reflect.Struct {
+			embedded = append(embedded, i)
+			continue
+		}
+
+		if f.PkgPath != "" {
+			continue
+		}
+
+		name := strings.ToLower(f.Name)
+		if _, ok := fields[name]; !ok {
+			fields[name] = append(append([]int(nil), index...), i)
+		}
+	}
+
+	for _, i := range embedded {
+		optionFields(t.Field(i).Type, append(append([]int(nil), index...), i), fields)
+	}
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// setOption assigns v to field, converting between compatible kinds.
+func setOption(field reflect.Value, v interface{}) error {
+	value := reflect.ValueOf(v)
+	if !value.IsValid() {
+		return fmt.Errorf("value is missing")
+	}
+
+	if field.Type() == durationType {
+		s, ok := v.(string)
+		if !ok {
+			return fmt.Errorf("expected duration string like \"5s\", got %T", v)
+		}
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(d))
+		return nil
+	}
+
+	switch field.Kind() {
+	case reflect.String:
+		if value.Kind() != reflect.String {
+			return fmt.Errorf("expected string, got %T", v)
+		}
+		field.SetString(value.String())
+
+	case reflect.Bool:
+		if value.Kind() != reflect.Bool {
+			return fmt.Errorf("expected boolean, got %T", v)
+		}
+		field.SetBool(value.Bool())
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := toInt64(value)
+		if err != nil {
+			return err
+		}
+		if field.OverflowInt(n) {
+			return fmt.Errorf("value %d overflows %s", n, field.Type())
+		}
+		field.SetInt(n)
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := toInt64(value)
+		if err != nil {
+			return err
+		}
+		if n < 0 || field.OverflowUint(uint64(n)) {
+			return fmt.Errorf("value %d overflows %s", n, field.Type())
+		}
+		field.SetUint(uint64(n))
+
+	case reflect.Float32, reflect.Float64:
+		switch value.Kind() {
+		case reflect.Float32, reflect.Float64:
+			field.SetFloat(value.Float())
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			field.SetFloat(float64(value.Int()))
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			field.SetFloat(float64(value.Uint()))
+		default:
+			return fmt.Errorf("expected number, got %T", v)
+		}
+
+	default:
+		return fmt.Errorf("unsupported option type %s", field.Type())
+	}
+
+	return nil
+}
+
+// toInt64 converts integral numeric values to int64.
+func toInt64(value reflect.Value) (int64, error) {
+	switch value.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return value.Int(), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if value.Uint() > math.MaxInt64 {
+			return 0, fmt.Errorf("value %d is too large", value.Uint())
+		}
+		return int64(value.Uint()), nil
+	case reflect.Float32, reflect.Float64:
+		f := value.Float()
+		if f != math.Trunc(f) || f > math.MaxInt64 || f < math.MinInt64 {
+			return 0, fmt.Errorf("expected integer, got %v", f)
+		}
+		return int64(f), nil
+	}
+
+	return 0, fmt.Errorf("expected integer, got %s", value.Type())
+}
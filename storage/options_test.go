@@ -0,0 +1,95 @@
+package storage
+
+import (
+	"testing"
+	"time"
+)
+
+type testOptions struct {
+	Network string
+	MaxIdle int
+	Ratio   float64
+	Wait    bool
+	Timeout time.Duration
+}
+
+func TestDecodeOptions(t *testing.T) {
+	options := map[string]interface{}{
+		"network": "unix",
+		"MAXIDLE": int64(12),
+		"Ratio":   int64(2),
+		"wait":    true,
+		"timeout": "1500ms",
+		"unknown": "ignored",
+	}
+
+	var opts testOptions
+	if err := DecodeOptions(options, &opts); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := testOptions{
+		Network: "unix",
+		MaxIdle: 12,
+		Ratio:   2,
+		Wait:    true,
+		Timeout: 1500 * time.Millisecond,
+	}
+
+	if opts != expected {
+		t.Errorf("Decoded options do not match. got %#v, expected %#v", opts, expected)
+	}
+}
+
+type testEmbeddingOptions struct {
+	testOptions
+	Stream string
+	Wait   string
+}
+
+func TestDecodeEmbeddedOptions(t *testing.T) {
+	options := map[string]interface{}{
+		"network": "unix",
+		"stream":  "jobs",
+		"wait":    "forever",
+	}
+
+	var opts testEmbeddingOptions
+	if err := DecodeOptions(options, &opts); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := testEmbeddingOptions{
+		testOptions: testOptions{Network: "unix"},
+		Stream:      "jobs",
+		Wait:        "forever",
+	}
+
+	if opts != expected {
+		t.Errorf("Decoded options do not match. got %#v, expected %#v", opts, expected)
+	}
+}
+
+func TestDecodeOptionsInvalid(t *testing.T) {
+	invalid := []map[string]interface{}{
+		{"network": int64(1)},
+		{"maxIdle": "ten"},
+		{"maxIdle": 1.5},
+		{"wait": "yes"},
+		{"timeout": int64(5)},
+		{"maxIdle": int64(1), "MaxIdle": int64(2)},
+	}
+
+	for _, options := range invalid {
+		var opts testOptions
+		if err := DecodeOptions(options, &opts); err == nil {
+			t.Errorf("Expected error for options %v", options)
+		}
+	}
+}
+
+func TestInitUnknownDriver(t *testing.T) {
+	if _, err := Init("nosuchdriver", nil); err == nil {
+		t.Error("Expected error for unknown driver.")
+	}
+}
@@ -0,0 +1,98 @@
+package storage
+
+import "context"
+
+// ScanFunc gets a page of subscribers starting at cursor, as
+// ScanChannelSubscribers does.
+type ScanFunc func(ctx context.Context, cursor string, count int) (subscriberIDs []string, next string, err error)
+
+// Scanner pages through a set of subscribers with a ScanFunc, so huge sets
+// are never loaded at once.
+//
+//	scanner := storage.NewChannelScanner(stg, appID, channelID, 1000)
+//	for scanner.Next(ctx) {
+//		page := scanner.Subscribers()
+//		...
+//	}
+//	if err := scanner.Err(); err != nil {
+//		...
+//	}
+type Scanner struct {
+	scan  ScanFunc
+	count int
+
+	cursor string
+	page   []string
+	done   bool
+	err    error
+}
+
+// NewScanner creates a scanner that requests pages of count subscribers from
+// scan.
+func NewScanner(scan ScanFunc, count int) *Scanner {
+	return &Scanner{scan: scan, count: count}
+}
+
+// NewChannelScanner creates a scanner over the subscribers of a channel.
+func NewChannelScanner(stg Storage, appID string, channelID string, count int) *Scanner {
+	return NewScanner(func(ctx context.Context, cursor string, count int) ([]string, string, error) {
+		return stg.ScanChannelSubscribers(ctx, appID, channelID, cursor, count)
+	}, count)
+}
+
+// NewIntersectionScanner creates a scanner over the subscribers that are
+// members of every channel of channelIDs and of none of exceptChannelIDs.
+func NewIntersectionScanner(stg Storage, appID string, channelIDs []string, exceptChannelIDs []string, count int) *Scanner {
+	return NewScanner(func(ctx context.Context, cursor string, count int) ([]string, string, error) {
+		return stg.ScanChannelsIntersection(ctx, appID, channelIDs, exceptChannelIDs, cursor, count)
+	}, count)
+}
+
+// NewSubscriberScanner creates a scanner over the subscribers of an app.
+func NewSubscriberScanner(stg Storage, appID string, count int) *Scanner {
+	return NewScanner(func(ctx context.Context, cursor string, count int) ([]string, string, error) {
+		return stg.ScanSubscribers(ctx, appID, cursor, count)
+	}, count)
+}
+
+// NewAttributeScanner creates a scanner over the subscribers that have a
+// device with the indexed attribute set to value.
+func NewAttributeScanner(stg Storage, appID string, attribute string, value string, count int) *Scanner {
+	return NewScanner(func(ctx context.Context, cursor string, count int) ([]string, string, error) {
+		return stg.ScanAttributeSubscribers(ctx, appID, attribute, value, cursor, count)
+	}, count)
+}
+
+// Next fetches the next non-empty page. It returns false when the scan is
+// complete or an error occurs.
+func (s *Scanner) Next(ctx context.Context) bool {
+	for !s.done {
+		page, next, err := s.scan(ctx, s.cursor, s.count)
+		if err != nil {
+			s.err = err
+			s.done = true
+			return false
+		}
+
+		s.cursor = next
+		s.done = next == ""
+
+		if len(page) > 0 {
+			s.page = page
+			return true
+		}
+	}
+
+	s.page = nil
+	return false
+}
+
+// Subscribers returns the page fetched by the last call to Next.
+func (s *Scanner) Subscribers() []string {
+	return s.page
+}
+
+// Err returns the error that stopped the scan, if any.
+func (s *Scanner) Err() error {
+	return s.err
+}
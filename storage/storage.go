@@ -1,6 +1,8 @@
 package storage
 
-type driverFactory func(config map[string]interface{}) Storage
+import "fmt"
+
+type driverFactory func(options map[string]interface{}) (Storage, error)
 
 var drivers = make(map[string]driverFactory)
 
@@ -8,10 +10,18 @@ func Register(driverType string, factory driverFactory) {
 	drivers[driverType] = factory
 }
 
-func Init(driverType string, options map[string]interface{}) Storage {
+// Init initializes the storage driver registered as driverType with the given
+// options.
+func Init(driverType string, options map[string]interface{}) (Storage, error) {
 	factory, ok := drivers[driverType]
 	if !ok {
-		panic("storage:driver:" + driverType + " is unknown")
+		return nil, fmt.Errorf("storage: unknown driver %q", driverType)
+	}
+
+	stg, err := factory(options)
+	if err != nil {
+		return nil, fmt.Errorf("storage:%s: %s", driverType, err)
 	}
-	return factory(options)
+
+	return stg, nil
 }
@@ -0,0 +1,1523 @@
+// Package storagetest provides a conformance test suite for storage drivers.
+//
+// A driver runs the suite from its own tests:
+//
+//	func TestConformance(t *testing.T) {
+//		storagetest.Run(t, func(t *testing.T) storage.Storage {
+//			return New()
+//		})
+//	}
+package storagetest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gamegos/scotty/message"
+	"github.com/gamegos/scotty/storage"
+)
+
+// Factory returns a storage to run a single test against. It may skip the
+// test if the storage is not available.
+type Factory func(t *testing.T) storage.Storage
+
+var idSeq int64
+
+var ctx = context.Background()
+
+// uniqueID returns an id that is not used by any other test, so drivers backed
+// by a shared server do not need to be flushed between tests.
+func uniqueID(prefix string) string {
+	n := atomic.AddInt64(&idSeq, 1)
+	return fmt.Sprintf("storagetest-%s-%d-%d", prefix, time.Now().UnixNano(), n)
+}
+
+// Run runs the full storage.Storage contract against the storage returned by
+// newStorage.
+func Run(t *testing.T, newStorage Factory) {
+	tests := []struct {
+		name string
+		fn   func(t *testing.T, stg storage.Storage)
+	}{
+		{"PutGetApp", testPutGetApp},
+		{"GetMissingApp", testGetMissingApp},
+		{"GetApps", testGetApps},
+		{"Segments", testSegments},
+		{"MissingSegment", testMissingSegment},
+		{"Templates", testTemplates},
+		{"SubscriberDevices", testSubscriberDevices},
+		{"SubscriberDevicesUniqueToken", testSubscriberDevicesUniqueToken},
+		{"MissingSubscriberDevices", testMissingSubscriberDevices},
+		{"SubscribersDevices", testSubscribersDevices},
+		{"SubscribersDevicesStop", testSubscribersDevicesStop},
+		{"UpdateDeviceToken", testUpdateDeviceToken},
+		{"UpdateMissingDeviceToken", testUpdateMissingDeviceToken},
+		{"MoveDevice", testMoveDevice},
+		{"UpdateDeviceTokenMovesDevice", testUpdateDeviceTokenMovesDevice},
+		{"GetMissingDeviceOwner", testGetMissingDeviceOwner},
+		{"PruneSubscriber", testPruneSubscriber},
+		{"DeleteSubscriber", testDeleteSubscriber},
+		{"DeleteMissingSubscriber", testDeleteMissingSubscriber},
+		{"MergeSubscriber", testMergeSubscriber},
+		{"MergeMissingSubscriber", testMergeMissingSubscriber},
+		{"PrefixedAppIDs", testPrefixedAppIDs},
+		{"DottedIDs", testDottedIDs},
+		{"Preferences", testPreferences},
+		{"Tombstones", testTombstones},
+		{"DeadLetters", testDeadLetters},
+		{"Circuits", testCircuits},
+		{"ChannelSubscribers", testChannelSubscribers},
+		{"ChannelSubscribersUnique", testChannelSubscribersUnique},
+		{"MissingChannelSubscribers", testMissingChannelSubscribers},
+		{"ScanChannelSubscribers", testScanChannelSubscribers},
+		{"ScanMissingChannel", testScanMissingChannel},
+		{"FilterChannelMembers", testFilterChannelMembers},
+		{"ScanChannelsIntersection", testScanChannelsIntersection},
+		{"ScanSubscribers", testScanSubscribers},
+		{"AttributeSubscribers", testAttributeSubscribers},
+		{"DeleteChannel", testDeleteChannel},
+		{"CanceledContext", testCanceledContext},
+	}
+
+	for _, test := range tests {
+		fn := test.fn
+		t.Run(test.name, func(t *testing.T) {
+			fn(t, newStorage(t))
+		})
+	}
+}
+
+func testPutGetApp(t *testing.T, stg storage.Storage) {
+	app := &storage.App{
+		ID: uniqueID("app"),
+		GCM: storage.GCMConfig{
+			APIKey:    "apikey",
+			ProjectID: "projectid",
+		},
+	}
+
+	if err := stg.PutApp(ctx, app); err != nil {
+		t.Fatal(err)
+	}
+
+	received, err := stg.GetApp(ctx, app.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(app, received) {
+		t.Errorf("App does not match. got %#v, expected %#v", received, app)
+	}
+
+	app.GCM.APIKey = "updatedapikey"
+	if err := stg.PutApp(ctx, app); err != nil {
+		t.Fatal(err)
+	}
+
+	received, err = stg.GetApp(ctx, app.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if received.GCM.APIKey != "updatedapikey" {
+		t.Error("App was not updated.")
+	}
+}
+
+func testGetMissingApp(t *testing.T, stg storage.Storage) {
+	app, err := stg.GetApp(ctx, uniqueID("app"))
+
+	if err != storage.ErrNotFound {
+		t.Errorf("Expected storage.ErrNotFound, got %v", err)
+	}
+
+	if app != nil {
+		t.Error("Expected nil app.")
+	}
+}
+
+func testGetApps(t *testing.T, stg storage.Storage) {
+	second := &storage.App{ID: uniqueID("app") + "-b", DeviceRetentionDays: 30}
+	first := &storage.App{ID: second.ID[:len(second.ID)-2] + "-a"}
+
+	for _, app := range []*storage.App{second, first} {
+		if err := stg.PutApp(ctx, app); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	apps, err := stg.GetApps(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a shared server may hold apps of other tests.
+	var received []*storage.App
+	for _, app := range apps {
+		if app.ID == first.ID || app.ID == second.ID {
+			received = append(received, app)
+		}
+	}
+
+	expected := []*storage.App{first, second}
+	if !reflect.DeepEqual(received, expected) {
+		t.Errorf("Apps do not match. got %#v, expected %#v", received, expected)
+	}
+}
+
+func testSegments(t *testing.T, stg storage.Storage) {
+	appID := uniqueID("app")
+
+	segments := []*storage.Segment{
+		{
+			ID:                "b",
+			Name:              "Premium Turkish",
+			Channels:          []string{"premium"},
+			IntersectChannels: []string{"tr_locale"},
+			ExceptChannels:    []string{"purchased"},
+			ExceptSubscribers: []string{"sub_1"},
+			Filter:            `platform == "gcm"`,
+		},
+		{
+			ID:          "a",
+			Name:        "Testers",
+			Subscribers: []string{"sub_2", "sub_3"},
+		},
+	}
+
+	for _, segment := range segments {
+		if err := stg.PutSegment(ctx, appID, segment); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	received, err := stg.GetSegment(ctx, appID, "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(received, segments[0]) {
+		t.Errorf("Segment does not match. got %#v, expected %#v", received, segments[0])
+	}
+
+	all, err := stg.GetSegments(ctx, appID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []*storage.Segment{segments[1], segments[0]}
+	if !reflect.DeepEqual(all, expected) {
+		t.Errorf("Segments do not match. got %#v, expected %#v", all, expected)
+	}
+
+	segments[1].Name = "Beta testers"
+	if err := stg.PutSegment(ctx, appID, segments[1]); err != nil {
+		t.Fatal(err)
+	}
+
+	received, err = stg.GetSegment(ctx, appID, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if received.Name != "Beta testers" {
+		t.Error("Segment was not updated.")
+	}
+
+	if err := stg.DeleteSegment(ctx, appID, "a"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := stg.GetSegment(ctx, appID, "a"); err != storage.ErrNotFound {
+		t.Errorf("Expected storage.ErrNotFound after delete, got %v", err)
+	}
+
+	all, err = stg.GetSegments(ctx, appID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(all) != 1 || all[0].ID != "b" {
+		t.Errorf("Segments do not match after delete. got %#v", all)
+	}
+}
+
+func testMissingSegment(t *testing.T, stg storage.Storage) {
+	appID := uniqueID("app")
+
+	if _, err := stg.GetSegment(ctx, appID, "missing"); err != storage.ErrNotFound {
+		t.Errorf("Expected storage.ErrNotFound, got %v", err)
+	}
+
+	if err := stg.DeleteSegment(ctx, appID, "missing"); err != storage.ErrNotFound {
+		t.Errorf("Expected storage.ErrNotFound on delete, got %v", err)
+	}
+
+	segments, err := stg.GetSegments(ctx, appID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(segments) != 0 {
+		t.Errorf("Expected no segments, got %#v", segments)
+	}
+}
+
+func testTemplates(t *testing.T, stg storage.Storage) {
+	appID := uniqueID("app")
+
+	templates := []*storage.Template{
+		{
+			ID:   "shipped",
+			Name: "Order shipped",
+			Message: &message.Message{
+				Title: "Hi {{name|there}}",
+				Body:  "Your order {{orderId}} shipped",
+				Data:  map[string]interface{}{"orderId": "{{orderId}}"},
+			},
+		},
+		{
+			ID:      "welcome",
+			Name:    "Welcome",
+			Message: &message.Message{Title: "Welcome"},
+		},
+	}
+
+	for _, template := range templates {
+		if err := stg.PutTemplate(ctx, appID, template); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	received, err := stg.GetTemplate(ctx, appID, "shipped")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(received, templates[0]) {
+		t.Errorf("Template does not match. got %#v, expected %#v", received, templates[0])
+	}
+
+	received.Message.Data["orderId"] = "modified"
+	if received, _ := stg.GetTemplate(ctx, appID, "shipped"); received.Message.Data["orderId"] != "{{orderId}}" {
+		t.Error("Stored template was modified through a returned one.")
+	}
+
+	all, err := stg.GetTemplates(ctx, appID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(all, templates) {
+		t.Errorf("Templates do not match. got %#v, expected %#v", all, templates)
+	}
+
+	if err := stg.DeleteTemplate(ctx, appID, "shipped"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := stg.GetTemplate(ctx, appID, "shipped"); err != storage.ErrNotFound {
+		t.Errorf("Expected storage.ErrNotFound after delete, got %v", err)
+	}
+
+	if err := stg.DeleteTemplate(ctx, appID, "shipped"); err != storage.ErrNotFound {
+		t.Errorf("Expected storage.ErrNotFound on second delete, got %v", err)
+	}
+
+	all, err = stg.GetTemplates(ctx, appID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(all) != 1 || all[0].ID != "welcome" {
+		t.Errorf("Templates do not match after delete. got %#v", all)
+	}
+}
+
+func testSubscriberDevices(t *testing.T, stg storage.Storage) {
+	appID := uniqueID("app")
+	subscriberID := uniqueID("sub")
+
+	expected := []*storage.Device{
+		{Platform: "gcm", Token: "token1", CreatedAt: 1436546411},
+		{
+			Platform:   "apns",
+			Token:      "token2",
+			CreatedAt:  1436546412,
+			AppVersion: "2.3.1",
+			OSVersion:  "9.1",
+			Locale:     "tr-TR",
+			Timezone:   "Europe/Istanbul",
+			Model:      "iPhone7,2",
+			Tags:       map[string]string{"tier": "premium"},
+			LastSeen:   1436546500,
+		},
+	}
+
+	for _, device := range expected {
+		if err := stg.AddSubscriberDevice(ctx, appID, subscriberID, device); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	devices, err := stg.GetSubscriberDevices(ctx, appID, subscriberID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertDevices(t, devices, expected)
+}
+
+func testSubscriberDevicesUniqueToken(t *testing.T, stg storage.Storage) {
+	appID := uniqueID("app")
+	subscriberID := uniqueID("sub")
+
+	first := &storage.Device{Platform: "gcm", Token: "token", CreatedAt: 1436546411}
+	second := &storage.Device{Platform: "gcm", Token: "token", CreatedAt: 1436546500}
+
+	for _, device := range []*storage.Device{first, second} {
+		if err := stg.AddSubscriberDevice(ctx, appID, subscriberID, device); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	devices, err := stg.GetSubscriberDevices(ctx, appID, subscriberID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertDevices(t, devices, []*storage.Device{second})
+}
+
+func testMissingSubscriberDevices(t *testing.T, stg storage.Storage) {
+	devices, err := stg.GetSubscriberDevices(ctx, uniqueID("app"), uniqueID("sub"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(devices) != 0 {
+		t.Errorf("Expected no devices, got %d", len(devices))
+	}
+}
+
+func testSubscribersDevices(t *testing.T, stg storage.Storage) {
+	appID := uniqueID("app")
+
+	expected := map[string][]*storage.Device{
+		"sub_foo": {
+			{Platform: "gcm", Token: "token1", CreatedAt: 1436546411},
+			{Platform: "gcm", Token: "token2", CreatedAt: 1436546412},
+		},
+		"sub_bar": {
+			{Platform: "apns", Token: "token3", CreatedAt: 1436546413},
+		},
+		"sub_baz": nil,
+	}
+
+	for subscriberID, devices := range expected {
+		for _, device := range devices {
+			if err := stg.AddSubscriberDevice(ctx, appID, subscriberID, device); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	subscriberIDs := []string{"sub_bar", "sub_baz", "sub_foo"}
+	var received []string
+
+	err := stg.GetSubscribersDevices(ctx, appID, subscriberIDs, func(subscriberID string, devices []*storage.Device) error {
+		received = append(received, subscriberID)
+		assertDevices(t, devices, expected[subscriberID])
+		return nil
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(received, subscriberIDs) {
+		t.Errorf("Subscribers were not resolved in order. got %v, expected %v", received, subscriberIDs)
+	}
+}
+
+func testSubscribersDevicesStop(t *testing.T, stg storage.Storage) {
+	stop := errors.New("stop")
+	calls := 0
+
+	err := stg.GetSubscribersDevices(ctx, uniqueID("app"), []string{"sub_foo", "sub_bar"}, func(subscriberID string, devices []*storage.Device) error {
+		calls++
+		return stop
+	})
+
+	if err != stop {
+		t.Errorf("Expected error returned from fn, got %v", err)
+	}
+
+	if calls != 1 {
+		t.Errorf("Expected resolution to stop after first call, got %d calls", calls)
+	}
+}
+
+func testUpdateDeviceToken(t *testing.T, stg storage.Storage) {
+	appID := uniqueID("app")
+	subscriberID := uniqueID("sub")
+
+	device := &storage.Device{
+		Platform:  "gcm",
+		Token:     "footoken",
+		CreatedAt: 1436546411,
+		Locale:    "tr-TR",
+		Tags:      map[string]string{"tier": "premium"},
+	}
+	if err := stg.AddSubscriberDevice(ctx, appID, subscriberID, device); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := stg.UpdateDeviceToken(ctx, appID, subscriberID, "footoken", "bartoken"); err != nil {
+		t.Fatal(err)
+	}
+
+	devices, err := stg.GetSubscriberDevices(ctx, appID, subscriberID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertDevices(t, devices, []*storage.Device{
+		{
+			Platform:  "gcm",
+			Token:     "bartoken",
+			CreatedAt: 1436546411,
+			Locale:    "tr-TR",
+			Tags:      map[string]string{"tier": "premium"},
+		},
+	})
+
+	// the caller's device must not be modified by the storage.
+	if device.Token != "footoken" {
+		t.Error("Storage modified the added device.")
+	}
+}
+
+func testUpdateMissingDeviceToken(t *testing.T, stg storage.Storage) {
+	err := stg.UpdateDeviceToken(ctx, uniqueID("app"), uniqueID("sub"), "footoken", "bartoken")
+
+	if err != storage.ErrNotFound {
+		t.Errorf("Expected storage.ErrNotFound, got %v", err)
+	}
+}
+
+func testMoveDevice(t *testing.T, stg storage.Storage) {
+	appID := uniqueID("app")
+
+	device := &storage.Device{Platform: "gcm", Token: "token", CreatedAt: 1436546411}
+	moved := &storage.Device{Platform: "gcm", Token: "token", CreatedAt: 1436546500}
+
+	if err := stg.AddSubscriberDevice(ctx, appID, "sub_foo", device); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := stg.AddSubscriberDevice(ctx, appID, "sub_bar", moved); err != nil {
+		t.Fatal(err)
+	}
+
+	assertSubscriberDevices(t, stg, appID, "sub_foo", nil)
+	assertSubscriberDevices(t, stg, appID, "sub_bar", []*storage.Device{moved})
+	assertDeviceOwner(t, stg, appID, "token", "sub_bar", moved)
+}
+
+func testUpdateDeviceTokenMovesDevice(t *testing.T, stg storage.Storage) {
+	appID := uniqueID("app")
+
+	foo := &storage.Device{Platform: "gcm", Token: "footoken", CreatedAt: 1436546411}
+	bar := &storage.Device{Platform: "gcm", Token: "bartoken", CreatedAt: 1436546412}
+
+	if err := stg.AddSubscriberDevice(ctx, appID, "sub_foo", foo); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := stg.AddSubscriberDevice(ctx, appID, "sub_bar", bar); err != nil {
+		t.Fatal(err)
+	}
+
+	// sub_foo's device gets the token of sub_bar's device.
+	if err := stg.UpdateDeviceToken(ctx, appID, "sub_foo", "footoken", "bartoken"); err != nil {
+		t.Fatal(err)
+	}
+
+	updated := &storage.Device{Platform: "gcm", Token: "bartoken", CreatedAt: 1436546411}
+
+	assertSubscriberDevices(t, stg, appID, "sub_foo", []*storage.Device{updated})
+	assertSubscriberDevices(t, stg, appID, "sub_bar", nil)
+	assertDeviceOwner(t, stg, appID, "bartoken", "sub_foo", updated)
+
+	if _, _, err := stg.GetDeviceOwner(ctx, appID, "footoken"); err != storage.ErrNotFound {
+		t.Errorf("Expected storage.ErrNotFound for old token, got %v", err)
+	}
+}
+
+func testPruneSubscriber(t *testing.T, stg storage.Storage) {
+	appID := uniqueID("app")
+	stale := uniqueID("sub")
+	mixed := uniqueID("sub")
+	staleChannel := uniqueID("chan")
+	sharedChannel := uniqueID("chan")
+
+	staleDevice := &storage.Device{Platform: "gcm", Token: uniqueID("token"), CreatedAt: 100, Locale: "tr"}
+	oldDevice := &storage.Device{Platform: "gcm", Token: uniqueID("token"), CreatedAt: 100, LastSeen: 150}
+	newDevice := &storage.Device{Platform: "gcm", Token: uniqueID("token"), CreatedAt: 100, LastSeen: 300}
+
+	if err := stg.AddSubscriberDevice(ctx, appID, stale, staleDevice); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, device := range []*storage.Device{oldDevice, newDevice} {
+		if err := stg.AddSubscriberDevice(ctx, appID, mixed, device); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := stg.AddSubscriber(ctx, appID, staleChannel, []string{stale}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := stg.AddSubscriber(ctx, appID, sharedChannel, []string{stale, mixed}); err != nil {
+		t.Fatal(err)
+	}
+
+	prefs := &storage.Preferences{Categories: map[string]bool{"promotions": false}}
+	if err := stg.PutPreferences(ctx, appID, stale, prefs); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := stg.PruneSubscriber(ctx, appID, mixed, 200)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := &storage.PruneResult{Devices: []*storage.Device{oldDevice}}
+	if !reflect.DeepEqual(result, expected) {
+		t.Errorf("Prune result does not match. got %#v, expected %#v", result, expected)
+	}
+
+	assertSubscriberDevices(t, stg, appID, mixed, []*storage.Device{newDevice})
+
+	result, err = stg.PruneSubscriber(ctx, appID, stale, 200)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected = &storage.PruneResult{
+		Devices:           []*storage.Device{staleDevice},
+		SubscriberRemoved: true,
+		Channels:          []string{staleChannel},
+	}
+	if !reflect.DeepEqual(result, expected) {
+		t.Errorf("Prune result does not match. got %#v, expected %#v", result, expected)
+	}
+
+	if _, _, err := stg.GetDeviceOwner(ctx, appID, staleDevice.Token); err != storage.ErrNotFound {
+		t.Errorf("Expected storage.ErrNotFound for pruned token, got %v", err)
+	}
+
+	assertChannelSubscribers(t, stg, appID, sharedChannel, []string{mixed})
+	assertChannelSubscribers(t, stg, appID, staleChannel, nil)
+	assertScan(t, storage.NewSubscriberScanner(stg, appID, 10), []string{mixed})
+	assertScan(t, storage.NewAttributeScanner(stg, appID, "locale", "tr", 10), nil)
+	assertCategoryChoices(t, stg, appID, "promotions", false, []string{stale}, []string{})
+}
+
+func testDeleteSubscriber(t *testing.T, stg storage.Storage) {
+	appID := uniqueID("app")
+	subscriberID := uniqueID("sub")
+	other := uniqueID("sub")
+	channels := []string{uniqueID("chan"), uniqueID("chan")}
+	sort.Strings(channels)
+
+	device := &storage.Device{Platform: "gcm", Token: uniqueID("token"), CreatedAt: 100, Locale: "tr"}
+	if err := stg.AddSubscriberDevice(ctx, appID, subscriberID, device); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, channelID := range channels {
+		if err := stg.AddSubscriber(ctx, appID, channelID, []string{subscriberID, other}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	received, err := stg.GetSubscriberChannels(ctx, appID, subscriberID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(received, channels) {
+		t.Errorf("Subscriber channels do not match. got %v, expected %v", received, channels)
+	}
+
+	if err := stg.DeleteSubscriber(ctx, appID, subscriberID); err != nil {
+		t.Fatal(err)
+	}
+
+	assertSubscriberDevices(t, stg, appID, subscriberID, nil)
+
+	if _, _, err := stg.GetDeviceOwner(ctx, appID, device.Token); err != storage.ErrNotFound {
+		t.Errorf("Expected storage.ErrNotFound for deleted token, got %v", err)
+	}
+
+	received, err = stg.GetSubscriberChannels(ctx, appID, subscriberID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(received) != 0 {
+		t.Errorf("Expected no channels, got %v", received)
+	}
+
+	for _, channelID := range channels {
+		assertChannelSubscribers(t, stg, appID, channelID, []string{other})
+	}
+
+	assertScan(t, storage.NewSubscriberScanner(stg, appID, 10), nil)
+	assertScan(t, storage.NewAttributeScanner(stg, appID, "locale", "tr", 10), nil)
+
+	if err := stg.DeleteSubscriber(ctx, appID, subscriberID); err != storage.ErrNotFound {
+		t.Errorf("Expected storage.ErrNotFound on second delete, got %v", err)
+	}
+}
+
+func testDeleteMissingSubscriber(t *testing.T, stg storage.Storage) {
+	if err := stg.DeleteSubscriber(ctx, uniqueID("app"), uniqueID("sub")); err != storage.ErrNotFound {
+		t.Errorf("Expected storage.ErrNotFound, got %v", err)
+	}
+}
+
+// testPrefixedAppIDs checks that the channels and aliases of an app do not
+// leak into an app whose id is a dotted prefix of its id.
+func testPrefixedAppIDs(t *testing.T, stg storage.Storage) {
+	appID := uniqueID("app")
+	otherAppID := appID + ".b"
+
+	device := &storage.Device{Platform: "gcm", Token: uniqueID("token"), CreatedAt: 100}
+	if err := stg.AddSubscriberDevice(ctx, appID, "u1", device); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := stg.AddSubscriber(ctx, otherAppID, "c", []string{"u1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := stg.AddSubscriber(ctx, otherAppID, "d", []string{"x"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := stg.MergeSubscriber(ctx, otherAppID, "x", "u1"); err != nil {
+		t.Fatal(err)
+	}
+
+	channels, err := stg.GetSubscriberChannels(ctx, appID, "u1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(channels) != 0 {
+		t.Errorf("Expected no channels of the other app, got %v", channels)
+	}
+
+	aliases, err := stg.GetSubscriberAliases(ctx, appID, "u1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(aliases) != 0 {
+		t.Errorf("Expected no aliases of the other app, got %v", aliases)
+	}
+
+	if err := stg.DeleteSubscriber(ctx, appID, "u1"); err != nil {
+		t.Fatal(err)
+	}
+
+	members, err := stg.GetChannelSubscribers(ctx, otherAppID, "c")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(members, []string{"u1"}) {
+		t.Errorf("Expected the channel of the other app to keep its member, got %v", members)
+	}
+
+	aliases, err = stg.GetSubscriberAliases(ctx, otherAppID, "u1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(aliases, []string{"x"}) {
+		t.Errorf("Expected the aliases of the other app to be kept, got %v", aliases)
+	}
+}
+
+// testDottedIDs checks that subscribers and channels of apps do not collide
+// when the ids joined by dots are the same.
+func testDottedIDs(t *testing.T, stg storage.Storage) {
+	appID := uniqueID("app")
+	otherAppID := appID + ".b"
+	token := uniqueID("token")
+
+	// appID and "b.c" against otherAppID and "c".
+	device := &storage.Device{Platform: "gcm", Token: token, CreatedAt: 100}
+	if err := stg.AddSubscriberDevice(ctx, appID, "b.c", device); err != nil {
+		t.Fatal(err)
+	}
+
+	prefs := &storage.Preferences{Categories: map[string]bool{"promotions": false}}
+	if err := stg.PutPreferences(ctx, appID, "b.c", prefs); err != nil {
+		t.Fatal(err)
+	}
+
+	otherDevice := &storage.Device{Platform: "apns", Token: token, CreatedAt: 200}
+	if err := stg.AddSubscriberDevice(ctx, otherAppID, "c", otherDevice); err != nil {
+		t.Fatal(err)
+	}
+
+	// the channels of appID+".subs.x" against the channels of "x".
+	if err := stg.AddChannel(ctx, appID+".subs.x", "d"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := stg.AddSubscriber(ctx, appID, "e", []string{"x"}); err != nil {
+		t.Fatal(err)
+	}
+
+	devices, err := stg.GetSubscriberDevices(ctx, otherAppID, "c")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(devices) != 1 || devices[0].Platform != "apns" {
+		t.Errorf("Expected only the device of the other app, got %+v", devices)
+	}
+
+	otherPrefs, err := stg.GetPreferences(ctx, otherAppID, "c")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(otherPrefs.Categories) != 0 {
+		t.Errorf("Expected no preferences in the other app, got %+v", otherPrefs)
+	}
+
+	channels, err := stg.GetSubscriberChannels(ctx, appID, "x")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(channels, []string{"e"}) {
+		t.Errorf("Expected only the channel of the subscriber, got %v", channels)
+	}
+
+	if err := stg.DeleteSubscriber(ctx, otherAppID, "c"); err != nil {
+		t.Fatal(err)
+	}
+
+	devices, err = stg.GetSubscriberDevices(ctx, appID, "b.c")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(devices) != 1 || devices[0].Token != token {
+		t.Errorf("Expected the device to be kept, got %+v", devices)
+	}
+
+	owner, _, err := stg.GetDeviceOwner(ctx, appID, token)
+	if err != nil || owner != "b.c" {
+		t.Errorf("Expected the token to be kept, got %q, %v", owner, err)
+	}
+
+	prefs, err = stg.GetPreferences(ctx, appID, "b.c")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(prefs.Categories, map[string]bool{"promotions": false}) {
+		t.Errorf("Expected the preferences to be kept, got %+v", prefs)
+	}
+}
+
+func testMergeSubscriber(t *testing.T, stg storage.Storage) {
+	appID := uniqueID("app")
+	first := uniqueID("anon")
+	second := uniqueID("anon")
+	target := uniqueID("sub")
+	channelID := uniqueID("chan")
+
+	firstDevice := &storage.Device{Platform: "gcm", Token: uniqueID("token"), CreatedAt: 100, Locale: "tr"}
+	if err := stg.AddSubscriberDevice(ctx, appID, first, firstDevice); err != nil {
+		t.Fatal(err)
+	}
+
+	secondDevice := &storage.Device{Platform: "apns", Token: uniqueID("token"), CreatedAt: 200, Locale: "en"}
+	if err := stg.AddSubscriberDevice(ctx, appID, second, secondDevice); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := stg.AddSubscriber(ctx, appID, channelID, []string{first}); err != nil {
+		t.Fatal(err)
+	}
+
+	prefs := &storage.Preferences{Categories: map[string]bool{"promotions": false}}
+	if err := stg.PutPreferences(ctx, appID, first, prefs); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := stg.MergeSubscriber(ctx, appID, first, second); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := stg.MergeSubscriber(ctx, appID, second, target); err != nil {
+		t.Fatal(err)
+	}
+
+	assertSubscriberDevices(t, stg, appID, first, nil)
+	assertSubscriberDevices(t, stg, appID, second, nil)
+	devices, err := stg.GetSubscriberDevices(ctx, appID, target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertDevices(t, devices, []*storage.Device{firstDevice, secondDevice})
+
+	assertDeviceOwner(t, stg, appID, firstDevice.Token, target, firstDevice)
+	assertChannelSubscribers(t, stg, appID, channelID, []string{target})
+	assertScan(t, storage.NewSubscriberScanner(stg, appID, 10), []string{target})
+	assertScan(t, storage.NewAttributeScanner(stg, appID, "locale", "tr", 10), []string{target})
+	assertCategoryChoices(t, stg, appID, "promotions", false, []string{first, second, target}, []string{target})
+
+	unknown := uniqueID("sub")
+	resolved, err := stg.ResolveAliases(ctx, appID, []string{first, second, target, unknown})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{first: target, second: target}
+	if !reflect.DeepEqual(resolved, expected) {
+		t.Errorf("Resolved aliases do not match. got %v, expected %v", resolved, expected)
+	}
+
+	aliases, err := stg.GetSubscriberAliases(ctx, appID, target)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectedAliases := []string{first, second}
+	sort.Strings(expectedAliases)
+	if !reflect.DeepEqual(aliases, expectedAliases) {
+		t.Errorf("Subscriber aliases do not match. got %v, expected %v", aliases, expectedAliases)
+	}
+
+	if err := stg.DeleteSubscriber(ctx, appID, target); err != nil {
+		t.Fatal(err)
+	}
+
+	resolved, err = stg.ResolveAliases(ctx, appID, []string{first, second})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(resolved) != 0 {
+		t.Errorf("Expected no aliases after delete, got %v", resolved)
+	}
+}
+
+func testMergeMissingSubscriber(t *testing.T, stg storage.Storage) {
+	appID := uniqueID("app")
+	target := uniqueID("sub")
+
+	if err := stg.MergeSubscriber(ctx, appID, uniqueID("sub"), target); err != storage.ErrNotFound {
+		t.Errorf("Expected storage.ErrNotFound, got %v", err)
+	}
+
+	aliases, err := stg.GetSubscriberAliases(ctx, appID, target)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(aliases) != 0 {
+		t.Errorf("Expected no aliases, got %v", aliases)
+	}
+}
+
+func testPreferences(t *testing.T, stg storage.Storage) {
+	appID := uniqueID("app")
+	subscriberID := uniqueID("sub")
+	other := uniqueID("sub")
+	page := []string{other, subscriberID}
+
+	prefs, err := stg.GetPreferences(ctx, appID, subscriberID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(prefs.Categories) != 0 || len(prefs.Channels) != 0 {
+		t.Errorf("Expected empty preferences, got %#v", prefs)
+	}
+
+	prefs = &storage.Preferences{
+		Categories: map[string]bool{"promotions": false, "news": true},
+		Channels:   map[string]bool{"chan1": false, "chan2": true},
+	}
+	if err := stg.PutPreferences(ctx, appID, subscriberID, prefs); err != nil {
+		t.Fatal(err)
+	}
+
+	received, err := stg.GetPreferences(ctx, appID, subscriberID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(received, prefs) {
+		t.Errorf("Preferences do not match. got %#v, expected %#v", received, prefs)
+	}
+
+	assertCategoryChoices(t, stg, appID, "promotions", false, page, []string{subscriberID})
+	assertCategoryChoices(t, stg, appID, "promotions", true, page, []string{})
+	assertCategoryChoices(t, stg, appID, "news", true, page, []string{subscriberID})
+	assertChannelOptOuts(t, stg, appID, "chan1", page, []string{subscriberID})
+	assertChannelOptOuts(t, stg, appID, "chan2", page, []string{})
+
+	// replaced choices leave the indexes.
+	prefs = &storage.Preferences{Categories: map[string]bool{"promotions": true}}
+	if err := stg.PutPreferences(ctx, appID, subscriberID, prefs); err != nil {
+		t.Fatal(err)
+	}
+
+	assertCategoryChoices(t, stg, appID, "promotions", false, page, []string{})
+	assertCategoryChoices(t, stg, appID, "promotions", true, page, []string{subscriberID})
+	assertCategoryChoices(t, stg, appID, "news", true, page, []string{})
+	assertChannelOptOuts(t, stg, appID, "chan1", page, []string{})
+
+	if err := stg.DeleteSubscriber(ctx, appID, subscriberID); err != nil {
+		t.Fatal(err)
+	}
+
+	assertCategoryChoices(t, stg, appID, "promotions", true, page, []string{})
+
+	received, err = stg.GetPreferences(ctx, appID, subscriberID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(received.Categories) != 0 {
+		t.Errorf("Expected no preferences after delete, got %#v", received)
+	}
+}
+
+func testTombstones(t *testing.T, stg storage.Storage) {
+	appID := uniqueID("app")
+
+	tombstones, err := stg.GetTombstones(ctx, appID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(tombstones) != 0 {
+		t.Errorf("Expected no tombstones, got %#v", tombstones)
+	}
+
+	expected := []*storage.Tombstone{
+		{SubscriberHash: "a1", ErasedAt: 100, Devices: 2, Channels: 1, Reason: "user request"},
+		{SubscriberHash: "b2", ErasedAt: 200, Segments: 1},
+	}
+
+	for _, tombstone := range expected {
+		if err := stg.AddTombstone(ctx, appID, tombstone); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tombstones, err = stg.GetTombstones(ctx, appID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(tombstones, expected) {
+		t.Errorf("Tombstones do not match. got %#v, expected %#v", tombstones, expected)
+	}
+}
+
+func testDeadLetters(t *testing.T, stg storage.Storage) {
+	appID := uniqueID("app")
+	now := int(time.Now().Unix())
+
+	letters := []*storage.DeadLetter{
+		{
+			ID:            "l2",
+			TransactionID: "tx1",
+			SubscriberID:  "sub_1",
+			Platform:      "gcm",
+			Token:         "t1",
+			Message:       &message.Message{Title: "Hi", Data: map[string]interface{}{"key": "value"}},
+			Error:         "MismatchSenderId",
+			Attempts:      1,
+			FailedAt:      now,
+			ExpiresAt:     now + 200,
+		},
+		{ID: "l1", TransactionID: "tx1", SubscriberID: "sub_2", Platform: "gcm", Token: "t2", Message: &message.Message{Title: "Hi"}, FailedAt: now, ExpiresAt: now + 100},
+		{ID: "l3", TransactionID: "tx2", SubscriberID: "sub_1", Platform: "gcm", Token: "t1", Message: &message.Message{Title: "Bye"}, FailedAt: now, ExpiresAt: now + 300},
+		{ID: "expired", TransactionID: "tx0", Platform: "gcm", Token: "t3", Message: &message.Message{Title: "Old"}, ExpiresAt: now - 1},
+	}
+
+	if err := stg.PutDeadLetters(ctx, appID, letters); err != nil {
+		t.Fatal(err)
+	}
+
+	received, err := stg.GetDeadLetter(ctx, appID, "l2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(received, letters[0]) {
+		t.Errorf("Dead letter does not match. got %#v, expected %#v", received, letters[0])
+	}
+
+	if _, err := stg.GetDeadLetter(ctx, appID, "expired"); err != storage.ErrNotFound {
+		t.Errorf("Expected storage.ErrNotFound for an expired dead letter, got %v", err)
+	}
+
+	// replacing a dead letter keeps a single copy.
+	updated := *letters[0]
+	updated.Attempts = 2
+	if err := stg.PutDeadLetters(ctx, appID, []*storage.DeadLetter{&updated}); err != nil {
+		t.Fatal(err)
+	}
+
+	var ids []string
+	cursor := ""
+	for {
+		page, next, err := stg.ScanDeadLetters(ctx, appID, cursor, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, letter := range page {
+			ids = append(ids, letter.ID)
+		}
+
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+
+	if expected := []string{"l1", "l2", "l3"}; !reflect.DeepEqual(ids, expected) {
+		t.Errorf("Scanned dead letters do not match. got %v, expected %v", ids, expected)
+	}
+
+	if received, _ := stg.GetDeadLetter(ctx, appID, "l2"); received == nil || received.Attempts != 2 {
+		t.Errorf("Dead letter was not replaced. got %#v", received)
+	}
+
+	deleted, err := stg.DeleteDeadLetters(ctx, appID, []string{"l1", "l3", "missing"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if deleted != 2 {
+		t.Errorf("Expected 2 dead letters deleted, got %d", deleted)
+	}
+
+	page, next, err := stg.ScanDeadLetters(ctx, appID, "", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(page) != 1 || page[0].ID != "l2" || next != "" {
+		t.Errorf("Dead letters do not match after delete. got %#v, %q", page, next)
+	}
+}
+
+func testCircuits(t *testing.T, stg storage.Storage) {
+	appID := uniqueID("app")
+	otherAppID := uniqueID("app")
+	now := int(time.Now().Unix())
+
+	circuits := []*storage.Circuit{
+		{AppID: appID, Provider: "gcm", Process: "p2", State: "closed", ReportedAt: now, ExpiresAt: now + 100},
+		{AppID: appID, Provider: "gcm", Process: "p1", State: "open", Failures: 5, LastError: "gcm: 500 Internal Server Error", OpenedAt: now, ProbeAt: now + 30, ReportedAt: now, ExpiresAt: now + 100},
+		{AppID: appID, Provider: "gcm", Process: "stopped", State: "open", ReportedAt: now - 100, ExpiresAt: now - 1},
+		{AppID: otherAppID, Provider: "gcm", Process: "p1", State: "closed", ReportedAt: now, ExpiresAt: now + 100},
+	}
+
+	if err := stg.PutCircuits(ctx, circuits); err != nil {
+		t.Fatal(err)
+	}
+
+	// a later report of a process replaces the earlier one.
+	updated := *circuits[0]
+	updated.State = "halfOpen"
+	if err := stg.PutCircuits(ctx, []*storage.Circuit{&updated}); err != nil {
+		t.Fatal(err)
+	}
+
+	received, err := stg.GetCircuits(ctx, appID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if expected := []*storage.Circuit{circuits[1], &updated}; !reflect.DeepEqual(received, expected) {
+		t.Errorf("Circuits do not match. got %+v, expected %+v", received, expected)
+	}
+
+	all, err := stg.GetCircuits(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	found := 0
+	for _, circuit := range all {
+		if circuit.AppID == appID || circuit.AppID == otherAppID {
+			found++
+		}
+	}
+
+	if found != 3 {
+		t.Errorf("Expected the circuits of both apps, got %+v", all)
+	}
+
+	if received, err := stg.GetCircuits(ctx, uniqueID("app")); err != nil || len(received) != 0 {
+		t.Errorf("Expected no circuits for a missing app, got %+v, %v", received, err)
+	}
+}
+
+func testGetMissingDeviceOwner(t *testing.T, stg storage.Storage) {
+	_, _, err := stg.GetDeviceOwner(ctx, uniqueID("app"), "token")
+
+	if err != storage.ErrNotFound {
+		t.Errorf("Expected storage.ErrNotFound, got %v", err)
+	}
+}
+
+func testChannelSubscribers(t *testing.T, stg storage.Storage) {
+	appID := uniqueID("app")
+	channelID := uniqueID("chan")
+	subscriberIDs := []string{"sub_foo", "sub_bar"}
+
+	if err := stg.AddChannel(ctx, appID, channelID); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := stg.AddSubscriber(ctx, appID, channelID, subscriberIDs); err != nil {
+		t.Fatal(err)
+	}
+
+	assertChannelSubscribers(t, stg, appID, channelID, subscriberIDs)
+}
+
+func testChannelSubscribersUnique(t *testing.T, stg storage.Storage) {
+	appID := uniqueID("app")
+	channelID := uniqueID("chan")
+
+	// adding subscribers creates the channel when it does not exist.
+	if err := stg.AddSubscriber(ctx, appID, channelID, []string{"sub_foo", "sub_bar"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := stg.AddSubscriber(ctx, appID, channelID, []string{"sub_bar", "sub_baz", "sub_baz"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := stg.AddSubscriber(ctx, appID, channelID, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	assertChannelSubscribers(t, stg, appID, channelID, []string{"sub_foo", "sub_bar", "sub_baz"})
+}
+
+func testMissingChannelSubscribers(t *testing.T, stg storage.Storage) {
+	assertChannelSubscribers(t, stg, uniqueID("app"), uniqueID("chan"), nil)
+}
+
+func testScanChannelSubscribers(t *testing.T, stg storage.Storage) {
+	appID := uniqueID("app")
+	channelID := uniqueID("chan")
+	subscriberIDs := []string{"sub_1", "sub_2", "sub_3", "sub_4", "sub_5"}
+
+	if err := stg.AddSubscriber(ctx, appID, channelID, subscriberIDs); err != nil {
+		t.Fatal(err)
+	}
+
+	assertScan(t, storage.NewChannelScanner(stg, appID, channelID, 2), subscriberIDs)
+}
+
+func testScanMissingChannel(t *testing.T, stg storage.Storage) {
+	subscribers, next, err := stg.ScanChannelSubscribers(ctx, uniqueID("app"), uniqueID("chan"), "", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(subscribers) != 0 || next != "" {
+		t.Errorf("Expected empty complete scan, got %v with cursor %q", subscribers, next)
+	}
+}
+
+func testScanChannelsIntersection(t *testing.T, stg storage.Storage) {
+	appID := uniqueID("app")
+	premium := uniqueID("chan")
+	turkish := uniqueID("chan")
+	purchased := uniqueID("chan")
+
+	channels := map[string][]string{
+		premium:   {"sub_1", "sub_2", "sub_3", "sub_4", "sub_5", "sub_6"},
+		turkish:   {"sub_1", "sub_2", "sub_3", "sub_4", "sub_7"},
+		purchased: {"sub_2"},
+	}
+
+	for channelID, members := range channels {
+		if err := stg.AddSubscriber(ctx, appID, channelID, members); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	assertScan(t, storage.NewIntersectionScanner(stg, appID, []string{premium, turkish}, []string{purchased}, 1), []string{"sub_1", "sub_3", "sub_4"})
+	assertScan(t, storage.NewIntersectionScanner(stg, appID, []string{premium}, []string{turkish}, 1), []string{"sub_5", "sub_6"})
+	assertScan(t, storage.NewIntersectionScanner(stg, appID, []string{premium, uniqueID("chan")}, nil, 1), nil)
+}
+
+func testFilterChannelMembers(t *testing.T, stg storage.Storage) {
+	appID := uniqueID("app")
+	channelID := uniqueID("chan")
+
+	if err := stg.AddSubscriber(ctx, appID, channelID, []string{"sub_foo", "sub_baz"}); err != nil {
+		t.Fatal(err)
+	}
+
+	members, err := stg.FilterChannelMembers(ctx, appID, channelID, []string{"sub_baz", "sub_bar", "sub_foo"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"sub_baz", "sub_foo"}
+	if !reflect.DeepEqual(members, expected) {
+		t.Errorf("Channel members do not match. got %v, expected %v", members, expected)
+	}
+}
+
+func testScanSubscribers(t *testing.T, stg storage.Storage) {
+	appID := uniqueID("app")
+	subscriberIDs := []string{"sub_1", "sub_2", "sub_3"}
+
+	for _, subscriberID := range subscriberIDs {
+		device := &storage.Device{Platform: "gcm", Token: subscriberID + "_token"}
+		if err := stg.AddSubscriberDevice(ctx, appID, subscriberID, device); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	assertScan(t, storage.NewSubscriberScanner(stg, appID, 2), subscriberIDs)
+}
+
+func testAttributeSubscribers(t *testing.T, stg storage.Storage) {
+	appID := uniqueID("app")
+
+	devices := map[string][]*storage.Device{
+		"sub_1": {
+			{Platform: "gcm", Token: "token1", Locale: "tr"},
+			{Platform: "gcm", Token: "token2", Locale: "de"},
+		},
+		"sub_2": {{Platform: "apns", Token: "token3", Locale: "tr"}},
+		"sub_3": {{Platform: "gcm", Token: "token4", Locale: "en"}},
+	}
+
+	for subscriberID, subscriberDevices := range devices {
+		for _, device := range subscriberDevices {
+			if err := stg.AddSubscriberDevice(ctx, appID, subscriberID, device); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	assertScan(t, storage.NewAttributeScanner(stg, appID, "platform", "gcm", 1), []string{"sub_1", "sub_3"})
+	assertScan(t, storage.NewAttributeScanner(stg, appID, "locale", "tr", 10), []string{"sub_1", "sub_2"})
+
+	// re-registration updates the indexes.
+	if err := stg.AddSubscriberDevice(ctx, appID, "sub_1", &storage.Device{Platform: "gcm", Token: "token1", Locale: "en"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// moving a device updates the indexes of both subscribers.
+	if err := stg.AddSubscriberDevice(ctx, appID, "sub_3", &storage.Device{Platform: "apns", Token: "token3", Locale: "tr"}); err != nil {
+		t.Fatal(err)
+	}
+
+	assertScan(t, storage.NewAttributeScanner(stg, appID, "locale", "tr", 10), []string{"sub_3"})
+	assertScan(t, storage.NewAttributeScanner(stg, appID, "locale", "en", 10), []string{"sub_1", "sub_3"})
+	assertScan(t, storage.NewAttributeScanner(stg, appID, "platform", "apns", 10), []string{"sub_3"})
+	assertScan(t, storage.NewAttributeScanner(stg, appID, "model", "missing", 10), nil)
+
+	filtered, err := stg.FilterAttributeSubscribers(ctx, appID, "locale", "en", []string{"sub_3", "sub_2", "sub_1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"sub_3", "sub_1"}
+	if !reflect.DeepEqual(filtered, expected) {
+		t.Errorf("Filtered subscribers do not match. got %v, expected %v", filtered, expected)
+	}
+}
+
+func testDeleteChannel(t *testing.T, stg storage.Storage) {
+	appID := uniqueID("app")
+	channelID := uniqueID("chan")
+
+	if err := stg.AddSubscriber(ctx, appID, channelID, []string{"sub_foo"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := stg.DeleteChannel(ctx, appID, channelID); err != nil {
+		t.Fatal(err)
+	}
+
+	assertChannelSubscribers(t, stg, appID, channelID, nil)
+
+	// deleting a missing channel is not an error.
+	if err := stg.DeleteChannel(ctx, appID, channelID); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func assertScan(t *testing.T, scanner *storage.Scanner, expected []string) {
+	seen := make(map[string]bool)
+	for scanner.Next(ctx) {
+		for _, subscriberID := range scanner.Subscribers() {
+			seen[subscriberID] = true
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	scanned := make([]string, 0, len(seen))
+	for subscriberID := range seen {
+		scanned = append(scanned, subscriberID)
+	}
+
+	want := append([]string{}, expected...)
+	sort.Strings(scanned)
+	sort.Strings(want)
+
+	if !reflect.DeepEqual(scanned, want) {
+		t.Errorf("Scanned subscribers do not match. got %v, expected %v", scanned, want)
+	}
+}
+
+func assertChannelSubscribers(t *testing.T, stg storage.Storage, appID, channelID string, expected []string) {
+	subscribers, err := stg.GetChannelSubscribers(ctx, appID, channelID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := append([]string{}, subscribers...)
+	want := append([]string{}, expected...)
+	sort.Strings(got)
+	sort.Strings(want)
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Channel subscribers do not match. got %v, expected %v", got, want)
+	}
+}
+
+func assertCategoryChoices(t *testing.T, stg storage.Storage, appID, categoryID string, optIn bool, subscriberIDs []string, expected []string) {
+	received, err := stg.FilterCategoryChoices(ctx, appID, categoryID, optIn, subscriberIDs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(received, expected) {
+		t.Errorf("Choices of category %s (opt-in %v) do not match. got %v, expected %v", categoryID, optIn, received, expected)
+	}
+}
+
+func assertChannelOptOuts(t *testing.T, stg storage.Storage, appID, channelID string, subscriberIDs []string, expected []string) {
+	received, err := stg.FilterChannelOptOuts(ctx, appID, channelID, subscriberIDs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(received, expected) {
+		t.Errorf("Opt-outs of channel %s do not match. got %v, expected %v", channelID, received, expected)
+	}
+}
+
+func assertSubscriberDevices(t *testing.T, stg storage.Storage, appID, subscriberID string, expected []*storage.Device) {
+	devices, err := stg.GetSubscriberDevices(ctx, appID, subscriberID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertDevices(t, devices, expected)
+}
+
+func assertDeviceOwner(t *testing.T, stg storage.Storage, appID, token string, expectedOwner string, expectedDevice *storage.Device) {
+	owner, device, err := stg.GetDeviceOwner(ctx, appID, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if owner != expectedOwner {
+		t.Errorf("Device owner does not match. got %q, expected %q", owner, expectedOwner)
+	}
+
+	if !reflect.DeepEqual(device, expectedDevice) {
+		t.Errorf("Device does not match. got %#v, expected %#v", device, expectedDevice)
+	}
+}
+
+func assertDevices(t *testing.T, devices []*storage.Device, expected []*storage.Device) {
+	if len(devices) != len(expected) {
+		t.Fatalf("Expected %d devices, got %d", len(expected), len(devices))
+	}
+
+	byToken := make(map[string]*storage.Device)
+	for _, device := range devices {
+		byToken[device.Token] = device
+	}
+
+	for _, want := range expected {
+		got, ok := byToken[want.Token]
+		if !ok {
+			t.Errorf("Device %q is missing.", want.Token)
+			continue
+		}
+
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("Device does not match. got %#v, expected %#v", got, want)
+		}
+	}
+}
+
+func testCanceledContext(t *testing.T, stg storage.Storage) {
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+
+	appID := uniqueID("app")
+
+	if err := stg.PutApp(canceled, &storage.App{ID: appID}); err != context.Canceled {
+		t.Errorf("Expected context.Canceled from PutApp, got %v", err)
+	}
+
+	if _, err := stg.GetApp(canceled, appID); err != context.Canceled {
+		t.Errorf("Expected context.Canceled from GetApp, got %v", err)
+	}
+
+	if _, err := stg.GetChannelSubscribers(canceled, appID, uniqueID("chan")); err != context.Canceled {
+		t.Errorf("Expected context.Canceled from GetChannelSubscribers, got %v", err)
+	}
+
+	// nothing must be written with a canceled context.
+	if _, err := stg.GetApp(ctx, appID); err != storage.ErrNotFound {
+		t.Errorf("Expected storage.ErrNotFound, got %v", err)
+	}
+}
@@ -0,0 +1,159 @@
+package worker
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/gamegos/gcmlib"
+	"github.com/gamegos/scotty/delivery"
+	"github.com/gamegos/scotty/message"
+	"github.com/gamegos/scotty/queue"
+	"github.com/gamegos/scotty/storage"
+)
+
+// Job is a batch of a publish: a message localized and rendered for the
+// tokens of the batch, which are sent in a single GCM request.
+type Job struct {
+	AppID         string `json:"appId"`
+	TransactionID string `json:"transactionId"`
+	// Locale is the locale of the translation the message was localized to.
+	Locale  string           `json:"locale"`
+	Message *message.Message `json:"message"`
+	// Subscribers are the subscribers of Tokens by index.
+	Tokens      []string `json:"tokens"`
+	Subscribers []string `json:"subscribers"`
+}
+
+// ErrSubscribersMismatch is returned for a job without a subscriber for each
+// of its tokens.
+var ErrSubscribersMismatch = errors.New("worker: job subscribers do not match its tokens")
+
+// Validate checks that the job has a subscriber for each of its tokens.
+func (job *Job) Validate() error {
+	if len(job.Subscribers) != len(job.Tokens) {
+		return ErrSubscribersMismatch
+	}
+	return nil
+}
+
+// NewID returns a random id of a transaction or a dead letter.
+func NewID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// GCMMessage returns the GCM message of the job addressed to its tokens.
+func (job *Job) GCMMessage() (*gcmlib.Message, error) {
+	msg, err := job.Message.GCMMessage()
+	if err != nil {
+		return nil, err
+	}
+
+	msg.RegistrationIDs = job.Tokens
+
+	if err := msg.Validate(); err != nil {
+		return nil, err
+	}
+
+	return msg, nil
+}
+
+// Push adds a job to a queue.
+func Push(ctx context.Context, q queue.Queue, job *Job) (string, error) {
+	data, err := json.Marshal(job)
+	if err != nil {
+		return "", err
+	}
+
+	return q.Push(ctx, data)
+}
+
+// Send sends a job to GCM with client. It returns the response and the errors
+// of the tokens that could not be delivered by index. The error is an
+// *delivery.Error if the message was not delivered.
+func Send(ctx context.Context, d *delivery.Deliverer, client delivery.GCMClient, job *Job) (*gcmlib.Response, map[int]string, error) {
+	msg, err := job.GCMMessage()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	res, err := d.SendGCM(ctx, job.AppID, client, msg)
+
+	return res, Failures(res, err, len(job.Tokens)), err
+}
+
+// Failures returns the errors of the tokens of a batch that could not be
+// delivered by index: all of them if the batch failed, or the ones with
+// errors other than invalid tokens in the response.
+func Failures(res *gcmlib.Response, err error, n int) map[int]string {
+	failures := make(map[int]string)
+
+	if err != nil {
+		for i := 0; i < n; i++ {
+			failures[i] = err.Error()
+		}
+		return failures
+	}
+
+	if len(res.Results) != n {
+		return failures
+	}
+
+	for i, result := range res.Results {
+		if result.Error != "" && !delivery.InvalidTokenResult(result.Error) {
+			failures[i] = result.Error
+		}
+	}
+
+	return failures
+}
+
+// RecordDeadLetters records the failures of a job after a number of attempts
+// as dead letters kept for ttl and returns the number of them. The job must
+// have a subscriber for each of its tokens.
+func RecordDeadLetters(ctx context.Context, stg storage.Storage, job *Job, failures map[int]string, attempts int, ttl time.Duration) (int, error) {
+	if err := job.Validate(); err != nil {
+		return 0, err
+	}
+
+	now := time.Now()
+	letters := make([]*storage.DeadLetter, 0, len(failures))
+
+	for i, token := range job.Tokens {
+		failure, ok := failures[i]
+		if !ok {
+			continue
+		}
+
+		letterID, err := NewID()
+		if err != nil {
+			return 0, err
+		}
+
+		letters = append(letters, &storage.DeadLetter{
+			ID:            letterID,
+			TransactionID: job.TransactionID,
+			SubscriberID:  job.Subscribers[i],
+			Platform:      message.PlatformGCM,
+			Token:         token,
+			Message:       job.Message,
+			Error:         failure,
+			Attempts:      attempts,
+			FailedAt:      int(now.Unix()),
+			ExpiresAt:     int(now.Add(ttl).Unix()),
+		})
+	}
+
+	if err := stg.PutDeadLetters(ctx, job.AppID, letters); err != nil {
+		return 0, err
+	}
+
+	return len(letters), nil
+}
@@ -0,0 +1,220 @@
+// Package worker delivers the batches of publish requests received from a
+// queue, so the deliveries of a publish are shared by the workers of all
+// scotty processes. A batch that fails temporarily is left pending and
+// reclaimed after a while, by this or another worker, until it runs out of
+// deliveries.
+package worker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gamegos/scotty/config"
+	"github.com/gamegos/scotty/delivery"
+	"github.com/gamegos/scotty/queue"
+	"github.com/gamegos/scotty/storage"
+)
+
+// receiveWait is the longest a consumer waits for a job before checking
+// whether it should stop.
+const receiveWait = 5 * time.Second
+
+// errorDelay is the time a consumer waits after failing to receive jobs.
+const errorDelay = time.Second
+
+// reclaimCount is the number of jobs reclaimed at once.
+const reclaimCount = 10
+
+// Worker consumes jobs of a queue and sends them.
+type Worker struct {
+	q             queue.Queue
+	stg           storage.Storage
+	deliverer     *delivery.Deliverer
+	conf          config.WorkerConfig
+	deadLetterTTL time.Duration
+	// consumer names the worker in the queue, it is unique among processes.
+	consumer string
+	// newClient returns the GCM client of an app.
+	newClient func(apiKey string) delivery.GCMClient
+}
+
+// New creates a worker. Failed deliveries are kept as dead letters for
+// deadLetterTTL.
+func New(q queue.Queue, stg storage.Storage, deliverer *delivery.Deliverer, conf config.WorkerConfig, deadLetterTTL time.Duration) *Worker {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "scotty"
+	}
+
+	return &Worker{
+		q:             q,
+		stg:           stg,
+		deliverer:     deliverer,
+		conf:          conf,
+		deadLetterTTL: deadLetterTTL,
+		consumer:      fmt.Sprintf("%s-%d", hostname, os.Getpid()),
+		newClient: func(apiKey string) delivery.GCMClient {
+			return delivery.NewGCMClient(apiKey)
+		},
+	}
+}
+
+// Run consumes jobs with conf.Concurrency consumers, and reclaims jobs idle
+// for conf.ClaimIdle seconds every conf.ClaimInterval seconds, until ctx is
+// done.
+func (w *Worker) Run(ctx context.Context) {
+	concurrency := w.conf.Concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func(consumer string) {
+			defer wg.Done()
+			w.consume(ctx, consumer)
+		}(fmt.Sprintf("%s-%d", w.consumer, i))
+	}
+
+	if w.conf.ClaimInterval > 0 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w.reclaim(ctx)
+		}()
+	}
+
+	wg.Wait()
+}
+
+// consume receives and processes jobs for a consumer until ctx is done.
+func (w *Worker) consume(ctx context.Context, consumer string) {
+	for ctx.Err() == nil {
+		jobs, err := w.q.Receive(ctx, consumer, 1, receiveWait)
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Printf("worker: could not receive jobs: %s", err)
+				sleep(ctx, errorDelay)
+			}
+			continue
+		}
+
+		for _, job := range jobs {
+			w.process(ctx, job)
+		}
+	}
+}
+
+// reclaim processes jobs left pending by failed deliveries or by workers that
+// stopped, every conf.ClaimInterval seconds until ctx is done.
+func (w *Worker) reclaim(ctx context.Context) {
+	ticker := time.NewTicker(time.Duration(w.conf.ClaimInterval) * time.Second)
+	defer ticker.Stop()
+
+	minIdle := time.Duration(w.conf.ClaimIdle) * time.Second
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		for ctx.Err() == nil {
+			jobs, err := w.q.Reclaim(ctx, w.consumer, minIdle, reclaimCount)
+			if err != nil {
+				if ctx.Err() == nil {
+					log.Printf("worker: could not reclaim jobs: %s", err)
+				}
+				break
+			}
+
+			for _, job := range jobs {
+				w.process(ctx, job)
+			}
+
+			if len(jobs) < reclaimCount {
+				break
+			}
+		}
+	}
+}
+
+// process sends a job and acknowledges it. A job failing temporarily is left
+// pending to be reclaimed unless it was delivered conf.MaxDeliveries times;
+// then, or if it fails permanently, its tokens are recorded as dead letters.
+func (w *Worker) process(ctx context.Context, qjob *queue.Job) {
+	job := new(Job)
+	err := json.Unmarshal(qjob.Data, job)
+	if err == nil {
+		err = job.Validate()
+	}
+
+	if err != nil {
+		log.Printf("worker: dropping invalid job %s: %s", qjob.ID, err)
+		w.ack(ctx, qjob)
+		return
+	}
+
+	app, err := w.stg.GetApp(ctx, job.AppID)
+	if err == storage.ErrNotFound {
+		log.Printf("worker: dropping job %s of unknown app %s", qjob.ID, job.AppID)
+		w.ack(ctx, qjob)
+		return
+	}
+
+	if err != nil {
+		log.Printf("worker: could not get app of job %s: %s", qjob.ID, err)
+		return
+	}
+
+	res, failures, err := Send(ctx, w.deliverer, w.newClient(app.GCM.APIKey), job)
+	log.Printf("worker: job %s of transaction %s: GCM Request: %#v, %#v", qjob.ID, job.TransactionID, res, err)
+
+	// jobs of a stopping worker are reclaimed by the others.
+	if ctx.Err() != nil {
+		return
+	}
+
+	if retryable(err) && qjob.Deliveries < w.conf.MaxDeliveries {
+		return
+	}
+
+	if len(failures) > 0 {
+		if _, err := RecordDeadLetters(ctx, w.stg, job, failures, qjob.Deliveries, w.deadLetterTTL); err != nil {
+			log.Printf("worker: could not record %d dead letters of transaction %s: %s", len(failures), job.TransactionID, err)
+		}
+	}
+
+	w.ack(ctx, qjob)
+}
+
+func (w *Worker) ack(ctx context.Context, qjob *queue.Job) {
+	if err := w.q.Ack(ctx, qjob.ID); err != nil {
+		log.Printf("worker: could not acknowledge job %s: %s", qjob.ID, err)
+	}
+}
+
+// retryable reports whether a job failed temporarily.
+func retryable(err error) bool {
+	deliveryErr, ok := err.(*delivery.Error)
+	return ok && deliveryErr.Retryable
+}
+
+// sleep waits for d or until ctx is done.
+func sleep(ctx context.Context, d time.Duration) {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+	case <-timer.C:
+	}
+}
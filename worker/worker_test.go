@@ -0,0 +1,189 @@
+package worker
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/gamegos/gcmlib"
+	"github.com/gamegos/scotty/config"
+	"github.com/gamegos/scotty/delivery"
+	"github.com/gamegos/scotty/message"
+	"github.com/gamegos/scotty/queue"
+	memqueue "github.com/gamegos/scotty/queue/drivers/memory"
+	"github.com/gamegos/scotty/storage"
+	memstorage "github.com/gamegos/scotty/storage/drivers/memory"
+)
+
+var ctx = context.Background()
+
+type fakeClient struct {
+	res  *gcmlib.Response
+	err  error
+	sent [][]string
+}
+
+func (c *fakeClient) Send(msg *gcmlib.Message) (*delivery.GCMResponse, error) {
+	c.sent = append(c.sent, msg.RegistrationIDs)
+	if c.err != nil {
+		return nil, c.err
+	}
+	return &delivery.GCMResponse{Response: c.res}, nil
+}
+
+// temporaryError is a provider error asking for a retry.
+type temporaryError struct{}
+
+func (e *temporaryError) Error() string   { return "gcm: unavailable" }
+func (e *temporaryError) Temporary() bool { return true }
+
+func testWorker(t *testing.T, client *fakeClient) (*Worker, queue.Queue, storage.Storage) {
+	q := memqueue.New()
+	stg := memstorage.New()
+
+	if err := stg.PutApp(ctx, &storage.App{ID: "app", GCM: storage.GCMConfig{APIKey: "key"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	deliverer := delivery.New(config.DeliveryConfig{MaxAttempts: 1})
+	w := New(q, stg, deliverer, config.WorkerConfig{MaxDeliveries: 2}, time.Hour)
+	w.newClient = func(apiKey string) delivery.GCMClient {
+		if apiKey != "key" {
+			t.Errorf("Expected the client of the app, got key %q", apiKey)
+		}
+		return client
+	}
+
+	return w, q, stg
+}
+
+// receive pushes a job and receives it.
+func receive(t *testing.T, q queue.Queue, job *Job) *queue.Job {
+	if _, err := Push(ctx, q, job); err != nil {
+		t.Fatal(err)
+	}
+
+	jobs, err := q.Receive(ctx, "test", 1, 0)
+	if err != nil || len(jobs) != 1 {
+		t.Fatalf("Could not receive job: %v, %v", jobs, err)
+	}
+
+	return jobs[0]
+}
+
+func pending(t *testing.T, q queue.Queue) []*queue.Job {
+	jobs, err := q.Reclaim(ctx, "test", 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return jobs
+}
+
+func deadLetters(t *testing.T, stg storage.Storage) []*storage.DeadLetter {
+	letters, _, err := stg.ScanDeadLetters(ctx, "app", "", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return letters
+}
+
+func testJob() *Job {
+	return &Job{
+		AppID:         "app",
+		TransactionID: "tx",
+		Message:       &message.Message{Title: "Hi"},
+		Tokens:        []string{"t1", "t2", "t3"},
+		Subscribers:   []string{"s1", "s2", "s3"},
+	}
+}
+
+func TestProcess(t *testing.T) {
+	client := &fakeClient{res: &gcmlib.Response{
+		Success: 1,
+		Failure: 2,
+		Results: []gcmlib.Result{{MessageID: "m1"}, {Error: "NotRegistered"}, {Error: "MismatchSenderId"}},
+	}}
+	w, q, stg := testWorker(t, client)
+
+	w.process(ctx, receive(t, q, testJob()))
+
+	if len(client.sent) != 1 || len(client.sent[0]) != 3 {
+		t.Errorf("Expected the tokens to be sent once, got %v", client.sent)
+	}
+
+	if jobs := pending(t, q); len(jobs) != 0 {
+		t.Errorf("Expected the job to be acknowledged, got %+v", jobs)
+	}
+
+	letters := deadLetters(t, stg)
+	if len(letters) != 1 || letters[0].Token != "t3" || letters[0].SubscriberID != "s3" ||
+		letters[0].TransactionID != "tx" || letters[0].Error != "MismatchSenderId" || letters[0].Attempts != 1 {
+		t.Errorf("Dead letters do not match. got %+v", letters)
+	}
+}
+
+func TestProcessRetry(t *testing.T) {
+	client := &fakeClient{err: &temporaryError{}}
+	w, q, stg := testWorker(t, client)
+
+	w.process(ctx, receive(t, q, testJob()))
+
+	if letters := deadLetters(t, stg); len(letters) != 0 {
+		t.Errorf("Expected no dead letters before the last delivery, got %+v", letters)
+	}
+
+	jobs := pending(t, q)
+	if len(jobs) != 1 || jobs[0].Deliveries != 2 {
+		t.Fatalf("Expected the job to be left pending, got %+v", jobs)
+	}
+
+	w.process(ctx, jobs[0])
+
+	if jobs := pending(t, q); len(jobs) != 0 {
+		t.Errorf("Expected the job to be acknowledged after the last delivery, got %+v", jobs)
+	}
+
+	letters := deadLetters(t, stg)
+	if len(letters) != 3 || letters[0].Attempts != 2 {
+		t.Errorf("Expected dead letters of all tokens, got %+v", letters)
+	}
+}
+
+func TestProcessUnknownApp(t *testing.T) {
+	client := &fakeClient{}
+	w, q, _ := testWorker(t, client)
+
+	job := testJob()
+	job.AppID = "missing"
+	w.process(ctx, receive(t, q, job))
+
+	if len(client.sent) != 0 {
+		t.Errorf("Expected nothing to be sent, got %v", client.sent)
+	}
+
+	if jobs := pending(t, q); len(jobs) != 0 {
+		t.Errorf("Expected the job to be dropped, got %+v", jobs)
+	}
+}
+
+func TestProcessInvalidJob(t *testing.T) {
+	client := &fakeClient{}
+	w, q, stg := testWorker(t, client)
+
+	// a subscriber is missing for a token.
+	job := testJob()
+	job.Subscribers = job.Subscribers[:2]
+	w.process(ctx, receive(t, q, job))
+
+	if len(client.sent) != 0 {
+		t.Errorf("Expected nothing to be sent, got %v", client.sent)
+	}
+
+	if jobs := pending(t, q); len(jobs) != 0 {
+		t.Errorf("Expected the job to be dropped, got %+v", jobs)
+	}
+
+	if _, err := RecordDeadLetters(ctx, stg, job, map[int]string{2: "Unavailable"}, 1, time.Hour); err != ErrSubscribersMismatch {
+		t.Errorf("Expected ErrSubscribersMismatch, got %v", err)
+	}
+}